@@ -0,0 +1,134 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/Diniboy1123/usque/internal"
+)
+
+// ClientProfile bundles the parameters an official client uses to talk to the registration API.
+// Cloudflare occasionally bumps the accepted versions, so every field can be overridden.
+type ClientProfile struct {
+	Name          string            // Name of the profile.
+	BaseURL       string            // Base URL of the API, without the version.
+	Version       string            // API version path segment. (e.g., "v0a4471")
+	ClientVersion string            // Value of the CF-Client-Version header.
+	UserAgent     string            // Value of the User-Agent header.
+	Platform      string            // Operating system reported in registrations. (e.g., "Android")
+	Headers       map[string]string // Additional headers sent with every request.
+}
+
+// DefaultClientProfile is the name of the profile used when none is given.
+const DefaultClientProfile = "android"
+
+// Platforms reported by the built-in client profiles.
+const (
+	PlatformAndroid = "Android"
+	PlatformLinux   = "Linux"
+)
+
+var clientProfiles = map[string]ClientProfile{
+	"android": {
+		Name:          "android",
+		BaseURL:       internal.ApiUrl,
+		Version:       internal.ApiVersion,
+		ClientVersion: internal.ClientVersion,
+		UserAgent:     internal.UserAgent,
+		Platform:      PlatformAndroid,
+	},
+	// Values used by older Android releases. Kept for accounts created with tools mimicking them.
+	"android-legacy": {
+		Name:          "android-legacy",
+		BaseURL:       internal.ApiUrl,
+		Version:       "v0a1922",
+		ClientVersion: "a-6.3-1922",
+		UserAgent:     "okhttp/3.12.1",
+		Platform:      PlatformAndroid,
+	},
+	// Values used by the Linux desktop client. The API version path is shared with Android.
+	"linux": {
+		Name:          "linux",
+		BaseURL:       internal.ApiUrl,
+		Version:       internal.ApiVersion,
+		ClientVersion: internal.LinuxClientVersion,
+		UserAgent:     internal.LinuxUserAgent,
+		Platform:      PlatformLinux,
+	},
+}
+
+// GetClientProfile looks up a built-in client profile by name.
+//
+// Parameters:
+//   - name: string - The profile name. Empty selects DefaultClientProfile.
+//
+// Returns:
+//   - ClientProfile: A copy of the profile that may be modified freely.
+//   - error: An error if no such profile exists.
+func GetClientProfile(name string) (ClientProfile, error) {
+	if name == "" {
+		name = DefaultClientProfile
+	}
+
+	profile, ok := clientProfiles[strings.ToLower(name)]
+	if !ok {
+		return ClientProfile{}, fmt.Errorf("unknown client profile %q (available: %s)", name, strings.Join(ClientProfileNames(), ", "))
+	}
+
+	headers := make(map[string]string, len(profile.Headers))
+	for k, v := range profile.Headers {
+		headers[k] = v
+	}
+	profile.Headers = headers
+
+	return profile, nil
+}
+
+// ClientProfileNames returns the names of the built-in client profiles in sorted order.
+//
+// Returns:
+//   - []string: The profile names.
+func ClientProfileNames() []string {
+	names := make([]string, 0, len(clientProfiles))
+	for name := range clientProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newRequest creates an API request for the given path, relative to the versioned base URL,
+// with all headers of the profile set.
+//
+// Parameters:
+//   - method: string - The HTTP method.
+//   - path: string - The path below the API version. (e.g., "/reg")
+//   - body: io.Reader - The request body.
+//
+// Returns:
+//   - *http.Request: The prepared request.
+//   - error: An error if the request can't be created.
+func (p ClientProfile) newRequest(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(p.BaseURL, "/")+"/"+p.Version+path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range internal.Headers {
+		req.Header.Set(k, v)
+	}
+	if p.UserAgent != "" {
+		req.Header.Set("User-Agent", p.UserAgent)
+	}
+	if p.ClientVersion != "" {
+		req.Header.Set("CF-Client-Version", p.ClientVersion)
+	}
+	for k, v := range p.Headers {
+		req.Header.Set(k, v)
+	}
+
+	return req, nil
+}
@@ -1,11 +1,10 @@
 package api
 
 import (
-	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
 	"time"
 
@@ -13,45 +12,102 @@ import (
 	"github.com/Diniboy1123/usque/models"
 )
 
-// Register creates a new user account by registering a WireGuard public key and generating a random Android-like device identifier.
+// ConfirmTos asks the user on stdin to accept the Terms of Service.
+//
+// Returns:
+//   - error: An error if the input can't be read or the user declines.
+func ConfirmTos() error {
+	fmt.Print("You must accept the Terms of Service (https://www.cloudflare.com/application/terms/) to register. Do you agree? (y/n): ")
+	var response string
+	if _, err := fmt.Scanln(&response); err != nil {
+		return fmt.Errorf("failed to read user input: %v", err)
+	}
+	if response != "y" {
+		return fmt.Errorf("user did not accept TOS")
+	}
+	return nil
+}
+
+// TeamAuth authenticates a registration against a Zero Trust organization. The zero value registers a
+// consumer account.
+type TeamAuth struct {
+	JWT          string // Team token, sent as CF-Access-Jwt-Assertion
+	ClientID     string // Access service token client ID, sent as CF-Access-Client-Id
+	ClientSecret string // Access service token client secret, sent as CF-Access-Client-Secret
+}
+
+// headers returns the request headers carrying the credentials.
+//
+// Returns:
+//   - map[string]string: The headers, nil for the zero value.
+//   - error: An error if the service token is incomplete.
+func (a TeamAuth) headers() (map[string]string, error) {
+	if (a.ClientID == "") != (a.ClientSecret == "") {
+		return nil, fmt.Errorf("service token needs both a client ID and a client secret")
+	}
+
+	headers := make(map[string]string)
+	if a.JWT != "" {
+		headers["CF-Access-Jwt-Assertion"] = a.JWT
+	}
+	if a.ClientID != "" {
+		headers["CF-Access-Client-Id"] = a.ClientID
+		headers["CF-Access-Client-Secret"] = a.ClientSecret
+	}
+	if len(headers) == 0 {
+		return nil, nil
+	}
+
+	return headers, nil
+}
+
+// Register creates a new user account by registering a WireGuard public key and, for Android profiles, a random Android-like device identifier.
 // The WireGuard private key isn't stored anywhere, therefore it won't be usable. It's sole purpose is to mimic the Android app's registration process.
 //
 // This function sends a POST request to the API to register a new user and returns the created account data.
 //
 // Parameters:
+//   - ctx: context.Context - Cancels the request.
+//   - client: *http.Client - The HTTP client to use. (optional, nil uses a default client with a timeout)
+//   - profile: ClientProfile - The client profile to identify as. (see GetClientProfile)
 //   - model: string - The device model string to register. (e.g., "PC")
 //   - locale: string - The user's locale. (e.g., "en-US")
-//   - jwt: string - Team token to register.
+//   - auth: TeamAuth - Zero Trust credentials. (optional, the zero value registers a consumer account)
 //   - acceptTos: bool - Whether the user accepts the Terms of Service (TOS). If false, the user will be prompted to accept.
 //
 // Returns:
 //   - models.AccountData: The account data returned from the registration process.
+//   - *models.APIError:   The error returned by the API, if any.
 //   - error:              An error if registration fails at any step.
 //
 // Example:
 //
-//	account, err := Register("PC", "en-US", "", false)
+//	account, apiErr, err := Register(ctx, nil, profile, "PC", "en-US", TeamAuth{}, false)
 //	if err != nil {
 //	    log.Fatalf("Registration failed: %v", err)
 //	}
-func Register(model, locale, jwt string, acceptTos bool) (models.AccountData, error) {
-	wgKey, err := internal.GenerateRandomWgPubkey()
+func Register(ctx context.Context, client *http.Client, profile ClientProfile, model, locale string, auth TeamAuth, acceptTos bool) (models.AccountData, *models.APIError, error) {
+	headers, err := auth.headers()
 	if err != nil {
-		return models.AccountData{}, fmt.Errorf("failed to generate wg key: %v", err)
+		return models.AccountData{}, nil, err
 	}
-	serial, err := internal.GenerateRandomAndroidSerial()
+
+	wgKey, err := internal.GenerateRandomWgPubkey()
 	if err != nil {
-		return models.AccountData{}, fmt.Errorf("failed to generate serial: %v", err)
+		return models.AccountData{}, nil, fmt.Errorf("failed to generate wg key: %v", err)
+	}
+	// only the Android app reports a device serial
+	var serial string
+	if profile.Platform == PlatformAndroid {
+		serial, err = internal.GenerateRandomAndroidSerial()
+		if err != nil {
+			return models.AccountData{}, nil, fmt.Errorf("failed to generate serial: %v", err)
+		}
 	}
 
 	if !acceptTos {
-		fmt.Print("You must accept the Terms of Service (https://www.cloudflare.com/application/terms/) to register. Do you agree? (y/n): ")
-		var response string
-		if _, err := fmt.Scanln(&response); err != nil {
-			return models.AccountData{}, fmt.Errorf("failed to read user input: %v", err)
-		}
-		if response != "y" {
-			return models.AccountData{}, fmt.Errorf("user did not accept TOS")
+		if err := ConfirmTos(); err != nil {
+			return models.AccountData{}, nil, err
 		}
 	}
 
@@ -66,42 +122,30 @@ func Register(model, locale, jwt string, acceptTos bool) (models.AccountData, er
 		KeyType:   internal.KeyTypeWg,
 		TunType:   internal.TunTypeWg,
 		Locale:    locale,
+		Type:      profile.Platform,
 	}
 
 	jsonData, err := json.Marshal(data)
 	if err != nil {
-		return models.AccountData{}, fmt.Errorf("failed to marshal json: %v", err)
-	}
-
-	req, err := http.NewRequest("POST", internal.ApiUrl+"/"+internal.ApiVersion+"/reg", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return models.AccountData{}, fmt.Errorf("failed to create request: %v", err)
-	}
-
-	for k, v := range internal.Headers {
-		req.Header.Set(k, v)
-	}
-
-	if jwt != "" {
-		req.Header.Set("CF-Access-Jwt-Assertion", jwt)
+		return models.AccountData{}, nil, fmt.Errorf("failed to marshal json: %v", err)
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, body, err := doRequest(ctx, client, profile, "POST", "/reg", jsonData, headers)
 	if err != nil {
-		return models.AccountData{}, fmt.Errorf("failed to send request: %v", err)
+		return models.AccountData{}, nil, err
 	}
-	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return models.AccountData{}, fmt.Errorf("failed to register: %v", resp.Status)
+		apiErr, err := parseAPIError(resp, body, "register")
+		return models.AccountData{}, apiErr, err
 	}
 
 	var accountData models.AccountData
-	if err := json.NewDecoder(resp.Body).Decode(&accountData); err != nil {
-		return models.AccountData{}, fmt.Errorf("failed to decode response: %v", err)
+	if err := json.Unmarshal(body, &accountData); err != nil {
+		return models.AccountData{}, nil, fmt.Errorf("failed to decode response: %v", err)
 	}
 
-	return accountData, nil
+	return accountData, nil, nil
 }
 
 // EnrollKey updates an existing user account with a new MASQUE public key.
@@ -109,21 +153,25 @@ func Register(model, locale, jwt string, acceptTos bool) (models.AccountData, er
 // This function sends a PATCH request to update the user's account with a new key.
 //
 // Parameters:
+//   - ctx: context.Context - Cancels the request.
+//   - client: *http.Client - The HTTP client to use. (optional, nil uses a default client with a timeout)
+//   - profile: ClientProfile - The client profile to identify as. (see GetClientProfile)
 //   - accountData: models.AccountData - The account data of the user being updated.
 //   - pubKey: []byte - The new MASQUE public key in binary format.
 //   - deviceName: string - The name of the device to enroll. (optional)
 //
 // Returns:
 //   - models.AccountData: The updated account data.
+//   - *models.APIError:   The error returned by the API, if any.
 //   - error:              An error if the update process fails.
 //
 // Example:
 //
-//	updatedAccount, apiErr, err := EnrollKey(account, pubKey, "PC")
+//	updatedAccount, apiErr, err := EnrollKey(ctx, nil, profile, account, pubKey, "PC")
 //	if err != nil {
 //	    log.Fatalf("Key enrollment failed: %v", err)
 //	}
-func EnrollKey(accountData models.AccountData, pubKey []byte, deviceName string) (models.AccountData, *models.APIError, error) {
+func EnrollKey(ctx context.Context, client *http.Client, profile ClientProfile, accountData models.AccountData, pubKey []byte, deviceName string) (models.AccountData, *models.APIError, error) {
 	deviceUpdate := models.DeviceUpdate{
 		Key:     base64.StdEncoding.EncodeToString(pubKey),
 		KeyType: internal.KeyTypeMasque,
@@ -139,38 +187,280 @@ func EnrollKey(accountData models.AccountData, pubKey []byte, deviceName string)
 		return models.AccountData{}, nil, fmt.Errorf("failed to marshal json: %v", err)
 	}
 
-	req, err := http.NewRequest("PATCH", internal.ApiUrl+"/"+internal.ApiVersion+"/reg/"+accountData.ID, bytes.NewBuffer(jsonData))
+	resp, body, err := doRequest(ctx, client, profile, "PATCH", "/reg/"+accountData.ID, jsonData, map[string]string{
+		"Authorization": "Bearer " + accountData.Token,
+	})
 	if err != nil {
-		return models.AccountData{}, nil, fmt.Errorf("failed to create request: %v", err)
+		return models.AccountData{}, nil, err
 	}
 
-	for k, v := range internal.Headers {
-		req.Header.Set(k, v)
+	if resp.StatusCode != http.StatusOK {
+		apiErr, err := parseAPIError(resp, body, "update")
+		return models.AccountData{}, apiErr, err
 	}
-	req.Header.Set("Authorization", "Bearer "+accountData.Token)
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return models.AccountData{}, nil, fmt.Errorf("failed to send request: %v", err)
+	if err := json.Unmarshal(body, &accountData); err != nil {
+		return models.AccountData{}, nil, fmt.Errorf("failed to decode response: %v", err)
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	return accountData, nil, nil
+}
+
+// GetAccount fetches the current registration, including account type, license, WARP+ quota and peers.
+//
+// This function sends a GET request for the device registration using its access token.
+//
+// Parameters:
+//   - ctx: context.Context - Cancels the request.
+//   - client: *http.Client - The HTTP client to use. (optional, nil uses a default client with a timeout)
+//   - profile: ClientProfile - The client profile to identify as. (see GetClientProfile)
+//   - accountData: models.AccountData - The account to fetch. Only ID and Token are used.
+//
+// Returns:
+//   - models.AccountData: The account data.
+//   - *models.APIError:   The error returned by the API, if any.
+//   - error:              An error if the request fails.
+func GetAccount(ctx context.Context, client *http.Client, profile ClientProfile, accountData models.AccountData) (models.AccountData, *models.APIError, error) {
+	resp, body, err := doRequest(ctx, client, profile, "GET", "/reg/"+accountData.ID, nil, map[string]string{
+		"Authorization": "Bearer " + accountData.Token,
+	})
 	if err != nil {
-		return models.AccountData{}, nil, fmt.Errorf("failed to read response body: %v", err)
+		return models.AccountData{}, nil, err
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		var apiErr models.APIError
-		if err := json.Unmarshal(body, &apiErr); err != nil {
-			return models.AccountData{}, nil, fmt.Errorf("failed to parse error response: %v", err)
-		}
-		return models.AccountData{}, &apiErr, fmt.Errorf("failed to update: %s", resp.Status)
+		apiErr, err := parseAPIError(resp, body, "get account")
+		return models.AccountData{}, apiErr, err
 	}
 
-	if err := json.Unmarshal(body, &accountData); err != nil {
+	var account models.AccountData
+	if err := json.Unmarshal(body, &account); err != nil {
 		return models.AccountData{}, nil, fmt.Errorf("failed to decode response: %v", err)
 	}
 
-	return accountData, nil, nil
+	return account, nil, nil
+}
+
+// GetPolicy fetches the device policy of the registration, e.g. split tunnel and fallback domains for ZeroTier.
+//
+// The policy is part of the registration, so this sends the same GET request as GetAccount.
+//
+// Parameters:
+//   - ctx: context.Context - Cancels the request.
+//   - client: *http.Client - The HTTP client to use. (optional, nil uses a default client with a timeout)
+//   - profile: ClientProfile - The client profile to identify as. (see GetClientProfile)
+//   - accountData: models.AccountData - The account to fetch the policy of. Only ID and Token are used.
+//
+// Returns:
+//   - models.Policy:      The device policy.
+//   - *models.APIError:   The error returned by the API, if any.
+//   - error:              An error if the request fails.
+func GetPolicy(ctx context.Context, client *http.Client, profile ClientProfile, accountData models.AccountData) (models.Policy, *models.APIError, error) {
+	account, apiErr, err := GetAccount(ctx, client, profile, accountData)
+	if err != nil {
+		return models.Policy{}, apiErr, err
+	}
+
+	return account.Policy, nil, nil
+}
+
+// UpdateLicense binds the account of the device to another license, e.g. a WARP+ key.
+//
+// This function sends a PUT request for the device's account with the new license.
+//
+// Parameters:
+//   - ctx: context.Context - Cancels the request.
+//   - client: *http.Client - The HTTP client to use. (optional, nil uses a default client with a timeout)
+//   - profile: ClientProfile - The client profile to identify as. (see GetClientProfile)
+//   - accountData: models.AccountData - The device to update. Only ID and Token are used.
+//   - license: string - The license key to bind.
+//
+// Returns:
+//   - models.Account:   The updated account.
+//   - *models.APIError: The error returned by the API, if any.
+//   - error:            An error if the request fails.
+func UpdateLicense(ctx context.Context, client *http.Client, profile ClientProfile, accountData models.AccountData, license string) (models.Account, *models.APIError, error) {
+	jsonData, err := json.Marshal(models.License{License: license})
+	if err != nil {
+		return models.Account{}, nil, fmt.Errorf("failed to marshal json: %v", err)
+	}
+
+	resp, body, err := doRequest(ctx, client, profile, "PUT", "/reg/"+accountData.ID+"/account", jsonData, map[string]string{
+		"Authorization": "Bearer " + accountData.Token,
+	})
+	if err != nil {
+		return models.Account{}, nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		apiErr, err := parseAPIError(resp, body, "update license")
+		return models.Account{}, apiErr, err
+	}
+
+	var account models.Account
+	if err := json.Unmarshal(body, &account); err != nil {
+		return models.Account{}, nil, fmt.Errorf("failed to decode response: %v", err)
+	}
+
+	return account, nil, nil
+}
+
+// ResetLicense replaces the license of the device's account with a freshly generated one.
+// Other devices bound with the old license lose access to the account.
+//
+// Parameters:
+//   - ctx: context.Context - Cancels the request.
+//   - client: *http.Client - The HTTP client to use. (optional, nil uses a default client with a timeout)
+//   - profile: ClientProfile - The client profile to identify as. (see GetClientProfile)
+//   - accountData: models.AccountData - The device whose account is reset. Only ID and Token are used.
+//
+// Returns:
+//   - string:           The new license key.
+//   - *models.APIError: The error returned by the API, if any.
+//   - error:            An error if the request fails.
+func ResetLicense(ctx context.Context, client *http.Client, profile ClientProfile, accountData models.AccountData) (string, *models.APIError, error) {
+	resp, body, err := doRequest(ctx, client, profile, "POST", "/reg/"+accountData.ID+"/account/license", nil, map[string]string{
+		"Authorization": "Bearer " + accountData.Token,
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		apiErr, err := parseAPIError(resp, body, "reset license")
+		return "", apiErr, err
+	}
+
+	var license models.License
+	if err := json.Unmarshal(body, &license); err != nil {
+		return "", nil, fmt.Errorf("failed to decode response: %v", err)
+	}
+
+	return license.License, nil, nil
+}
+
+// ListDevices lists the devices bound to the account of the given device.
+//
+// Parameters:
+//   - ctx: context.Context - Cancels the request.
+//   - client: *http.Client - The HTTP client to use. (optional, nil uses a default client with a timeout)
+//   - profile: ClientProfile - The client profile to identify as. (see GetClientProfile)
+//   - accountData: models.AccountData - The device whose account is queried. Only ID and Token are used.
+//
+// Returns:
+//   - []models.BoundDevice: The bound devices, including the given one.
+//   - *models.APIError:     The error returned by the API, if any.
+//   - error:                An error if the request fails.
+func ListDevices(ctx context.Context, client *http.Client, profile ClientProfile, accountData models.AccountData) ([]models.BoundDevice, *models.APIError, error) {
+	resp, body, err := doRequest(ctx, client, profile, "GET", "/reg/"+accountData.ID+"/account/devices", nil, map[string]string{
+		"Authorization": "Bearer " + accountData.Token,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		apiErr, err := parseAPIError(resp, body, "list devices")
+		return nil, apiErr, err
+	}
+
+	var devices []models.BoundDevice
+	if err := json.Unmarshal(body, &devices); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode response: %v", err)
+	}
+
+	return devices, nil, nil
+}
+
+// UpdateBoundDevice renames, activates or deactivates a device bound to the same account.
+//
+// Parameters:
+//   - ctx: context.Context - Cancels the request.
+//   - client: *http.Client - The HTTP client to use. (optional, nil uses a default client with a timeout)
+//   - profile: ClientProfile - The client profile to identify as. (see GetClientProfile)
+//   - accountData: models.AccountData - The device making the request. Only ID and Token are used.
+//   - deviceID: string - The ID of the device to update.
+//   - update: models.DeviceUpdate - The changes. Only Name and Active are supported.
+//
+// Returns:
+//   - []models.BoundDevice: The bound devices after the update.
+//   - *models.APIError:     The error returned by the API, if any.
+//   - error:                An error if the request fails.
+func UpdateBoundDevice(ctx context.Context, client *http.Client, profile ClientProfile, accountData models.AccountData, deviceID string, update models.DeviceUpdate) ([]models.BoundDevice, *models.APIError, error) {
+	jsonData, err := json.Marshal(update)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal json: %v", err)
+	}
+
+	resp, body, err := doRequest(ctx, client, profile, "PATCH", "/reg/"+accountData.ID+"/account/reg/"+deviceID, jsonData, map[string]string{
+		"Authorization": "Bearer " + accountData.Token,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		apiErr, err := parseAPIError(resp, body, "update device")
+		return nil, apiErr, err
+	}
+
+	var devices []models.BoundDevice
+	if err := json.Unmarshal(body, &devices); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode response: %v", err)
+	}
+
+	return devices, nil, nil
+}
+
+// RemoveBoundDevice unbinds a device from the account.
+//
+// Parameters:
+//   - ctx: context.Context - Cancels the request.
+//   - client: *http.Client - The HTTP client to use. (optional, nil uses a default client with a timeout)
+//   - profile: ClientProfile - The client profile to identify as. (see GetClientProfile)
+//   - accountData: models.AccountData - The device making the request. Only ID and Token are used.
+//   - deviceID: string - The ID of the device to remove.
+//
+// Returns:
+//   - *models.APIError: The error returned by the API, if any.
+//   - error:            An error if the request fails.
+func RemoveBoundDevice(ctx context.Context, client *http.Client, profile ClientProfile, accountData models.AccountData, deviceID string) (*models.APIError, error) {
+	resp, body, err := doRequest(ctx, client, profile, "DELETE", "/reg/"+accountData.ID+"/account/reg/"+deviceID, nil, map[string]string{
+		"Authorization": "Bearer " + accountData.Token,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return parseAPIError(resp, body, "remove device")
+	}
+
+	return nil, nil
+}
+
+// Unregister deletes the device registration. Its access token and enrolled key stop working.
+//
+// Parameters:
+//   - ctx: context.Context - Cancels the request.
+//   - client: *http.Client - The HTTP client to use. (optional, nil uses a default client with a timeout)
+//   - profile: ClientProfile - The client profile to identify as. (see GetClientProfile)
+//   - accountData: models.AccountData - The device to delete. Only ID and Token are used.
+//
+// Returns:
+//   - *models.APIError: The error returned by the API, if any.
+//   - error:            An error if the request fails.
+func Unregister(ctx context.Context, client *http.Client, profile ClientProfile, accountData models.AccountData) (*models.APIError, error) {
+	resp, body, err := doRequest(ctx, client, profile, "DELETE", "/reg/"+accountData.ID, nil, map[string]string{
+		"Authorization": "Bearer " + accountData.Token,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return parseAPIError(resp, body, "unregister")
+	}
+
+	return nil, nil
 }
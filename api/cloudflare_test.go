@@ -0,0 +1,523 @@
+package api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/Diniboy1123/usque/internal/mockapi"
+	"github.com/Diniboy1123/usque/models"
+)
+
+// newMockAPI starts a mock registration API and returns a client profile and HTTP client pointing to it.
+func newMockAPI(t *testing.T) (*mockapi.Server, ClientProfile, *http.Client) {
+	t.Helper()
+
+	mock, err := mockapi.New()
+	if err != nil {
+		t.Fatalf("failed to create mock API: %v", err)
+	}
+	srv := httptest.NewServer(mock)
+	t.Cleanup(srv.Close)
+
+	profile, err := GetClientProfile("")
+	if err != nil {
+		t.Fatalf("failed to get client profile: %v", err)
+	}
+	profile.BaseURL = srv.URL
+
+	return mock, profile, srv.Client()
+}
+
+// mustRegister registers a consumer device with the mock API.
+func mustRegister(t *testing.T, profile ClientProfile, client *http.Client) models.AccountData {
+	t.Helper()
+
+	account, _, err := Register(context.Background(), client, profile, "PC", "en_US", TeamAuth{}, true)
+	if err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+	return account
+}
+
+// masqueKey returns a fresh P-256 public key in the PKIX DER form EnrollKey expects.
+func masqueKey(t *testing.T) []byte {
+	t.Helper()
+
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&privKey.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	return der
+}
+
+// checkAPIError checks the outcome of an API call. An empty wantStatus expects success,
+// otherwise the error must mention the status and, if wantMessage is set, the API error
+// must carry that message.
+func checkAPIError(t *testing.T, apiErr *models.APIError, err error, wantStatus, wantMessage string) {
+	t.Helper()
+
+	if wantStatus == "" {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if apiErr != nil {
+			t.Fatalf("unexpected API error: %s", apiErr.ErrorsAsString("; "))
+		}
+		return
+	}
+
+	if err == nil {
+		t.Fatalf("expected an error with status %s", wantStatus)
+	}
+	if !strings.Contains(err.Error(), wantStatus) {
+		t.Errorf("error %q doesn't mention status %s", err, wantStatus)
+	}
+	if wantMessage == "" {
+		return
+	}
+	if apiErr == nil {
+		t.Fatalf("expected API error %q, got none", wantMessage)
+	}
+	if !apiErr.HasErrorMessage(wantMessage) {
+		t.Errorf("expected API error %q, got %q", wantMessage, apiErr.ErrorsAsString("; "))
+	}
+}
+
+func TestRegister(t *testing.T) {
+	tests := []struct {
+		name        string
+		profile     string
+		auth        TeamAuth
+		setup       func(mock *mockapi.Server)
+		wantType    string
+		wantStatus  string
+		wantMessage string
+		wantLocal   bool
+	}{
+		{
+			name:     "consumer",
+			wantType: "free",
+		},
+		{
+			name:     "linux profile",
+			profile:  "linux",
+			wantType: "free",
+		},
+		{
+			name:     "service token",
+			auth:     TeamAuth{ClientID: "id.access", ClientSecret: "secret"},
+			setup:    func(mock *mockapi.Server) { mock.ServiceTokens["id.access"] = "secret" },
+			wantType: internal.AccountTypeTeam,
+		},
+		{
+			name:     "retried after rate limit",
+			setup:    func(mock *mockapi.Server) { mock.Throttle = 1 },
+			wantType: "free",
+		},
+		{
+			name:        "wrong service token",
+			auth:        TeamAuth{ClientID: "id.access", ClientSecret: "wrong"},
+			setup:       func(mock *mockapi.Server) { mock.ServiceTokens["id.access"] = "secret" },
+			wantStatus:  "403",
+			wantMessage: "Invalid service token",
+		},
+		{
+			name:        "unknown team token",
+			auth:        TeamAuth{JWT: "eyJhbGciOiJub25lIn0.e30.unknown"},
+			wantStatus:  "403",
+			wantMessage: "Invalid team token",
+		},
+		{
+			name:      "incomplete service token",
+			auth:      TeamAuth{ClientID: "id.access"},
+			wantLocal: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock, profile, client := newMockAPI(t)
+			if tt.setup != nil {
+				tt.setup(mock)
+			}
+			if tt.profile != "" {
+				named, err := GetClientProfile(tt.profile)
+				if err != nil {
+					t.Fatalf("failed to get client profile: %v", err)
+				}
+				named.BaseURL = profile.BaseURL
+				profile = named
+			}
+
+			account, apiErr, err := Register(context.Background(), client, profile, "PC", "en_US", tt.auth, true)
+			if tt.wantLocal {
+				if err == nil || apiErr != nil {
+					t.Fatalf("expected a local error without API error, got %v / %v", err, apiErr)
+				}
+				return
+			}
+			checkAPIError(t, apiErr, err, tt.wantStatus, tt.wantMessage)
+			if tt.wantStatus != "" {
+				return
+			}
+
+			if account.ID == "" || account.Token == "" {
+				t.Errorf("registration lacks ID or token: %+v", account)
+			}
+			if account.Account.AccountType != tt.wantType {
+				t.Errorf("account type = %q, want %q", account.Account.AccountType, tt.wantType)
+			}
+			if account.Config.Interface.Addresses.V4 == "" {
+				t.Error("registration lacks an IPv4 address")
+			}
+		})
+	}
+}
+
+func TestRegisterCancelled(t *testing.T) {
+	_, profile, client := newMockAPI(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, _, err := Register(ctx, client, profile, "PC", "en_US", TeamAuth{}, true)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestEnrollKey(t *testing.T) {
+	tests := []struct {
+		name        string
+		setup       func(mock *mockapi.Server, account *models.AccountData)
+		key         func(t *testing.T) []byte
+		wantStatus  string
+		wantMessage string
+	}{
+		{
+			name: "valid key",
+			key:  masqueKey,
+		},
+		{
+			name:        "rejected key",
+			setup:       func(mock *mockapi.Server, account *models.AccountData) { mock.RejectKeys = 1 },
+			key:         masqueKey,
+			wantStatus:  "400",
+			wantMessage: models.InvalidPublicKey,
+		},
+		{
+			name:        "malformed key",
+			key:         func(t *testing.T) []byte { return []byte("not a key") },
+			wantStatus:  "400",
+			wantMessage: models.InvalidPublicKey,
+		},
+		{
+			name:        "wrong token",
+			setup:       func(mock *mockapi.Server, account *models.AccountData) { account.Token = "wrong" },
+			key:         masqueKey,
+			wantStatus:  "401",
+			wantMessage: "Authentication error",
+		},
+		{
+			name:        "unknown device",
+			setup:       func(mock *mockapi.Server, account *models.AccountData) { account.ID = "unknown" },
+			key:         masqueKey,
+			wantStatus:  "404",
+			wantMessage: "Device not found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock, profile, client := newMockAPI(t)
+			account := mustRegister(t, profile, client)
+			if tt.setup != nil {
+				tt.setup(mock, &account)
+			}
+
+			updated, apiErr, err := EnrollKey(context.Background(), client, profile, account, tt.key(t), "usque-test")
+			checkAPIError(t, apiErr, err, tt.wantStatus, tt.wantMessage)
+			if tt.wantStatus != "" {
+				return
+			}
+
+			if updated.KeyType != internal.KeyTypeMasque || updated.TunType != internal.TunTypeMasque {
+				t.Errorf("key type = %q, tunnel type = %q, want MASQUE", updated.KeyType, updated.TunType)
+			}
+			if updated.Name != "usque-test" {
+				t.Errorf("name = %q, want usque-test", updated.Name)
+			}
+			if len(updated.Config.Peers) != 1 || updated.Config.Peers[0].PublicKey != mock.EndpointPubKey {
+				t.Errorf("peers = %+v, want the MASQUE endpoint", updated.Config.Peers)
+			}
+		})
+	}
+}
+
+func TestAccountCalls(t *testing.T) {
+	const plusLicense = "AAAAAAAA-BBBBBBBB-CCCCCCCC"
+
+	tests := []struct {
+		name        string
+		call        func(ctx context.Context, client *http.Client, profile ClientProfile, account models.AccountData) (*models.APIError, error)
+		badToken    bool
+		wantStatus  string
+		wantMessage string
+	}{
+		{
+			name: "get account",
+			call: func(ctx context.Context, client *http.Client, profile ClientProfile, account models.AccountData) (*models.APIError, error) {
+				got, apiErr, err := GetAccount(ctx, client, profile, account)
+				if err == nil && got.ID != account.ID {
+					return nil, errors.New("wrong device returned")
+				}
+				return apiErr, err
+			},
+		},
+		{
+			name: "get account with wrong token",
+			call: func(ctx context.Context, client *http.Client, profile ClientProfile, account models.AccountData) (*models.APIError, error) {
+				_, apiErr, err := GetAccount(ctx, client, profile, account)
+				return apiErr, err
+			},
+			badToken:    true,
+			wantStatus:  "401",
+			wantMessage: "Authentication error",
+		},
+		{
+			name: "get policy",
+			call: func(ctx context.Context, client *http.Client, profile ClientProfile, account models.AccountData) (*models.APIError, error) {
+				policy, apiErr, err := GetPolicy(ctx, client, profile, account)
+				if err == nil && policy.TunnelProtocol != internal.TunTypeWg {
+					return nil, errors.New("wrong tunnel protocol in policy")
+				}
+				return apiErr, err
+			},
+		},
+		{
+			name: "update license",
+			call: func(ctx context.Context, client *http.Client, profile ClientProfile, account models.AccountData) (*models.APIError, error) {
+				got, apiErr, err := UpdateLicense(ctx, client, profile, account, plusLicense)
+				if err == nil && (!got.WarpPlus || got.License != plusLicense) {
+					return nil, errors.New("device not moved to the WARP+ account")
+				}
+				return apiErr, err
+			},
+		},
+		{
+			name: "update license with invalid license",
+			call: func(ctx context.Context, client *http.Client, profile ClientProfile, account models.AccountData) (*models.APIError, error) {
+				_, apiErr, err := UpdateLicense(ctx, client, profile, account, "invalid")
+				return apiErr, err
+			},
+			wantStatus:  "400",
+			wantMessage: "Invalid license",
+		},
+		{
+			name: "reset license",
+			call: func(ctx context.Context, client *http.Client, profile ClientProfile, account models.AccountData) (*models.APIError, error) {
+				license, apiErr, err := ResetLicense(ctx, client, profile, account)
+				if err == nil && (license == "" || license == account.Account.License) {
+					return nil, errors.New("license not replaced")
+				}
+				return apiErr, err
+			},
+		},
+		{
+			name: "reset license with wrong token",
+			call: func(ctx context.Context, client *http.Client, profile ClientProfile, account models.AccountData) (*models.APIError, error) {
+				_, apiErr, err := ResetLicense(ctx, client, profile, account)
+				return apiErr, err
+			},
+			badToken:    true,
+			wantStatus:  "401",
+			wantMessage: "Authentication error",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock, profile, client := newMockAPI(t)
+			mock.AddPlusAccount(plusLicense, 1<<30)
+			account := mustRegister(t, profile, client)
+			if tt.badToken {
+				account.Token = "wrong"
+			}
+
+			apiErr, err := tt.call(context.Background(), client, profile, account)
+			checkAPIError(t, apiErr, err, tt.wantStatus, tt.wantMessage)
+		})
+	}
+}
+
+func TestDevices(t *testing.T) {
+	ctx := context.Background()
+
+	// setup registers two devices bound to the same account and returns the first one
+	// and the ID of the second one.
+	setup := func(t *testing.T, profile ClientProfile, client *http.Client) (models.AccountData, string) {
+		t.Helper()
+
+		first := mustRegister(t, profile, client)
+		second := mustRegister(t, profile, client)
+		if _, _, err := UpdateLicense(ctx, client, profile, second, first.Account.License); err != nil {
+			t.Fatalf("failed to bind second device: %v", err)
+		}
+		return first, second.ID
+	}
+
+	tests := []struct {
+		name        string
+		call        func(t *testing.T, profile ClientProfile, client *http.Client, account models.AccountData, other string) (*models.APIError, error)
+		wantStatus  string
+		wantMessage string
+	}{
+		{
+			name: "list",
+			call: func(t *testing.T, profile ClientProfile, client *http.Client, account models.AccountData, other string) (*models.APIError, error) {
+				devices, apiErr, err := ListDevices(ctx, client, profile, account)
+				if err == nil && len(devices) != 2 {
+					t.Errorf("listed %d devices, want 2", len(devices))
+				}
+				return apiErr, err
+			},
+		},
+		{
+			name: "rename",
+			call: func(t *testing.T, profile ClientProfile, client *http.Client, account models.AccountData, other string) (*models.APIError, error) {
+				devices, apiErr, err := UpdateBoundDevice(ctx, client, profile, account, other, models.DeviceUpdate{Name: "renamed"})
+				if err != nil {
+					return apiErr, err
+				}
+				for _, device := range devices {
+					if device.ID == other && device.Name != "renamed" {
+						t.Errorf("name = %q, want renamed", device.Name)
+					}
+				}
+				return nil, nil
+			},
+		},
+		{
+			name: "deactivate",
+			call: func(t *testing.T, profile ClientProfile, client *http.Client, account models.AccountData, other string) (*models.APIError, error) {
+				active := false
+				devices, apiErr, err := UpdateBoundDevice(ctx, client, profile, account, other, models.DeviceUpdate{Active: &active})
+				if err != nil {
+					return apiErr, err
+				}
+				for _, device := range devices {
+					if device.ID == other && device.Active {
+						t.Error("device still active")
+					}
+				}
+				return nil, nil
+			},
+		},
+		{
+			name: "update unknown device",
+			call: func(t *testing.T, profile ClientProfile, client *http.Client, account models.AccountData, other string) (*models.APIError, error) {
+				_, apiErr, err := UpdateBoundDevice(ctx, client, profile, account, "unknown", models.DeviceUpdate{Name: "renamed"})
+				return apiErr, err
+			},
+			wantStatus:  "404",
+			wantMessage: "Device not found",
+		},
+		{
+			name: "remove",
+			call: func(t *testing.T, profile ClientProfile, client *http.Client, account models.AccountData, other string) (*models.APIError, error) {
+				apiErr, err := RemoveBoundDevice(ctx, client, profile, account, other)
+				if err != nil {
+					return apiErr, err
+				}
+				devices, apiErr, err := ListDevices(ctx, client, profile, account)
+				if err == nil && len(devices) != 1 {
+					t.Errorf("listed %d devices after removal, want 1", len(devices))
+				}
+				return apiErr, err
+			},
+		},
+		{
+			name: "remove unknown device",
+			call: func(t *testing.T, profile ClientProfile, client *http.Client, account models.AccountData, other string) (*models.APIError, error) {
+				return RemoveBoundDevice(ctx, client, profile, account, "unknown")
+			},
+			wantStatus:  "404",
+			wantMessage: "Device not found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, profile, client := newMockAPI(t)
+			account, other := setup(t, profile, client)
+
+			apiErr, err := tt.call(t, profile, client, account, other)
+			checkAPIError(t, apiErr, err, tt.wantStatus, tt.wantMessage)
+		})
+	}
+}
+
+func TestUnregister(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name        string
+		setup       func(t *testing.T, profile ClientProfile, client *http.Client, account *models.AccountData)
+		wantStatus  string
+		wantMessage string
+	}{
+		{
+			name: "registered device",
+		},
+		{
+			name: "already unregistered",
+			setup: func(t *testing.T, profile ClientProfile, client *http.Client, account *models.AccountData) {
+				if _, err := Unregister(ctx, client, profile, *account); err != nil {
+					t.Fatalf("failed to unregister: %v", err)
+				}
+			},
+			wantStatus:  "404",
+			wantMessage: "Device not found",
+		},
+		{
+			name: "wrong token",
+			setup: func(t *testing.T, profile ClientProfile, client *http.Client, account *models.AccountData) {
+				account.Token = "wrong"
+			},
+			wantStatus:  "401",
+			wantMessage: "Authentication error",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, profile, client := newMockAPI(t)
+			account := mustRegister(t, profile, client)
+			if tt.setup != nil {
+				tt.setup(t, profile, client, &account)
+			}
+
+			apiErr, err := Unregister(ctx, client, profile, account)
+			checkAPIError(t, apiErr, err, tt.wantStatus, tt.wantMessage)
+			if tt.wantStatus != "" {
+				return
+			}
+
+			_, apiErr, err = GetAccount(ctx, client, profile, account)
+			checkAPIError(t, apiErr, err, "404", "Device not found")
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// Errors returned while establishing or running a MASQUE session.
+// Use errors.Is to check for them, the returned errors usually wrap the underlying cause.
+var (
+	// ErrAuthDenied means the server rejected our client certificate, usually because
+	// the key isn't enrolled (anymore).
+	ErrAuthDenied = errors.New("login failed! Please double-check if your tls key and cert is enrolled in the Cloudflare Access service")
+	// ErrEndpointKeyMismatch means the server presented a different public key than the one we pin to.
+	ErrEndpointKeyMismatch = errors.New("remote endpoint has a different public key than what we trust in config.json")
+	// ErrHandshakeTimeout means the QUIC handshake with the server didn't complete in time.
+	ErrHandshakeTimeout = errors.New("handshake with the MASQUE server timed out")
+)
+
+// tlsAlertAccessDenied is the TLS access_denied alert, sent as QUIC CRYPTO_ERROR 0x131.
+const tlsAlertAccessDenied = 49
+
+// ConnectStatusError is returned when the server answers the CONNECT-IP request with a non-2xx status.
+type ConnectStatusError struct {
+	// StatusCode is the HTTP status code returned by the server.
+	StatusCode int
+	// Response is the server's response. Its body must not be read.
+	Response *http.Response
+}
+
+func (e *ConnectStatusError) Error() string {
+	return fmt.Sprintf("tunnel connection failed: %s", e.Response.Status)
+}
+
+// ServerCloseError is returned when the server closed the session.
+type ServerCloseError struct {
+	// Code is the HTTP/3 error code the server closed the connection with.
+	// http3.ErrCodeNoError usually means the server dropped an idle session.
+	Code http3.ErrCode
+	// Message is the reason phrase sent by the server, if any.
+	Message string
+}
+
+func (e *ServerCloseError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("server closed the connection: %s", e.Code)
+	}
+	return fmt.Sprintf("server closed the connection: %s (%s)", e.Code, e.Message)
+}
+
+// endpointKeyMismatchError is returned from the TLS verification callback. It unwraps to
+// the x509 error for compatibility and matches ErrEndpointKeyMismatch.
+type endpointKeyMismatchError struct {
+	x509.CertificateInvalidError
+}
+
+func (e endpointKeyMismatchError) Unwrap() error        { return e.CertificateInvalidError }
+func (e endpointKeyMismatchError) Is(target error) bool { return target == ErrEndpointKeyMismatch }
+
+// classifyDialError maps errors from dialing the QUIC connection and the CONNECT-IP
+// request to the exported error values, keeping the original error wrapped.
+//
+// Parameters:
+//   - err: error - The error returned while dialing.
+//
+// Returns:
+//   - error: The classified error.
+func classifyDialError(err error) error {
+	if errors.Is(err, ErrEndpointKeyMismatch) {
+		return err
+	}
+
+	var transportErr *quic.TransportError
+	if errors.As(err, &transportErr) && transportErr.Remote && transportErr.ErrorCode == quic.TransportErrorCode(0x100+tlsAlertAccessDenied) {
+		return fmt.Errorf("%w: %w", ErrAuthDenied, err)
+	}
+
+	var timeoutErr *quic.HandshakeTimeoutError
+	if errors.As(err, &timeoutErr) {
+		return fmt.Errorf("%w: %w", ErrHandshakeTimeout, err)
+	}
+
+	var appErr *quic.ApplicationError
+	if errors.As(err, &appErr) && appErr.Remote {
+		return &ServerCloseError{Code: http3.ErrCode(appErr.ErrorCode), Message: appErr.ErrorMessage}
+	}
+
+	return fmt.Errorf("failed to dial connect-ip: %w", err)
+}
+
+// classifyCloseError returns a ServerCloseError if the connection was closed by the server,
+// otherwise the given error.
+//
+// Parameters:
+//   - conn: quic.Connection - The QUIC connection of the session.
+//   - err: error - The error the session failed with.
+//
+// Returns:
+//   - error: The classified error.
+func classifyCloseError(conn quic.Connection, err error) error {
+	if conn == nil {
+		return err
+	}
+
+	var appErr *quic.ApplicationError
+	if errors.As(context.Cause(conn.Context()), &appErr) && appErr.Remote {
+		return &ServerCloseError{Code: http3.ErrCode(appErr.ErrorCode), Message: appErr.ErrorMessage}
+	}
+
+	return err
+}
+
+// isPermanent reports whether retrying a failed dial is pointless without a config change.
+func isPermanent(err error) bool {
+	return errors.Is(err, ErrAuthDenied) || errors.Is(err, ErrEndpointKeyMismatch)
+}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// NewHTTPClient creates an HTTP client for API calls that goes through the given upstream proxy.
+// Supported proxy schemes are http, https (both using CONNECT), socks5 and socks5h.
+// Credentials may be given in the URL. Without a proxy URL the HTTPS_PROXY, HTTP_PROXY
+// and NO_PROXY environment variables are honoured.
+//
+// Parameters:
+//   - proxyURL: string - The proxy URL. (e.g., "socks5://127.0.0.1:1080", optional)
+//
+// Returns:
+//   - *http.Client: The HTTP client.
+//   - error: An error if the proxy URL is invalid.
+func NewHTTPClient(proxyURL string) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if proxyURL != "" {
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse proxy URL: %v", err)
+		}
+
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %q (use http, https, socks5 or socks5h)", u.Scheme)
+		}
+		if u.Host == "" {
+			return nil, fmt.Errorf("proxy URL %q has no host", proxyURL)
+		}
+
+		transport.Proxy = http.ProxyURL(u)
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   defaultHTTPClient.Timeout,
+	}, nil
+}
+
+// NewDialerHTTPClient creates an HTTP client for API calls that opens its connections with
+// the given dial function, e.g. the DialContext of a tunnel's netstack. Proxy environment
+// variables are ignored.
+//
+// Parameters:
+//   - dial: func(ctx context.Context, network, addr string) (net.Conn, error) - The dial function.
+//
+// Returns:
+//   - *http.Client: The HTTP client.
+func NewDialerHTTPClient(dial func(ctx context.Context, network, addr string) (net.Conn, error)) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:         dial,
+			ForceAttemptHTTP2:   true,
+			TLSHandshakeTimeout: 10 * time.Second,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		Timeout: defaultHTTPClient.Timeout,
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"crypto/ecdsa"
 	"crypto/tls"
 	"crypto/x509"
-	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -63,7 +62,7 @@ func PrepareTlsConfig(privKey *ecdsa.PrivateKey, peerPubKey *ecdsa.PublicKey, ce
 				// detail explains the actual reason
 
 				//10 is NoValidChains, but we support go1.22 where it's not defined
-				return x509.CertificateInvalidError{Cert: cert, Reason: 10, Detail: "remote endpoint has a different public key than what we trust in config.json"}
+				return endpointKeyMismatchError{x509.CertificateInvalidError{Cert: cert, Reason: 10, Detail: ErrEndpointKeyMismatch.Error()}}
 			}
 
 			return nil
@@ -77,6 +76,13 @@ func PrepareTlsConfig(privKey *ecdsa.PrivateKey, peerPubKey *ecdsa.PublicKey, ce
 // Endpoint address is used to check whether the authentication/connection is successful or not.
 // Requires modified connect-ip-go for now to support Cloudflare's non RFC compliant implementation.
 //
+// Errors can be inspected with errors.Is and errors.As, see ErrAuthDenied, ErrEndpointKeyMismatch,
+// ErrHandshakeTimeout, ConnectStatusError and ServerCloseError.
+//
+// On failure, the UDP socket and every other resource of the attempt are already released
+// and nil is returned in their place. Earlier versions returned the open UDP socket for the
+// caller to close; closing the nil *net.UDPConn returned now is harmless.
+//
 // Parameters:
 //   - ctx: context.Context - The QUIC TLS context.
 //   - tlsConfig: *tls.Config - The TLS configuration for secure communication.
@@ -85,12 +91,46 @@ func PrepareTlsConfig(privKey *ecdsa.PrivateKey, peerPubKey *ecdsa.PublicKey, ce
 //   - endpoint: *net.UDPAddr - The UDP address of the QUIC server.
 //
 // Returns:
-//   - *net.UDPConn: The UDP connection used for the QUIC session.
-//   - *http3.Transport: The HTTP/3 transport used for initial request.
-//   - *connectip.Conn: The Connect-IP connection instance.
-//   - *http.Response: The response from the Connect-IP handshake.
+//   - *net.UDPConn: The UDP connection used for the QUIC session, nil on failure.
+//   - *http3.Transport: The HTTP/3 transport used for initial request, nil on failure.
+//   - *connectip.Conn: The Connect-IP connection instance, nil on failure.
+//   - *http.Response: The response from the Connect-IP handshake, if the server sent one.
 //   - error: An error if the connection setup fails.
 func ConnectTunnel(ctx context.Context, tlsConfig *tls.Config, quicConfig *quic.Config, connectUri string, endpoint *net.UDPAddr) (*net.UDPConn, *http3.Transport, *connectip.Conn, *http.Response, error) {
+	return ConnectTunnelWithProfile(ctx, ProfileCloudflare, tlsConfig, quicConfig, connectUri, endpoint)
+}
+
+// ConnectTunnelWithProfile is like ConnectTunnel, but speaks the given protocol profile.
+// With ProfileStandard, connectUri must be an expanded URI, see ExpandConnectURI, and the
+// TLS configuration should come from PrepareStandardTlsConfig. Like ConnectTunnel, it
+// releases every resource itself on failure.
+//
+// Parameters:
+//   - ctx: context.Context - The QUIC TLS context.
+//   - profile: ProtocolProfile - The CONNECT-IP flavour to speak.
+//   - tlsConfig: *tls.Config - The TLS configuration for secure communication.
+//   - quicConfig: *quic.Config - The QUIC configuration settings.
+//   - connectUri: string - The URI for the Connect-IP request.
+//   - endpoint: *net.UDPAddr - The UDP address of the QUIC server.
+//
+// Returns:
+//   - *net.UDPConn: The UDP connection used for the QUIC session, nil on failure.
+//   - *http3.Transport: The HTTP/3 transport used for initial request, nil on failure.
+//   - *connectip.Conn: The Connect-IP connection instance, nil on failure.
+//   - *http.Response: The response from the Connect-IP handshake, if the server sent one.
+//   - error: An error if the connection setup fails.
+func ConnectTunnelWithProfile(ctx context.Context, profile ProtocolProfile, tlsConfig *tls.Config, quicConfig *quic.Config, connectUri string, endpoint *net.UDPAddr) (*net.UDPConn, *http3.Transport, *connectip.Conn, *http.Response, error) {
+	session, rsp, err := connectTunnel(ctx, profile, tlsConfig, quicConfig, connectUri, endpoint)
+	if err != nil {
+		return nil, nil, nil, rsp, err
+	}
+
+	return session.udpConn, session.tr, session.ipConn, rsp, nil
+}
+
+// connectTunnel does the work of ConnectTunnelWithProfile and returns the established session.
+// All resources are released if the setup fails.
+func connectTunnel(ctx context.Context, profile ProtocolProfile, tlsConfig *tls.Config, quicConfig *quic.Config, connectUri string, endpoint *net.UDPAddr) (*tunnelSession, *http.Response, error) {
 	var udpConn *net.UDPConn
 	var err error
 	if endpoint.IP.To4() == nil {
@@ -105,7 +145,7 @@ func ConnectTunnel(ctx context.Context, tlsConfig *tls.Config, quicConfig *quic.
 		})
 	}
 	if err != nil {
-		return udpConn, nil, nil, nil, err
+		return nil, nil, err
 	}
 
 	conn, err := quic.Dial(
@@ -116,35 +156,42 @@ func ConnectTunnel(ctx context.Context, tlsConfig *tls.Config, quicConfig *quic.
 		quicConfig,
 	)
 	if err != nil {
-		return udpConn, nil, nil, nil, err
+		udpConn.Close()
+		return nil, nil, classifyDialError(err)
 	}
 
 	tr := &http3.Transport{
-		EnableDatagrams: true,
-		AdditionalSettings: map[uint64]uint64{
-			// official client still sends this out as well, even though
-			// it's deprecated, see https://datatracker.ietf.org/doc/draft-ietf-masque-h3-datagram/00/
-			// SETTINGS_H3_DATAGRAM_00 = 0x0000000000000276
-			// https://github.com/cloudflare/quiche/blob/7c66757dbc55b8d0c3653d4b345c6785a181f0b7/quiche/src/h3/frame.rs#L46
-			0x276: 1,
-		},
+		EnableDatagrams:    true,
+		AdditionalSettings: profile.additionalSettings(),
 		DisableCompression: true,
 	}
 
 	hconn := tr.NewClientConn(conn)
 
-	additionalHeaders := http.Header{
-		"User-Agent": []string{""},
+	template, err := uritemplate.New(connectUri)
+	if err != nil {
+		conn.CloseWithError(quic.ApplicationErrorCode(http3.ErrCodeNoError), "")
+		tr.Close()
+		udpConn.Close()
+		return nil, nil, fmt.Errorf("invalid connect URI: %v", err)
 	}
 
-	template := uritemplate.MustNew(connectUri)
-	ipConn, rsp, err := connectip.Dial(ctx, hconn, template, "cf-connect-ip", additionalHeaders, true)
+	ipConn, rsp, err := connectip.Dial(ctx, hconn, template, profile.requestProtocol(), profile.additionalHeaders(), profile.ignoreExtendedConnect())
 	if err != nil {
-		if err.Error() == "CRYPTO_ERROR 0x131 (remote): tls: access denied" {
-			return udpConn, nil, nil, nil, errors.New("login failed! Please double-check if your tls key and cert is enrolled in the Cloudflare Access service")
+		conn.CloseWithError(quic.ApplicationErrorCode(http3.ErrCodeNoError), "")
+		tr.Close()
+		udpConn.Close()
+		if rsp != nil {
+			return nil, rsp, &ConnectStatusError{StatusCode: rsp.StatusCode, Response: rsp}
 		}
-		return udpConn, nil, nil, nil, fmt.Errorf("failed to dial connect-ip: %v", err)
+		return nil, nil, classifyDialError(err)
 	}
 
-	return udpConn, tr, ipConn, rsp, nil
+	return &tunnelSession{
+		udpConn: udpConn,
+		tr:      tr,
+		conn:    conn,
+		ipConn:  ipConn,
+		done:    make(chan struct{}),
+	}, rsp, nil
 }
@@ -0,0 +1,293 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// natUDPTimeout is how long a forwarded UDP flow is kept open without traffic.
+const natUDPTimeout = 2 * time.Minute
+
+// NATDevice is a TunnelDevice backed by a userspace gVisor network stack. Every TCP and
+// UDP flow written to it is terminated inside the stack and re-originated from the host,
+// so peers reach the network the host can reach, much like behind a NAT. No privileges
+// are required.
+//
+// Flows to loopback, link-local and unspecified addresses and to the addresses of the
+// host itself are refused, so peers can't reach services that only listen locally,
+// unless AllowLocal is set.
+type NATDevice struct {
+	// AllowLocal lets flows reach the loopback, link-local and own addresses of the host.
+	AllowLocal bool
+
+	ep       *channel.Endpoint
+	stack    *stack.Stack
+	notify   *channel.NotificationHandle
+	incoming chan *buffer.View
+	dialer   net.Dialer
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewNATDevice creates a new NATDevice.
+//
+// Parameters:
+//   - mtu: int - The MTU of the device.
+//
+// Returns:
+//   - *NATDevice: The device.
+//   - error: An error if the network stack could not be set up.
+func NewNATDevice(mtu int) (*NATDevice, error) {
+	d := &NATDevice{
+		ep: channel.New(1024, uint32(mtu), ""),
+		stack: stack.New(stack.Options{
+			NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+			TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4, icmp.NewProtocol6},
+		}),
+		incoming: make(chan *buffer.View),
+		dialer:   net.Dialer{Timeout: 10 * time.Second},
+		closed:   make(chan struct{}),
+	}
+
+	sackEnabledOpt := tcpip.TCPSACKEnabled(true)
+	if err := d.stack.SetTransportProtocolOption(tcp.ProtocolNumber, &sackEnabledOpt); err != nil {
+		return nil, fmt.Errorf("could not enable TCP SACK: %v", err)
+	}
+
+	d.notify = d.ep.AddNotify(d)
+	if err := d.stack.CreateNIC(1, d.ep); err != nil {
+		return nil, fmt.Errorf("failed to create NIC: %v", err)
+	}
+	// accept and answer packets for any destination
+	if err := d.stack.SetPromiscuousMode(1, true); err != nil {
+		return nil, fmt.Errorf("failed to enable promiscuous mode: %v", err)
+	}
+	if err := d.stack.SetSpoofing(1, true); err != nil {
+		return nil, fmt.Errorf("failed to enable spoofing: %v", err)
+	}
+	d.stack.AddRoute(tcpip.Route{Destination: header.IPv4EmptySubnet, NIC: 1})
+	d.stack.AddRoute(tcpip.Route{Destination: header.IPv6EmptySubnet, NIC: 1})
+
+	tcpForwarder := tcp.NewForwarder(d.stack, 0, 1024, d.forwardTCP)
+	d.stack.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder.HandlePacket)
+	udpForwarder := udp.NewForwarder(d.stack, d.forwardUDP)
+	d.stack.SetTransportProtocolHandler(udp.ProtocolNumber, udpForwarder.HandlePacket)
+
+	return d, nil
+}
+
+// ReadPacket reads a packet the stack sends back towards the peers.
+func (d *NATDevice) ReadPacket(buf []byte) (int, error) {
+	select {
+	case view := <-d.incoming:
+		defer view.Release()
+		return view.Read(buf)
+	case <-d.closed:
+		return 0, os.ErrClosed
+	}
+}
+
+// WritePacket injects a packet coming from a peer into the stack.
+func (d *NATDevice) WritePacket(pkt []byte) error {
+	if len(pkt) == 0 {
+		return nil
+	}
+
+	pkb := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(pkt)})
+	defer pkb.DecRef()
+
+	switch pkt[0] >> 4 {
+	case 4:
+		d.ep.InjectInbound(header.IPv4ProtocolNumber, pkb)
+	case 6:
+		d.ep.InjectInbound(header.IPv6ProtocolNumber, pkb)
+	default:
+		return syscall.EAFNOSUPPORT
+	}
+
+	return nil
+}
+
+// WriteNotify is called by the link endpoint when the stack has an outbound packet.
+func (d *NATDevice) WriteNotify() {
+	pkt := d.ep.Read()
+	if pkt == nil {
+		return
+	}
+
+	view := pkt.ToView()
+	pkt.DecRef()
+
+	select {
+	case d.incoming <- view:
+	case <-d.closed:
+		view.Release()
+	}
+}
+
+// Close shuts the network stack down. Forwarded connections are closed.
+func (d *NATDevice) Close() error {
+	d.closeOnce.Do(func() {
+		close(d.closed)
+		d.ep.RemoveNotify(d.notify)
+		d.stack.RemoveNIC(1)
+		d.stack.Close()
+		d.ep.Close()
+	})
+	return nil
+}
+
+// allowed reports whether flows may be forwarded to the destination address.
+func (d *NATDevice) allowed(addr tcpip.Address) bool {
+	if d.AllowLocal {
+		return true
+	}
+
+	ip, ok := netip.AddrFromSlice(addr.AsSlice())
+	if !ok {
+		return false
+	}
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsUnspecified() {
+		return false
+	}
+
+	return !isHostAddress(ip)
+}
+
+// isHostAddress reports whether the address is assigned to one of the host's interfaces.
+func isHostAddress(ip netip.Addr) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		// without the list, err on the side of refusing
+		return true
+	}
+
+	for _, addr := range addrs {
+		prefix, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if own, ok := netip.AddrFromSlice(prefix.IP); ok && own.Unmap() == ip {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forwardTCP dials the destination of a new TCP flow from the host and relays the data.
+func (d *NATDevice) forwardTCP(r *tcp.ForwarderRequest) {
+	id := r.ID()
+	if !d.allowed(id.LocalAddress) {
+		r.Complete(true)
+		return
+	}
+	dest := endpointAddress(id.LocalAddress, id.LocalPort)
+
+	outbound, err := d.dialer.Dial("tcp", dest)
+	if err != nil {
+		r.Complete(true)
+		return
+	}
+
+	var wq waiter.Queue
+	ep, tcpErr := r.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		r.Complete(true)
+		outbound.Close()
+		return
+	}
+	r.Complete(false)
+
+	relay(gonet.NewTCPConn(&wq, ep), outbound)
+}
+
+// forwardUDP opens a host UDP socket for a new UDP flow and relays the datagrams.
+func (d *NATDevice) forwardUDP(r *udp.ForwarderRequest) {
+	id := r.ID()
+	if !d.allowed(id.LocalAddress) {
+		return
+	}
+	dest := endpointAddress(id.LocalAddress, id.LocalPort)
+
+	var wq waiter.Queue
+	ep, udpErr := r.CreateEndpoint(&wq)
+	if udpErr != nil {
+		return
+	}
+	inbound := gonet.NewUDPConn(&wq, ep)
+
+	go func() {
+		outbound, err := d.dialer.Dial("udp", dest)
+		if err != nil {
+			inbound.Close()
+			return
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go copyDatagrams(ctx, cancel, outbound, inbound)
+		copyDatagrams(ctx, cancel, inbound, outbound)
+	}()
+}
+
+// copyDatagrams copies datagrams from src to dst until either side fails or the flow is idle.
+func copyDatagrams(ctx context.Context, cancel context.CancelFunc, dst, src net.Conn) {
+	defer cancel()
+	defer src.Close()
+	defer dst.Close()
+
+	buf := make([]byte, 65535)
+	for ctx.Err() == nil {
+		src.SetReadDeadline(time.Now().Add(natUDPTimeout))
+		n, err := src.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := dst.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+// relay copies data in both directions until one side is done.
+func relay(a, b net.Conn) {
+	go func() {
+		io.Copy(a, b)
+		a.Close()
+		b.Close()
+	}()
+	io.Copy(b, a)
+	a.Close()
+	b.Close()
+}
+
+// endpointAddress formats a gVisor address and port as host:port.
+func endpointAddress(addr tcpip.Address, port uint16) string {
+	ip, _ := netip.AddrFromSlice(addr.AsSlice())
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+func TestNATDeviceAllowed(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{addr: "1.1.1.1", want: true},
+		{addr: "2606:4700:4700::1111", want: true},
+		{addr: "198.51.100.77", want: true},
+		{addr: "127.0.0.1", want: false},
+		{addr: "127.1.2.3", want: false},
+		{addr: "::1", want: false},
+		{addr: "::ffff:127.0.0.1", want: false},
+		{addr: "169.254.169.254", want: false},
+		{addr: "fe80::1", want: false},
+		{addr: "ff02::1", want: false},
+		{addr: "0.0.0.0", want: false},
+		{addr: "::", want: false},
+	}
+
+	// an address of one of our own interfaces, other than loopback
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if prefix, ok := addr.(*net.IPNet); ok && !prefix.IP.IsLoopback() && !prefix.IP.IsLinkLocalUnicast() {
+				tests = append(tests, struct {
+					addr string
+					want bool
+				}{addr: prefix.IP.String(), want: false})
+				break
+			}
+		}
+	}
+
+	d := &NATDevice{}
+	local := &NATDevice{AllowLocal: true}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			addr := tcpip.AddrFromSlice(netip.MustParseAddr(tt.addr).AsSlice())
+			if got := d.allowed(addr); got != tt.want {
+				t.Errorf("allowed(%s) = %v, want %v", tt.addr, got, tt.want)
+			}
+			if !local.allowed(addr) {
+				t.Errorf("allowed(%s) = false with AllowLocal", tt.addr)
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/yosida95/uritemplate/v3"
+)
+
+// ProtocolProfile selects the flavour of CONNECT-IP spoken to the MASQUE server.
+type ProtocolProfile int
+
+const (
+	// ProfileCloudflare mimics the official WARP client: the cf-connect-ip protocol token,
+	// the deprecated SETTINGS_H3_DATAGRAM_00 setting, an empty User-Agent and endpoint
+	// public key pinning instead of certificate verification.
+	ProfileCloudflare ProtocolProfile = iota
+	// ProfileStandard speaks RFC 9484 connect-ip to any compliant proxy using a URI template,
+	// standard SETTINGS and a server certificate verified against the system roots.
+	ProfileStandard
+)
+
+// String returns the name of the profile.
+func (p ProtocolProfile) String() string {
+	switch p {
+	case ProfileCloudflare:
+		return "cloudflare"
+	case ProfileStandard:
+		return "standard"
+	default:
+		return "unknown(" + strconv.Itoa(int(p)) + ")"
+	}
+}
+
+// ParseProtocolProfile parses a profile name as returned by ProtocolProfile.String.
+//
+// Parameters:
+//   - name: string - The profile name.
+//
+// Returns:
+//   - ProtocolProfile: The parsed profile.
+//   - error: An error if the name is unknown.
+func ParseProtocolProfile(name string) (ProtocolProfile, error) {
+	switch strings.ToLower(name) {
+	case "", "cloudflare", "cf":
+		return ProfileCloudflare, nil
+	case "standard", "rfc9484":
+		return ProfileStandard, nil
+	default:
+		return 0, fmt.Errorf("unknown protocol profile: %s", name)
+	}
+}
+
+// requestProtocol returns the :protocol pseudo-header value of the Extended CONNECT request.
+func (p ProtocolProfile) requestProtocol() string {
+	if p == ProfileStandard {
+		return "connect-ip"
+	}
+	return "cf-connect-ip"
+}
+
+// additionalSettings returns the HTTP/3 SETTINGS sent in addition to the ones quic-go sends.
+func (p ProtocolProfile) additionalSettings() map[uint64]uint64 {
+	if p == ProfileStandard {
+		return nil
+	}
+	return map[uint64]uint64{
+		// official client still sends this out as well, even though
+		// it's deprecated, see https://datatracker.ietf.org/doc/draft-ietf-masque-h3-datagram/00/
+		// SETTINGS_H3_DATAGRAM_00 = 0x0000000000000276
+		// https://github.com/cloudflare/quiche/blob/7c66757dbc55b8d0c3653d4b345c6785a181f0b7/quiche/src/h3/frame.rs#L46
+		0x276: 1,
+	}
+}
+
+// additionalHeaders returns the headers sent along with the CONNECT-IP request.
+func (p ProtocolProfile) additionalHeaders() http.Header {
+	if p == ProfileStandard {
+		return http.Header{
+			"User-Agent": []string{"usque"},
+		}
+	}
+	return http.Header{
+		"User-Agent": []string{""},
+	}
+}
+
+// ignoreExtendedConnect reports whether the request is sent even if the server
+// didn't enable Extended CONNECT, which Cloudflare doesn't.
+func (p ProtocolProfile) ignoreExtendedConnect() bool {
+	return p != ProfileStandard
+}
+
+// ExpandConnectURI turns a CONNECT-IP URI template into the URI requested from the server.
+// For the standard profile, the {target} and {ipproto} variables are set to "*" to request
+// a full tunnel, as no IP flow forwarding is supported. An empty template with the
+// Cloudflare profile returns the URI the official client uses.
+//
+// Parameters:
+//   - profile: ProtocolProfile - The profile the URI is used with.
+//   - template: string - The URI template.
+//
+// Returns:
+//   - string: The expanded URI.
+//   - error: An error if the template is invalid or contains unsupported variables.
+func ExpandConnectURI(profile ProtocolProfile, template string) (string, error) {
+	if template == "" {
+		if profile == ProfileStandard {
+			return "", fmt.Errorf("the %s profile requires a connect URI", profile)
+		}
+		return internal.ConnectURI, nil
+	}
+
+	tmpl, err := uritemplate.New(template)
+	if err != nil {
+		return "", fmt.Errorf("invalid connect URI template: %v", err)
+	}
+
+	// "*" is reserved, so it would get percent-encoded, but RFC 9484 proxies expect it
+	// literally. The variables are expanded to a placeholder that needs no encoding and
+	// doesn't occur in the template, which is then replaced by the wildcard.
+	placeholder := "wildcard"
+	for strings.Contains(template, placeholder) {
+		placeholder += "_"
+	}
+
+	values := uritemplate.Values{}
+	for _, name := range tmpl.Varnames() {
+		switch name {
+		case "target", "ipproto":
+			values.Set(name, uritemplate.String(placeholder))
+		default:
+			return "", fmt.Errorf("unsupported variable in connect URI template: %s", name)
+		}
+	}
+
+	expanded, err := tmpl.Expand(values)
+	if err != nil {
+		return "", fmt.Errorf("failed to expand connect URI template: %v", err)
+	}
+
+	return strings.ReplaceAll(expanded, placeholder, "*"), nil
+}
+
+// ResolveConnectURI returns the UDP address of the server named in a CONNECT-IP URI.
+//
+// Parameters:
+//   - connectUri: string - The expanded CONNECT-IP URI.
+//
+// Returns:
+//   - *net.UDPAddr: The resolved server address.
+//   - string: The host name to use for SNI and certificate verification.
+//   - error: An error if the URI is invalid or the host can't be resolved.
+func ResolveConnectURI(connectUri string) (*net.UDPAddr, string, error) {
+	u, err := url.Parse(connectUri)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid connect URI: %v", err)
+	}
+	if u.Scheme != "https" {
+		return nil, "", fmt.Errorf("connect URI must use https, got %q", u.Scheme)
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to resolve %s: %v", u.Hostname(), err)
+	}
+
+	return addr, u.Hostname(), nil
+}
+
+// PrepareStandardTlsConfig creates a TLS configuration for RFC 9484 proxies. Unlike
+// PrepareTlsConfig, the server certificate is verified against the system roots.
+//
+// Parameters:
+//   - privKey: *ecdsa.PrivateKey - The private key to use for TLS authentication.
+//   - cert: [][]byte - The certificate chain to use for TLS authentication.
+//   - serverName: string - The server name to send as SNI and to verify the certificate against.
+//
+// Returns:
+//   - *tls.Config: A TLS configuration for secure communication.
+//   - error: An error if TLS setup fails.
+func PrepareStandardTlsConfig(privKey *ecdsa.PrivateKey, cert [][]byte, serverName string) (*tls.Config, error) {
+	if serverName == "" {
+		return nil, fmt.Errorf("server name is required for certificate verification")
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{
+			{
+				Certificate: cert,
+				PrivateKey:  privKey,
+			},
+		},
+		ServerName: serverName,
+		NextProtos: []string{http3.NextProtoH3},
+	}, nil
+}
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/Diniboy1123/usque/internal"
+)
+
+func TestParseProtocolProfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    ProtocolProfile
+		wantErr bool
+	}{
+		{name: "", want: ProfileCloudflare},
+		{name: "cloudflare", want: ProfileCloudflare},
+		{name: "CF", want: ProfileCloudflare},
+		{name: "standard", want: ProfileStandard},
+		{name: "RFC9484", want: ProfileStandard},
+		{name: "connect-udp", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseProtocolProfile(tt.name)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+			if tt.name != "" {
+				if again, err := ParseProtocolProfile(got.String()); err != nil || again != got {
+					t.Errorf("%s doesn't parse back: %v, %v", got, again, err)
+				}
+			}
+		})
+	}
+}
+
+func TestExpandConnectURI(t *testing.T) {
+	tests := []struct {
+		name     string
+		profile  ProtocolProfile
+		template string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name: "cloudflare default",
+			want: internal.ConnectURI,
+		},
+		{
+			name:    "standard without template",
+			profile: ProfileStandard,
+			wantErr: true,
+		},
+		{
+			name:     "path variables",
+			profile:  ProfileStandard,
+			template: "https://proxy.example/.well-known/masque/ip/{target}/{ipproto}/",
+			want:     "https://proxy.example/.well-known/masque/ip/*/*/",
+		},
+		{
+			name:     "query variables",
+			profile:  ProfileStandard,
+			template: "https://proxy.example/masque{?target,ipproto}",
+			want:     "https://proxy.example/masque?target=*&ipproto=*",
+		},
+		{
+			name:     "placeholder in the template",
+			profile:  ProfileStandard,
+			template: "https://wildcard.example/wildcard_/{target}/{ipproto}/",
+			want:     "https://wildcard.example/wildcard_/*/*/",
+		},
+		{
+			name:     "literal asterisk kept",
+			profile:  ProfileStandard,
+			template: "https://proxy.example/*/{target}",
+			want:     "https://proxy.example/*/*",
+		},
+		{
+			name:     "no variables",
+			profile:  ProfileStandard,
+			template: "https://proxy.example/ip",
+			want:     "https://proxy.example/ip",
+		},
+		{
+			name:     "unsupported variable",
+			profile:  ProfileStandard,
+			template: "https://proxy.example/{target}/{port}/",
+			wantErr:  true,
+		},
+		{
+			name:     "unterminated expression",
+			profile:  ProfileStandard,
+			template: "https://proxy.example/{target",
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ExpandConnectURI(tt.profile, tt.template)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveConnectURI(t *testing.T) {
+	tests := []struct {
+		name     string
+		uri      string
+		wantAddr string
+		wantHost string
+		wantErr  bool
+	}{
+		{name: "explicit port", uri: "https://127.0.0.1:4433/ip/*/*/", wantAddr: "127.0.0.1:4433", wantHost: "127.0.0.1"},
+		{name: "default port", uri: "https://127.0.0.1/ip", wantAddr: "127.0.0.1:443", wantHost: "127.0.0.1"},
+		{name: "IPv6", uri: "https://[::1]:8443/ip", wantAddr: "[::1]:8443", wantHost: "::1"},
+		{name: "not https", uri: "http://127.0.0.1/ip", wantErr: true},
+		{name: "invalid", uri: "https://%zz/", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, host, err := ResolveConnectURI(tt.uri)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if addr.String() != tt.wantAddr || host != tt.wantHost {
+				t.Errorf("got %s, %q, want %s, %q", addr, host, tt.wantAddr, tt.wantHost)
+			}
+		})
+	}
+}
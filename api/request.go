@@ -0,0 +1,187 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Diniboy1123/usque/models"
+)
+
+// Retry behaviour of API requests.
+const (
+	apiMaxAttempts    = 4
+	apiInitialBackoff = 500 * time.Millisecond
+	apiMaxBackoff     = 30 * time.Second
+)
+
+// defaultHTTPClient is used for API requests when no client is given.
+// Unlike http.DefaultClient it doesn't wait forever on a stalled connection.
+var defaultHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// doRequest sends an API request and reads the response body. Network errors, 5xx responses
+// and 429 responses are retried with exponential backoff, honouring Retry-After if present.
+// Requests with methods that aren't idempotent, such as the POST creating a registration,
+// are only retried if they never reached the server or on 429 responses with Retry-After,
+// so a lost response can't create a second device.
+//
+// Parameters:
+//   - ctx: context.Context - Cancels the request and any pending retry.
+//   - client: *http.Client - The HTTP client to use. Nil uses a default client with a timeout.
+//   - profile: ClientProfile - The client profile providing the URL and headers.
+//   - method: string - The HTTP method.
+//   - path: string - The path below the API version. (e.g., "/reg")
+//   - body: []byte - The request body, nil for none.
+//   - headers: map[string]string - Additional request headers.
+//
+// Returns:
+//   - *http.Response: The last response. Its body has already been consumed.
+//   - []byte: The body of the last response.
+//   - error: An error if no response could be obtained.
+func doRequest(ctx context.Context, client *http.Client, profile ClientProfile, method, path string, body []byte, headers map[string]string) (*http.Response, []byte, error) {
+	if client == nil {
+		client = defaultHTTPClient
+	}
+
+	backoff := apiInitialBackoff
+	for attempt := 1; ; attempt++ {
+		var reqBody io.Reader
+		if body != nil {
+			reqBody = bytes.NewReader(body)
+		}
+
+		req, err := profile.newRequest(method, path, reqBody)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create request: %v", err)
+		}
+		req = req.WithContext(ctx)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+
+		resp, err := client.Do(req)
+		notSent := err != nil && requestNotSent(err)
+		var respBody []byte
+		if err == nil {
+			respBody, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				err = fmt.Errorf("failed to read response body: %v", err)
+			}
+		} else {
+			err = fmt.Errorf("failed to send request: %v", err)
+		}
+
+		if err != nil && ctx.Err() != nil {
+			return nil, nil, fmt.Errorf("request cancelled: %w", context.Cause(ctx))
+		}
+
+		retry := err != nil || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		if retry && !idempotentMethod(method) {
+			retry = notSent || (err == nil && resp.StatusCode == http.StatusTooManyRequests && resp.Header.Get("Retry-After") != "")
+		}
+		if !retry || attempt == apiMaxAttempts {
+			if err != nil {
+				return nil, nil, err
+			}
+			return resp, respBody, nil
+		}
+
+		delay := backoff
+		if err == nil {
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+				delay = retryAfter
+			}
+		}
+		delay = min(delay, apiMaxBackoff)
+		backoff = min(backoff*2, apiMaxBackoff)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, nil, fmt.Errorf("request cancelled: %w", context.Cause(ctx))
+		case <-timer.C:
+		}
+	}
+}
+
+// idempotentMethod reports whether repeating a request with the method has the same effect as sending it once.
+func idempotentMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+// requestNotSent reports whether a request failed before it could reach the server,
+// i.e. while resolving the host, connecting or during the TLS handshake.
+func requestNotSent(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+
+	var recordErr tls.RecordHeaderError
+	var verifyErr *tls.CertificateVerificationError
+	var alertErr tls.AlertError
+	return errors.As(err, &recordErr) || errors.As(err, &verifyErr) || errors.As(err, &alertErr)
+}
+
+// parseRetryAfter parses a Retry-After header given either in seconds or as an HTTP date.
+//
+// Parameters:
+//   - value: string - The header value.
+//
+// Returns:
+//   - time.Duration: The time to wait.
+//   - bool: Whether the header held a valid value.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0), true
+	}
+
+	return 0, false
+}
+
+// parseAPIError turns an unsuccessful response into an error, decoding the API error body if there is one.
+//
+// Parameters:
+//   - resp: *http.Response - The unsuccessful response.
+//   - body: []byte - The response body.
+//   - action: string - What was attempted, used in the error message. (e.g., "register")
+//
+// Returns:
+//   - *models.APIError: The decoded API error, nil if the body isn't one.
+//   - error: An error describing the failure.
+func parseAPIError(resp *http.Response, body []byte, action string) (*models.APIError, error) {
+	var apiErr models.APIError
+	if err := json.Unmarshal(body, &apiErr); err != nil || len(apiErr.Errors) == 0 {
+		return nil, fmt.Errorf("failed to %s: %s", action, resp.Status)
+	}
+
+	return &apiErr, fmt.Errorf("failed to %s: %s", action, resp.Status)
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDoRequestRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		status       int
+		retryAfter   string
+		wantAttempts int32
+	}{
+		{name: "GET on 503", method: http.MethodGet, status: http.StatusServiceUnavailable, retryAfter: "0", wantAttempts: apiMaxAttempts},
+		{name: "DELETE on 503", method: http.MethodDelete, status: http.StatusServiceUnavailable, retryAfter: "0", wantAttempts: apiMaxAttempts},
+		{name: "GET on 404", method: http.MethodGet, status: http.StatusNotFound, wantAttempts: 1},
+		{name: "POST on 503", method: http.MethodPost, status: http.StatusServiceUnavailable, retryAfter: "0", wantAttempts: 1},
+		{name: "PATCH on 503", method: http.MethodPatch, status: http.StatusServiceUnavailable, retryAfter: "0", wantAttempts: 1},
+		{name: "POST on 429 with Retry-After", method: http.MethodPost, status: http.StatusTooManyRequests, retryAfter: "0", wantAttempts: apiMaxAttempts},
+		{name: "POST on 429 without Retry-After", method: http.MethodPost, status: http.StatusTooManyRequests, wantAttempts: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempts.Add(1)
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+
+			profile := ClientProfile{BaseURL: srv.URL, Version: "v0test"}
+			resp, _, err := doRequest(context.Background(), srv.Client(), profile, tt.method, "/reg", []byte("{}"), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if got := attempts.Load(); got != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", got, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestRequestNotSent(t *testing.T) {
+	// a closed listener refuses the connection, so the request never reaches a server
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	_, err = http.Get("http://" + addr + "/")
+	if err == nil {
+		t.Fatal("expected the request to fail")
+	}
+	if !requestNotSent(err) {
+		t.Errorf("requestNotSent(%v) = false, want true", err)
+	}
+
+	// the server dropping the connection after reading the request may have processed it
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL, nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	_, err = srv.Client().Do(req)
+	if err == nil {
+		t.Fatal("expected the request to fail")
+	}
+	if requestNotSent(err) {
+		t.Errorf("requestNotSent(%v) = true, want false", err)
+	}
+}
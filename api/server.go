@@ -0,0 +1,539 @@
+package api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+
+	connectip "github.com/Diniboy1123/connect-ip-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/yosida95/uritemplate/v3"
+)
+
+// errAccessDenied is returned to clients presenting a key that isn't authorized.
+// Wrapping the TLS alert makes QUIC send CRYPTO_ERROR 0x131, just like Cloudflare does.
+var errAccessDenied = fmt.Errorf("%w: client key is not enrolled", tls.AlertError(tlsAlertAccessDenied))
+
+// AddressPool hands out tunnel addresses to connecting peers.
+// The network address and the first host address of every prefix are reserved for the server.
+type AddressPool struct {
+	mu       sync.Mutex
+	prefixes []netip.Prefix
+	leased   map[netip.Addr]bool
+}
+
+// NewAddressPool creates an AddressPool from at most one IPv4 and one IPv6 prefix.
+//
+// Parameters:
+//   - prefixes: ...netip.Prefix - The prefixes to allocate addresses from.
+//
+// Returns:
+//   - *AddressPool: The address pool.
+//   - error: An error if a prefix is invalid or a family is given twice.
+func NewAddressPool(prefixes ...netip.Prefix) (*AddressPool, error) {
+	var hasV4, hasV6 bool
+	for _, prefix := range prefixes {
+		if !prefix.IsValid() {
+			return nil, fmt.Errorf("invalid prefix: %s", prefix)
+		}
+		if prefix.Addr().Is4() {
+			if hasV4 {
+				return nil, errors.New("only one IPv4 prefix is supported")
+			}
+			hasV4 = true
+		} else {
+			if hasV6 {
+				return nil, errors.New("only one IPv6 prefix is supported")
+			}
+			hasV6 = true
+		}
+	}
+
+	return &AddressPool{
+		prefixes: prefixes,
+		leased:   make(map[netip.Addr]bool),
+	}, nil
+}
+
+// Allocate leases one free address from every prefix of the pool.
+//
+// Returns:
+//   - []netip.Prefix: The leased addresses as single-address prefixes.
+//   - error: An error if a prefix is exhausted.
+func (p *AddressPool) Allocate() ([]netip.Prefix, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var leased []netip.Prefix
+	for _, prefix := range p.prefixes {
+		addr := prefix.Masked().Addr().Next().Next()
+		for ; prefix.Contains(addr) && p.leased[addr]; addr = addr.Next() {
+		}
+		if !prefix.Contains(addr) {
+			for _, l := range leased {
+				delete(p.leased, l.Addr())
+			}
+			return nil, fmt.Errorf("address pool %s is exhausted", prefix)
+		}
+		p.leased[addr] = true
+		leased = append(leased, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+
+	return leased, nil
+}
+
+// Reserve marks an address in use by someone else, so Allocate doesn't hand it out.
+// Addresses outside the prefixes of the pool can always be reserved.
+//
+// Parameters:
+//   - addr: netip.Addr - The address.
+//
+// Returns:
+//   - bool: false if the address is already leased.
+func (p *AddressPool) Reserve(addr netip.Addr) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, prefix := range p.prefixes {
+		if prefix.Contains(addr) {
+			if p.leased[addr] {
+				return false
+			}
+			p.leased[addr] = true
+		}
+	}
+
+	return true
+}
+
+// Release returns addresses to the pool.
+//
+// Parameters:
+//   - prefixes: []netip.Prefix - The addresses returned by Allocate.
+func (p *AddressPool) Release(prefixes []netip.Prefix) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, prefix := range prefixes {
+		delete(p.leased, prefix.Addr())
+	}
+}
+
+// ParseAuthorizedKeys parses a list of enrolled client public keys. Keys may be PEM
+// encoded or given one per line as base64 PKIX DER, the format used for enrollment.
+// Empty lines and lines starting with # are ignored.
+//
+// Parameters:
+//   - data: []byte - The key list.
+//
+// Returns:
+//   - []*ecdsa.PublicKey: The parsed keys.
+//   - error: An error if a key can't be parsed or isn't an ECDSA key.
+func ParseAuthorizedKeys(data []byte) ([]*ecdsa.PublicKey, error) {
+	var ders [][]byte
+	for {
+		block, rest := pem.Decode(data)
+		if block == nil {
+			break
+		}
+		ders = append(ders, block.Bytes)
+		data = rest
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		der, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode key %q: %v", line, err)
+		}
+		ders = append(ders, der)
+	}
+
+	var keys []*ecdsa.PublicKey
+	for _, der := range ders {
+		pubKey, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse public key: %v", err)
+		}
+		ecPubKey, ok := pubKey.(*ecdsa.PublicKey)
+		if !ok {
+			return nil, errors.New("only ECDSA public keys are supported")
+		}
+		keys = append(keys, ecPubKey)
+	}
+
+	return keys, nil
+}
+
+// maxLearnedRoutes caps the source addresses learned from a Cloudflare session. The
+// official clients use one IPv4 and one IPv6 address.
+const maxLearnedRoutes = 4
+
+var (
+	errRouteTaken    = errors.New("address belongs to another session")
+	errTooManyRoutes = fmt.Errorf("session already uses %d addresses", maxLearnedRoutes)
+	errNotAssigned   = errors.New("address is not assigned to the session")
+)
+
+// serverSession is a CONNECT-IP session accepted by the Server.
+type serverSession struct {
+	conn     *connectip.Conn
+	key      *ecdsa.PublicKey // The client's authorized key
+	assigned []netip.Prefix
+	learned  []netip.Prefix // Guarded by Server.mu
+}
+
+// Server accepts CONNECT-IP sessions over HTTP/3 Extended CONNECT, speaking both
+// Cloudflare's cf-connect-ip and standard RFC 9484 connect-ip. Clients authenticate
+// with a certificate carrying one of the authorized public keys.
+//
+// Packets from all sessions are written to a single Device, e.g. a native TUN device
+// or a NATDevice. Packets read from the Device are routed to the session owning the
+// destination address. Standard sessions get addresses from the Pool and packets from
+// other source addresses are dropped. Cloudflare clients don't accept address assignment,
+// so the addresses they use are learned from the packets they send, up to maxLearnedRoutes
+// per session, just like those of standard sessions without a Pool. An address is only
+// ever routed to one session. A new session of the same client takes the learned
+// addresses over, so clients can replace their session make-before-break.
+//
+// The exported fields must be set before calling ListenAndServe.
+type Server struct {
+	// Addr is the UDP address to listen on.
+	Addr string
+	// TLSConfig must contain the server certificate, or GetCertificate to provide it. Client
+	// authentication is set up by the server.
+	TLSConfig *tls.Config
+	// AuthorizedKeys are the enrolled client public keys.
+	AuthorizedKeys []*ecdsa.PublicKey
+	// Pool assigns addresses to standard sessions. Nil disables address assignment.
+	Pool *AddressPool
+	// Device receives the packets of all sessions.
+	Device TunnelDevice
+	// MTU is the MTU of the device.
+	MTU int
+
+	mu     sync.RWMutex
+	routes map[netip.Addr]*serverSession
+	h3     *http3.Server
+}
+
+// ListenAndServe accepts sessions until the context is cancelled. Routing packets from the
+// Device stops with the context as well. The Device is not closed; close it after
+// ListenAndServe returned to end a read that is still blocking.
+//
+// Parameters:
+//   - ctx: context.Context - Stops the server when cancelled.
+//
+// Returns:
+//   - error: The reason the server stopped.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	if s.TLSConfig == nil || (len(s.TLSConfig.Certificates) == 0 && s.TLSConfig.GetCertificate == nil) {
+		return errors.New("a server certificate is required")
+	}
+	if s.Device == nil {
+		return errors.New("a device is required")
+	}
+
+	tlsConfig := s.TLSConfig.Clone()
+	tlsConfig.ClientAuth = tls.RequireAnyClientCert
+	tlsConfig.VerifyPeerCertificate = s.verifyClient
+
+	s.routes = make(map[netip.Addr]*serverSession)
+	s.h3 = &http3.Server{
+		Addr:            s.Addr,
+		TLSConfig:       tlsConfig,
+		EnableDatagrams: true,
+		Handler:         s,
+	}
+
+	go s.pumpDevice(ctx)
+
+	go func() {
+		<-ctx.Done()
+		s.h3.Close()
+	}()
+
+	err := s.h3.ListenAndServe()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// verifyClient accepts client certificates carrying an authorized key.
+func (s *Server) verifyClient(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errAccessDenied
+	}
+
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return errAccessDenied
+	}
+
+	pubKey, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return errAccessDenied
+	}
+
+	for _, key := range s.AuthorizedKeys {
+		if key.Equal(pubKey) {
+			return nil
+		}
+	}
+
+	return errAccessDenied
+}
+
+// ServeHTTP handles a CONNECT-IP request and forwards the session's packets until it ends.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var profile ProtocolProfile
+	switch r.Proto {
+	case ProfileCloudflare.requestProtocol():
+		profile = ProfileCloudflare
+	case ProfileStandard.requestProtocol():
+		profile = ProfileStandard
+	default:
+		http.Error(w, "unsupported protocol", http.StatusNotImplemented)
+		return
+	}
+
+	template, err := uritemplate.New("https://" + r.Host)
+	if err != nil {
+		http.Error(w, "invalid authority", http.StatusBadRequest)
+		return
+	}
+
+	req, err := connectip.ParseRequest(r, template, r.Proto)
+	if err != nil {
+		var perr *connectip.RequestParseError
+		if errors.As(err, &perr) {
+			http.Error(w, perr.Error(), perr.HTTPStatus)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var proxy connectip.Proxy
+	conn, err := proxy.Proxy(w, req)
+	if err != nil {
+		log.Printf("Failed to accept CONNECT-IP session from %s: %v", r.RemoteAddr, err)
+		return
+	}
+
+	session := &serverSession{conn: conn}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		session.key, _ = r.TLS.PeerCertificates[0].PublicKey.(*ecdsa.PublicKey)
+	}
+	defer s.removeSession(session)
+
+	if profile == ProfileStandard && s.Pool != nil {
+		session.assigned, err = s.Pool.Allocate()
+		if err != nil {
+			log.Printf("Rejecting %s: %v", r.RemoteAddr, err)
+			conn.Close()
+			return
+		}
+		for _, prefix := range session.assigned {
+			if err := s.addRoute(prefix.Addr(), session); err != nil {
+				log.Printf("Rejecting %s: %s: %v", r.RemoteAddr, prefix.Addr(), err)
+				conn.Close()
+				return
+			}
+		}
+		if err := conn.AssignAddresses(r.Context(), session.assigned); err != nil {
+			log.Printf("Failed to assign addresses to %s: %v", r.RemoteAddr, err)
+		}
+		if err := conn.AdvertiseRoute(r.Context(), []connectip.IPRoute{
+			{StartIP: netip.IPv4Unspecified(), EndIP: netip.AddrFrom4([4]byte{255, 255, 255, 255})},
+			{StartIP: netip.IPv6Unspecified(), EndIP: netip.AddrFrom16([16]byte{0: 0xff, 1: 0xff, 2: 0xff, 3: 0xff, 4: 0xff, 5: 0xff, 6: 0xff, 7: 0xff, 8: 0xff, 9: 0xff, 10: 0xff, 11: 0xff, 12: 0xff, 13: 0xff, 14: 0xff, 15: 0xff})},
+		}); err != nil {
+			log.Printf("Failed to advertise routes to %s: %v", r.RemoteAddr, err)
+		}
+	}
+
+	log.Printf("Accepted %s session from %s (addresses: %v)", profile, r.RemoteAddr, session.assigned)
+
+	buf := make([]byte, s.MTU)
+	for {
+		n, err := conn.ReadPacket(buf, true)
+		if err != nil {
+			if errors.As(err, new(*connectip.CloseError)) {
+				log.Printf("Session from %s closed", r.RemoteAddr)
+				return
+			}
+			log.Printf("Error reading from session %s: %v, continuing...", r.RemoteAddr, err)
+			continue
+		}
+
+		src, _, ok := packetAddresses(buf[:n])
+		if !ok {
+			continue
+		}
+		if session.assigned != nil {
+			if !session.owns(src) {
+				log.Printf("Dropping packet from %s: source %s: %v", r.RemoteAddr, src, errNotAssigned)
+				continue
+			}
+		} else if err := s.learnRoute(src, session); err != nil {
+			log.Printf("Dropping packet from %s: source %s: %v", r.RemoteAddr, src, err)
+			continue
+		}
+
+		if err := s.Device.WritePacket(buf[:n]); err != nil {
+			log.Printf("Error writing to device: %v", err)
+		}
+	}
+}
+
+// pumpDevice routes packets read from the device to the session owning the destination
+// until the context is cancelled.
+func (s *Server) pumpDevice(ctx context.Context) {
+	buf := make([]byte, s.MTU)
+	for {
+		n, err := s.Device.ReadPacket(buf)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to read from device: %v", err)
+			return
+		}
+
+		_, dst, ok := packetAddresses(buf[:n])
+		if !ok {
+			continue
+		}
+
+		s.mu.RLock()
+		session := s.routes[dst]
+		s.mu.RUnlock()
+		if session == nil {
+			continue
+		}
+
+		icmp, err := session.conn.WritePacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		if len(icmp) > 0 {
+			if err := s.Device.WritePacket(icmp); err != nil {
+				log.Printf("Error writing ICMP to device: %v", err)
+			}
+		}
+	}
+}
+
+// owns reports whether addr is one of the addresses assigned to the session.
+func (session *serverSession) owns(addr netip.Addr) bool {
+	for _, prefix := range session.assigned {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// addRoute routes packets for addr to the session, unless another session already owns it.
+func (s *Server) addRoute(addr netip.Addr, session *serverSession) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if owner, ok := s.routes[addr]; ok && owner != session {
+		return errRouteTaken
+	}
+	s.routes[addr] = session
+	return nil
+}
+
+// learnRoute routes addr to the session unless another client's session already owns it
+// or the session already uses maxLearnedRoutes addresses. An address learned by an earlier
+// session of the same client is handed over. Learned addresses are reserved in the pool,
+// so they aren't assigned to standard sessions.
+func (s *Server) learnRoute(addr netip.Addr, session *serverSession) error {
+	s.mu.RLock()
+	owner, ok := s.routes[addr]
+	s.mu.RUnlock()
+	if ok && owner == session {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	owner, ok = s.routes[addr]
+	if ok && owner == session {
+		return nil
+	}
+	if ok && (owner.learned == nil || session.key == nil || !session.key.Equal(owner.key)) {
+		return errRouteTaken
+	}
+	if len(session.learned) >= maxLearnedRoutes {
+		return errTooManyRoutes
+	}
+
+	prefix := netip.PrefixFrom(addr, addr.BitLen())
+	if ok {
+		// the address stays reserved in the pool, it just moves to the new session
+		owner.learned = slices.DeleteFunc(owner.learned, func(p netip.Prefix) bool { return p == prefix })
+	} else if s.Pool != nil && !s.Pool.Reserve(addr) {
+		return errRouteTaken
+	}
+	s.routes[addr] = session
+	session.learned = append(session.learned, prefix)
+	return nil
+}
+
+// removeSession drops every route of the session and releases its addresses.
+func (s *Server) removeSession(session *serverSession) {
+	s.mu.Lock()
+	for addr, owner := range s.routes {
+		if owner == session {
+			delete(s.routes, addr)
+		}
+	}
+	learned := session.learned
+	session.learned = nil
+	s.mu.Unlock()
+
+	if s.Pool != nil {
+		s.Pool.Release(session.assigned)
+		s.Pool.Release(learned)
+	}
+}
+
+// packetAddresses returns the source and destination address of an IP packet.
+func packetAddresses(pkt []byte) (src, dst netip.Addr, ok bool) {
+	if len(pkt) == 0 {
+		return src, dst, false
+	}
+
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < 20 {
+			return src, dst, false
+		}
+		return netip.AddrFrom4([4]byte(pkt[12:16])), netip.AddrFrom4([4]byte(pkt[16:20])), true
+	case 6:
+		if len(pkt) < 40 {
+			return src, dst, false
+		}
+		return netip.AddrFrom16([16]byte(pkt[8:24])), netip.AddrFrom16([16]byte(pkt[24:40])), true
+	default:
+		return src, dst, false
+	}
+}
@@ -0,0 +1,387 @@
+package api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	connectip "github.com/Diniboy1123/connect-ip-go"
+	"github.com/Diniboy1123/usque/internal"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// testServerMTU is the MTU used by the test server and its clients.
+const testServerMTU = 1280
+
+// probeTarget is the destination of the TCP probes sent through the test server. The NAT
+// device refuses link-local destinations by default and answers the SYN with a reset
+// itself, so no network access is needed.
+var probeTarget = netip.MustParseAddr("169.254.169.254")
+
+// recordingDevice remembers the source addresses of the packets the server writes to it.
+type recordingDevice struct {
+	TunnelDevice
+
+	mu      sync.Mutex
+	sources []netip.Addr
+}
+
+func (d *recordingDevice) WritePacket(pkt []byte) error {
+	if src, _, ok := packetAddresses(pkt); ok {
+		d.mu.Lock()
+		d.sources = append(d.sources, src)
+		d.mu.Unlock()
+	}
+	return d.TunnelDevice.WritePacket(pkt)
+}
+
+func (d *recordingDevice) wrote(src netip.Addr) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return slices.Contains(d.sources, src)
+}
+
+// testServer is a Server listening on loopback in front of a NAT device.
+type testServer struct {
+	*Server
+
+	endpoint  *net.UDPAddr
+	device    *recordingDevice
+	roots     *x509.CertPool
+	serverKey *ecdsa.PrivateKey
+	clientKey *ecdsa.PrivateKey // An authorized client key
+}
+
+// newTestServer starts a Server on a free loopback port and stops it when the test ends.
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	serverKey := newTestKey(t)
+	clientKey := newTestKey(t)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &serverKey.PublicKey, serverKey)
+	if err != nil {
+		t.Fatalf("failed to create server certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse server certificate: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	pool, err := NewAddressPool(netip.MustParsePrefix("10.77.0.0/24"), netip.MustParsePrefix("fd77::/64"))
+	if err != nil {
+		t.Fatalf("failed to create address pool: %v", err)
+	}
+
+	nat, err := NewNATDevice(testServerMTU)
+	if err != nil {
+		t.Fatalf("failed to create NAT device: %v", err)
+	}
+	device := &recordingDevice{TunnelDevice: nat}
+
+	// reserve a free port, the server can't report the one it picked
+	free, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	endpoint := free.LocalAddr().(*net.UDPAddr)
+	free.Close()
+
+	ts := &testServer{
+		Server: &Server{
+			Addr:           endpoint.String(),
+			TLSConfig:      &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: serverKey}}},
+			AuthorizedKeys: []*ecdsa.PublicKey{&clientKey.PublicKey},
+			Pool:           pool,
+			Device:         device,
+			MTU:            testServerMTU,
+		},
+		endpoint:  endpoint,
+		device:    device,
+		roots:     roots,
+		serverKey: serverKey,
+		clientKey: clientKey,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- ts.ListenAndServe(ctx) }()
+
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case err := <-stopped:
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("server stopped with %v, want %v", err, context.Canceled)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("server didn't stop")
+		}
+		nat.Close()
+	})
+
+	return ts
+}
+
+// newTestKey generates a P-256 key.
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	return key
+}
+
+// tunnelConfig returns the parameters to reach the server with the given profile and client key.
+func (ts *testServer) tunnelConfig(t *testing.T, profile ProtocolProfile, key *ecdsa.PrivateKey) TunnelConfig {
+	t.Helper()
+
+	cert, err := internal.GenerateCert(key, &key.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to generate client certificate: %v", err)
+	}
+
+	config := TunnelConfig{
+		KeepalivePeriod:   30 * time.Second,
+		InitialPacketSize: 1242,
+		Endpoint:          ts.endpoint,
+		Profile:           profile,
+	}
+	if profile == ProfileCloudflare {
+		config.ConnectURI = internal.ConnectURI
+		config.TLSConfig, err = PrepareTlsConfig(key, &ts.serverKey.PublicKey, cert, internal.ConnectSNI)
+	} else {
+		config.ConnectURI, err = ExpandConnectURI(profile, fmt.Sprintf("https://%s/.well-known/masque/ip/{target}/{ipproto}/", ts.endpoint))
+		if err != nil {
+			t.Fatalf("failed to expand connect URI: %v", err)
+		}
+		config.TLSConfig, err = PrepareStandardTlsConfig(key, cert, "127.0.0.1")
+		if config.TLSConfig != nil {
+			config.TLSConfig.RootCAs = ts.roots
+		}
+	}
+	if err != nil {
+		t.Fatalf("failed to prepare TLS config: %v", err)
+	}
+
+	return config
+}
+
+// dial connects to the server. The session is closed when the test ends.
+func (ts *testServer) dial(t *testing.T, profile ProtocolProfile, key *ecdsa.PrivateKey) (*connectip.Conn, *http.Response, error) {
+	t.Helper()
+
+	config := ts.tunnelConfig(t, profile, key)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	udpConn, tr, ipConn, rsp, err := ConnectTunnelWithProfile(ctx, profile, config.TLSConfig,
+		internal.DefaultQuicConfig(config.KeepalivePeriod, config.InitialPacketSize), config.ConnectURI, config.Endpoint)
+	if err != nil {
+		return nil, rsp, err
+	}
+	t.Cleanup(func() {
+		ipConn.Close()
+		tr.Close()
+		udpConn.Close()
+	})
+
+	return ipConn, rsp, nil
+}
+
+// waitReleased waits until the server dropped every route and pool lease.
+func (ts *testServer) waitReleased(t *testing.T) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ts.mu.RLock()
+		routes := len(ts.routes)
+		ts.mu.RUnlock()
+		ts.Pool.mu.Lock()
+		leased := len(ts.Pool.leased)
+		ts.Pool.mu.Unlock()
+
+		if routes == 0 && leased == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server still holds %d routes and %d leases", routes, leased)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// probePacket builds a TCP SYN from src:port to probeTarget.
+func probePacket(src netip.Addr, port uint16) []byte {
+	pkt := make([]byte, header.IPv4MinimumSize+header.TCPMinimumSize)
+	srcAddr, dstAddr := tcpip.AddrFrom4(src.As4()), tcpip.AddrFrom4(probeTarget.As4())
+
+	ip := header.IPv4(pkt)
+	ip.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(pkt)),
+		TTL:         64,
+		Protocol:    uint8(header.TCPProtocolNumber),
+		SrcAddr:     srcAddr,
+		DstAddr:     dstAddr,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+
+	tcp := header.TCP(ip.Payload())
+	tcp.Encode(&header.TCPFields{
+		SrcPort:    port,
+		DstPort:    80,
+		SeqNum:     1,
+		DataOffset: header.TCPMinimumSize,
+		Flags:      header.TCPFlagSyn,
+		WindowSize: 65535,
+	})
+	tcp.SetChecksum(^tcp.CalculateChecksum(header.PseudoHeaderChecksum(header.TCPProtocolNumber, srcAddr, dstAddr, header.TCPMinimumSize)))
+
+	return pkt
+}
+
+// probeReply returns the port a TCP reset from probeTarget was sent to.
+func probeReply(pkt []byte) (uint16, bool) {
+	ip := header.IPv4(pkt)
+	if !ip.IsValid(len(pkt)) || ip.TransportProtocol() != header.TCPProtocolNumber {
+		return 0, false
+	}
+	tcp := header.TCP(ip.Payload())
+	if len(tcp) < header.TCPMinimumSize || !tcp.Flags().Contains(header.TCPFlagRst) {
+		return 0, false
+	}
+	return tcp.DestinationPort(), true
+}
+
+// probe sends a TCP probe from src:port through the session and waits for the reset.
+func probe(t *testing.T, conn *connectip.Conn, src netip.Addr, port uint16) {
+	t.Helper()
+
+	if _, err := conn.WritePacket(probePacket(src, port)); err != nil {
+		t.Fatalf("failed to send probe: %v", err)
+	}
+
+	replied := make(chan error, 1)
+	go func() {
+		buf := make([]byte, testServerMTU)
+		for {
+			n, err := conn.ReadPacket(buf, true)
+			if err != nil {
+				replied <- err
+				return
+			}
+			if got, ok := probeReply(buf[:n]); ok && got == port {
+				replied <- nil
+				return
+			}
+		}
+	}()
+
+	select {
+	case err := <-replied:
+		if err != nil {
+			t.Fatalf("failed to read reply to probe %d: %v", port, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no reply to probe %d", port)
+	}
+}
+
+func TestServer(t *testing.T) {
+	for _, profile := range []ProtocolProfile{ProfileCloudflare, ProfileStandard} {
+		t.Run(profile.String(), func(t *testing.T) {
+			ts := newTestServer(t)
+
+			conn, rsp, err := ts.dial(t, profile, ts.clientKey)
+			if err != nil {
+				t.Fatalf("failed to connect: %v", err)
+			}
+			if rsp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want %d", rsp.StatusCode, http.StatusOK)
+			}
+
+			// Cloudflare clients use a fixed address, standard ones get theirs from the pool
+			src := netip.MustParseAddr("172.16.0.2")
+			if profile == ProfileStandard {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				prefixes, err := conn.LocalPrefixes(ctx)
+				cancel()
+				if err != nil {
+					t.Fatalf("failed to get assigned addresses: %v", err)
+				}
+				want := []netip.Prefix{netip.MustParsePrefix("10.77.0.2/32"), netip.MustParsePrefix("fd77::2/128")}
+				if !slices.Equal(prefixes, want) {
+					t.Fatalf("assigned %v, want %v", prefixes, want)
+				}
+				src = prefixes[0].Addr()
+			}
+			probe(t, conn, src, 40001)
+
+			if profile == ProfileStandard {
+				// packets from addresses other than the assigned ones never reach the device
+				spoofed := netip.MustParseAddr("10.77.0.99")
+				if _, err := conn.WritePacket(probePacket(spoofed, 40002)); err != nil {
+					t.Fatalf("failed to send probe: %v", err)
+				}
+				probe(t, conn, src, 40003)
+				if ts.device.wrote(spoofed) {
+					t.Errorf("packet from spoofed source %s was forwarded", spoofed)
+				}
+			} else {
+				// a new session of the same client takes the learned address over
+				replacement, _, err := ts.dial(t, profile, ts.clientKey)
+				if err != nil {
+					t.Fatalf("failed to connect again: %v", err)
+				}
+				probe(t, replacement, src, 40002)
+				replacement.Close()
+			}
+
+			if _, _, err := ts.dial(t, profile, newTestKey(t)); !errors.Is(err, ErrAuthDenied) {
+				t.Errorf("unknown key: got %v, want %v", err, ErrAuthDenied)
+			}
+
+			conn.Close()
+			ts.waitReleased(t)
+
+			if profile == ProfileStandard {
+				// the released addresses are handed out again
+				conn, _, err := ts.dial(t, profile, ts.clientKey)
+				if err != nil {
+					t.Fatalf("failed to reconnect: %v", err)
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				prefixes, err := conn.LocalPrefixes(ctx)
+				cancel()
+				if err != nil || len(prefixes) == 0 || prefixes[0] != netip.MustParsePrefix("10.77.0.2/32") {
+					t.Errorf("reassigned %v (%v), want 10.77.0.2/32 first", prefixes, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/Diniboy1123/usque/internal"
+)
+
+// TeamLoginURL returns the page where members of a Zero Trust organization log in to enroll a device.
+// After logging in, the page links to a com.cloudflare.warp:// URL carrying the team token.
+//
+// Parameters:
+//   - team: string - The team name (e.g., "acme"), its domain (e.g., "acme.cloudflareaccess.com")
+//     or the base URL of a stand-in (e.g., "http://127.0.0.1:8787").
+//
+// Returns:
+//   - string: The login URL.
+//   - error: An error if the team name is invalid.
+func TeamLoginURL(team string) (string, error) {
+	team = strings.TrimSuffix(strings.TrimSpace(team), "/")
+	if team == "" {
+		return "", errors.New("empty team name")
+	}
+
+	if strings.Contains(team, "://") {
+		u, err := url.Parse(team)
+		if err != nil || u.Host == "" {
+			return "", fmt.Errorf("invalid team URL %q", team)
+		}
+		return team + "/warp", nil
+	}
+
+	if !strings.Contains(team, ".") {
+		team += "." + internal.TeamDomain
+	}
+	if strings.ContainsAny(team, "/?#@: ") {
+		return "", fmt.Errorf("invalid team name %q", team)
+	}
+
+	return "https://" + team + "/warp", nil
+}
+
+// ParseTeamToken extracts the team token from the redirect URL shown after logging in.
+//
+// Accepted forms: "com.cloudflare.warp://acme.cloudflareaccess.com/auth?token=<jwt>",
+// any other URL with a token query parameter, and the bare token.
+//
+// Parameters:
+//   - input: string - The pasted redirect URL or token.
+//
+// Returns:
+//   - string: The team token.
+//   - error: An error if no token could be found.
+func ParseTeamToken(input string) (string, error) {
+	input = strings.Trim(strings.TrimSpace(input), `"'`)
+	if input == "" {
+		return "", errors.New("empty input")
+	}
+
+	if !strings.Contains(input, "://") {
+		if strings.Count(input, ".") != 2 || strings.ContainsAny(input, " /?&=") {
+			return "", errors.New("not a redirect URL or team token")
+		}
+		return input, nil
+	}
+
+	u, err := url.Parse(input)
+	if err != nil {
+		return "", fmt.Errorf("invalid redirect URL: %v", err)
+	}
+
+	token := u.Query().Get("token")
+	if token == "" {
+		return "", errors.New("redirect URL has no token")
+	}
+
+	return token, nil
+}
@@ -0,0 +1,163 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/Diniboy1123/usque/internal"
+)
+
+// warpLink matches the link behind the "Open Cloudflare WARP" button of a login page.
+var warpLink = regexp.MustCompile(`href="(com\.cloudflare\.warp://[^"]*)"`)
+
+// fetchTeamToken opens the login page of team like a browser would and parses the token out
+// of the WARP link on it.
+func fetchTeamToken(t *testing.T, client *http.Client, team string) (string, error) {
+	t.Helper()
+
+	loginURL, err := TeamLoginURL(team)
+	if err != nil {
+		t.Fatalf("failed to build login URL: %v", err)
+	}
+
+	resp, err := client.Get(loginURL)
+	if err != nil {
+		t.Fatalf("failed to open login page: %v", err)
+	}
+	defer resp.Body.Close()
+
+	page, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read login page: %v", err)
+	}
+
+	link := warpLink.FindSubmatch(page)
+	if link == nil {
+		return "", fmt.Errorf("login page has no WARP link")
+	}
+
+	return ParseTeamToken(string(link[1]))
+}
+
+func TestTeamLoginURL(t *testing.T) {
+	tests := []struct {
+		team    string
+		want    string
+		wantErr bool
+	}{
+		{team: "acme", want: "https://acme." + internal.TeamDomain + "/warp"},
+		{team: " acme.example.com/ ", want: "https://acme.example.com/warp"},
+		{team: "http://127.0.0.1:8787", want: "http://127.0.0.1:8787/warp"},
+		{team: "", wantErr: true},
+		{team: "acme.example.com/path", wantErr: true},
+		{team: "user@acme", wantErr: true},
+		{team: "http://", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.team, func(t *testing.T) {
+			got, err := TeamLoginURL(tt.team)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTeamToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{name: "redirect URL", input: "com.cloudflare.warp://acme.cloudflareaccess.com/auth?token=a.b.c", want: "a.b.c"},
+		{name: "quoted redirect URL", input: ` "com.cloudflare.warp://acme/auth?token=a.b.c" `, want: "a.b.c"},
+		{name: "bare token", input: "a.b.c", want: "a.b.c"},
+		{name: "empty", input: "  ", wantErr: true},
+		{name: "URL without token", input: "com.cloudflare.warp://acme/auth", wantErr: true},
+		{name: "not a token", input: "hello world", wantErr: true},
+		{name: "too few segments", input: "a.b", wantErr: true},
+		{name: "invalid URL", input: "com.cloudflare.warp://acme/auth?token=%zz", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseTeamToken(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTeamLogin(t *testing.T) {
+	_, profile, client := newMockAPI(t)
+
+	token, err := fetchTeamToken(t, client, profile.BaseURL)
+	if err != nil {
+		t.Fatalf("failed to get team token: %v", err)
+	}
+
+	account, apiErr, err := Register(context.Background(), client, profile, "PC", "en_US", TeamAuth{JWT: token}, true)
+	checkAPIError(t, apiErr, err, "", "")
+	if account.Account.AccountType != internal.AccountTypeTeam {
+		t.Errorf("account type = %q, want %q", account.Account.AccountType, internal.AccountTypeTeam)
+	}
+
+	// each token is good for one registration
+	_, apiErr, err = Register(context.Background(), client, profile, "PC", "en_US", TeamAuth{JWT: token}, true)
+	checkAPIError(t, apiErr, err, "403", "Invalid team token")
+}
+
+func TestTeamLoginMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		page string
+	}{
+		{name: "no link", page: "<p>Access denied</p>"},
+		{name: "link without token", page: `<a href="com.cloudflare.warp://acme/auth">Open Cloudflare WARP</a>`},
+		{name: "empty token", page: `<a href="com.cloudflare.warp://acme/auth?token=">Open Cloudflare WARP</a>`},
+		{name: "broken query", page: `<a href="com.cloudflare.warp://acme/auth?token=%zz">Open Cloudflare WARP</a>`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/warp" {
+					http.NotFound(w, r)
+					return
+				}
+				fmt.Fprint(w, tt.page)
+			}))
+			defer srv.Close()
+
+			if token, err := fetchTeamToken(t, srv.Client(), srv.URL); err == nil {
+				t.Fatalf("expected an error, got token %q", token)
+			}
+		})
+	}
+}
@@ -8,10 +8,13 @@ import (
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	connectip "github.com/Diniboy1123/connect-ip-go"
 	"github.com/Diniboy1123/usque/internal"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
 	"github.com/songgao/water"
 	"golang.zx2c4.com/wireguard/tun"
 )
@@ -143,114 +146,698 @@ func NewWaterAdapter(iface *water.Interface) TunnelDevice {
 	return &WaterAdapter{iface: iface}
 }
 
-// MaintainTunnel continuously connects to the MASQUE server, then starts two
-// forwarding goroutines: one forwarding from the device to the IP connection (and handling
-// any ICMP reply), and the other forwarding from the IP connection to the device.
-// If an error occurs in either loop, the connection is closed and a reconnect is attempted.
+// TunnelConfig holds the parameters used to dial a single MASQUE session.
+type TunnelConfig struct {
+	// TLSConfig is the TLS configuration used for the QUIC handshake.
+	TLSConfig *tls.Config
+	// KeepalivePeriod is the keepalive period for the QUIC connection.
+	KeepalivePeriod time.Duration
+	// InitialPacketSize is the initial packet size for the QUIC connection.
+	InitialPacketSize uint16
+	// Endpoint is the UDP address of the MASQUE server.
+	Endpoint *net.UDPAddr
+	// Profile is the CONNECT-IP flavour spoken to the server.
+	Profile ProtocolProfile
+	// ConnectURI is the CONNECT-IP URI template. Empty uses the URI of the official client,
+	// which only works with the Cloudflare profile.
+	ConnectURI string
+}
+
+// tunnelSession is a single established MASQUE session and the resources it owns.
+type tunnelSession struct {
+	udpConn *net.UDPConn
+	tr      *http3.Transport
+	conn    quic.Connection
+	ipConn  *connectip.Conn
+
+	// done is closed once the session failed or was closed.
+	done      chan struct{}
+	err       error
+	failOnce  sync.Once
+	closeOnce sync.Once
+}
+
+// fail marks the session as broken. Only the first error is kept.
+func (s *tunnelSession) fail(err error) {
+	s.failOnce.Do(func() {
+		s.err = err
+		close(s.done)
+	})
+}
+
+// close releases every resource held by the session.
+func (s *tunnelSession) close() {
+	s.fail(net.ErrClosed)
+	s.closeOnce.Do(func() {
+		s.ipConn.Close()
+		if s.conn != nil {
+			s.conn.CloseWithError(quic.ApplicationErrorCode(http3.ErrCodeNoError), "")
+		}
+		if s.udpConn != nil {
+			s.udpConn.Close()
+		}
+		if s.tr != nil {
+			s.tr.Close()
+		}
+	})
+}
+
+// heldPacket is a packet read from the device while an on-demand session is being dialed.
+type heldPacket struct {
+	data     []byte
+	received time.Time
+}
+
+// maxHeldPackets caps the number of packets held while an on-demand session is being dialed.
+const maxHeldPackets = 128
+
+// TunnelEventType is the kind of a TunnelEvent.
+type TunnelEventType int
+
+const (
+	// TunnelConnected is emitted when a session was established while none was up.
+	TunnelConnected TunnelEventType = iota
+	// TunnelConnectFailed is emitted when a session couldn't be established. Err holds the reason.
+	TunnelConnectFailed
+	// TunnelRotated is emitted when traffic was switched over to a replacement session.
+	TunnelRotated
+	// TunnelDisconnected is emitted when the session was lost. Err holds the reason.
+	TunnelDisconnected
+	// TunnelIdle is emitted when an on-demand session was closed for lack of traffic.
+	TunnelIdle
+	// TunnelStopped is emitted once when Run returns. Err holds the reason.
+	TunnelStopped
+)
+
+// String returns the name of the event type.
+func (t TunnelEventType) String() string {
+	switch t {
+	case TunnelConnected:
+		return "connected"
+	case TunnelConnectFailed:
+		return "connect failed"
+	case TunnelRotated:
+		return "rotated"
+	case TunnelDisconnected:
+		return "disconnected"
+	case TunnelIdle:
+		return "idle"
+	case TunnelStopped:
+		return "stopped"
+	default:
+		return fmt.Sprintf("TunnelEventType(%d)", int(t))
+	}
+}
+
+// TunnelEvent reports a change of the state of a Tunnel.
+type TunnelEvent struct {
+	Type     TunnelEventType
+	Time     time.Time
+	Endpoint *net.UDPAddr // The MASQUE server of the session concerned
+	Err      error        // The reason for failures, disconnects and stops, nil otherwise
+}
+
+// TunnelStats are the traffic counters of a Tunnel. Packets and bytes are counted
+// as the IP packets passed between the device and the MASQUE sessions.
+type TunnelStats struct {
+	Connected       bool      // Whether a session is up
+	SessionStart    time.Time // When the current session was established, zero if none is up
+	Sessions        uint64    // Sessions established, including replacements
+	PacketsSent     uint64    // Packets sent from the device into the tunnel
+	BytesSent       uint64
+	PacketsReceived uint64 // Packets received from the tunnel and written to the device
+	BytesReceived   uint64
+	LastActivity    time.Time // When a packet was last sent or received, zero if none was
+}
+
+type rotateRequest struct {
+	config *TunnelConfig
+	result chan error
+}
+
+// Tunnel keeps a MASQUE session alive and forwards packets between it and a TunnelDevice.
+//
+// Sessions can be replaced make-before-break: a new session is dialed while the current
+// one still carries traffic, the packet pumps are switched over atomically and the old
+// session is closed after a drain period. Replacement can be triggered with Rotate or
+// scheduled with RotateInterval.
+//
+// In on-demand mode no session is dialed until the device produces the first packet.
+// Packets are held for HoldTimeout while the handshake is in progress, and the session
+// is closed again once no traffic passed for IdleTimeout.
+//
+// The exported fields must be set before calling Run.
+type Tunnel struct {
+	// ReconnectDelay is the delay between reconnect attempts after a session was lost.
+	ReconnectDelay time.Duration
+	// RotateInterval schedules a session replacement at the given interval. Zero disables it.
+	RotateInterval time.Duration
+	// DrainPeriod is how long a replaced session keeps delivering in-flight packets before it is closed.
+	DrainPeriod time.Duration
+	// RotateConfig, if set, is called before every scheduled rotation to obtain the
+	// dial parameters of the new session, e.g. to issue a fresh client certificate.
+	RotateConfig func() (TunnelConfig, error)
+	// OnDemand delays dialing until the device produces a packet, and doesn't reconnect
+	// a lost or idle session until there is traffic again.
+	OnDemand bool
+	// IdleTimeout closes an on-demand session after no traffic passed for the given duration.
+	// Zero keeps the session open. Only used in on-demand mode.
+	IdleTimeout time.Duration
+	// HoldTimeout is how long packets are held while an on-demand session is being dialed.
+	HoldTimeout time.Duration
+	// OnEvent, if set, is called for every TunnelEvent. It is called from the goroutine
+	// running the tunnel, so it must not block.
+	OnEvent func(event TunnelEvent)
+
+	device  TunnelDevice
+	bufPool *NetBuffer
+
+	mu     sync.Mutex
+	config TunnelConfig
+
+	current      atomic.Pointer[tunnelSession]
+	lastActivity atomic.Int64
+	sessionStart atomic.Int64
+	sessions     atomic.Uint64
+	packetsSent  atomic.Uint64
+	bytesSent    atomic.Uint64
+	packetsRecv  atomic.Uint64
+	bytesRecv    atomic.Uint64
+	rotateCh     chan rotateRequest
+	stopped      chan struct{}
+
+	heldMu sync.Mutex
+	held   []heldPacket
+	wake   chan struct{}
+}
+
+// NewTunnel creates a new Tunnel that forwards packets of the given device.
 //
 // Parameters:
-//   - ctx: context.Context - The context for the connection.
-//   - tlsConfig: *tls.Config - The TLS configuration for secure communication.
-//   - keepalivePeriod: time.Duration - The keepalive period for the QUIC connection.
-//   - initialPacketSize: uint16 - The initial packet size for the QUIC connection.
-//   - endpoint: *net.UDPAddr - The UDP address of the MASQUE server.
 //   - device: TunnelDevice - The TUN device to forward packets to and from.
 //   - mtu: int - The MTU of the TUN device.
-//   - reconnectDelay: time.Duration - The delay between reconnect attempts.
-func MaintainTunnel(ctx context.Context, tlsConfig *tls.Config, keepalivePeriod time.Duration, initialPacketSize uint16, endpoint *net.UDPAddr, device TunnelDevice, mtu int, reconnectDelay time.Duration) {
-	packetBufferPool := NewNetBuffer(mtu)
-	for {
-		log.Printf("Establishing MASQUE connection to %s:%d", endpoint.IP, endpoint.Port)
-		udpConn, tr, ipConn, rsp, err := ConnectTunnel(
-			ctx,
-			tlsConfig,
-			internal.DefaultQuicConfig(keepalivePeriod, initialPacketSize),
-			internal.ConnectURI,
-			endpoint,
-		)
-		if err != nil {
-			log.Printf("Failed to connect tunnel: %v", err)
-			time.Sleep(reconnectDelay)
-			continue
-		}
-		if rsp.StatusCode != 200 {
-			log.Printf("Tunnel connection failed: %s", rsp.Status)
-			ipConn.Close()
-			if udpConn != nil {
-				udpConn.Close()
-			}
-			if tr != nil {
-				tr.Close()
-			}
-			time.Sleep(reconnectDelay)
-			continue
+//   - config: TunnelConfig - The parameters used to dial the MASQUE session.
+//
+// Returns:
+//   - *Tunnel: The tunnel, ready to be started with Run.
+func NewTunnel(device TunnelDevice, mtu int, config TunnelConfig) *Tunnel {
+	return &Tunnel{
+		ReconnectDelay: time.Second,
+		DrainPeriod:    5 * time.Second,
+		HoldTimeout:    5 * time.Second,
+		device:         device,
+		bufPool:        NewNetBuffer(mtu),
+		config:         config,
+		rotateCh:       make(chan rotateRequest),
+		stopped:        make(chan struct{}),
+		wake:           make(chan struct{}, 1),
+	}
+}
+
+// Config returns the dial parameters currently in use.
+func (t *Tunnel) Config() TunnelConfig {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.config
+}
+
+func (t *Tunnel) setConfig(config TunnelConfig) {
+	t.mu.Lock()
+	t.config = config
+	t.mu.Unlock()
+}
+
+// Stats returns the traffic counters of the tunnel. It is safe to call while the tunnel runs.
+//
+// Returns:
+//   - TunnelStats: The counters.
+func (t *Tunnel) Stats() TunnelStats {
+	stats := TunnelStats{
+		Connected:       t.current.Load() != nil,
+		Sessions:        t.sessions.Load(),
+		PacketsSent:     t.packetsSent.Load(),
+		BytesSent:       t.bytesSent.Load(),
+		PacketsReceived: t.packetsRecv.Load(),
+		BytesReceived:   t.bytesRecv.Load(),
+	}
+	if stats.Connected {
+		stats.SessionStart = time.Unix(0, t.sessionStart.Load())
+	}
+	if last := t.lastActivity.Load(); last != 0 && stats.PacketsSent+stats.PacketsReceived > 0 {
+		stats.LastActivity = time.Unix(0, last)
+	}
+	return stats
+}
+
+// emit reports an event to OnEvent, if set.
+func (t *Tunnel) emit(eventType TunnelEventType, endpoint *net.UDPAddr, err error) {
+	if t.OnEvent != nil {
+		t.OnEvent(TunnelEvent{Type: eventType, Time: time.Now(), Endpoint: endpoint, Err: err})
+	}
+}
+
+// Rotate brings up a new MASQUE session next to the current one and switches traffic
+// over to it once it is established. The old session keeps delivering in-flight packets
+// for DrainPeriod before it is closed. If the new session can't be established, the
+// current one stays in use and the error is returned.
+//
+// If no session is up at the moment, the config is stored and used for the next
+// connection attempt.
+//
+// Parameters:
+//   - ctx: context.Context - Cancels waiting for the rotation.
+//   - config: *TunnelConfig - The dial parameters of the new session. Nil reuses the current ones.
+//
+// Returns:
+//   - error: An error if the replacement session could not be established.
+func (t *Tunnel) Rotate(ctx context.Context, config *TunnelConfig) error {
+	req := rotateRequest{config: config, result: make(chan error, 1)}
+	select {
+	case t.rotateCh <- req:
+	case <-t.stopped:
+		return errors.New("tunnel is not running")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-req.result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Run connects to the MASQUE server and forwards packets until the context is cancelled.
+// Lost sessions are re-established after ReconnectDelay. A failing device read drops the
+// current session and is retried after ReconnectDelay as well. Errors that can't be fixed
+// by retrying, such as ErrAuthDenied or ErrEndpointKeyMismatch, stop the tunnel.
+//
+// Parameters:
+//   - ctx: context.Context - The context for the tunnel.
+//
+// Returns:
+//   - error: The reason the tunnel stopped.
+func (t *Tunnel) Run(ctx context.Context) (err error) {
+	defer close(t.stopped)
+	defer func() {
+		t.emit(TunnelStopped, t.Config().Endpoint, err)
+	}()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	defer func() {
+		if session := t.current.Swap(nil); session != nil {
+			session.close()
 		}
+	}()
 
-		log.Println("Connected to MASQUE server")
-		errChan := make(chan error, 2)
+	go t.pumpDevice()
 
-		go func() {
-			for {
-				buf := packetBufferPool.Get()
-				n, err := device.ReadPacket(buf)
-				if err != nil {
-					packetBufferPool.Put(buf)
-					errChan <- fmt.Errorf("failed to read from TUN device: %v", err)
-					return
-				}
-				icmp, err := ipConn.WritePacket(buf[:n])
-				if err != nil {
-					packetBufferPool.Put(buf)
-					if errors.As(err, new(*connectip.CloseError)) {
-						errChan <- fmt.Errorf("connection closed while writing to IP connection: %v", err)
-						return
+	var rotateTick <-chan time.Time
+	if t.RotateInterval > 0 {
+		ticker := time.NewTicker(t.RotateInterval)
+		defer ticker.Stop()
+		rotateTick = ticker.C
+	}
+
+	var idleTick <-chan time.Time
+	if t.OnDemand && t.IdleTimeout > 0 {
+		ticker := time.NewTicker(max(t.IdleTimeout/4, time.Second))
+		defer ticker.Stop()
+		idleTick = ticker.C
+	}
+
+	for {
+		session := t.current.Load()
+		if session == nil {
+			if t.OnDemand && !t.hasHeld() {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case req := <-t.rotateCh:
+					if req.config != nil {
+						t.setConfig(*req.config)
 					}
-					log.Printf("Error writing to IP connection: %v, continuing...", err)
+					req.result <- nil
 					continue
+				case <-t.wake:
 				}
-				packetBufferPool.Put(buf)
-
-				if len(icmp) > 0 {
-					if err := device.WritePacket(icmp); err != nil {
-						if errors.As(err, new(*connectip.CloseError)) {
-							errChan <- fmt.Errorf("connection closed while writing ICMP to TUN device: %v", err)
-							return
-						}
-						log.Printf("Error writing ICMP to TUN device: %v, continuing...", err)
+			} else {
+				select {
+				case req := <-t.rotateCh:
+					if req.config != nil {
+						t.setConfig(*req.config)
 					}
+					req.result <- nil
+				default:
 				}
 			}
-		}()
 
-		go func() {
-			buf := packetBufferPool.Get()
-			defer packetBufferPool.Put(buf)
-			for {
-				n, err := ipConn.ReadPacket(buf, true)
+			config := t.Config()
+			session, err := t.dial(ctx, config)
+			if err != nil {
+				t.emit(TunnelConnectFailed, config.Endpoint, err)
+				if isPermanent(err) {
+					return err
+				}
+				log.Printf("Failed to connect tunnel: %v", err)
+				if !sleepContext(ctx, t.ReconnectDelay) {
+					return ctx.Err()
+				}
+				continue
+			}
+			t.activate(session)
+			log.Println("Connected to MASQUE server")
+			t.emit(TunnelConnected, config.Endpoint, nil)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-session.done:
+			t.current.CompareAndSwap(session, nil)
+			session.close()
+			t.emit(TunnelDisconnected, t.Config().Endpoint, session.err)
+			if t.OnDemand {
+				log.Printf("Tunnel connection lost: %v. Reconnecting on demand.", session.err)
+				continue
+			}
+			log.Printf("Tunnel connection lost: %v. Reconnecting...", session.err)
+			if !sleepContext(ctx, t.ReconnectDelay) {
+				return ctx.Err()
+			}
+		case <-idleTick:
+			idle := time.Since(time.Unix(0, t.lastActivity.Load()))
+			if idle < t.IdleTimeout {
+				continue
+			}
+			log.Printf("No traffic for %s, closing MASQUE session until needed", idle.Truncate(time.Second))
+			t.current.CompareAndSwap(session, nil)
+			session.close()
+			t.emit(TunnelIdle, t.Config().Endpoint, nil)
+		case req := <-t.rotateCh:
+			req.result <- t.rotate(ctx, req.config)
+		case <-rotateTick:
+			var config *TunnelConfig
+			if t.RotateConfig != nil {
+				next, err := t.RotateConfig()
 				if err != nil {
-					if errors.As(err, new(*connectip.CloseError)) {
-						errChan <- fmt.Errorf("connection closed while reading from IP connection: %v", err)
-						return
-					}
-					log.Printf("Error reading from IP connection: %v, continuing...", err)
+					log.Printf("Scheduled session rotation skipped: %v", err)
 					continue
 				}
-				if err := device.WritePacket(buf[:n]); err != nil {
-					errChan <- fmt.Errorf("failed to write to TUN device: %v", err)
-					return
-				}
+				config = &next
+			}
+			if err := t.rotate(ctx, config); err != nil {
+				log.Printf("Scheduled session rotation failed: %v", err)
 			}
-		}()
+		}
+	}
+}
+
+// rotate dials a replacement session and switches over to it.
+func (t *Tunnel) rotate(ctx context.Context, config *TunnelConfig) error {
+	next := t.Config()
+	if config != nil {
+		next = *config
+	}
+
+	session, err := t.dial(ctx, next)
+	if err != nil {
+		return fmt.Errorf("failed to establish replacement session: %w", err)
+	}
+	t.setConfig(next)
+
+	old := t.activate(session)
+	if old != nil {
+		log.Printf("Switched to new MASQUE session, draining old session for %s", t.DrainPeriod)
+		time.AfterFunc(t.DrainPeriod, old.close)
+		t.emit(TunnelRotated, next.Endpoint, nil)
+	} else {
+		log.Println("Connected to MASQUE server")
+		t.emit(TunnelConnected, next.Endpoint, nil)
+	}
+
+	return nil
+}
+
+// activate makes the session the current one and starts forwarding its packets to the device.
+// It returns the previously active session, if any.
+func (t *Tunnel) activate(session *tunnelSession) *tunnelSession {
+	t.lastActivity.Store(time.Now().UnixNano())
+	t.sessionStart.Store(time.Now().UnixNano())
+	t.sessions.Add(1)
+
+	// Held packets are sent before pumpDevice can see the new session, so they can't be
+	// overtaken by packets read later.
+	t.heldMu.Lock()
+	old := t.current.Swap(session)
+	t.flushHeldLocked(session)
+	t.heldMu.Unlock()
+
+	go t.pumpSession(session)
+
+	select {
+	case <-t.wake:
+	default:
+	}
+
+	return old
+}
+
+// holdOrCurrent returns the current session, or queues a copy of the packet and wakes the
+// on-demand dialer if no session is up. Packets held before are sent through the session
+// first, so the packet can be sent directly afterwards.
+func (t *Tunnel) holdOrCurrent(pkt []byte) *tunnelSession {
+	t.heldMu.Lock()
+	defer t.heldMu.Unlock()
+
+	if session := t.current.Load(); session != nil {
+		t.flushHeldLocked(session)
+		return session
+	}
+
+	if len(t.held) < maxHeldPackets {
+		t.held = append(t.held, heldPacket{data: append([]byte(nil), pkt...), received: time.Now()})
+	}
+
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// hasHeld reports whether there are held packets that did not expire yet.
+func (t *Tunnel) hasHeld() bool {
+	t.heldMu.Lock()
+	defer t.heldMu.Unlock()
+
+	fresh := t.held[:0]
+	for _, pkt := range t.held {
+		if time.Since(pkt.received) < t.HoldTimeout {
+			fresh = append(fresh, pkt)
+		}
+	}
+	t.held = fresh
+
+	return len(t.held) > 0
+}
+
+// flushHeldLocked sends every held packet that did not expire yet through the session.
+// heldMu must be held.
+func (t *Tunnel) flushHeldLocked(session *tunnelSession) {
+	held := t.held
+	t.held = nil
+
+	for _, pkt := range held {
+		if time.Since(pkt.received) >= t.HoldTimeout {
+			continue
+		}
+		if _, err := session.ipConn.WritePacket(pkt.data); err != nil {
+			log.Printf("Error writing held packet to IP connection: %v", err)
+			continue
+		}
+		t.packetsSent.Add(1)
+		t.bytesSent.Add(uint64(len(pkt.data)))
+	}
+}
+
+// dial establishes a new MASQUE session using the given parameters.
+func (t *Tunnel) dial(ctx context.Context, config TunnelConfig) (*tunnelSession, error) {
+	log.Printf("Establishing MASQUE connection to %s:%d", config.Endpoint.IP, config.Endpoint.Port)
+	connectUri, err := ExpandConnectURI(config.Profile, config.ConnectURI)
+	if err != nil {
+		return nil, err
+	}
+
+	session, rsp, err := connectTunnel(
+		ctx,
+		config.Profile,
+		config.TLSConfig,
+		internal.DefaultQuicConfig(config.KeepalivePeriod, config.InitialPacketSize),
+		connectUri,
+		config.Endpoint,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if rsp.StatusCode != 200 {
+		session.close()
+		return nil, &ConnectStatusError{StatusCode: rsp.StatusCode, Response: rsp}
+	}
+
+	if config.Profile == ProfileStandard {
+		go logAssignedPrefixes(session)
+	}
+
+	return session, nil
+}
+
+// pumpDevice forwards packets from the device to whichever session is current until the
+// tunnel stops. Packets read while no session is up are dropped, or held in on-demand mode.
+func (t *Tunnel) pumpDevice() {
+	for {
+		buf := t.bufPool.Get()
+		n, err := t.device.ReadPacket(buf)
+		if err != nil {
+			t.bufPool.Put(buf)
+			select {
+			case <-t.stopped:
+				return
+			default:
+			}
+
+			err = fmt.Errorf("failed to read from TUN device: %v", err)
+			if session := t.current.Load(); session != nil {
+				session.fail(err)
+			} else {
+				log.Printf("%v, retrying...", err)
+			}
+
+			timer := time.NewTimer(t.ReconnectDelay)
+			select {
+			case <-t.stopped:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			continue
+		}
+
+		var session *tunnelSession
+		if t.OnDemand {
+			session = t.holdOrCurrent(buf[:n])
+		} else {
+			session = t.current.Load()
+		}
+		if session == nil {
+			t.bufPool.Put(buf)
+			continue
+		}
+		t.lastActivity.Store(time.Now().UnixNano())
+
+		icmp, err := session.ipConn.WritePacket(buf[:n])
+		t.bufPool.Put(buf)
+		if err != nil {
+			if errors.As(err, new(*connectip.CloseError)) {
+				session.fail(classifyCloseError(session.conn, fmt.Errorf("connection closed while writing to IP connection: %w", err)))
+				continue
+			}
+			log.Printf("Error writing to IP connection: %v, continuing...", err)
+			continue
+		}
+		t.packetsSent.Add(1)
+		t.bytesSent.Add(uint64(n))
+
+		if len(icmp) > 0 {
+			if err := t.device.WritePacket(icmp); err != nil {
+				log.Printf("Error writing ICMP to TUN device: %v, continuing...", err)
+			}
+		}
+	}
+}
 
-		err = <-errChan
-		log.Printf("Tunnel connection lost: %v. Reconnecting...", err)
-		ipConn.Close()
-		if udpConn != nil {
-			udpConn.Close()
+// pumpSession forwards packets from the session to the device until the session fails or is closed.
+func (t *Tunnel) pumpSession(session *tunnelSession) {
+	buf := t.bufPool.Get()
+	defer t.bufPool.Put(buf)
+	for {
+		n, err := session.ipConn.ReadPacket(buf, true)
+		if err != nil {
+			if errors.As(err, new(*connectip.CloseError)) {
+				session.fail(classifyCloseError(session.conn, fmt.Errorf("connection closed while reading from IP connection: %w", err)))
+				return
+			}
+			log.Printf("Error reading from IP connection: %v, continuing...", err)
+			continue
 		}
-		if tr != nil {
-			tr.Close()
+		if err := t.device.WritePacket(buf[:n]); err != nil {
+			session.fail(fmt.Errorf("failed to write to TUN device: %v", err))
+			return
 		}
-		time.Sleep(reconnectDelay)
+		t.lastActivity.Store(time.Now().UnixNano())
+		t.packetsRecv.Add(1)
+		t.bytesRecv.Add(uint64(n))
+	}
+}
+
+// logAssignedPrefixes logs the addresses an RFC 9484 server assigned to us, if it does so.
+func logAssignedPrefixes(session *tunnelSession) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	prefixes, err := session.ipConn.LocalPrefixes(ctx)
+	if err != nil {
+		return
+	}
+	log.Printf("Server assigned addresses: %v", prefixes)
+}
+
+// sleepContext waits for the given duration. It returns false if the context was cancelled first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// MaintainTunnel continuously connects to the MASQUE server, then starts two
+// forwarding goroutines: one forwarding from the device to the IP connection (and handling
+// any ICMP reply), and the other forwarding from the IP connection to the device.
+// If an error occurs in either loop, the connection is closed and a reconnect is attempted.
+// It only returns once the context is cancelled, or on errors that retrying can't fix,
+// such as ErrAuthDenied or ErrEndpointKeyMismatch.
+//
+// It is a shorthand for NewTunnel followed by Run. Use a Tunnel directly to replace
+// sessions make-before-break.
+//
+// Parameters:
+//   - ctx: context.Context - The context for the connection.
+//   - tlsConfig: *tls.Config - The TLS configuration for secure communication.
+//   - keepalivePeriod: time.Duration - The keepalive period for the QUIC connection.
+//   - initialPacketSize: uint16 - The initial packet size for the QUIC connection.
+//   - endpoint: *net.UDPAddr - The UDP address of the MASQUE server.
+//   - device: TunnelDevice - The TUN device to forward packets to and from.
+//   - mtu: int - The MTU of the TUN device.
+//   - reconnectDelay: time.Duration - The delay between reconnect attempts.
+func MaintainTunnel(ctx context.Context, tlsConfig *tls.Config, keepalivePeriod time.Duration, initialPacketSize uint16, endpoint *net.UDPAddr, device TunnelDevice, mtu int, reconnectDelay time.Duration) {
+	tunnel := NewTunnel(device, mtu, TunnelConfig{
+		TLSConfig:         tlsConfig,
+		KeepalivePeriod:   keepalivePeriod,
+		InitialPacketSize: initialPacketSize,
+		Endpoint:          endpoint,
+	})
+	tunnel.ReconnectDelay = reconnectDelay
+	if err := tunnel.Run(ctx); err != nil {
+		log.Printf("Tunnel stopped: %v", err)
 	}
 }
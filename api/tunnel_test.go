@@ -0,0 +1,276 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// cloudflareSource is the tunnel address Cloudflare clients send from.
+var cloudflareSource = netip.MustParseAddr("172.16.0.2")
+
+// pipeDevice is a TunnelDevice fed and drained by the test.
+type pipeDevice struct {
+	in  chan []byte // Packets read by the tunnel
+	out chan []byte // Packets written by the tunnel
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newPipeDevice() *pipeDevice {
+	return &pipeDevice{
+		in:     make(chan []byte),
+		out:    make(chan []byte, 1024),
+		closed: make(chan struct{}),
+	}
+}
+
+func (d *pipeDevice) ReadPacket(buf []byte) (int, error) {
+	select {
+	case pkt := <-d.in:
+		return copy(buf, pkt), nil
+	case <-d.closed:
+		return 0, os.ErrClosed
+	}
+}
+
+func (d *pipeDevice) WritePacket(pkt []byte) error {
+	select {
+	case d.out <- append([]byte(nil), pkt...):
+		return nil
+	case <-d.closed:
+		return os.ErrClosed
+	}
+}
+
+func (d *pipeDevice) Close() {
+	d.closeOnce.Do(func() { close(d.closed) })
+}
+
+// send hands a packet to the tunnel as if the system routed it into the device.
+func (d *pipeDevice) send(t *testing.T, pkt []byte) {
+	t.Helper()
+
+	select {
+	case d.in <- pkt:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("tunnel doesn't read from the device")
+	}
+}
+
+// waitReplies waits until the tunnel wrote the replies to the probes sent from every port.
+func (d *pipeDevice) waitReplies(t *testing.T, ports ...uint16) {
+	t.Helper()
+
+	missing := make(map[uint16]bool)
+	for _, port := range ports {
+		missing[port] = true
+	}
+
+	timeout := time.After(10 * time.Second)
+	for len(missing) > 0 {
+		select {
+		case pkt := <-d.out:
+			if port, ok := probeReply(pkt); ok {
+				delete(missing, port)
+			}
+		case <-timeout:
+			t.Fatalf("%d of %d probes weren't answered", len(missing), len(ports))
+		}
+	}
+}
+
+// runTunnel runs the tunnel until the test ends and returns the events it emits.
+func runTunnel(t *testing.T, tun *Tunnel, dev *pipeDevice) <-chan TunnelEvent {
+	t.Helper()
+
+	events := make(chan TunnelEvent, 64)
+	tun.OnEvent = func(event TunnelEvent) {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- tun.Run(ctx) }()
+
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case err := <-stopped:
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("tunnel stopped with %v, want %v", err, context.Canceled)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("tunnel didn't stop")
+		}
+		dev.Close()
+	})
+
+	return events
+}
+
+// waitEvent waits for an event of the given type, skipping others.
+func waitEvent(t *testing.T, events <-chan TunnelEvent, want TunnelEventType) TunnelEvent {
+	t.Helper()
+
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			if event.Type == want {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("no %s event", want)
+		}
+	}
+}
+
+func TestTunnelRotate(t *testing.T) {
+	ts := newTestServer(t)
+	dev := newPipeDevice()
+	tun := NewTunnel(dev, testServerMTU, ts.tunnelConfig(t, ProfileCloudflare, ts.clientKey))
+	tun.DrainPeriod = 500 * time.Millisecond
+	events := runTunnel(t, tun, dev)
+
+	waitEvent(t, events, TunnelConnected)
+	old := tun.current.Load()
+
+	// keep probes flowing while the session is replaced
+	const probes = 300
+	rotated := make(chan time.Time, 1)
+	var ports []uint16
+	for i := range probes {
+		if i == probes/3 {
+			go func() {
+				if err := tun.Rotate(context.Background(), nil); err != nil {
+					t.Errorf("failed to rotate: %v", err)
+				}
+				rotated <- time.Now()
+			}()
+		}
+		port := uint16(41000 + i)
+		ports = append(ports, port)
+		dev.send(t, probePacket(cloudflareSource, port))
+		time.Sleep(2 * time.Millisecond)
+	}
+	dev.waitReplies(t, ports...)
+
+	waitEvent(t, events, TunnelRotated)
+	at := <-rotated
+	if current := tun.current.Load(); current == old {
+		t.Fatalf("session wasn't replaced")
+	}
+	if stats := tun.Stats(); stats.Sessions != 2 || stats.PacketsSent != probes || stats.PacketsReceived != probes {
+		t.Errorf("stats = %+v, want 2 sessions, %d packets each way", stats, probes)
+	}
+
+	// the old session is closed once it drained
+	select {
+	case <-old.done:
+		if since := time.Since(at); since < tun.DrainPeriod/2 {
+			t.Errorf("old session closed %s after the rotation, before draining for %s", since, tun.DrainPeriod)
+		}
+	case <-time.After(tun.DrainPeriod + 5*time.Second):
+		t.Fatalf("old session wasn't closed after draining for %s", tun.DrainPeriod)
+	}
+	if !errors.Is(old.err, net.ErrClosed) {
+		t.Errorf("old session ended with %v, want it closed", old.err)
+	}
+
+	// traffic keeps flowing through the replacement
+	dev.send(t, probePacket(cloudflareSource, 42000))
+	dev.waitReplies(t, 42000)
+}
+
+func TestTunnelOnDemand(t *testing.T) {
+	ts := newTestServer(t)
+	dev := newPipeDevice()
+	tun := NewTunnel(dev, testServerMTU, ts.tunnelConfig(t, ProfileCloudflare, ts.clientKey))
+	tun.OnDemand = true
+	tun.IdleTimeout = time.Second
+	events := runTunnel(t, tun, dev)
+
+	// nothing is dialed before there is traffic
+	time.Sleep(300 * time.Millisecond)
+	if stats := tun.Stats(); stats.Connected || stats.Sessions != 0 {
+		t.Fatalf("connected without traffic: %+v", stats)
+	}
+
+	// the packets that triggered the connection are held and sent once it is up
+	for _, port := range []uint16{43001, 43002, 43003} {
+		dev.send(t, probePacket(cloudflareSource, port))
+	}
+	waitEvent(t, events, TunnelConnected)
+	dev.waitReplies(t, 43001, 43002, 43003)
+
+	// the session is closed once idle, and the server releases it
+	waitEvent(t, events, TunnelIdle)
+	if stats := tun.Stats(); stats.Connected {
+		t.Errorf("still connected after idling: %+v", stats)
+	}
+	ts.waitReleased(t)
+
+	// and brought up again by new traffic
+	dev.send(t, probePacket(cloudflareSource, 43004))
+	waitEvent(t, events, TunnelConnected)
+	dev.waitReplies(t, 43004)
+	if stats := tun.Stats(); stats.Sessions != 2 {
+		t.Errorf("sessions = %d, want 2", stats.Sessions)
+	}
+}
+
+func TestTunnelHoldTimeout(t *testing.T) {
+	ts := newTestServer(t)
+	dev := newPipeDevice()
+	t.Cleanup(dev.Close)
+	config := ts.tunnelConfig(t, ProfileCloudflare, ts.clientKey)
+	tun := NewTunnel(dev, testServerMTU, config)
+	tun.OnDemand = true
+	tun.HoldTimeout = 100 * time.Millisecond
+
+	if session := tun.holdOrCurrent(probePacket(cloudflareSource, 44000)); session != nil {
+		t.Fatalf("got a session before dialing")
+	}
+	time.Sleep(2 * tun.HoldTimeout)
+	if tun.hasHeld() {
+		t.Fatalf("expired packet is still held")
+	}
+
+	tun.holdOrCurrent(probePacket(cloudflareSource, 44001))
+	time.Sleep(2 * tun.HoldTimeout)
+	tun.holdOrCurrent(probePacket(cloudflareSource, 44002))
+
+	session, err := tun.dial(context.Background(), config)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(session.close)
+	tun.activate(session)
+
+	// only the packet held for less than HoldTimeout is sent
+	dev.waitReplies(t, 44002)
+	timeout := time.After(500 * time.Millisecond)
+	for done := false; !done; {
+		select {
+		case pkt := <-dev.out:
+			if port, ok := probeReply(pkt); ok && port != 44002 {
+				t.Fatalf("expired packet was sent")
+			}
+		case <-timeout:
+			done = true
+		}
+	}
+	if stats := tun.Stats(); stats.PacketsSent != 1 {
+		t.Errorf("packets sent = %d, want 1", stats.PacketsSent)
+	}
+}
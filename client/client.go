@@ -0,0 +1,417 @@
+// Package client runs a MASQUE tunnel for a usque config. It does what every tunnel
+// command of usque does: it loads the keys, issues the client certificate, prepares the
+// TLS config, picks the endpoint, sets up a userspace network stack or uses a given
+// device, and keeps the tunnel connected.
+//
+//	cfg, err := config.LoadConfig("config.json", "")
+//	c, err := client.New(cfg, client.WithDNS([]netip.Addr{netip.MustParseAddr("1.1.1.1")}))
+//	err = c.Start(ctx)
+//	defer c.Close()
+//	conn, err := c.Dial(ctx, "tcp", "example.com:80")
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/internal"
+	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+// ErrNoNetstack is returned by Dial and Listen of a Client that forwards a device given
+// with WithDevice instead of running a userspace network stack.
+var ErrNoNetstack = errors.New("client has no userspace network stack")
+
+// Client is a MASQUE tunnel for a usque config. Create it with New, connect it with Start
+// and release it with Close.
+type Client struct {
+	opts         options
+	privKey      *ecdsa.PrivateKey
+	peerPubKey   *ecdsa.PublicKey
+	sni          string
+	tunnelConfig api.TunnelConfig
+
+	tunDev tun.Device    // The userspace device, nil with WithDevice
+	tunNet *netstack.Net // The userspace network stack, nil with WithDevice
+	tunnel *api.Tunnel   // Forwards the packets of the device
+	events chan api.TunnelEvent
+
+	mu      sync.Mutex
+	started bool
+	closed  bool
+	cancel  context.CancelFunc
+	done    chan struct{} // Closed once the tunnel stopped or the client was closed unstarted
+	err     error         // Why the tunnel stopped, set before done is closed
+}
+
+// New prepares a tunnel for a config. Nothing is connected until Start is called.
+//
+// Parameters:
+//   - cfg: *config.Config - The config with the keys, endpoints and addresses of the registration.
+//   - opts: ...Option - Changes to the default settings.
+//
+// Returns:
+//   - *Client: The client.
+//   - error: An error if the config lacks a key, endpoint or address, or the network stack can't be created.
+func New(cfg *config.Config, opts ...Option) (*Client, error) {
+	if cfg == nil {
+		return nil, errors.New("config is required")
+	}
+
+	o := options{
+		connectPort:       DefaultConnectPort,
+		keepalivePeriod:   DefaultKeepalivePeriod,
+		initialPacketSize: DefaultInitialPacketSize,
+		mtu:               DefaultMTU,
+		tunnelIPv4:        true,
+		tunnelIPv6:        true,
+		dns:               DefaultDNS,
+		reconnectDelay:    DefaultReconnectDelay,
+		drainPeriod:       DefaultDrainPeriod,
+		eventBuffer:       16,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	c := &Client{
+		opts:   o,
+		sni:    o.sni,
+		events: make(chan api.TunnelEvent, max(o.eventBuffer, 0)),
+		done:   make(chan struct{}),
+	}
+	if c.sni == "" {
+		c.sni = internal.ConnectSNI
+		if cfg.AccountType == internal.AccountTypeTeam {
+			c.sni = internal.ZeroTierSNI
+		}
+	}
+
+	var err error
+	if c.privKey, err = cfg.GetEcPrivateKey(); err != nil {
+		return nil, fmt.Errorf("failed to get private key: %v", err)
+	}
+	if c.peerPubKey, err = cfg.GetEcEndpointPublicKey(); err != nil {
+		return nil, fmt.Errorf("failed to get public key: %v", err)
+	}
+
+	if c.tunnelConfig, err = c.dialConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	device := o.device
+	if device == nil {
+		var localAddresses []netip.Addr
+		for _, addr := range []struct {
+			enabled bool
+			value   string
+			family  string
+		}{
+			{o.tunnelIPv4, cfg.IPv4, "IPv4"},
+			{o.tunnelIPv6, cfg.IPv6, "IPv6"},
+		} {
+			if !addr.enabled {
+				continue
+			}
+			parsed, err := netip.ParseAddr(addr.value)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse %s address: %v", addr.family, err)
+			}
+			localAddresses = append(localAddresses, parsed)
+		}
+
+		if c.tunDev, c.tunNet, err = netstack.CreateNetTUN(localAddresses, o.dns, o.mtu); err != nil {
+			return nil, fmt.Errorf("failed to create virtual TUN device: %v", err)
+		}
+		device = api.NewNetstackAdapter(c.tunDev)
+	}
+
+	c.tunnel = api.NewTunnel(device, o.mtu, c.tunnelConfig)
+	c.tunnel.ReconnectDelay = o.reconnectDelay
+	c.tunnel.RotateInterval = o.rotateInterval
+	c.tunnel.DrainPeriod = o.drainPeriod
+	c.tunnel.RotateConfig = c.renewConfig
+	c.tunnel.OnDemand = o.onDemand
+	c.tunnel.IdleTimeout = o.idleTimeout
+	c.tunnel.OnEvent = func(event api.TunnelEvent) {
+		select {
+		case c.events <- event:
+		default:
+		}
+	}
+
+	return c, nil
+}
+
+// dialConfig prepares the dial parameters of the first session.
+func (c *Client) dialConfig(cfg *config.Config) (api.TunnelConfig, error) {
+	cert, err := internal.GenerateCert(c.privKey, &c.privKey.PublicKey)
+	if err != nil {
+		return api.TunnelConfig{}, fmt.Errorf("failed to generate cert: %v", err)
+	}
+
+	tunnelConfig := api.TunnelConfig{
+		KeepalivePeriod:   c.opts.keepalivePeriod,
+		InitialPacketSize: c.opts.initialPacketSize,
+		Endpoint:          c.opts.endpoint,
+	}
+
+	if c.opts.connectURI != "" {
+		expanded, err := api.ExpandConnectURI(api.ProfileStandard, c.opts.connectURI)
+		if err != nil {
+			return api.TunnelConfig{}, fmt.Errorf("failed to use connect URI: %v", err)
+		}
+
+		endpoint, serverName, err := api.ResolveConnectURI(expanded)
+		if err != nil {
+			return api.TunnelConfig{}, fmt.Errorf("failed to use connect URI: %v", err)
+		}
+		if c.opts.sni != "" {
+			serverName = c.opts.sni
+		}
+
+		if tunnelConfig.TLSConfig, err = api.PrepareStandardTlsConfig(c.privKey, cert, serverName); err != nil {
+			return api.TunnelConfig{}, fmt.Errorf("failed to prepare TLS config: %v", err)
+		}
+		if tunnelConfig.Endpoint == nil {
+			tunnelConfig.Endpoint = endpoint
+		}
+		tunnelConfig.Profile = api.ProfileStandard
+		tunnelConfig.ConnectURI = c.opts.connectURI
+
+		return tunnelConfig, nil
+	}
+
+	if tunnelConfig.TLSConfig, err = api.PrepareTlsConfig(c.privKey, c.peerPubKey, cert, c.sni); err != nil {
+		return api.TunnelConfig{}, fmt.Errorf("failed to prepare TLS config: %v", err)
+	}
+
+	if tunnelConfig.Endpoint == nil {
+		endpoint, family := cfg.EndpointV4, "IPv4"
+		if c.opts.ipv6Endpoint {
+			endpoint, family = cfg.EndpointV6, "IPv6"
+		}
+		ip := net.ParseIP(endpoint)
+		if ip == nil {
+			return api.TunnelConfig{}, fmt.Errorf("config has no valid %s endpoint", family)
+		}
+		tunnelConfig.Endpoint = &net.UDPAddr{IP: ip, Port: c.opts.connectPort}
+	}
+
+	return tunnelConfig, nil
+}
+
+// renewConfig issues a fresh client certificate for a session rotation, keeping the
+// rest of the current dial parameters.
+func (c *Client) renewConfig() (api.TunnelConfig, error) {
+	cert, err := internal.GenerateCert(c.privKey, &c.privKey.PublicKey)
+	if err != nil {
+		return api.TunnelConfig{}, err
+	}
+
+	config := c.tunnel.Config()
+
+	var tlsConfig *tls.Config
+	if config.Profile == api.ProfileStandard {
+		tlsConfig, err = api.PrepareStandardTlsConfig(c.privKey, cert, config.TLSConfig.ServerName)
+	} else {
+		tlsConfig, err = api.PrepareTlsConfig(c.privKey, c.peerPubKey, cert, c.sni)
+	}
+	if err != nil {
+		return api.TunnelConfig{}, err
+	}
+
+	config.TLSConfig = tlsConfig
+	return config, nil
+}
+
+// Start connects the tunnel in the background, or with WithOnDemand once there is traffic.
+// It doesn't wait for the connection, watch Events for api.TunnelConnected for that.
+// Lost sessions are re-established until the context is cancelled, Close is called or
+// an error occurs that retrying can't fix, such as api.ErrAuthDenied.
+//
+// Parameters:
+//   - ctx: context.Context - Stops the tunnel when cancelled.
+//
+// Returns:
+//   - error: An error if the client was already started or closed.
+func (c *Client) Start(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return errors.New("client is closed")
+	}
+	if c.started {
+		return errors.New("client is already started")
+	}
+	c.started = true
+
+	ctx, c.cancel = context.WithCancel(ctx)
+	go func() {
+		err := c.tunnel.Run(ctx)
+		close(c.events)
+		c.err = err
+		close(c.done)
+	}()
+
+	return nil
+}
+
+// Wait blocks until the tunnel stopped.
+//
+// Returns:
+//   - error: The reason the tunnel stopped, the context error if it was cancelled or Close was called.
+func (c *Client) Wait() error {
+	<-c.done
+	return c.err
+}
+
+// Close stops the tunnel and releases the network stack. Open connections of Dial and
+// Listen fail afterwards. It is safe to call more than once.
+//
+// Returns:
+//   - error: Always nil, for io.Closer.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	started := c.started
+	c.mu.Unlock()
+
+	if started {
+		c.cancel()
+	} else {
+		close(c.events)
+		close(c.done)
+	}
+	<-c.done
+
+	if c.tunDev != nil {
+		c.tunDev.Close()
+	}
+
+	return nil
+}
+
+// Rotate replaces the MASQUE session make-before-break, with a fresh client certificate.
+// The current session stays in use if the new one can't be established.
+//
+// Parameters:
+//   - ctx: context.Context - Cancels waiting for the rotation.
+//
+// Returns:
+//   - error: An error if the replacement session could not be established.
+func (c *Client) Rotate(ctx context.Context) error {
+	config, err := c.renewConfig()
+	if err != nil {
+		return err
+	}
+	return c.tunnel.Rotate(ctx, &config)
+}
+
+// Stats returns the traffic counters of the tunnel.
+//
+// Returns:
+//   - api.TunnelStats: The counters.
+func (c *Client) Stats() api.TunnelStats {
+	return c.tunnel.Stats()
+}
+
+// Events returns the channel of connection events of the tunnel. It is closed once the
+// tunnel stopped, the last event is api.TunnelStopped then. Events are dropped while
+// nobody receives and the buffer set with WithEventBuffer is full.
+//
+// Returns:
+//   - <-chan api.TunnelEvent: The events.
+func (c *Client) Events() <-chan api.TunnelEvent {
+	return c.events
+}
+
+// Dial connects to an address through the tunnel. Host names are resolved with the DNS
+// servers given with WithDNS, inside the tunnel.
+//
+// Parameters:
+//   - ctx: context.Context - Cancels the dial.
+//   - network: string - The network. (e.g., "tcp", "udp6")
+//   - address: string - The address. (e.g., "example.com:443")
+//
+// Returns:
+//   - net.Conn: The connection.
+//   - error: ErrNoNetstack with WithDevice, or an error if the connection fails.
+func (c *Client) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if c.tunNet == nil {
+		return nil, ErrNoNetstack
+	}
+	return c.tunNet.DialContext(ctx, network, address)
+}
+
+// Listen accepts TCP connections coming in through the tunnel, e.g. from other devices
+// of a Zero Trust organization.
+//
+// Parameters:
+//   - network: string - "tcp", "tcp4" or "tcp6".
+//   - address: string - The tunnel address and port to listen on. (e.g., "100.96.0.2:8080")
+//
+// Returns:
+//   - net.Listener: The listener.
+//   - error: ErrNoNetstack with WithDevice, or an error if the network or address is invalid.
+func (c *Client) Listen(network, address string) (net.Listener, error) {
+	if c.tunNet == nil {
+		return nil, ErrNoNetstack
+	}
+
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address: %v", err)
+	}
+
+	return c.tunNet.ListenTCPAddrPort(addrPort)
+}
+
+// Resolver returns a resolver that sends DNS queries to the first server given with
+// WithDNS, inside the tunnel.
+//
+// Returns:
+//   - *net.Resolver: The resolver, nil with WithDevice.
+func (c *Client) Resolver() *net.Resolver {
+	if c.tunNet == nil {
+		return nil
+	}
+	return internal.NewNetstackResolver(c.tunNet, c.opts.dns)
+}
+
+// Net returns the userspace network stack of the tunnel, for uses Dial and Listen don't
+// cover, e.g. UDP listeners.
+//
+// Returns:
+//   - *netstack.Net: The network stack, nil with WithDevice.
+func (c *Client) Net() *netstack.Net {
+	return c.tunNet
+}
+
+// DNS returns the DNS servers used inside the tunnel.
+//
+// Returns:
+//   - []netip.Addr: The servers given with WithDNS, or DefaultDNS.
+func (c *Client) DNS() []netip.Addr {
+	return c.opts.dns
+}
@@ -0,0 +1,194 @@
+package client
+
+import (
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+)
+
+// Default parameters of a Client. They match the defaults of the usque commands.
+const (
+	DefaultConnectPort       = 443
+	DefaultMTU               = 1280
+	DefaultKeepalivePeriod   = 30 * time.Second
+	DefaultInitialPacketSize = 1242
+	DefaultReconnectDelay    = time.Second
+	DefaultDrainPeriod       = 5 * time.Second
+)
+
+// DefaultDNS are the DNS servers used inside the tunnel unless WithDNS is given. (Quad9)
+var DefaultDNS = []netip.Addr{
+	netip.MustParseAddr("9.9.9.9"),
+	netip.MustParseAddr("149.112.112.112"),
+	netip.MustParseAddr("2620:fe::fe"),
+	netip.MustParseAddr("2620:fe::9"),
+}
+
+// options are the settings of a Client, changed by Option functions.
+type options struct {
+	sni               string
+	endpoint          *net.UDPAddr
+	ipv6Endpoint      bool
+	connectPort       int
+	connectURI        string
+	keepalivePeriod   time.Duration
+	initialPacketSize uint16
+	mtu               int
+	tunnelIPv4        bool
+	tunnelIPv6        bool
+	dns               []netip.Addr
+	device            api.TunnelDevice
+	reconnectDelay    time.Duration
+	rotateInterval    time.Duration
+	drainPeriod       time.Duration
+	onDemand          bool
+	idleTimeout       time.Duration
+	eventBuffer       int
+}
+
+// Option changes a setting of a Client created with New.
+type Option func(*options)
+
+// WithSNI sets the SNI of the MASQUE connection. By default it is chosen by the account
+// type of the config, and taken from the URI with WithConnectURI.
+//
+// Parameters:
+//   - sni: string - The server name.
+func WithSNI(sni string) Option {
+	return func(o *options) { o.sni = sni }
+}
+
+// WithEndpoint connects to the given MASQUE server instead of an endpoint of the config.
+//
+// Parameters:
+//   - endpoint: *net.UDPAddr - The address of the server.
+func WithEndpoint(endpoint *net.UDPAddr) Option {
+	return func(o *options) { o.endpoint = endpoint }
+}
+
+// WithIPv6Endpoint connects to the IPv6 endpoint of the config instead of the IPv4 one.
+//
+// Parameters:
+//   - ipv6: bool - Whether to use the IPv6 endpoint.
+func WithIPv6Endpoint(ipv6 bool) Option {
+	return func(o *options) { o.ipv6Endpoint = ipv6 }
+}
+
+// WithConnectPort sets the port of the endpoint of the config. (default DefaultConnectPort)
+//
+// Parameters:
+//   - port: int - The UDP port.
+func WithConnectPort(port int) Option {
+	return func(o *options) { o.connectPort = port }
+}
+
+// WithConnectURI uses standard RFC 9484 connect-ip with the given URI template instead
+// of Cloudflare's flavour. The server is resolved from the URI and its certificate is
+// verified against the system roots instead of the pinned endpoint key.
+//
+// Parameters:
+//   - uri: string - The URI template. (e.g., "https://proxy.example.com/.well-known/masque/ip/{target}/{ipproto}/")
+func WithConnectURI(uri string) Option {
+	return func(o *options) { o.connectURI = uri }
+}
+
+// WithKeepalivePeriod sets the keepalive period of the QUIC connection. (default DefaultKeepalivePeriod)
+//
+// Parameters:
+//   - period: time.Duration - The keepalive period.
+func WithKeepalivePeriod(period time.Duration) Option {
+	return func(o *options) { o.keepalivePeriod = period }
+}
+
+// WithInitialPacketSize sets the initial packet size of the QUIC connection. (default DefaultInitialPacketSize)
+//
+// Parameters:
+//   - size: uint16 - The packet size.
+func WithInitialPacketSize(size uint16) Option {
+	return func(o *options) { o.initialPacketSize = size }
+}
+
+// WithMTU sets the MTU of the tunnel. (default DefaultMTU) Other values are not supported
+// by Cloudflare and may cause packet loss.
+//
+// Parameters:
+//   - mtu: int - The MTU.
+func WithMTU(mtu int) Option {
+	return func(o *options) { o.mtu = mtu }
+}
+
+// WithTunnelIPv4 enables or disables IPv4 inside the tunnel. (default enabled)
+//
+// Parameters:
+//   - enabled: bool - Whether the IPv4 address of the config is used.
+func WithTunnelIPv4(enabled bool) Option {
+	return func(o *options) { o.tunnelIPv4 = enabled }
+}
+
+// WithTunnelIPv6 enables or disables IPv6 inside the tunnel. (default enabled)
+//
+// Parameters:
+//   - enabled: bool - Whether the IPv6 address of the config is used.
+func WithTunnelIPv6(enabled bool) Option {
+	return func(o *options) { o.tunnelIPv6 = enabled }
+}
+
+// WithDNS sets the DNS servers used inside the tunnel. (default DefaultDNS)
+//
+// Parameters:
+//   - servers: []netip.Addr - The DNS servers.
+func WithDNS(servers []netip.Addr) Option {
+	return func(o *options) { o.dns = servers }
+}
+
+// WithDevice forwards the packets of a device, e.g. a native TUN interface, instead of
+// a userspace network stack. Dial, Listen and Resolver are not available then.
+//
+// Parameters:
+//   - device: api.TunnelDevice - The device. It is not closed by Close.
+func WithDevice(device api.TunnelDevice) Option {
+	return func(o *options) { o.device = device }
+}
+
+// WithReconnectDelay sets the delay between reconnect attempts. (default DefaultReconnectDelay)
+//
+// Parameters:
+//   - delay: time.Duration - The delay.
+func WithReconnectDelay(delay time.Duration) Option {
+	return func(o *options) { o.reconnectDelay = delay }
+}
+
+// WithRotation replaces the MASQUE session make-before-break at an interval, with a fresh
+// client certificate.
+//
+// Parameters:
+//   - interval: time.Duration - The interval, zero disables rotation.
+//   - drainPeriod: time.Duration - How long a replaced session keeps delivering in-flight packets.
+func WithRotation(interval, drainPeriod time.Duration) Option {
+	return func(o *options) {
+		o.rotateInterval = interval
+		o.drainPeriod = drainPeriod
+	}
+}
+
+// WithOnDemand only connects the tunnel when there is traffic.
+//
+// Parameters:
+//   - idleTimeout: time.Duration - Disconnects after this long without traffic, zero stays connected.
+func WithOnDemand(idleTimeout time.Duration) Option {
+	return func(o *options) {
+		o.onDemand = true
+		o.idleTimeout = idleTimeout
+	}
+}
+
+// WithEventBuffer sets how many events Events buffers. Events are dropped while the
+// buffer is full. (default 16)
+//
+// Parameters:
+//   - size: int - The buffer size.
+func WithEventBuffer(size int) Option {
+	return func(o *options) { o.eventBuffer = size }
+}
@@ -0,0 +1,171 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/Diniboy1123/usque/models"
+	"github.com/spf13/cobra"
+)
+
+var accountCmd = &cobra.Command{
+	Use:   "account",
+	Short: "Show registration and account details",
+	Long: "Fetches the registration from the API and shows the account type, license, remaining WARP+ data," +
+		" device name, assigned addresses and peer endpoints.",
+	Run: func(cmd *cobra.Command, args []string) {
+		asJson, err := cmd.Flags().GetBool("json")
+		if err != nil {
+			log.Fatalf("Failed to get json flag: %v", err)
+		}
+
+		withAPI(cmd, func(cfg *config.Config, profile api.ClientProfile, httpClient *http.Client) {
+			account, apiErr, err := api.GetAccount(cmd.Context(), httpClient, profile, configAccount(cfg))
+			if err != nil {
+				fatalAPIError("Failed to get account", apiErr, err)
+			}
+
+			if asJson {
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				if err := encoder.Encode(account); err != nil {
+					log.Fatalf("Failed to encode account: %v", err)
+				}
+				return
+			}
+
+			printAccount(account)
+		})
+	},
+}
+
+// configAccount returns the credentials of the registration in a config.
+//
+// Parameters:
+//   - cfg: *config.Config - The config.
+//
+// Returns:
+//   - models.AccountData: Account data with only ID and Token set.
+func configAccount(cfg *config.Config) models.AccountData {
+	return models.AccountData{
+		ID:    cfg.ID,
+		Token: cfg.AccessToken,
+	}
+}
+
+// applyAccountData updates a config with the endpoint, addresses and license of a registration.
+// Keys and the access token are left untouched.
+//
+// Parameters:
+//   - cfg: *config.Config - The config to update.
+//   - account: models.AccountData - The registration returned by the API.
+//
+// Returns:
+//   - error: An error if the registration has no usable peer.
+func applyAccountData(cfg *config.Config, account models.AccountData) error {
+	if len(account.Config.Peers) == 0 {
+		return errors.New("registration has no peers")
+	}
+
+	peer := account.Config.Peers[0]
+	endpoint, err := internal.ParsePeerEndpoint(peer.Endpoint.V4, peer.Endpoint.V6, peer.Endpoint.Host, peer.Endpoint.Ports)
+	if err != nil {
+		return fmt.Errorf("failed to parse peer endpoint: %v", err)
+	}
+
+	cfg.EndpointV4 = ""
+	if endpoint.V4.IsValid() {
+		cfg.EndpointV4 = endpoint.V4.String()
+	}
+	cfg.EndpointV6 = ""
+	if endpoint.V6.IsValid() {
+		cfg.EndpointV6 = endpoint.V6.String()
+	}
+	cfg.EndpointPubKey = peer.PublicKey
+	cfg.License = account.Account.License
+	cfg.AccountType = account.Account.AccountType
+	cfg.ID = account.ID
+	cfg.IPv4 = account.Config.Interface.Addresses.V4
+	cfg.IPv6 = account.Config.Interface.Addresses.V6
+
+	return nil
+}
+
+// printAccount prints the interesting parts of a registration as a table.
+//
+// Parameters:
+//   - account: models.AccountData - The registration to print.
+func printAccount(account models.AccountData) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	row := func(key, value string) {
+		if value == "" {
+			value = "-"
+		}
+		fmt.Fprintf(w, "%s:\t%s\n", key, value)
+	}
+
+	row("Device ID", account.ID)
+	row("Device name", account.Name)
+	row("Model", account.Model)
+	row("Tunnel type", account.TunType)
+	row("Enabled", strconv.FormatBool(account.Enabled))
+	row("Created", account.Created)
+	row("Updated", account.Updated)
+	row("Account ID", account.Account.ID)
+	row("Account type", account.Account.AccountType)
+	row("Role", account.Account.Role)
+	row("License", account.Account.License)
+	row("WARP+", strconv.FormatBool(account.Account.WarpPlus))
+	row("WARP+ data", formatBytes(int64(account.Account.PremiumData)))
+	row("Quota", formatBytes(int64(account.Account.Quota)))
+	row("Referrals", strconv.Itoa(account.Account.ReferralCount))
+	row("IPv4", account.Config.Interface.Addresses.V4)
+	row("IPv6", account.Config.Interface.Addresses.V6)
+	for i, peer := range account.Config.Peers {
+		ports := make([]string, 0, len(peer.Endpoint.Ports))
+		for _, port := range peer.Endpoint.Ports {
+			ports = append(ports, strconv.Itoa(port))
+		}
+		row(fmt.Sprintf("Peer %d", i), strings.Join([]string{peer.Endpoint.V4, peer.Endpoint.V6, peer.Endpoint.Host}, " "))
+		row(fmt.Sprintf("Peer %d ports", i), strings.Join(ports, ", "))
+	}
+
+	w.Flush()
+}
+
+// formatBytes formats a byte count with a binary unit suffix.
+//
+// Parameters:
+//   - n: int64 - The byte count.
+//
+// Returns:
+//   - string: The formatted count. (e.g., "1.5 GiB")
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func init() {
+	accountCmd.Flags().Bool("json", false, "Print the raw registration as JSON")
+	rootCmd.AddCommand(accountCmd)
+}
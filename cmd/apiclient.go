@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/client"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/models"
+	"github.com/spf13/cobra"
+)
+
+// tunnelDNS are the DNS servers used to resolve the API inside the tunnel.
+var tunnelDNS = []netip.Addr{netip.MustParseAddr("9.9.9.9"), netip.MustParseAddr("2620:fe::fe")}
+
+// apiHTTPClient returns the HTTP client for API calls as selected by the api-proxy and
+// api-via-tunnel flags. Without either, a nil client is returned, which makes the api
+// package use its default client honouring the proxy environment variables.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The running command.
+//
+// Returns:
+//   - *http.Client: The HTTP client to pass to the api package.
+//   - func(): Releases the resources of the client. Always non-nil.
+//   - error: An error if the flags are invalid or the tunnel can't be set up.
+func apiHTTPClient(cmd *cobra.Command) (*http.Client, func(), error) {
+	noop := func() {}
+
+	viaTunnel, err := cmd.Flags().GetBool("api-via-tunnel")
+	if err != nil {
+		return nil, noop, err
+	}
+
+	proxyURL := apiSetting(cmd, "api-proxy", "USQUE_API_PROXY", "")
+
+	if viaTunnel {
+		if proxyURL != "" {
+			return nil, noop, errors.New("api-proxy and api-via-tunnel can't be used together")
+		}
+
+		dial, stop, err := dialViaTunnel(commandConfig(cmd))
+		if err != nil {
+			return nil, noop, err
+		}
+
+		return api.NewDialerHTTPClient(dial), stop, nil
+	}
+
+	if proxyURL == "" {
+		return nil, noop, nil
+	}
+
+	client, err := api.NewHTTPClient(proxyURL)
+	if err != nil {
+		return nil, noop, err
+	}
+
+	return client, noop, nil
+}
+
+// dialViaTunnel brings up a userspace MASQUE tunnel with a config and returns
+// its dial function. The tunnel connects on demand, so connections opened right away
+// are held until the session is up.
+//
+// Parameters:
+//   - cfg: *config.Config - The config of the tunnel, nil if none is loaded.
+//
+// Returns:
+//   - func(ctx context.Context, network, addr string) (net.Conn, error): Dials through the tunnel.
+//   - func(): Tears the tunnel down.
+//   - error: An error if the config is missing or the tunnel can't be set up.
+func dialViaTunnel(cfg *config.Config) (func(ctx context.Context, network, addr string) (net.Conn, error), func(), error) {
+	if cfg == nil {
+		return nil, nil, errors.New("a working config is required to reach the API through the tunnel")
+	}
+
+	tunnel, err := client.New(cfg, client.WithDNS(tunnelDNS), client.WithOnDemand(0))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to set up tunnel: %v", err)
+	}
+
+	if err := tunnel.Start(context.Background()); err != nil {
+		tunnel.Close()
+		return nil, nil, fmt.Errorf("failed to start tunnel: %v", err)
+	}
+
+	go func() {
+		if err := tunnel.Wait(); err != nil && !errors.Is(err, context.Canceled) {
+			log.Printf("Tunnel stopped: %v", err)
+		}
+	}()
+
+	stop := func() {
+		tunnel.Close()
+	}
+
+	return tunnel.Dial, stop, nil
+}
+
+// fatalAPIError logs a failed API call, including the errors reported by the API, and exits.
+//
+// Parameters:
+//   - action: string - What failed. (e.g., "Failed to list devices")
+//   - apiErr: *models.APIError - The error returned by the API, if any.
+//   - err: error - The error of the call.
+func fatalAPIError(action string, apiErr *models.APIError, err error) {
+	if apiErr != nil {
+		log.Fatalf("%s: %v (API errors: %s)", action, err, apiErr.ErrorsAsString("; "))
+	}
+	log.Fatalf("%s: %v", action, err)
+}
+
+// withAPI checks that a config is loaded, sets up the API client and runs fn with it.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The running command.
+//   - fn: func(*config.Config, api.ClientProfile, *http.Client) - The API calls to make with the loaded config.
+func withAPI(cmd *cobra.Command, fn func(cfg *config.Config, profile api.ClientProfile, httpClient *http.Client)) {
+	cfg := commandConfig(cmd)
+	if cfg == nil {
+		cmd.Println("Config not loaded. Please register first.")
+		return
+	}
+
+	withAPIClient(cmd, func(profile api.ClientProfile, httpClient *http.Client) {
+		fn(cfg, profile, httpClient)
+	})
+}
+
+// withAPIClient sets up the API client and runs fn with it. Unlike withAPI it doesn't
+// require a loaded config, e.g. to create one.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The running command.
+//   - fn: func(api.ClientProfile, *http.Client) - The API calls to make.
+func withAPIClient(cmd *cobra.Command, fn func(profile api.ClientProfile, httpClient *http.Client)) {
+	profile, err := clientProfile(cmd)
+	if err != nil {
+		log.Fatalf("Failed to get client profile: %v", err)
+	}
+
+	httpClient, closeClient, err := apiHTTPClient(cmd)
+	if err != nil {
+		log.Fatalf("Failed to set up API client: %v", err)
+	}
+	defer closeClient()
+
+	fn(profile, httpClient)
+}
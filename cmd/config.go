@@ -0,0 +1,390 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/Diniboy1123/usque/config"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+// noSecrets is the annotation of commands that never read the secrets of the config,
+// so an encrypted config is not unlocked for them.
+var noSecrets = map[string]string{"secrets": "none"}
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Manage the config file",
+}
+
+var configEncryptCmd = &cobra.Command{
+	Use:   "encrypt",
+	Short: "Encrypt the private keys, access tokens and licenses of the config with a passphrase",
+	Long: "Seals the secrets of every profile with AES-256-GCM, using a key derived from a passphrase with scrypt." +
+		" Afterwards every command asks for the passphrase, or reads it from the " + passphraseEnv + " environment" +
+		" variable or the file descriptor given with --passphrase-fd.",
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		configPath, file := loadedConfigFile(cmd)
+
+		if file.Encrypted() {
+			log.Fatalf("Config is already encrypted. Decrypt it first to change the passphrase.")
+		}
+
+		passphrase, err := readPassphrase(cmd, true)
+		if err != nil {
+			log.Fatalf("Failed to get passphrase: %v", err)
+		}
+		if len(passphrase) == 0 {
+			log.Fatalf("Passphrase must not be empty")
+		}
+
+		if err := file.Encrypt(passphrase); err != nil {
+			log.Fatalf("Failed to encrypt config: %v", err)
+		}
+
+		if err := file.Save(configPath); err != nil {
+			log.Fatalf("Failed to save config: %v", err)
+		}
+
+		log.Printf("Encrypted the secrets of %s", configPath)
+		for _, backup := range configBackups(configPath, false) {
+			log.Printf("Warning: the backup %s still holds the secrets in plain text, delete it once you don't need it anymore", backup)
+		}
+	},
+}
+
+var configDecryptCmd = &cobra.Command{
+	Use:   "decrypt",
+	Short: "Store the secrets of the config in plain text again",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		configPath, file := loadedConfigFile(cmd)
+
+		if !file.Encrypted() {
+			log.Fatalf("Config is not encrypted")
+		}
+
+		if err := file.Decrypt(); err != nil {
+			log.Fatalf("Failed to decrypt config: %v", err)
+		}
+
+		if err := file.Save(configPath); err != nil {
+			log.Fatalf("Failed to save config: %v", err)
+		}
+
+		log.Printf("Decrypted the secrets of %s", configPath)
+		for _, backup := range configBackups(configPath, true) {
+			log.Printf("Note: the backup %s stays encrypted with the old passphrase", backup)
+		}
+	},
+}
+
+var configMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Update a config file written by an older version to the current format",
+	Long: "Older config files are migrated in memory every time they are loaded. This writes the migration back and" +
+		" keeps the old file as <config>.v<version>.bak, the secrets of an encrypted file stay sealed in it.",
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		configPath, file := loadedConfigFile(cmd)
+
+		version, ok := file.Migrated()
+		if !ok {
+			cmd.Printf("%s is already at config version %d.\n", configPath, config.CurrentVersion)
+			return
+		}
+
+		backupPath, err := backupConfig(configPath, version)
+		if err != nil {
+			log.Fatalf("Failed to back up config: %v", err)
+		}
+
+		if err := file.Save(configPath); err != nil {
+			log.Fatalf("Failed to save config: %v", err)
+		}
+
+		log.Printf("Migrated %s from version %d to %d, the old file is kept as %s", configPath, version, config.CurrentVersion, backupPath)
+	},
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Check the config for problems before they break a command",
+	Long: "Checks that the keys parse and the private key matches its stored public key, that addresses and" +
+		" endpoints are valid and that every setting belongs to a command and has a valid value." +
+		" Exits with status 1 if there are problems.",
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		all, err := cmd.Flags().GetBool("all")
+		if err != nil {
+			log.Fatalf("Failed to get all flag: %v", err)
+		}
+
+		_, file := loadedConfigFile(cmd)
+
+		names := []string{commandState(cmd).profile}
+		if all {
+			names = file.ProfileNames()
+		}
+
+		failed := false
+		for _, name := range names {
+			cfg, err := file.Select(name)
+			if err != nil {
+				log.Fatalf("Failed to load profile %s: %v", name, err)
+			}
+
+			problems := append(cfg.Validate(), validateSettings(cfg.Settings)...)
+			if len(problems) == 0 {
+				fmt.Printf("Profile %s: OK\n", name)
+				continue
+			}
+
+			failed = true
+			fmt.Printf("Profile %s:\n", name)
+			for _, problem := range problems {
+				fmt.Printf("  - %v\n", problem)
+			}
+		}
+
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+var configShowCmd = &cobra.Command{
+	Use:         "show",
+	Short:       "Print the config with secrets redacted",
+	Long:        "Prints the selected profile, or with --all the whole file, with keys, tokens, licenses and secret settings redacted.",
+	Annotations: noSecrets,
+	Args:        cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		all, err := cmd.Flags().GetBool("all")
+		if err != nil {
+			log.Fatalf("Failed to get all flag: %v", err)
+		}
+
+		_, file := loadedConfigFile(cmd)
+
+		var out any = redactConfig(*commandConfig(cmd))
+		if all {
+			redacted := *file
+			redacted.Profiles = make(map[string]config.Config, len(file.Profiles))
+			for _, name := range file.ProfileNames() {
+				profile, _ := file.Profile(name)
+				redacted.SetProfile(name, redactConfig(profile))
+			}
+			if len(redacted.Profiles) == 0 {
+				redacted.Profiles = nil
+			}
+			out = redacted
+		}
+
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(out); err != nil {
+			log.Fatalf("Failed to encode config: %v", err)
+		}
+	},
+}
+
+// secretSettings are the flags whose values are redacted by config show.
+var secretSettings = []string{"password", "client-secret", "jwt"}
+
+// redactConfig redacts the secrets of a profile, including secret settings.
+//
+// Parameters:
+//   - cfg: config.Config - The profile.
+//
+// Returns:
+//   - config.Config: The redacted copy.
+func redactConfig(cfg config.Config) config.Config {
+	cfg = cfg.Redact()
+	if cfg.Settings == nil {
+		return cfg
+	}
+
+	settings := make(config.Settings, len(cfg.Settings))
+	for section, values := range cfg.Settings {
+		settings[section] = make(map[string]any, len(values))
+		for key, value := range values {
+			if slices.Contains(secretSettings, key) {
+				value = config.Redacted
+			}
+			settings[section][key] = value
+		}
+	}
+	cfg.Settings = settings
+
+	return cfg
+}
+
+// backupConfig copies a config file as it is on disk to <path>.v<version>.bak, so the secrets
+// of an encrypted file stay sealed. Like Save, it replaces an existing backup atomically and
+// leaves it only readable by its owner.
+//
+// Parameters:
+//   - configPath: string - The path of the config file.
+//   - version: int - The version of the file on disk.
+//
+// Returns:
+//   - string: The path of the backup.
+//   - error: An error if the config file can't be read or the backup can't be written.
+func backupConfig(configPath string, version int) (string, error) {
+	old, err := os.ReadFile(configPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	backupPath := fmt.Sprintf("%s.v%d.bak", configPath, version)
+	if err := config.WriteFile(backupPath, old); err != nil {
+		return "", fmt.Errorf("failed to write backup: %v", err)
+	}
+
+	return backupPath, nil
+}
+
+// configBackups returns the backups kept by config migrate next to a config file, either
+// the encrypted or the plain text ones.
+//
+// Parameters:
+//   - configPath: string - The path of the config file.
+//   - encrypted: bool - Whether to return the encrypted backups instead of the plain text ones.
+//
+// Returns:
+//   - []string: The paths of the backups, sorted.
+func configBackups(configPath string, encrypted bool) []string {
+	entries, err := os.ReadDir(filepath.Dir(configPath))
+	if err != nil {
+		return nil
+	}
+
+	prefix := filepath.Base(configPath) + ".v"
+	var backups []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".bak") {
+			continue
+		}
+
+		path := filepath.Join(filepath.Dir(configPath), name)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var backup struct {
+			Encryption json.RawMessage `json:"encryption"`
+		}
+		if json.Unmarshal(data, &backup) == nil && (backup.Encryption != nil) == encrypted {
+			backups = append(backups, path)
+		}
+	}
+
+	return backups
+}
+
+// loadedConfigFile returns the config file of the running command and exits if it couldn't be loaded.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The running command.
+//
+// Returns:
+//   - string: The path of the config file.
+//   - *config.File: The config file.
+func loadedConfigFile(cmd *cobra.Command) (string, *config.File) {
+	configPath, err := cmd.Flags().GetString("config")
+	if err != nil {
+		log.Fatalf("Failed to get config path: %v", err)
+	}
+	if commandConfig(cmd) == nil {
+		log.Fatalf("Config not loaded. Please register first.")
+	}
+	return configPath, commandState(cmd).file
+}
+
+// passphraseEnv is the environment variable holding the passphrase of an encrypted config.
+const passphraseEnv = "USQUE_PASSPHRASE"
+
+// readPassphrase gets the passphrase of an encrypted config. It is read from the file
+// descriptor given with --passphrase-fd, the USQUE_PASSPHRASE environment variable or,
+// if stdin is a terminal, a prompt.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The running command.
+//   - confirm: bool - Whether to prompt twice, for a new passphrase.
+//
+// Returns:
+//   - []byte: The passphrase.
+//   - error: An error if no source is available or reading fails.
+func readPassphrase(cmd *cobra.Command, confirm bool) ([]byte, error) {
+	fd, err := cmd.Flags().GetInt("passphrase-fd")
+	if err != nil {
+		return nil, err
+	}
+
+	if fd >= 0 {
+		file := os.NewFile(uintptr(fd), "passphrase")
+		if file == nil {
+			return nil, fmt.Errorf("invalid file descriptor %d", fd)
+		}
+		defer file.Close()
+
+		line, err := bufio.NewReader(file).ReadBytes('\n')
+		if err != nil && len(line) == 0 {
+			return nil, fmt.Errorf("failed to read file descriptor %d: %v", fd, err)
+		}
+		return bytes.TrimRight(line, "\r\n"), nil
+	}
+
+	if value, ok := os.LookupEnv(passphraseEnv); ok {
+		return []byte(value), nil
+	}
+
+	stdin := int(os.Stdin.Fd())
+	if !term.IsTerminal(stdin) {
+		return nil, fmt.Errorf("config is encrypted, set %s or use --passphrase-fd", passphraseEnv)
+	}
+
+	fmt.Fprint(os.Stderr, "Config passphrase: ")
+	passphrase, err := term.ReadPassword(stdin)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read passphrase: %v", err)
+	}
+
+	if confirm {
+		fmt.Fprint(os.Stderr, "Repeat passphrase: ")
+		repeated, err := term.ReadPassword(stdin)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read passphrase: %v", err)
+		}
+		if !bytes.Equal(passphrase, repeated) {
+			return nil, fmt.Errorf("passphrases don't match")
+		}
+	}
+
+	return passphrase, nil
+}
+
+func init() {
+	configCmd.AddCommand(configEncryptCmd)
+	configCmd.AddCommand(configDecryptCmd)
+	configCmd.AddCommand(configMigrateCmd)
+	configValidateCmd.Flags().Bool("all", false, "Validate every profile of the file")
+	configCmd.AddCommand(configValidateCmd)
+	configShowCmd.Flags().Bool("all", false, "Print every profile of the file")
+	configCmd.AddCommand(configShowCmd)
+	rootCmd.AddCommand(configCmd)
+}
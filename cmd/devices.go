@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/models"
+	"github.com/spf13/cobra"
+)
+
+var devicesCmd = &cobra.Command{
+	Use:   "devices",
+	Short: "Manage the devices bound to the account",
+	Long:  "Lists, renames, removes, activates and deactivates devices sharing the account, e.g. via a WARP+ license.",
+}
+
+var devicesListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the devices bound to the account",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		asJson, err := cmd.Flags().GetBool("json")
+		if err != nil {
+			log.Fatalf("Failed to get json flag: %v", err)
+		}
+
+		withAPI(cmd, func(cfg *config.Config, profile api.ClientProfile, httpClient *http.Client) {
+			devices, apiErr, err := api.ListDevices(cmd.Context(), httpClient, profile, configAccount(cfg))
+			if err != nil {
+				fatalAPIError("Failed to list devices", apiErr, err)
+			}
+
+			if asJson {
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				if err := encoder.Encode(devices); err != nil {
+					log.Fatalf("Failed to encode devices: %v", err)
+				}
+				return
+			}
+
+			printDevices(devices, cfg.ID)
+		})
+	},
+}
+
+var devicesRenameCmd = &cobra.Command{
+	Use:   "rename <device-id> <name>",
+	Short: "Rename a bound device",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		updateBoundDevice(cmd, args[0], models.DeviceUpdate{Name: args[1]})
+	},
+}
+
+var devicesActivateCmd = &cobra.Command{
+	Use:   "activate <device-id>",
+	Short: "Activate a bound device",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		active := true
+		updateBoundDevice(cmd, args[0], models.DeviceUpdate{Active: &active})
+	},
+}
+
+var devicesDeactivateCmd = &cobra.Command{
+	Use:   "deactivate <device-id>",
+	Short: "Deactivate a bound device, e.g. a stale one, without removing it",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		active := false
+		updateBoundDevice(cmd, args[0], models.DeviceUpdate{Active: &active})
+	},
+}
+
+var devicesRemoveCmd = &cobra.Command{
+	Use:   "remove <device-id>",
+	Short: "Unbind a device from the account",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		withAPI(cmd, func(cfg *config.Config, profile api.ClientProfile, httpClient *http.Client) {
+			if args[0] == cfg.ID {
+				cmd.Println("Refusing to remove the device of this config. Use the unregister command instead.")
+				return
+			}
+
+			yes, err := cmd.Flags().GetBool("yes")
+			if err != nil {
+				log.Fatalf("Failed to get yes flag: %v", err)
+			}
+			if !yes {
+				fmt.Printf("This unbinds device %s from the account. Continue? (y/n): ", args[0])
+				var response string
+				if _, err := fmt.Scanln(&response); err != nil {
+					log.Fatalf("Failed to read user input: %v", err)
+				}
+				if response != "y" {
+					return
+				}
+			}
+
+			apiErr, err := api.RemoveBoundDevice(cmd.Context(), httpClient, profile, configAccount(cfg), args[0])
+			if err != nil {
+				fatalAPIError("Failed to remove device", apiErr, err)
+			}
+
+			log.Printf("Removed device %s", args[0])
+		})
+	},
+}
+
+// updateBoundDevice applies an update to a bound device and prints the resulting device list.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The running command.
+//   - deviceID: string - The device to update.
+//   - update: models.DeviceUpdate - The changes to apply.
+func updateBoundDevice(cmd *cobra.Command, deviceID string, update models.DeviceUpdate) {
+	withAPI(cmd, func(cfg *config.Config, profile api.ClientProfile, httpClient *http.Client) {
+		devices, apiErr, err := api.UpdateBoundDevice(cmd.Context(), httpClient, profile, configAccount(cfg), deviceID, update)
+		if err != nil {
+			fatalAPIError("Failed to update device", apiErr, err)
+		}
+
+		printDevices(devices, cfg.ID)
+	})
+}
+
+// printDevices prints bound devices as a table. The current device is marked with an asterisk.
+//
+// Parameters:
+//   - devices: []models.BoundDevice - The devices to print.
+//   - currentID: string - The device ID of the config.
+func printDevices(devices []models.BoundDevice, currentID string) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\tID\tNAME\tMODEL\tTYPE\tCREATED\tACTIVE\tROLE")
+	for _, device := range devices {
+		current := ""
+		if device.ID == currentID {
+			current = "*"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", current, device.ID, device.Name, device.Model,
+			device.TunType, device.Created, strconv.FormatBool(device.Active), device.Role)
+	}
+	w.Flush()
+}
+
+func init() {
+	devicesListCmd.Flags().Bool("json", false, "Print the devices as JSON")
+	devicesRemoveCmd.Flags().BoolP("yes", "y", false, "Don't ask for confirmation")
+	devicesCmd.AddCommand(devicesListCmd)
+	devicesCmd.AddCommand(devicesRenameCmd)
+	devicesCmd.AddCommand(devicesActivateCmd)
+	devicesCmd.AddCommand(devicesDeactivateCmd)
+	devicesCmd.AddCommand(devicesRemoveCmd)
+	rootCmd.AddCommand(devicesCmd)
+}
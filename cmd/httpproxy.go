@@ -2,16 +2,16 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/netip"
+	"sync/atomic"
 	"time"
 
-	"github.com/Diniboy1123/usque/api"
-	"github.com/Diniboy1123/usque/config"
 	"github.com/Diniboy1123/usque/internal"
 	"github.com/spf13/cobra"
 	"golang.zx2c4.com/wireguard/tun/netstack"
@@ -22,51 +22,12 @@ var httpProxyCmd = &cobra.Command{
 	Short: "Expose Warp as an HTTP proxy with CONNECT support",
 	Long:  "Dual-stack HTTP proxy with CONNECT support. Doesn't require elevated privileges.",
 	Run: func(cmd *cobra.Command, args []string) {
-		if !config.ConfigLoaded {
+		cfg := commandConfig(cmd)
+		if cfg == nil {
 			cmd.Println("Config not loaded. Please register first.")
 			return
 		}
 
-		sni, err := cmd.Flags().GetString("sni-address")
-		if err != nil {
-			cmd.Printf("Failed to get SNI address: %v\n", err)
-			return
-		}
-
-		privKey, err := config.AppConfig.GetEcPrivateKey()
-		if err != nil {
-			cmd.Printf("Failed to get private key: %v\n", err)
-			return
-		}
-		peerPubKey, err := config.AppConfig.GetEcEndpointPublicKey()
-		if err != nil {
-			cmd.Printf("Failed to get public key: %v\n", err)
-			return
-		}
-
-		cert, err := internal.GenerateCert(privKey, &privKey.PublicKey)
-		if err != nil {
-			cmd.Printf("Failed to generate cert: %v\n", err)
-			return
-		}
-
-		tlsConfig, err := api.PrepareTlsConfig(privKey, peerPubKey, cert, sni)
-		if err != nil {
-			cmd.Printf("Failed to prepare TLS config: %v\n", err)
-			return
-		}
-
-		keepalivePeriod, err := cmd.Flags().GetDuration("keepalive-period")
-		if err != nil {
-			cmd.Printf("Failed to get keepalive period: %v\n", err)
-			return
-		}
-		initialPacketSize, err := cmd.Flags().GetUint16("initial-packet-size")
-		if err != nil {
-			cmd.Printf("Failed to get initial packet size: %v\n", err)
-			return
-		}
-
 		bindAddress, err := cmd.Flags().GetString("bind")
 		if err != nil {
 			cmd.Printf("Failed to get bind address: %v\n", err)
@@ -79,136 +40,51 @@ var httpProxyCmd = &cobra.Command{
 			return
 		}
 
-		connectPort, err := cmd.Flags().GetInt("connect-port")
+		tunnel, err := tunnelClient(cmd)
 		if err != nil {
-			cmd.Printf("Failed to get connect port: %v\n", err)
+			cmd.Printf("Failed to set up tunnel: %v\n", err)
 			return
 		}
+		defer tunnel.Close()
+		runTunnel(tunnel)
+		tunNet := tunnel.Net()
 
-		var endpoint *net.UDPAddr
-		if ipv6, err := cmd.Flags().GetBool("ipv6"); err == nil && !ipv6 {
-			endpoint = &net.UDPAddr{
-				IP:   net.ParseIP(config.AppConfig.EndpointV4),
-				Port: connectPort,
-			}
-		} else {
-			endpoint = &net.UDPAddr{
-				IP:   net.ParseIP(config.AppConfig.EndpointV6),
-				Port: connectPort,
-			}
-		}
-
-		tunnelIPv4, err := cmd.Flags().GetBool("no-tunnel-ipv4")
+		var settings atomic.Pointer[httpProxySettings]
+		current, err := newHTTPProxySettings(cmd, tunNet)
 		if err != nil {
-			cmd.Printf("Failed to get no tunnel IPv4: %v\n", err)
+			cmd.Printf("Failed to set up HTTP proxy: %v\n", err)
 			return
 		}
+		settings.Store(current)
 
-		tunnelIPv6, err := cmd.Flags().GetBool("no-tunnel-ipv6")
-		if err != nil {
-			cmd.Printf("Failed to get no tunnel IPv6: %v\n", err)
-			return
-		}
-
-		var localAddresses []netip.Addr
-		if !tunnelIPv4 {
-			v4, err := netip.ParseAddr(config.AppConfig.IPv4)
-			if err != nil {
-				cmd.Printf("Failed to parse IPv4 address: %v\n", err)
-				return
-			}
-			localAddresses = append(localAddresses, v4)
-		}
-		if !tunnelIPv6 {
-			v6, err := netip.ParseAddr(config.AppConfig.IPv6)
-			if err != nil {
-				cmd.Printf("Failed to parse IPv6 address: %v\n", err)
-				return
-			}
-			localAddresses = append(localAddresses, v6)
-		}
-
-		dnsServers, err := cmd.Flags().GetStringArray("dns")
-		if err != nil {
-			cmd.Printf("Failed to get DNS servers: %v\n", err)
-			return
-		}
-
-		var dnsAddrs []netip.Addr
-		for _, dns := range dnsServers {
-			addr, err := netip.ParseAddr(dns)
+		// Requests already being served keep the settings they started with.
+		watchReload(cmd, httpProxyReloadable, func() error {
+			current, err := newHTTPProxySettings(cmd, tunNet)
 			if err != nil {
-				cmd.Printf("Failed to parse DNS server: %v\n", err)
-				return
+				return err
 			}
-			dnsAddrs = append(dnsAddrs, addr)
-		}
-
-		dnsTimeout, err := cmd.Flags().GetDuration("dns-timeout")
-		if err != nil {
-			cmd.Printf("Failed to get DNS timeout: %v\n", err)
-			return
-		}
-
-		localDNS, err := cmd.Flags().GetBool("local-dns")
-		if err != nil {
-			cmd.Printf("Failed to get local-dns flag: %v\n", err)
-			return
-		}
-
-		mtu, err := cmd.Flags().GetInt("mtu")
-		if err != nil {
-			cmd.Printf("Failed to get MTU: %v\n", err)
-			return
-		}
-		if mtu != 1280 {
-			log.Println("Warning: MTU is not the default 1280. This is not supported. Packet loss and other issues may occur.")
-		}
-
-		var username string
-		var password string
-		if u, err := cmd.Flags().GetString("username"); err == nil && u != "" {
-			username = u
-		}
-		if p, err := cmd.Flags().GetString("password"); err == nil && p != "" {
-			password = p
-		}
-
-		reconnectDelay, err := cmd.Flags().GetDuration("reconnect-delay")
-		if err != nil {
-			cmd.Printf("Failed to get reconnect delay: %v\n", err)
-			return
-		}
-
-		var authHeader string
-		if username != "" && password != "" {
-			authHeader = "Basic " + internal.LoginToBase64(username, password)
-		}
-
-		tunDev, tunNet, err := netstack.CreateNetTUN(localAddresses, dnsAddrs, mtu)
-		if err != nil {
-			cmd.Printf("Failed to create virtual TUN device: %v\n", err)
-			return
-		}
-		defer tunDev.Close()
-
-		resolver := internal.GetProxyResolver(localDNS, tunNet, dnsAddrs, dnsTimeout)
-
-		go api.MaintainTunnel(context.Background(), tlsConfig, keepalivePeriod, initialPacketSize, endpoint, api.NewNetstackAdapter(tunDev), mtu, reconnectDelay)
+			settings.Store(current)
+			return nil
+		})
 
 		server := &http.Server{
 			Addr: net.JoinHostPort(bindAddress, port),
 			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				if !authenticate(r, authHeader) {
+				current := settings.Load()
+				if !clientAllowed(r, current.acl) {
+					http.Error(w, "Client not allowed", http.StatusForbidden)
+					return
+				}
+				if !authenticate(r, current.authHeader) {
 					w.Header().Set("Proxy-Authenticate", `Basic realm="Proxy"`)
 					http.Error(w, "Proxy authentication required", http.StatusProxyAuthRequired)
 					return
 				}
 
 				if r.Method == http.MethodConnect {
-					handleHTTPSConnect(w, r, tunNet, resolver)
+					handleHTTPSConnect(w, r, current.router, current.resolver)
 				} else {
-					handleHTTPProxy(w, r, tunNet, resolver)
+					handleHTTPProxy(w, r, current.router, current.resolver)
 				}
 			}),
 		}
@@ -220,6 +96,79 @@ var httpProxyCmd = &cobra.Command{
 	},
 }
 
+// httpProxyReloadable are the flags of the http-proxy command that are reloaded on SIGHUP.
+var httpProxyReloadable = []string{"username", "password", "dns", "dns-timeout", "local-dns", "apply-policy", "allow-client", "deny-dest"}
+
+// httpProxySettings are the settings of the HTTP proxy that can change while it runs.
+type httpProxySettings struct {
+	authHeader string        // Expected Proxy-Authorization header, empty if authentication is off
+	acl        *internal.ACL // Allowed clients and refused destinations, nil if all are allowed
+	router     *policyRouter // Applies the device policy and the ACL
+	resolver   *net.Resolver // Resolves the destinations
+}
+
+// newHTTPProxySettings reads the authentication, DNS servers, ACL and device policy from the
+// flags of the http-proxy command.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The running command.
+//   - tunNet: *netstack.Net - The network stack of the tunnel.
+//
+// Returns:
+//   - *httpProxySettings: The settings.
+//   - error: An error if a flag is invalid or the policy can't be fetched.
+func newHTTPProxySettings(cmd *cobra.Command, tunNet *netstack.Net) (*httpProxySettings, error) {
+	dnsServers, err := cmd.Flags().GetStringArray("dns")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get DNS servers: %v", err)
+	}
+	dnsAddrs, err := parseDNSServers(dnsServers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse DNS server: %v", err)
+	}
+
+	dnsTimeout, err := cmd.Flags().GetDuration("dns-timeout")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get DNS timeout: %v", err)
+	}
+
+	localDNS, err := cmd.Flags().GetBool("local-dns")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get local-dns flag: %v", err)
+	}
+
+	var username string
+	var password string
+	if u, err := cmd.Flags().GetString("username"); err == nil && u != "" {
+		username = u
+	}
+	if p, err := cmd.Flags().GetString("password"); err == nil && p != "" {
+		password = p
+	}
+
+	var authHeader string
+	if username != "" && password != "" {
+		authHeader = "Basic " + internal.LoginToBase64(username, password)
+	}
+
+	acl, err := proxyACL(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	split, fallback, err := fetchPolicy(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get policy: %v", err)
+	}
+
+	return &httpProxySettings{
+		authHeader: authHeader,
+		acl:        acl,
+		router:     &policyRouter{split: split, fallback: fallback, acl: acl, tunNet: tunNet, timeout: dnsTimeout},
+		resolver:   internal.GetProxyResolver(localDNS, tunNet, dnsAddrs, dnsTimeout),
+	}, nil
+}
+
 // authenticate verifies the Proxy-Authorization header in an HTTP request.
 //
 // Parameters:
@@ -233,14 +182,30 @@ func authenticate(r *http.Request, expectedAuth string) bool {
 	return authHeader == expectedAuth
 }
 
+// clientAllowed checks the address of the client that sent an HTTP request against the ACL.
+//
+// Parameters:
+//   - r: *http.Request - The incoming HTTP request.
+//   - acl: *internal.ACL - The ACL, nil to allow all clients.
+//
+// Returns:
+//   - bool: True if the client may use the proxy.
+func clientAllowed(r *http.Request, acl *internal.ACL) bool {
+	if acl == nil {
+		return true
+	}
+	addr, err := netip.ParseAddrPort(r.RemoteAddr)
+	return err == nil && acl.AllowsClient(addr.Addr())
+}
+
 // handleHTTPSConnect establishes a tunnel to the destination using the provided resolver.
 //
 // Parameters:
 //   - w: http.ResponseWriter - The response writer for the HTTP request.
 //   - r: *http.Request - The incoming HTTP request.
-//   - tunNet: *netstack.Net - The netstack network interface.
+//   - router: *policyRouter - Decides whether to use the tunnel for the destination.
 //   - resolver: *net.Resolver - The DNS resolver to use for the tunnel.
-func handleHTTPSConnect(w http.ResponseWriter, r *http.Request, tunNet *netstack.Net, resolver *net.Resolver) {
+func handleHTTPSConnect(w http.ResponseWriter, r *http.Request, router *policyRouter, resolver *net.Resolver) {
 	ctx := r.Context()
 
 	host, port, err := net.SplitHostPort(r.Host)
@@ -251,7 +216,7 @@ func handleHTTPSConnect(w http.ResponseWriter, r *http.Request, tunNet *netstack
 
 	var destAddr string
 	if resolver != nil {
-		ips, err := resolver.LookupIP(ctx, "ip", host)
+		ips, err := router.lookup(ctx, host, lookupIP(resolver))
 		if err != nil || len(ips) == 0 {
 			http.Error(w, "DNS resolution failed", http.StatusServiceUnavailable)
 			return
@@ -261,7 +226,11 @@ func handleHTTPSConnect(w http.ResponseWriter, r *http.Request, tunNet *netstack
 		destAddr = r.Host
 	}
 
-	destConn, err := tunNet.DialContext(ctx, "tcp", destAddr)
+	destConn, err := router.dial(ctx, "tcp", destAddr)
+	if errors.Is(err, errDestinationDenied) {
+		http.Error(w, "Destination not allowed", http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Unable to connect to destination", http.StatusServiceUnavailable)
 		return
@@ -301,9 +270,9 @@ func handleHTTPSConnect(w http.ResponseWriter, r *http.Request, tunNet *netstack
 // Parameters:
 //   - w: http.ResponseWriter - The response writer for the HTTP request.
 //   - r: *http.Request - The incoming HTTP request.
-//   - tunNet: *netstack.Net - The netstack network interface.
+//   - router: *policyRouter - Decides whether to use the tunnel for the destination.
 //   - resolver: *net.Resolver - The DNS resolver to use for the tunnel.
-func handleHTTPProxy(w http.ResponseWriter, r *http.Request, tunNet *netstack.Net, resolver *net.Resolver) {
+func handleHTTPProxy(w http.ResponseWriter, r *http.Request, router *policyRouter, resolver *net.Resolver) {
 	port := r.URL.Port()
 	if port == "" {
 		port = "80"
@@ -319,7 +288,7 @@ func handleHTTPProxy(w http.ResponseWriter, r *http.Request, tunNet *netstack.Ne
 
 				var dialAddr string
 				if resolver != nil {
-					ips, err := resolver.LookupIP(ctx, "ip", host)
+					ips, err := router.lookup(ctx, host, lookupIP(resolver))
 					if err != nil || len(ips) == 0 {
 						return nil, fmt.Errorf("DNS resolution failed for %s: %w", host, err)
 					}
@@ -328,7 +297,7 @@ func handleHTTPProxy(w http.ResponseWriter, r *http.Request, tunNet *netstack.Ne
 					dialAddr = addr
 				}
 
-				return tunNet.DialContext(ctx, network, dialAddr)
+				return router.dial(ctx, network, dialAddr)
 			},
 		},
 	}
@@ -341,6 +310,10 @@ func handleHTTPProxy(w http.ResponseWriter, r *http.Request, tunNet *netstack.Ne
 	req.Header = r.Header.Clone()
 
 	resp, err := client.Do(req)
+	if errors.Is(err, errDestinationDenied) {
+		http.Error(w, "Destination not allowed", http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to reach destination", http.StatusServiceUnavailable)
 		return
@@ -352,6 +325,19 @@ func handleHTTPProxy(w http.ResponseWriter, r *http.Request, tunNet *netstack.Ne
 	io.Copy(w, resp.Body)
 }
 
+// lookupIP adapts a resolver to policyRouter.lookup.
+//
+// Parameters:
+//   - resolver: *net.Resolver - The resolver.
+//
+// Returns:
+//   - func(context.Context, string) ([]net.IP, error): A lookup of all addresses of a host.
+func lookupIP(resolver *net.Resolver) func(context.Context, string) ([]net.IP, error) {
+	return func(ctx context.Context, host string) ([]net.IP, error) {
+		return resolver.LookupIP(ctx, "ip", host)
+	}
+}
+
 // copyHeader copies HTTP headers from one header map to another.
 //
 // Parameters:
@@ -376,11 +362,19 @@ func init() {
 	httpProxyCmd.Flags().BoolP("ipv6", "6", false, "Use IPv6 for MASQUE connection")
 	httpProxyCmd.Flags().BoolP("no-tunnel-ipv4", "F", false, "Disable IPv4 inside the MASQUE tunnel")
 	httpProxyCmd.Flags().BoolP("no-tunnel-ipv6", "S", false, "Disable IPv6 inside the MASQUE tunnel")
-	httpProxyCmd.Flags().StringP("sni-address", "s", internal.ConnectSNI, "SNI address to use for MASQUE connection")
+	httpProxyCmd.Flags().StringP("sni-address", "s", "", "SNI address to use for MASQUE connection (default: "+internal.ZeroTierSNI+" for Zero Trust accounts, "+internal.ConnectSNI+" otherwise)")
+	httpProxyCmd.Flags().String("connect-uri", "", "Use standard RFC 9484 connect-ip with this URI template instead of Cloudflare (e.g. https://proxy.example.com/.well-known/masque/ip/{target}/{ipproto}/)")
 	httpProxyCmd.Flags().DurationP("keepalive-period", "k", 30*time.Second, "Keepalive period for MASQUE connection")
 	httpProxyCmd.Flags().IntP("mtu", "m", 1280, "MTU for MASQUE connection")
 	httpProxyCmd.Flags().Uint16P("initial-packet-size", "i", 1242, "Initial packet size for MASQUE connection")
 	httpProxyCmd.Flags().DurationP("reconnect-delay", "r", 1*time.Second, "Delay between reconnect attempts")
+	httpProxyCmd.Flags().Duration("rotate-interval", 0, "Replace the MASQUE session make-before-break at this interval (0 disables)")
+	httpProxyCmd.Flags().Duration("drain-period", 5*time.Second, "How long a replaced MASQUE session keeps delivering in-flight packets")
+	httpProxyCmd.Flags().Bool("on-demand", false, "Only connect the MASQUE tunnel when there is traffic")
+	httpProxyCmd.Flags().Duration("idle-timeout", 5*time.Minute, "Disconnect an on-demand MASQUE tunnel after this long without traffic (0 disables)")
 	httpProxyCmd.Flags().BoolP("local-dns", "l", false, "Don't use the tunnel for DNS queries")
+	httpProxyCmd.Flags().Bool("apply-policy", false, "Apply the split tunnel and fallback domains of the device policy")
+	httpProxyCmd.Flags().StringArray("allow-client", nil, "Only accept clients from this address or prefix (repeatable, default: all clients)")
+	httpProxyCmd.Flags().StringArray("deny-dest", nil, "Refuse connections to this destination address or prefix (repeatable)")
 	rootCmd.AddCommand(httpProxyCmd)
 }
@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Diniboy1123/usque/internal"
+)
+
+func TestHTTPProxyACL(t *testing.T) {
+	acl, err := internal.NewACL([]string{"192.168.0.0/16", "::1"}, []string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("failed to create ACL: %v", err)
+	}
+
+	clients := []struct {
+		remoteAddr string
+		want       bool
+	}{
+		{remoteAddr: "192.168.1.2:50000", want: true},
+		{remoteAddr: "[::1]:50000", want: true},
+		{remoteAddr: "[::ffff:192.168.1.2]:50000", want: true},
+		{remoteAddr: "10.0.0.1:50000"},
+		{remoteAddr: "not an address"},
+	}
+	for _, tt := range clients {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if got := clientAllowed(r, acl); got != tt.want {
+			t.Errorf("client %s: got %v, want %v", tt.remoteAddr, got, tt.want)
+		}
+		if !clientAllowed(r, nil) {
+			t.Errorf("client %s refused without an ACL", tt.remoteAddr)
+		}
+	}
+
+	// refused destinations are never dialed, so the router needs no tunnel
+	router := &policyRouter{acl: acl}
+	requests := []struct {
+		name   string
+		method string
+		target string
+	}{
+		{name: "CONNECT to a denied address", method: http.MethodConnect, target: "10.1.2.3:443"},
+		{name: "CONNECT to an unresolved host", method: http.MethodConnect, target: "example.com:443"},
+		{name: "GET from a denied address", method: http.MethodGet, target: "http://10.1.2.3/"},
+		{name: "GET from an unresolved host", method: http.MethodGet, target: "http://example.com/"},
+	}
+	for _, tt := range requests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			w := httptest.NewRecorder()
+			if tt.method == http.MethodConnect {
+				r.Host = tt.target
+				handleHTTPSConnect(w, r, router, nil)
+			} else {
+				handleHTTPProxy(w, r, router, nil)
+			}
+			if w.Code != http.StatusForbidden {
+				t.Errorf("got status %d, want %d", w.Code, http.StatusForbidden)
+			}
+		})
+	}
+}
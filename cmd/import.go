@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/Diniboy1123/usque/models"
+	"github.com/spf13/cobra"
+)
+
+var importCmd = &cobra.Command{
+	Use:   "import <file>",
+	Short: "Import a registration from the official WARP client or wgcf",
+	Long: "Takes over the device ID, access token and license of an existing registration, e.g." +
+		" /var/lib/cloudflare-warp/reg.json of the official Linux client or wgcf-account.toml of wgcf." +
+		" A new MASQUE key pair is generated. With --enroll the key is enrolled right away, otherwise" +
+		" run the enroll command before connecting.",
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg := commandConfig(cmd)
+		if cfg != nil && cfg.PrivateKey != "" {
+			fmt.Printf("You already have a config. Do you want to overwrite it? (y/n) ")
+			var response string
+			if _, err := fmt.Scanln(&response); err != nil {
+				log.Fatalf("Failed to read response: %v", err)
+			}
+			if response != "y" {
+				return
+			}
+		}
+
+		configPath, err := cmd.Flags().GetString("config")
+		if err != nil {
+			log.Fatalf("Failed to get config path: %v", err)
+		}
+		if configPath == "" {
+			log.Fatalf("Config path is required")
+		}
+
+		format, err := cmd.Flags().GetString("format")
+		if err != nil {
+			log.Fatalf("Failed to get format: %v", err)
+		}
+
+		enroll, err := cmd.Flags().GetBool("enroll")
+		if err != nil {
+			log.Fatalf("Failed to get enroll flag: %v", err)
+		}
+
+		deviceName, err := cmd.Flags().GetString("name")
+		if err != nil {
+			log.Fatalf("Failed to get device name: %v", err)
+		}
+
+		data, err := os.ReadFile(args[0])
+		if err != nil {
+			log.Fatalf("Failed to read %s: %v", args[0], err)
+		}
+
+		identity, err := internal.ParseIdentity(data, format)
+		if err != nil {
+			log.Fatalf("Failed to import %s: %v", args[0], err)
+		}
+
+		log.Printf("Imported device %s", identity.ID)
+
+		privKey, pubKey, err := internal.GenerateEcKeyPair()
+		if err != nil {
+			log.Fatalf("Failed to generate key pair: %v", err)
+		}
+
+		newConfig := newCommandConfig(cmd)
+		newConfig.PrivateKey = base64.StdEncoding.EncodeToString(privKey)
+		newConfig.ID = identity.ID
+		newConfig.AccessToken = identity.AccessToken
+		newConfig.License = identity.License
+		if cfg != nil {
+			newConfig.APISettings = cfg.APISettings
+			newConfig.Settings = cfg.Settings
+		}
+
+		if enroll {
+			withAPIClient(cmd, func(profile api.ClientProfile, httpClient *http.Client) {
+				log.Printf("Enrolling device key...")
+
+				accountData, apiErr, err := api.EnrollKey(cmd.Context(), httpClient, profile, models.AccountData{
+					ID:    identity.ID,
+					Token: identity.AccessToken,
+				}, pubKey, deviceName)
+				if err != nil {
+					fatalAPIError("Failed to enroll key", apiErr, err)
+				}
+
+				if err := applyAccountData(newConfig, accountData); err != nil {
+					log.Fatalf("Failed to use account data: %v", err)
+				}
+			})
+		}
+
+		if err := newConfig.SaveConfig(configPath); err != nil {
+			log.Fatalf("Failed to save config: %v", err)
+		}
+
+		log.Printf("Config saved to %s", savedProfile(newConfig, configPath))
+		if !enroll {
+			log.Printf("Run the enroll command to enroll the new key before connecting")
+		}
+	},
+}
+
+func init() {
+	importCmd.Flags().String("format", internal.IdentityFormatAuto, "Format of the file: auto, warp (reg.json) or wgcf (wgcf-account.toml)")
+	importCmd.Flags().BoolP("enroll", "e", false, "Enroll a MASQUE key right after importing")
+	importCmd.Flags().StringP("name", "n", "", "Rename device a given name when enrolling")
+	rootCmd.AddCommand(importCmd)
+}
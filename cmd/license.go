@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/spf13/cobra"
+)
+
+var licenseCmd = &cobra.Command{
+	Use:   "license [key]",
+	Short: "Bind a license key (e.g. WARP+) to the account",
+	Long: "Binds the account to the given license key, e.g. a WARP+ key or the license of another device." +
+		" With --reset, a fresh personal license is generated instead. Saves the new license to the config.",
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if commandConfig(cmd) == nil {
+			cmd.Println("Config not loaded. Please register first.")
+			return
+		}
+
+		configPath, err := cmd.Flags().GetString("config")
+		if err != nil {
+			log.Fatalf("Failed to get config path: %v", err)
+		}
+		if configPath == "" {
+			log.Fatalf("Config path is required")
+		}
+
+		reset, err := cmd.Flags().GetBool("reset")
+		if err != nil {
+			log.Fatalf("Failed to get reset flag: %v", err)
+		}
+
+		if reset == (len(args) == 1) {
+			cmd.Println("Specify either a license key or --reset.")
+			return
+		}
+
+		if reset {
+			yes, err := cmd.Flags().GetBool("yes")
+			if err != nil {
+				log.Fatalf("Failed to get yes flag: %v", err)
+			}
+			if !yes {
+				fmt.Print("Resetting the license unbinds every other device using it. Continue? (y/n): ")
+				var response string
+				if _, err := fmt.Scanln(&response); err != nil {
+					log.Fatalf("Failed to read user input: %v", err)
+				}
+				if response != "y" {
+					return
+				}
+			}
+		}
+
+		withAPI(cmd, func(cfg *config.Config, profile api.ClientProfile, httpClient *http.Client) {
+			if reset {
+				_, apiErr, err := api.ResetLicense(cmd.Context(), httpClient, profile, configAccount(cfg))
+				if err != nil {
+					fatalAPIError("Failed to reset license", apiErr, err)
+				}
+			} else {
+				_, apiErr, err := api.UpdateLicense(cmd.Context(), httpClient, profile, configAccount(cfg), args[0])
+				if err != nil {
+					fatalAPIError("Failed to bind license", apiErr, err)
+				}
+			}
+
+			// The license endpoints return only parts of the account, so fetch it as a whole.
+			account, apiErr, err := api.GetAccount(cmd.Context(), httpClient, profile, configAccount(cfg))
+			if err != nil {
+				fatalAPIError("Failed to get account", apiErr, err)
+			}
+
+			cfg.License = account.Account.License
+			cfg.AccountType = account.Account.AccountType
+
+			if err := cfg.SaveConfig(configPath); err != nil {
+				log.Fatalf("Failed to save config: %v", err)
+			}
+
+			log.Printf("Account is now of type %s (WARP+: %t). Config saved to %s", account.Account.AccountType, account.Account.WarpPlus, savedProfile(cfg, configPath))
+		})
+	},
+}
+
+func init() {
+	licenseCmd.Flags().Bool("reset", false, "Generate a fresh personal license instead")
+	licenseCmd.Flags().BoolP("yes", "y", false, "Don't ask for confirmation")
+	rootCmd.AddCommand(licenseCmd)
+}
@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/Diniboy1123/usque/internal/mockapi"
+	"github.com/spf13/cobra"
+)
+
+var mockApiCmd = &cobra.Command{
+	Use:         "mockapi",
+	Short:       "Run a fake registration API for offline testing",
+	Long:        "Runs an in-memory stand-in for the registration API. Point other commands at it with --api-url.",
+	Hidden:      true,
+	Annotations: noSecrets,
+	Run: func(cmd *cobra.Command, args []string) {
+		listen, err := cmd.Flags().GetString("listen")
+		if err != nil {
+			cmd.Printf("Failed to get listen address: %v\n", err)
+			return
+		}
+
+		endpointV4, err := cmd.Flags().GetString("endpoint-v4")
+		if err != nil {
+			cmd.Printf("Failed to get IPv4 endpoint: %v\n", err)
+			return
+		}
+
+		endpointV6, err := cmd.Flags().GetString("endpoint-v6")
+		if err != nil {
+			cmd.Printf("Failed to get IPv6 endpoint: %v\n", err)
+			return
+		}
+
+		endpointPubKeyPath, err := cmd.Flags().GetString("endpoint-pub-key")
+		if err != nil {
+			cmd.Printf("Failed to get endpoint public key path: %v\n", err)
+			return
+		}
+
+		rejectKeys, err := cmd.Flags().GetInt("reject-keys")
+		if err != nil {
+			cmd.Printf("Failed to get reject-keys: %v\n", err)
+			return
+		}
+
+		throttle, err := cmd.Flags().GetInt("throttle")
+		if err != nil {
+			cmd.Printf("Failed to get throttle: %v\n", err)
+			return
+		}
+
+		plusLicenses, err := cmd.Flags().GetStringArray("plus-license")
+		if err != nil {
+			cmd.Printf("Failed to get WARP+ licenses: %v\n", err)
+			return
+		}
+
+		serviceTokens, err := cmd.Flags().GetStringArray("service-token")
+		if err != nil {
+			cmd.Printf("Failed to get service tokens: %v\n", err)
+			return
+		}
+
+		policyPath, err := cmd.Flags().GetString("team-policy")
+		if err != nil {
+			cmd.Printf("Failed to get team policy path: %v\n", err)
+			return
+		}
+
+		server, err := mockapi.New()
+		if err != nil {
+			cmd.Printf("Failed to create mock API: %v\n", err)
+			return
+		}
+
+		server.EndpointV4 = endpointV4
+		server.EndpointV6 = endpointV6
+		server.RejectKeys = rejectKeys
+		server.Throttle = throttle
+		for _, license := range plusLicenses {
+			server.AddPlusAccount(license, 10<<30)
+		}
+		for _, token := range serviceTokens {
+			clientID, secret, ok := strings.Cut(token, ":")
+			if !ok {
+				cmd.Printf("Invalid service token %q, expected id:secret\n", token)
+				return
+			}
+			server.ServiceTokens[clientID] = secret
+		}
+
+		if policyPath != "" {
+			policy, err := os.ReadFile(policyPath)
+			if err != nil {
+				cmd.Printf("Failed to read team policy: %v\n", err)
+				return
+			}
+			if err := json.Unmarshal(policy, &server.TeamPolicy); err != nil {
+				cmd.Printf("Failed to parse team policy: %v\n", err)
+				return
+			}
+		}
+
+		if endpointPubKeyPath != "" {
+			endpointPubKey, err := os.ReadFile(endpointPubKeyPath)
+			if err != nil {
+				cmd.Printf("Failed to read endpoint public key: %v\n", err)
+				return
+			}
+			server.EndpointPubKey = string(endpointPubKey)
+		}
+
+		log.Printf("Mock API listening on http://%s", listen)
+
+		if err := http.ListenAndServe(listen, server); err != nil {
+			log.Fatalf("Mock API stopped: %v", err)
+		}
+	},
+}
+
+func init() {
+	mockApiCmd.Flags().StringP("listen", "l", "127.0.0.1:8787", "Address to listen on")
+	mockApiCmd.Flags().String("endpoint-v4", "127.0.0.1", "IPv4 endpoint handed out to clients")
+	mockApiCmd.Flags().String("endpoint-v6", "::1", "IPv6 endpoint handed out to clients")
+	mockApiCmd.Flags().String("endpoint-pub-key", "", "PEM public key of the endpoint handed out to clients (random if empty)")
+	mockApiCmd.Flags().Int("reject-keys", 0, "Reject this many key enrollments with \"Invalid public key\"")
+	mockApiCmd.Flags().Int("throttle", 0, "Answer the next this many requests with 429 Too Many Requests")
+	mockApiCmd.Flags().StringArray("plus-license", nil, "Create a WARP+ account with this license key (can be repeated)")
+	mockApiCmd.Flags().StringArray("service-token", nil, "Accept this Access service token as id:secret for Zero Trust registrations (can be repeated)")
+	mockApiCmd.Flags().String("team-policy", "", "JSON file with the device policy handed out to Zero Trust devices")
+	rootCmd.AddCommand(mockApiCmd)
+}
@@ -1,13 +1,12 @@
 package cmd
 
 import (
-	"context"
 	"log"
-	"net"
+	"net/netip"
+	"strings"
 	"time"
 
-	"github.com/Diniboy1123/usque/api"
-	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/client"
 	"github.com/Diniboy1123/usque/internal"
 	"github.com/spf13/cobra"
 )
@@ -18,6 +17,9 @@ type tunDevice struct {
 	iproute2 bool
 	ipv4     bool
 	ipv6     bool
+	ipv4Addr string
+	ipv6Addr string
+	routes   []netip.Prefix
 }
 
 var nativeTunCmd = &cobra.Command{
@@ -25,70 +27,12 @@ var nativeTunCmd = &cobra.Command{
 	Short: "Expose Warp as a native TUN device",
 	Long:  longDescription,
 	Run: func(cmd *cobra.Command, args []string) {
-		if !config.ConfigLoaded {
+		cfg := commandConfig(cmd)
+		if cfg == nil {
 			cmd.Println("Config not loaded. Please register first.")
 			return
 		}
 
-		sni, err := cmd.Flags().GetString("sni-address")
-		if err != nil {
-			cmd.Printf("Failed to get SNI address: %v\n", err)
-			return
-		}
-
-		privKey, err := config.AppConfig.GetEcPrivateKey()
-		if err != nil {
-			cmd.Printf("Failed to get private key: %v\n", err)
-			return
-		}
-		peerPubKey, err := config.AppConfig.GetEcEndpointPublicKey()
-		if err != nil {
-			cmd.Printf("Failed to get public key: %v\n", err)
-			return
-		}
-
-		cert, err := internal.GenerateCert(privKey, &privKey.PublicKey)
-		if err != nil {
-			cmd.Printf("Failed to generate cert: %v\n", err)
-			return
-		}
-
-		tlsConfig, err := api.PrepareTlsConfig(privKey, peerPubKey, cert, sni)
-		if err != nil {
-			cmd.Printf("Failed to prepare TLS config: %v\n", err)
-			return
-		}
-
-		keepalivePeriod, err := cmd.Flags().GetDuration("keepalive-period")
-		if err != nil {
-			cmd.Printf("Failed to get keepalive period: %v\n", err)
-			return
-		}
-		initialPacketSize, err := cmd.Flags().GetUint16("initial-packet-size")
-		if err != nil {
-			cmd.Printf("Failed to get initial packet size: %v\n", err)
-			return
-		}
-
-		connectPort, err := cmd.Flags().GetInt("connect-port")
-		if err != nil {
-			cmd.Printf("Failed to get connect port: %v\n", err)
-			return
-		}
-
-		var endpoint *net.UDPAddr
-		if ipv6, err := cmd.Flags().GetBool("ipv6"); err == nil && !ipv6 {
-			endpoint = &net.UDPAddr{
-				IP:   net.ParseIP(config.AppConfig.EndpointV4),
-				Port: connectPort,
-			}
-		} else {
-			endpoint = &net.UDPAddr{
-				IP:   net.ParseIP(config.AppConfig.EndpointV6),
-				Port: connectPort,
-			}
-		}
-
 		tunnelIPv4, err := cmd.Flags().GetBool("no-tunnel-ipv4")
 		if err != nil {
 			cmd.Printf("Failed to get no tunnel IPv4: %v\n", err)
@@ -106,9 +50,6 @@ var nativeTunCmd = &cobra.Command{
 			cmd.Printf("Failed to get MTU: %v\n", err)
 			return
 		}
-		if mtu != 1280 {
-			log.Println("Warning: MTU is not the default 1280. This is not supported. Packet loss and other issues may occur.")
-		}
 
 		setIproute2, err := cmd.Flags().GetBool("no-iproute2")
 		if err != nil {
@@ -116,12 +57,6 @@ var nativeTunCmd = &cobra.Command{
 			return
 		}
 
-		reconnectDelay, err := cmd.Flags().GetDuration("reconnect-delay")
-		if err != nil {
-			cmd.Printf("Failed to get reconnect delay: %v\n", err)
-			return
-		}
-
 		interfaceName, err := cmd.Flags().GetString("interface-name")
 		if err != nil {
 			cmd.Printf("Failed to get interface name: %v\n", err)
@@ -136,12 +71,23 @@ var nativeTunCmd = &cobra.Command{
 			}
 		}
 
+		split, fallback, err := fetchPolicy(cmd)
+		if err != nil {
+			cmd.Printf("Failed to get policy: %v\n", err)
+			return
+		}
+
 		t := &tunDevice{
 			name:     interfaceName,
 			mtu:      mtu,
 			iproute2: !setIproute2,
 			ipv4:     !tunnelIPv4,
 			ipv6:     !tunnelIPv6,
+			ipv4Addr: cfg.IPv4,
+			ipv6Addr: cfg.IPv6,
+		}
+		if split != nil {
+			t.routes = policyRoutes(cfg, split, fallback, t.ipv4, t.ipv6)
 		}
 
 		dev, err := t.create()
@@ -152,9 +98,22 @@ var nativeTunCmd = &cobra.Command{
 
 		log.Printf("Created TUN device: %s", t.name)
 
-		go api.MaintainTunnel(context.Background(), tlsConfig, keepalivePeriod, initialPacketSize, endpoint, dev, mtu, reconnectDelay)
+		tunnel, err := tunnelClient(cmd, client.WithDevice(dev))
+		if err != nil {
+			cmd.Printf("Failed to set up tunnel: %v\n", err)
+			return
+		}
+		defer tunnel.Close()
+		runTunnel(tunnel)
 
-		log.Println("Tunnel established, you may now set up routing and DNS")
+		if fallback != nil {
+			log.Printf("Resolve these domains outside the tunnel: %s", strings.Join(fallback.Suffixes(), ", "))
+		}
+		if split != nil {
+			log.Println("Tunnel established, you may now set up DNS")
+		} else {
+			log.Println("Tunnel established, you may now set up routing and DNS")
+		}
 
 		select {}
 	},
@@ -165,12 +124,18 @@ func init() {
 	nativeTunCmd.Flags().BoolP("ipv6", "6", false, "Use IPv6 for MASQUE connection")
 	nativeTunCmd.Flags().BoolP("no-tunnel-ipv4", "F", false, "Disable IPv4 inside the MASQUE tunnel")
 	nativeTunCmd.Flags().BoolP("no-tunnel-ipv6", "S", false, "Disable IPv6 inside the MASQUE tunnel")
-	nativeTunCmd.Flags().StringP("sni-address", "s", internal.ConnectSNI, "SNI address to use for MASQUE connection")
+	nativeTunCmd.Flags().StringP("sni-address", "s", "", "SNI address to use for MASQUE connection (default: "+internal.ZeroTierSNI+" for Zero Trust accounts, "+internal.ConnectSNI+" otherwise)")
+	nativeTunCmd.Flags().String("connect-uri", "", "Use standard RFC 9484 connect-ip with this URI template instead of Cloudflare (e.g. https://proxy.example.com/.well-known/masque/ip/{target}/{ipproto}/)")
 	nativeTunCmd.Flags().DurationP("keepalive-period", "k", 30*time.Second, "Keepalive period for MASQUE connection")
 	nativeTunCmd.Flags().IntP("mtu", "m", 1280, "MTU for MASQUE connection")
 	nativeTunCmd.Flags().Uint16P("initial-packet-size", "i", 1242, "Initial packet size for MASQUE connection")
 	nativeTunCmd.Flags().BoolP("no-iproute2", "I", false, "Linux only: Do not set up IP addresses and do not set the link up")
 	nativeTunCmd.Flags().DurationP("reconnect-delay", "r", 1*time.Second, "Delay between reconnect attempts")
+	nativeTunCmd.Flags().Duration("rotate-interval", 0, "Replace the MASQUE session make-before-break at this interval (0 disables)")
+	nativeTunCmd.Flags().Duration("drain-period", 5*time.Second, "How long a replaced MASQUE session keeps delivering in-flight packets")
+	nativeTunCmd.Flags().Bool("on-demand", false, "Only connect the MASQUE tunnel when there is traffic")
+	nativeTunCmd.Flags().Duration("idle-timeout", 5*time.Minute, "Disconnect an on-demand MASQUE tunnel after this long without traffic (0 disables)")
+	nativeTunCmd.Flags().Bool("apply-policy", false, "Route the split tunnel ranges of the device policy into the TUN device")
 	nativeTunCmd.Flags().StringP("interface-name", "n", "", "Custom inteface name for the TUN interface")
 	rootCmd.AddCommand(nativeTunCmd)
 }
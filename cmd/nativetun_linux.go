@@ -8,7 +8,6 @@ import (
 	"net"
 
 	"github.com/Diniboy1123/usque/api"
-	"github.com/Diniboy1123/usque/config"
 	"github.com/songgao/water"
 	"github.com/vishvananda/netlink"
 )
@@ -40,7 +39,7 @@ func (t *tunDevice) create() (api.TunnelDevice, error) {
 		if t.ipv4 {
 			if err := netlink.AddrAdd(link, &netlink.Addr{
 				IPNet: &net.IPNet{
-					IP:   net.ParseIP(config.AppConfig.IPv4),
+					IP:   net.ParseIP(t.ipv4Addr),
 					Mask: net.CIDRMask(32, 32),
 				}}); err != nil {
 				return nil, fmt.Errorf("failed to add IPv4 address: %v", err)
@@ -49,7 +48,7 @@ func (t *tunDevice) create() (api.TunnelDevice, error) {
 		if t.ipv6 {
 			if err := netlink.AddrAdd(link, &netlink.Addr{
 				IPNet: &net.IPNet{
-					IP:   net.ParseIP(config.AppConfig.IPv6),
+					IP:   net.ParseIP(t.ipv6Addr),
 					Mask: net.CIDRMask(128, 128),
 				}}); err != nil {
 				return nil, fmt.Errorf("failed to add IPv6 address: %v", err)
@@ -58,11 +57,30 @@ func (t *tunDevice) create() (api.TunnelDevice, error) {
 		if err := netlink.LinkSetUp(link); err != nil {
 			return nil, fmt.Errorf("failed to set link up: %v", err)
 		}
+		for _, route := range t.routes {
+			if err := netlink.RouteReplace(&netlink.Route{
+				LinkIndex: link.Attrs().Index,
+				Dst: &net.IPNet{
+					IP:   route.Addr().AsSlice(),
+					Mask: net.CIDRMask(route.Bits(), route.Addr().BitLen()),
+				}}); err != nil {
+				return nil, fmt.Errorf("failed to add route %s: %v", route, err)
+			}
+		}
+		if len(t.routes) > 0 {
+			log.Printf("Added %d routes from the policy", len(t.routes))
+		}
 	} else {
 		log.Println("Skipping IP address and link setup. You should set the link up manually.")
 		log.Println("Config has the following IP addresses:")
-		log.Printf("IPv4: %s", config.AppConfig.IPv4)
-		log.Printf("IPv6: %s", config.AppConfig.IPv6)
+		log.Printf("IPv4: %s", t.ipv4Addr)
+		log.Printf("IPv6: %s", t.ipv6Addr)
+		if len(t.routes) > 0 {
+			log.Println("Policy asks for the following routes:")
+			for _, route := range t.routes {
+				log.Printf("Route: %s", route)
+			}
+		}
 	}
 
 	return api.NewWaterAdapter(dev), nil
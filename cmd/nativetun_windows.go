@@ -4,9 +4,9 @@ package cmd
 
 import (
 	"fmt"
+	"log"
 
 	"github.com/Diniboy1123/usque/api"
-	"github.com/Diniboy1123/usque/config"
 	"github.com/Diniboy1123/usque/internal"
 	"golang.zx2c4.com/wireguard/tun"
 )
@@ -30,7 +30,7 @@ func (t *tunDevice) create() (api.TunnelDevice, error) {
 	}
 
 	if t.ipv4 {
-		err = internal.SetIPv4Address(t.name, config.AppConfig.IPv4, "255.255.255.255")
+		err = internal.SetIPv4Address(t.name, t.ipv4Addr, "255.255.255.255")
 		if err != nil {
 			return nil, fmt.Errorf("failed to set IPv4 address: %v", err)
 		}
@@ -42,7 +42,7 @@ func (t *tunDevice) create() (api.TunnelDevice, error) {
 	}
 
 	if t.ipv6 {
-		err = internal.SetIPv6Address(t.name, config.AppConfig.IPv6, "128")
+		err = internal.SetIPv6Address(t.name, t.ipv6Addr, "128")
 		if err != nil {
 			return nil, fmt.Errorf("failed to set IPv6 address: %v", err)
 		}
@@ -53,5 +53,14 @@ func (t *tunDevice) create() (api.TunnelDevice, error) {
 		}
 	}
 
+	for _, route := range t.routes {
+		if err := internal.AddRoute(t.name, route); err != nil {
+			return nil, fmt.Errorf("failed to add route %s: %v", route, err)
+		}
+	}
+	if len(t.routes) > 0 {
+		log.Printf("Added %d routes from the policy", len(t.routes))
+	}
+
 	return api.NewNetstackAdapter(dev), nil
 }
@@ -0,0 +1,353 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/Diniboy1123/usque/models"
+	"github.com/spf13/cobra"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+var policyCmd = &cobra.Command{
+	Use:   "policy",
+	Short: "Show the device policy (split tunnel, fallback domains)",
+	Long: "Fetches the device policy of the registration. ZeroTrust organizations use it to hand out" +
+		" split tunnel include/exclude lists and local domain fallback. Tunnel commands apply it with --apply-policy.",
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		asJson, err := cmd.Flags().GetBool("json")
+		if err != nil {
+			log.Fatalf("Failed to get json flag: %v", err)
+		}
+
+		withAPI(cmd, func(cfg *config.Config, profile api.ClientProfile, httpClient *http.Client) {
+			policy, apiErr, err := api.GetPolicy(cmd.Context(), httpClient, profile, configAccount(cfg))
+			if err != nil {
+				fatalAPIError("Failed to get policy", apiErr, err)
+			}
+
+			if asJson {
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				if err := encoder.Encode(policy); err != nil {
+					log.Fatalf("Failed to encode policy: %v", err)
+				}
+				return
+			}
+
+			printPolicy(policy)
+		})
+	},
+}
+
+// printPolicy prints a device policy as a table.
+//
+// Parameters:
+//   - policy: models.Policy - The policy to print.
+func printPolicy(policy models.Policy) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	row := func(key, value string) {
+		if value == "" {
+			value = "-"
+		}
+		fmt.Fprintf(w, "%s:\t%s\n", key, value)
+	}
+	entry := func(e models.SplitTunnelEntry) string {
+		target := e.Address
+		if target == "" {
+			target = e.Host
+		}
+		if e.Description != "" {
+			target += " (" + e.Description + ")"
+		}
+		return target
+	}
+
+	row("Tunnel protocol", policy.TunnelProtocol)
+	row("Organization", policy.Organization)
+	if policy.ServiceMode != nil {
+		row("Service mode", policy.ServiceMode.Mode)
+	}
+
+	switch {
+	case len(policy.Include) > 0:
+		row("Split tunnel", "include")
+		for _, e := range policy.Include {
+			row("  Include", entry(e))
+		}
+	case len(policy.Exclude) > 0:
+		row("Split tunnel", "exclude")
+		for _, e := range policy.Exclude {
+			row("  Exclude", entry(e))
+		}
+	default:
+		row("Split tunnel", "")
+	}
+
+	for _, domain := range policy.FallbackDomains {
+		servers := strings.Join(domain.DNSServer, ", ")
+		if servers == "" {
+			servers = "system resolver"
+		}
+		row("Fallback "+domain.Suffix, servers)
+	}
+
+	w.Flush()
+}
+
+// fetchPolicy fetches the device policy for a tunnel command if the apply-policy flag is set.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The running command.
+//
+// Returns:
+//   - *internal.SplitTunnel: The split tunnel of the policy, nil if it has none or the flag is not set.
+//   - *internal.FallbackDNS: The fallback domains of the policy, nil if it has none or the flag is not set.
+//   - error: An error if the flag can't be read or the policy can't be fetched or parsed.
+func fetchPolicy(cmd *cobra.Command) (*internal.SplitTunnel, *internal.FallbackDNS, error) {
+	apply, err := cmd.Flags().GetBool("apply-policy")
+	if err != nil || !apply {
+		return nil, nil, err
+	}
+
+	profile, err := clientProfile(cmd)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get client profile: %v", err)
+	}
+
+	httpClient, closeClient, err := apiHTTPClient(cmd)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to set up API client: %v", err)
+	}
+	defer closeClient()
+
+	policy, apiErr, err := api.GetPolicy(cmd.Context(), httpClient, profile, configAccount(commandConfig(cmd)))
+	if err != nil {
+		if apiErr != nil {
+			return nil, nil, fmt.Errorf("%v (API errors: %s)", err, apiErr.ErrorsAsString("; "))
+		}
+		return nil, nil, err
+	}
+
+	split, err := internal.NewSplitTunnel(policy)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid split tunnel list: %v", err)
+	}
+
+	fallback, err := internal.NewFallbackDNS(policy)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid fallback domains: %v", err)
+	}
+
+	switch {
+	case split == nil:
+		log.Println("Policy has no split tunnel list, all traffic uses the tunnel")
+	case split.Include():
+		log.Printf("Policy includes %d addresses and %d hosts, other traffic bypasses the tunnel", len(split.Prefixes()), len(split.Domains()))
+	default:
+		log.Printf("Policy excludes %d addresses and %d hosts from the tunnel", len(split.Prefixes()), len(split.Domains()))
+	}
+	if fallback != nil {
+		log.Printf("Policy has %d fallback domains", len(policy.FallbackDomains))
+	}
+
+	return split, fallback, nil
+}
+
+// proxyACL reads the client and destination ACL from the flags of a proxy command.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The running command.
+//
+// Returns:
+//   - *internal.ACL: The ACL, nil if it allows everything.
+//   - error: An error if a flag can't be read or holds an invalid entry.
+func proxyACL(cmd *cobra.Command) (*internal.ACL, error) {
+	allowClients, err := cmd.Flags().GetStringArray("allow-client")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get allowed clients: %v", err)
+	}
+	denyDests, err := cmd.Flags().GetStringArray("deny-dest")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get denied destinations: %v", err)
+	}
+
+	acl, err := internal.NewACL(allowClients, denyDests)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ACL: %v", err)
+	}
+
+	return acl, nil
+}
+
+// errDestinationDenied is returned for connections to destinations the ACL refuses.
+var errDestinationDenied = errors.New("destination refused by the ACL")
+
+// policyRouter sends proxied connections and DNS lookups through the tunnel or the system
+// network according to a device policy, and refuses destinations the ACL denies. A zero
+// policyRouter tunnels everything.
+type policyRouter struct {
+	split    *internal.SplitTunnel
+	fallback *internal.FallbackDNS
+	acl      *internal.ACL
+	tunNet   *netstack.Net
+	timeout  time.Duration
+}
+
+// lookup resolves a host. Hosts in a fallback domain are resolved with its DNS servers over
+// the system network, hosts excluded from the tunnel with the system resolver and all others
+// with tunnelLookup.
+//
+// Parameters:
+//   - ctx: context.Context - Cancels the lookup.
+//   - host: string - The host name to resolve.
+//   - tunnelLookup: func(context.Context, string) ([]net.IP, error) - The default lookup.
+//
+// Returns:
+//   - []net.IP: The addresses of the host.
+//   - error: An error if the lookup fails.
+func (p *policyRouter) lookup(ctx context.Context, host string, tunnelLookup func(context.Context, string) ([]net.IP, error)) ([]net.IP, error) {
+	var (
+		ips []net.IP
+		err error
+	)
+
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	servers, fallback := []netip.Addr(nil), false
+	if p.fallback != nil {
+		servers, fallback = p.fallback.Match(host)
+	}
+
+	switch {
+	case fallback && len(servers) > 0:
+		ips, err = internal.NewStaticResolver(servers).LookupIP(ctx, "ip", host)
+	case fallback, p.split != nil && !p.split.Include() && p.split.MatchesHost(host):
+		ips, err = net.DefaultResolver.LookupIP(ctx, "ip", host)
+	default:
+		ips, err = tunnelLookup(ctx, host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if p.split != nil {
+		p.split.Learn(host, ips)
+	}
+
+	return ips, nil
+}
+
+// dial connects to an address through the tunnel, or over the system network if the
+// policy keeps the address out of the tunnel. Destinations the ACL denies are refused, as
+// are host names if it denies any destination.
+//
+// Parameters:
+//   - ctx: context.Context - Cancels the dial.
+//   - network: string - The network to dial. (e.g., "tcp")
+//   - addr: string - The address to dial.
+//
+// Returns:
+//   - net.Conn: The connection.
+//   - error: An error if the ACL refuses the destination or the connection fails.
+func (p *policyRouter) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	var ip netip.Addr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		ip, _ = netip.ParseAddr(host)
+	}
+
+	if p.acl.FiltersDests() && (!ip.IsValid() || !p.acl.AllowsDest(ip)) {
+		return nil, fmt.Errorf("%s: %w", addr, errDestinationDenied)
+	}
+
+	if p.split != nil && ip.IsValid() && !p.split.Tunneled(ip) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	return p.tunNet.DialContext(ctx, network, addr)
+}
+
+// policyResolver applies a policyRouter to the name resolution of the SOCKS proxy.
+type policyResolver struct {
+	router *policyRouter
+	next   internal.TunnelDNSResolver
+}
+
+// Resolve implements socks5.NameResolver.
+func (r policyResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	ips, err := r.router.lookup(ctx, name, func(ctx context.Context, host string) ([]net.IP, error) {
+		_, ip, err := r.next.Resolve(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		return []net.IP{ip}, nil
+	})
+	if err != nil {
+		return ctx, nil, err
+	}
+
+	return ctx, ips[0], nil
+}
+
+// policyRoutes computes the routes to point at the TUN device for a split tunnel.
+//
+// Parameters:
+//   - cfg: *config.Config - The config of the tunnel.
+//   - split: *internal.SplitTunnel - The split tunnel of the policy.
+//   - fallback: *internal.FallbackDNS - The fallback domains of the policy. (optional)
+//   - ipv4: bool - Whether IPv4 is tunneled.
+//   - ipv6: bool - Whether IPv6 is tunneled.
+//
+// Returns:
+//   - []netip.Prefix: The routes. The MASQUE endpoints and fallback DNS servers are never included.
+func policyRoutes(cfg *config.Config, split *internal.SplitTunnel, fallback *internal.FallbackDNS, ipv4, ipv6 bool) []netip.Prefix {
+	var base []netip.Prefix
+	if ipv4 {
+		base = append(base, netip.MustParsePrefix("0.0.0.0/0"))
+	}
+	if ipv6 {
+		base = append(base, netip.MustParsePrefix("::/0"))
+	}
+
+	var exclude []netip.Prefix
+	for _, endpoint := range []string{cfg.EndpointV4, cfg.EndpointV6} {
+		if addr, err := netip.ParseAddr(endpoint); err == nil {
+			exclude = append(exclude, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+	if fallback != nil {
+		for _, server := range fallback.Servers() {
+			exclude = append(exclude, netip.PrefixFrom(server, server.BitLen()))
+		}
+	}
+
+	if len(split.Domains()) > 0 {
+		log.Printf("Skipping %d host entries of the split tunnel list, only addresses can be routed", len(split.Domains()))
+	}
+
+	return split.Routes(base, exclude)
+}
+
+func init() {
+	policyCmd.Flags().Bool("json", false, "Print the raw policy as JSON")
+	rootCmd.AddCommand(policyCmd)
+}
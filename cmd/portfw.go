@@ -8,10 +8,10 @@ import (
 	"net"
 	"net/http"
 	"net/netip"
+	"slices"
+	"sync/atomic"
 	"time"
 
-	"github.com/Diniboy1123/usque/api"
-	"github.com/Diniboy1123/usque/config"
 	"github.com/Diniboy1123/usque/internal"
 	"github.com/spf13/cobra"
 	"golang.zx2c4.com/wireguard/tun/netstack"
@@ -24,216 +24,145 @@ var portFwCmd = &cobra.Command{
 		" It creates a virtual TUN device and forward ports through it either from or to the client. It works a bit like SSH port forwarding. TCP only at the moment." +
 		"Doesn't require elevated privileges.",
 	Run: func(cmd *cobra.Command, args []string) {
-		if !config.ConfigLoaded {
+		cfg := commandConfig(cmd)
+		if cfg == nil {
 			cmd.Println("Config not loaded. Please register first.")
 			return
 		}
 
-		sni, err := cmd.Flags().GetString("sni-address")
+		mappings, err := portMappings(cmd)
 		if err != nil {
-			cmd.Printf("Failed to get SNI address: %v\n", err)
+			cmd.Printf("Failed to get port mappings: %v\n", err)
 			return
 		}
 
-		privKey, err := config.AppConfig.GetEcPrivateKey()
+		tunnel, err := tunnelClient(cmd)
 		if err != nil {
-			cmd.Printf("Failed to get private key: %v\n", err)
-			return
-		}
-		peerPubKey, err := config.AppConfig.GetEcEndpointPublicKey()
-		if err != nil {
-			cmd.Printf("Failed to get public key: %v\n", err)
-			return
-		}
-
-		cert, err := internal.GenerateCert(privKey, &privKey.PublicKey)
-		if err != nil {
-			cmd.Printf("Failed to generate cert: %v\n", err)
-			return
-		}
-
-		tlsConfig, err := api.PrepareTlsConfig(privKey, peerPubKey, cert, sni)
-		if err != nil {
-			cmd.Printf("Failed to prepare TLS config: %v\n", err)
-			return
-		}
-
-		keepalivePeriod, err := cmd.Flags().GetDuration("keepalive-period")
-		if err != nil {
-			cmd.Printf("Failed to get keepalive period: %v\n", err)
-			return
-		}
-		initialPacketSize, err := cmd.Flags().GetUint16("initial-packet-size")
-		if err != nil {
-			cmd.Printf("Failed to get initial packet size: %v\n", err)
-			return
-		}
-
-		connectPort, err := cmd.Flags().GetInt("connect-port")
-		if err != nil {
-			cmd.Printf("Failed to get connect port: %v\n", err)
+			cmd.Printf("Failed to set up tunnel: %v\n", err)
 			return
 		}
+		defer tunnel.Close()
+		runTunnel(tunnel)
+		tunNet := tunnel.Net()
 
-		var endpoint *net.UDPAddr
-		if ipv6, err := cmd.Flags().GetBool("ipv6"); err == nil && !ipv6 {
-			endpoint = &net.UDPAddr{
-				IP:   net.ParseIP(config.AppConfig.EndpointV4),
-				Port: connectPort,
-			}
-		} else {
-			endpoint = &net.UDPAddr{
-				IP:   net.ParseIP(config.AppConfig.EndpointV6),
-				Port: connectPort,
-			}
-		}
+		log.Printf("Virtual tunnel created, forwarding ports")
 
-		tunnelIPv4, err := cmd.Flags().GetBool("no-tunnel-ipv4")
-		if err != nil {
-			cmd.Printf("Failed to get no tunnel IPv4: %v\n", err)
-			return
-		}
+		forwarder := &portForwarder{tunNet: tunNet, running: make(map[portForward]func())}
+		forwarder.apply(mappings)
 
-		tunnelIPv6, err := cmd.Flags().GetBool("no-tunnel-ipv6")
-		if err != nil {
-			cmd.Printf("Failed to get no tunnel IPv6: %v\n", err)
-			return
-		}
-
-		var localAddresses []netip.Addr
-		if !tunnelIPv4 {
-			v4, err := netip.ParseAddr(config.AppConfig.IPv4)
-			if err != nil {
-				cmd.Printf("Failed to parse IPv4 address: %v\n", err)
-				return
-			}
-			localAddresses = append(localAddresses, v4)
-		}
-		if !tunnelIPv6 {
-			v6, err := netip.ParseAddr(config.AppConfig.IPv6)
+		// Removed mappings stop listening, their open connections are kept.
+		watchReload(cmd, []string{"local-ports", "remote-ports"}, func() error {
+			mappings, err := portMappings(cmd)
 			if err != nil {
-				cmd.Printf("Failed to parse IPv6 address: %v\n", err)
-				return
+				return err
 			}
-			localAddresses = append(localAddresses, v6)
-		}
-
-		dnsServers, err := cmd.Flags().GetStringArray("dns")
-		if err != nil {
-			cmd.Printf("Failed to get DNS servers: %v\n", err)
-			return
-		}
+			forwarder.apply(mappings)
+			return nil
+		})
 
-		var dnsAddrs []netip.Addr
-		for _, dns := range dnsServers {
-			addr, err := netip.ParseAddr(dns)
-			if err != nil {
-				cmd.Printf("Failed to parse DNS server: %v\n", err)
-				return
-			}
-			dnsAddrs = append(dnsAddrs, addr)
+		// One packet must be sent in order to listen for incoming packets
+		// a ping may suffice as well, but we will use a simple GET request
+		client := &http.Client{
+			Transport: &http.Transport{
+				DialContext: tunNet.DialContext,
+			},
 		}
-
-		mtu, err := cmd.Flags().GetInt("mtu")
+		resp, err := client.Get("https://cloudflareok.com/test")
 		if err != nil {
-			cmd.Printf("Failed to get MTU: %v\n", err)
+			cmd.Printf("Failed to make request to cloudflare.com: %v\n", err)
 			return
 		}
-		if mtu != 1280 {
-			log.Println("Warning: MTU is not the default 1280. This is not supported. Packet loss and other issues may occur.")
-		}
-
-		localPorts, err := cmd.Flags().GetStringArray("local-ports")
-		if err != nil {
-			cmd.Printf("Failed to get local ports: %v\n", err)
+		defer resp.Body.Close()
+		if resp.StatusCode != 204 {
+			cmd.Printf("Failed to make request to cloudflare.com: %s\n", resp.Status)
 			return
 		}
+		log.Println("Successfully connected to Cloudflare")
 
-		remotePorts, err := cmd.Flags().GetStringArray("remote-ports")
-		if err != nil {
-			cmd.Printf("Failed to get remote ports: %v\n", err)
-			return
-		}
+		select {}
+	},
+}
 
-		var localPortMappings []internal.PortMapping
-		var remotePortMappings []internal.PortMapping
+// portForward is a port mapping and its direction.
+type portForward struct {
+	mapping  internal.PortMapping
+	isRemote bool // Listens inside the tunnel (-R) instead of on the local machine (-L)
+}
 
-		for _, port := range localPorts {
-			portMapping, err := internal.ParsePortMapping(port)
-			if err != nil {
-				cmd.Printf("Failed to parse local port mapping: %v\n", err)
-				return
-			}
-			localPortMappings = append(localPortMappings, portMapping)
-		}
+// portMappings parses the port mappings given with the local-ports and remote-ports flags.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The running command.
+//
+// Returns:
+//   - []portForward: The local mappings followed by the remote ones.
+//   - error: An error if a flag can't be read or a mapping is invalid.
+func portMappings(cmd *cobra.Command) ([]portForward, error) {
+	localPorts, err := cmd.Flags().GetStringArray("local-ports")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get local ports: %v", err)
+	}
 
-		for _, port := range remotePorts {
-			portMapping, err := internal.ParsePortMapping(port)
-			if err != nil {
-				cmd.Printf("Failed to parse remote port mapping: %v\n", err)
-				return
-			}
-			remotePortMappings = append(remotePortMappings, portMapping)
-		}
+	remotePorts, err := cmd.Flags().GetStringArray("remote-ports")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get remote ports: %v", err)
+	}
 
-		reconnectDelay, err := cmd.Flags().GetDuration("reconnect-delay")
+	var forwards []portForward
+	for _, port := range localPorts {
+		portMapping, err := internal.ParsePortMapping(port)
 		if err != nil {
-			cmd.Printf("Failed to get reconnect delay: %v\n", err)
-			return
+			return nil, fmt.Errorf("failed to parse local port mapping: %v", err)
 		}
+		forwards = append(forwards, portForward{mapping: portMapping})
+	}
 
-		tunDev, tunNet, err := netstack.CreateNetTUN(localAddresses, dnsAddrs, mtu)
+	for _, port := range remotePorts {
+		portMapping, err := internal.ParsePortMapping(port)
 		if err != nil {
-			cmd.Printf("Failed to create virtual TUN device: %v\n", err)
-			return
+			return nil, fmt.Errorf("failed to parse remote port mapping: %v", err)
 		}
-		defer tunDev.Close()
+		forwards = append(forwards, portForward{mapping: portMapping, isRemote: true})
+	}
 
-		go api.MaintainTunnel(context.Background(), tlsConfig, keepalivePeriod, initialPacketSize, endpoint, api.NewNetstackAdapter(tunDev), mtu, reconnectDelay)
+	return forwards, nil
+}
 
-		log.Printf("Virtual tunnel created, forwarding ports")
+// portForwarder runs the port mappings of the portfw command.
+type portForwarder struct {
+	tunNet  *netstack.Net
+	running map[portForward]func() // Stops the listener of a running mapping
+}
 
-		// Start Local Port Forwarding (-L)
-		for _, pm := range localPortMappings {
-			go func(pm internal.PortMapping) {
-				err := forwardPort(tunNet, pm, false) // false = local forwarding
-				if err != nil {
-					cmd.Printf("Error in local forwarding %d: %v\n", pm.LocalPort, err)
-				}
-			}(pm)
+// apply starts the mappings that aren't running yet and stops the running ones that are
+// no longer given. Mappings that fail to listen are logged and retried by the next apply.
+//
+// Parameters:
+//   - forwards: []portForward - The mappings to run.
+func (f *portForwarder) apply(forwards []portForward) {
+	for forward, stop := range f.running {
+		if !slices.Contains(forwards, forward) {
+			stop()
+			delete(f.running, forward)
 		}
+	}
 
-		// Start Remote Port Forwarding (-R)
-		for _, pm := range remotePortMappings {
-			go func(pm internal.PortMapping) {
-				err := forwardPort(tunNet, pm, true) // true = remote forwarding
-				if err != nil {
-					cmd.Printf("Error in remote forwarding %d: %v\n", pm.LocalPort, err)
-				}
-			}(pm)
+	for _, forward := range forwards {
+		if _, ok := f.running[forward]; ok {
+			continue
 		}
 
-		// One packet must be sent in order to listen for incoming packets
-		// a ping may suffice as well, but we will use a simple GET request
-		client := &http.Client{
-			Transport: &http.Transport{
-				DialContext: tunNet.DialContext,
-			},
-		}
-		resp, err := client.Get("https://cloudflareok.com/test")
+		stop, err := forwardPort(f.tunNet, forward.mapping, forward.isRemote)
 		if err != nil {
-			cmd.Printf("Failed to make request to cloudflare.com: %v\n", err)
-			return
-		}
-		defer resp.Body.Close()
-		if resp.StatusCode != 204 {
-			cmd.Printf("Failed to make request to cloudflare.com: %s\n", resp.Status)
-			return
+			if forward.isRemote {
+				log.Printf("Error in remote forwarding %d: %v", forward.mapping.LocalPort, err)
+			} else {
+				log.Printf("Error in local forwarding %d: %v", forward.mapping.LocalPort, err)
+			}
+			continue
 		}
-		log.Println("Successfully connected to Cloudflare")
-
-		select {}
-	},
+		f.running[forward] = stop
+	}
 }
 
 // forwardPort sets up a local or remote port forwarding using either the MASQUE tunnel or the local network.
@@ -244,52 +173,54 @@ var portFwCmd = &cobra.Command{
 //   - isRemote: bool - Indicates whether the forwarding is remote (true) or local (false).
 //
 // Returns:
-//   - error: An error if port forwarding fails; otherwise, nil.
-func forwardPort(netstackNet *netstack.Net, pm internal.PortMapping, isRemote bool) error {
+//   - func(): Stops listening. Connections already accepted are kept.
+//   - error: An error if listening fails; otherwise, nil.
+func forwardPort(netstackNet *netstack.Net, pm internal.PortMapping, isRemote bool) (func(), error) {
 	localAddrPort, err := netip.ParseAddrPort(fmt.Sprintf("%s:%d", pm.BindAddress, pm.LocalPort))
 	if err != nil {
-		return fmt.Errorf("invalid local address: %w", err)
+		return nil, fmt.Errorf("invalid local address: %w", err)
 	}
 
+	var listener net.Listener
 	if isRemote {
 		// Remote forwarding: Listen inside the MASQUE tunnel
-		listener, err := netstackNet.ListenTCPAddrPort(localAddrPort)
+		listener, err = netstackNet.ListenTCPAddrPort(localAddrPort)
 		if err != nil {
-			return fmt.Errorf("failed to listen on %s: %w", localAddrPort, err)
+			return nil, fmt.Errorf("failed to listen on %s: %w", localAddrPort, err)
 		}
-		defer listener.Close()
 
 		log.Printf("Remote forwarding: Listening on MASQUE network %s, forwarding to local %s:%d", localAddrPort, pm.RemoteIP, pm.RemotePort)
-
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				log.Printf("Accept error on %s: %v", localAddrPort, err)
-				continue
-			}
-
-			go handleConnection(conn, pm, isRemote, netstackNet)
-		}
 	} else {
 		// Local forwarding: Listen on local machine
-		listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", pm.BindAddress, pm.LocalPort))
+		listener, err = net.Listen("tcp", fmt.Sprintf("%s:%d", pm.BindAddress, pm.LocalPort))
 		if err != nil {
-			return fmt.Errorf("failed to listen on %s:%d: %w", pm.BindAddress, pm.LocalPort, err)
+			return nil, fmt.Errorf("failed to listen on %s:%d: %w", pm.BindAddress, pm.LocalPort, err)
 		}
-		defer listener.Close()
 
 		log.Printf("Local forwarding: Listening on %s:%d, forwarding to remote %s:%d", pm.BindAddress, pm.LocalPort, pm.RemoteIP, pm.RemotePort)
+	}
 
+	var stopped atomic.Bool
+	go func() {
 		for {
 			conn, err := listener.Accept()
 			if err != nil {
-				log.Printf("Accept error on %s:%d: %v", pm.BindAddress, pm.LocalPort, err)
+				if stopped.Load() {
+					return
+				}
+				log.Printf("Accept error on %s: %v", listener.Addr(), err)
 				continue
 			}
 
 			go handleConnection(conn, pm, isRemote, netstackNet)
 		}
-	}
+	}()
+
+	return func() {
+		stopped.Store(true)
+		listener.Close()
+		log.Printf("Stopped forwarding %s", listener.Addr())
+	}, nil
 }
 
 // handleConnection manages an individual forwarded connection between the local and remote endpoints.
@@ -335,10 +266,15 @@ func init() {
 	portFwCmd.Flags().BoolP("ipv6", "6", false, "Use IPv6 for MASQUE connection")
 	portFwCmd.Flags().BoolP("no-tunnel-ipv4", "F", false, "Disable IPv4 inside the MASQUE tunnel")
 	portFwCmd.Flags().BoolP("no-tunnel-ipv6", "S", false, "Disable IPv6 inside the MASQUE tunnel")
-	portFwCmd.Flags().StringP("sni-address", "s", internal.ConnectSNI, "SNI address to use for MASQUE connection")
+	portFwCmd.Flags().StringP("sni-address", "s", "", "SNI address to use for MASQUE connection (default: "+internal.ZeroTierSNI+" for Zero Trust accounts, "+internal.ConnectSNI+" otherwise)")
+	portFwCmd.Flags().String("connect-uri", "", "Use standard RFC 9484 connect-ip with this URI template instead of Cloudflare (e.g. https://proxy.example.com/.well-known/masque/ip/{target}/{ipproto}/)")
 	portFwCmd.Flags().DurationP("keepalive-period", "k", 30*time.Second, "Keepalive period for MASQUE connection")
 	portFwCmd.Flags().IntP("mtu", "m", 1280, "MTU for MASQUE connection")
 	portFwCmd.Flags().Uint16P("initial-packet-size", "i", 1242, "Initial packet size for MASQUE connection")
 	portFwCmd.Flags().DurationP("reconnect-delay", "r", 1*time.Second, "Delay between reconnect attempts")
+	portFwCmd.Flags().Duration("rotate-interval", 0, "Replace the MASQUE session make-before-break at this interval (0 disables)")
+	portFwCmd.Flags().Duration("drain-period", 5*time.Second, "How long a replaced MASQUE session keeps delivering in-flight packets")
+	portFwCmd.Flags().Bool("on-demand", false, "Only connect the MASQUE tunnel when there is traffic")
+	portFwCmd.Flags().Duration("idle-timeout", 5*time.Minute, "Disconnect an on-demand MASQUE tunnel after this long without traffic (0 disables)")
 	rootCmd.AddCommand(portFwCmd)
 }
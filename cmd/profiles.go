@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/Diniboy1123/usque/config"
+	"github.com/spf13/cobra"
+)
+
+var profilesCmd = &cobra.Command{
+	Use:   "profiles",
+	Short: "Manage the named profiles of the config file",
+	Long: "A config file can hold several identities, e.g. a personal and a Zero Trust one. The top level is the" +
+		" \"" + config.DefaultProfile + "\" profile, further ones are stored under \"profiles\". Every command" +
+		" selects one with --profile, register, enroll and import write to the selected one.",
+}
+
+var profilesListCmd = &cobra.Command{
+	Use:         "list",
+	Short:       "List the profiles of the config file",
+	Annotations: noSecrets,
+	Args:        cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		loaded := commandState(cmd)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "\tNAME\tID\tTYPE\tIPV4\tIPV6")
+		for _, name := range loaded.file.ProfileNames() {
+			profile, _ := loaded.file.Profile(name)
+
+			current := ""
+			if name == loaded.profile {
+				current = "*"
+			}
+			if name == loaded.file.SelectedProfile {
+				name += " (default)"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", current, name, orDash(profile.ID), orDash(profile.AccountType),
+				orDash(profile.IPv4), orDash(profile.IPv6))
+		}
+		w.Flush()
+	},
+}
+
+var profilesAddCmd = &cobra.Command{
+	Use:   "add <name> [config-file]",
+	Short: "Add a profile, empty or copied from another config file",
+	Long: "Adds a profile to the config file. With a config file argument its identity and settings are copied," +
+		" e.g. to merge a config written by an older version. Otherwise the profile is empty and can be filled" +
+		" with register --profile <name> or import --profile <name>.",
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		loaded := commandState(cmd)
+
+		configPath, err := cmd.Flags().GetString("config")
+		if err != nil {
+			log.Fatalf("Failed to get config path: %v", err)
+		}
+		if configPath == "" {
+			log.Fatalf("Config path is required")
+		}
+
+		makeDefault, err := cmd.Flags().GetBool("default")
+		if err != nil {
+			log.Fatalf("Failed to get default flag: %v", err)
+		}
+
+		name := args[0]
+		if existing, ok := loaded.file.Profile(name); ok && (name != config.DefaultProfile || existing.PrivateKey != "" || existing.Sealed != "") {
+			log.Fatalf("Profile %s already exists", name)
+		}
+
+		var profile config.Config
+		if len(args) == 2 {
+			profile, err = readProfile(args[1])
+			if err != nil {
+				log.Fatalf("Failed to read %s: %v", args[1], err)
+			}
+		}
+
+		loaded.file.SetProfile(name, profile)
+		if makeDefault {
+			loaded.file.SelectedProfile = name
+		}
+
+		if err := loaded.file.Save(configPath); err != nil {
+			log.Fatalf("Failed to save config: %v", err)
+		}
+
+		log.Printf("Added profile %s to %s", name, configPath)
+	},
+}
+
+var profilesRemoveCmd = &cobra.Command{
+	Use:   "remove <name>",
+	Short: "Remove a named profile from the config file",
+	Long: "Removes a named profile and its keys from the config file. The registration is not deleted from the" +
+		" server, run unregister --profile <name> first for that.",
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		loaded := commandState(cmd)
+
+		configPath, err := cmd.Flags().GetString("config")
+		if err != nil {
+			log.Fatalf("Failed to get config path: %v", err)
+		}
+		if configPath == "" {
+			log.Fatalf("Config path is required")
+		}
+
+		name := args[0]
+		if name == config.DefaultProfile {
+			log.Fatalf("The %s profile can't be removed, use the unregister command to wipe it", config.DefaultProfile)
+		}
+		if _, ok := loaded.file.Profiles[name]; !ok {
+			log.Fatalf("Profile %s not found in %s", name, configPath)
+		}
+
+		delete(loaded.file.Profiles, name)
+		if loaded.file.SelectedProfile == name {
+			loaded.file.SelectedProfile = ""
+		}
+
+		if err := loaded.file.Save(configPath); err != nil {
+			log.Fatalf("Failed to save config: %v", err)
+		}
+
+		log.Printf("Removed profile %s from %s", name, configPath)
+	},
+}
+
+// readProfile reads the selected profile of a config file, e.g. one written before named profiles existed.
+//
+// Parameters:
+//   - path: string - The path of the config file.
+//
+// Returns:
+//   - config.Config: The file's default_profile, or else its top level profile.
+//   - error: An error if the file can't be read or parsed.
+func readProfile(path string) (config.Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config.Config{}, err
+	}
+
+	var file config.File
+	if err := json.Unmarshal(data, &file); err != nil {
+		return config.Config{}, fmt.Errorf("failed to decode config file: %v", err)
+	}
+	if file.Encrypted() {
+		return config.Config{}, fmt.Errorf("config file is encrypted, decrypt it first")
+	}
+
+	name := file.SelectedProfile
+	if name == "" {
+		name = config.DefaultProfile
+	}
+	profile, ok := file.Profile(name)
+	if !ok {
+		return config.Config{}, fmt.Errorf("profile %q not found", name)
+	}
+
+	return profile, nil
+}
+
+// orDash returns a value for a table cell, a dash if it is empty.
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func init() {
+	profilesAddCmd.Flags().Bool("default", false, "Use the profile when --profile is not given")
+	profilesCmd.AddCommand(profilesListCmd)
+	profilesCmd.AddCommand(profilesAddCmd)
+	profilesCmd.AddCommand(profilesRemoveCmd)
+	rootCmd.AddCommand(profilesCmd)
+}
@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"log"
+	"net/http"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/spf13/cobra"
+)
+
+var refreshCmd = &cobra.Command{
+	Use:   "refresh",
+	Short: "Update endpoints and addresses from the server without re-enrolling",
+	Long: "Re-fetches the registration and updates the endpoints, assigned addresses, endpoint public key" +
+		" and license in the config. Unlike enroll, the device key is left alone.",
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		configPath, err := cmd.Flags().GetString("config")
+		if err != nil {
+			log.Fatalf("Failed to get config path: %v", err)
+		}
+		if configPath == "" {
+			log.Fatalf("Config path is required")
+		}
+
+		withAPI(cmd, func(cfg *config.Config, profile api.ClientProfile, httpClient *http.Client) {
+			account, apiErr, err := api.GetAccount(cmd.Context(), httpClient, profile, configAccount(cfg))
+			if err != nil {
+				fatalAPIError("Failed to get account", apiErr, err)
+			}
+
+			if account.TunType != internal.TunTypeMasque {
+				log.Printf("Warning: the device is in %s mode, run the enroll command to switch to MASQUE", account.TunType)
+			} else if privKey, err := cfg.GetEcPrivateKey(); err == nil {
+				if pubKey, err := x509.MarshalPKIXPublicKey(&privKey.PublicKey); err == nil && base64.StdEncoding.EncodeToString(pubKey) != account.Key {
+					log.Println("Warning: the enrolled key doesn't match the config, run the enroll command to enroll it again")
+				}
+			}
+
+			if err := applyAccountData(cfg, account); err != nil {
+				log.Fatalf("Failed to use account data: %v", err)
+			}
+
+			if err := cfg.SaveConfig(configPath); err != nil {
+				log.Fatalf("Failed to save config: %v", err)
+			}
+
+			log.Printf("Config refreshed (endpoint %s / %s, addresses %s / %s), saved to %s",
+				cfg.EndpointV4, cfg.EndpointV6, cfg.IPv4, cfg.IPv6, savedProfile(cfg, configPath))
+		})
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(refreshCmd)
+}
@@ -4,9 +4,9 @@ import (
 	"encoding/base64"
 	"fmt"
 	"log"
+	"net/http"
 
 	"github.com/Diniboy1123/usque/api"
-	"github.com/Diniboy1123/usque/config"
 	"github.com/Diniboy1123/usque/internal"
 	"github.com/spf13/cobra"
 )
@@ -17,7 +17,8 @@ var registerCmd = &cobra.Command{
 	Long: "Registers a new account and enrolls a device key. Also makes sure that it switches to" +
 		" MASQUE mode. Saves the config to a file.",
 	Run: func(cmd *cobra.Command, args []string) {
-		if config.ConfigLoaded {
+		cfg := commandConfig(cmd)
+		if cfg != nil && cfg.PrivateKey != "" {
 			fmt.Printf("You already have a config. Do you want to overwrite it? (y/n) ")
 			var response string
 			if _, err := fmt.Scanln(&response); err != nil {
@@ -56,58 +57,94 @@ var registerCmd = &cobra.Command{
 			log.Fatalf("Failed to get jwt: %v", err)
 		}
 
-		if jwt != "" {
-			log.Printf("Registering with locale %s and model %s using jwt authentication", locale, model)
-		} else {
-			log.Printf("Registering with locale %s and model %s", locale, model)
-		}
-
-		acceptTos, err := cmd.Flags().GetBool("accept-tos")
+		team, err := cmd.Flags().GetString("team")
 		if err != nil {
-			log.Fatalf("Failed to get accept-tos flag: %v", err)
+			log.Fatalf("Failed to get team: %v", err)
 		}
 
-		accountData, err := api.Register(model, locale, jwt, acceptTos)
+		teamCallback, err := cmd.Flags().GetString("team-callback")
 		if err != nil {
-			log.Fatalf("Failed to register: %v", err)
+			log.Fatalf("Failed to get team callback address: %v", err)
 		}
 
-		privKey, pubKey, err := internal.GenerateEcKeyPair()
+		acceptTos, err := cmd.Flags().GetBool("accept-tos")
 		if err != nil {
-			log.Fatalf("Failed to generate key pair: %v", err)
+			log.Fatalf("Failed to get accept-tos flag: %v", err)
 		}
 
-		log.Printf("Enrolling device key...")
+		clientID := apiSetting(cmd, "client-id", "USQUE_CLIENT_ID", "")
+		clientSecret := apiSetting(cmd, "client-secret", "USQUE_CLIENT_SECRET", "")
 
-		updatedAccountData, apiErr, err := api.EnrollKey(accountData, pubKey, deviceName)
-		if err != nil {
-			if apiErr != nil {
-				log.Fatalf("Failed to enroll key: %v (API errors: %s)", err, apiErr.ErrorsAsString("; "))
-			} else {
-				log.Fatalf("Failed to enroll key: %v", err)
+		if team != "" {
+			if jwt != "" || clientID != "" {
+				log.Fatalf("--team can't be combined with --jwt or a service token")
+			}
+
+			// The login reads stdin in the background, so ask for the TOS first.
+			if !acceptTos {
+				if err := api.ConfirmTos(); err != nil {
+					log.Fatalf("Failed to register: %v", err)
+				}
+				acceptTos = true
+			}
+
+			if jwt, err = teamLogin(cmd.Context(), team, teamCallback); err != nil {
+				log.Fatalf("Failed to log in to team %s: %v", team, err)
 			}
 		}
 
-		log.Printf("Successful registration. Saving config...")
-
-		config.AppConfig = config.Config{
-			PrivateKey: base64.StdEncoding.EncodeToString(privKey),
-			// TODO: proper endpoint parsing in utils
-			// strip :0
-			EndpointV4: updatedAccountData.Config.Peers[0].Endpoint.V4[:len(updatedAccountData.Config.Peers[0].Endpoint.V4)-2],
-			// strip [ from beginning and ]:0 from end
-			EndpointV6:     updatedAccountData.Config.Peers[0].Endpoint.V6[1 : len(updatedAccountData.Config.Peers[0].Endpoint.V6)-3],
-			EndpointPubKey: updatedAccountData.Config.Peers[0].PublicKey,
-			License:        updatedAccountData.Account.License,
-			ID:             updatedAccountData.ID,
-			AccessToken:    accountData.Token,
-			IPv4:           updatedAccountData.Config.Interface.Addresses.V4,
-			IPv6:           updatedAccountData.Config.Interface.Addresses.V6,
+		if jwt != "" {
+			log.Printf("Registering with locale %s and model %s using jwt authentication", locale, model)
+		} else if clientID != "" {
+			log.Printf("Registering with locale %s and model %s using service token %s", locale, model, clientID)
+		} else {
+			log.Printf("Registering with locale %s and model %s", locale, model)
 		}
 
-		config.AppConfig.SaveConfig(configPath)
+		withAPIClient(cmd, func(profile api.ClientProfile, httpClient *http.Client) {
+			accountData, apiErr, err := api.Register(cmd.Context(), httpClient, profile, model, locale, api.TeamAuth{
+				JWT:          jwt,
+				ClientID:     clientID,
+				ClientSecret: clientSecret,
+			}, acceptTos)
+			if err != nil {
+				fatalAPIError("Failed to register", apiErr, err)
+			}
+
+			privKey, pubKey, err := internal.GenerateEcKeyPair()
+			if err != nil {
+				log.Fatalf("Failed to generate key pair: %v", err)
+			}
+
+			log.Printf("Enrolling device key...")
+
+			updatedAccountData, apiErr, err := api.EnrollKey(cmd.Context(), httpClient, profile, accountData, pubKey, deviceName)
+			if err != nil {
+				fatalAPIError("Failed to enroll key", apiErr, err)
+			}
+
+			log.Printf("Successful registration. Saving config...")
+
+			newConfig := newCommandConfig(cmd)
+			newConfig.PrivateKey = base64.StdEncoding.EncodeToString(privKey)
+			newConfig.AccessToken = accountData.Token
+			if cfg != nil {
+				newConfig.APISettings = cfg.APISettings
+				newConfig.Settings = cfg.Settings
+			}
+			if err := applyAccountData(newConfig, updatedAccountData); err != nil {
+				log.Fatalf("Failed to use account data: %v", err)
+			}
+
+			if err := newConfig.SaveConfig(configPath); err != nil {
+				log.Fatalf("Failed to save config: %v", err)
+			}
 
-		log.Printf("Config saved to %s", configPath)
+			log.Printf("Config saved to %s", savedProfile(newConfig, configPath))
+			if newConfig.AccountType == internal.AccountTypeTeam {
+				log.Printf("Registered to a Zero Trust organization, tunnels will use %s as SNI by default", internal.ZeroTierSNI)
+			}
+		})
 	},
 }
 
@@ -116,6 +153,10 @@ func init() {
 	registerCmd.Flags().StringP("model", "m", internal.DefaultModel, "model")
 	registerCmd.Flags().StringP("name", "n", "", "device name")
 	registerCmd.Flags().String("jwt", "", "team token")
+	registerCmd.Flags().String("team", "", "Zero Trust team name to log in to (e.g. acme for acme.cloudflareaccess.com)")
+	registerCmd.Flags().String("team-callback", "127.0.0.1:0", "Address of the local listener to paste the team login redirect into (empty to only read stdin)")
+	registerCmd.Flags().String("client-id", "", "Access service token client ID (env USQUE_CLIENT_ID)")
+	registerCmd.Flags().String("client-secret", "", "Access service token client secret (env USQUE_CLIENT_SECRET)")
 	registerCmd.Flags().BoolP("accept-tos", "a", false, "accept Cloudflare TOS (not interactive setup)")
 	rootCmd.AddCommand(registerCmd)
 }
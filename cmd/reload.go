@@ -0,0 +1,143 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+
+	"github.com/Diniboy1123/usque/config"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// fixedFlags are never reloaded, they select what is reloaded.
+var fixedFlags = []string{"help", "config", "profile", "passphrase-fd"}
+
+// flagState is the value of a flag saved before a reload, to restore it if the reload fails.
+type flagState struct {
+	values  []string
+	changed bool
+}
+
+// watchReload reloads the settings of a running command on SIGHUP. The flags that weren't
+// given on the command line are resolved again from the environment and the config file,
+// then apply is called to put the reloadable ones into effect. Changes to other flags are
+// logged, as they need a restart.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The running command.
+//   - reloadable: []string - The flags apply reads.
+//   - apply: func() error - Reads the reloadable flags and swaps them in. It must not change anything if it fails.
+func watchReload(cmd *cobra.Command, reloadable []string, apply func() error) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		for range signals {
+			log.Println("Received SIGHUP, reloading settings")
+
+			before := saveFlags(cmd.Flags())
+			err := reloadFlags(cmd)
+			if err == nil {
+				err = apply()
+			}
+			if err != nil {
+				restoreFlags(cmd.Flags(), before)
+				log.Printf("Failed to reload settings, keeping the current ones: %v", err)
+				continue
+			}
+
+			after := saveFlags(cmd.Flags())
+			for _, name := range sortedKeys(after) {
+				if !slices.Contains(reloadable, name) && !slices.Equal(before[name].values, after[name].values) {
+					log.Printf("Warning: setting %q changed, restart to apply it", name)
+				}
+			}
+
+			log.Println("Settings reloaded")
+		}
+	}()
+}
+
+// reloadFlags resets the flags of a command that weren't given on the command line to their
+// defaults, then sets them from the environment and the config file again.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The running command.
+//
+// Returns:
+//   - error: An error if the config file can't be read or a setting holds an invalid value.
+func reloadFlags(cmd *cobra.Command) error {
+	loaded := commandState(cmd)
+
+	configPath, err := cmd.Flags().GetString("config")
+	if err != nil {
+		return err
+	}
+
+	file := &config.File{}
+	if configPath != "" {
+		if file, err = config.LoadFile(configPath); err != nil {
+			return fmt.Errorf("failed to load config: %v", err)
+		}
+	}
+
+	cmd.Flags().VisitAll(func(flag *pflag.Flag) {
+		if err != nil || loaded.cliFlags[flag.Name] || slices.Contains(fixedFlags, flag.Name) {
+			return
+		}
+
+		var values []string
+		if values, err = flagDefault(flag); err != nil {
+			err = fmt.Errorf("default of %s: %v", flag.Name, err)
+			return
+		}
+		if err = setFlag(cmd.Flags(), flag, values); err != nil {
+			err = fmt.Errorf("default of %s: %v", flag.Name, err)
+			return
+		}
+		flag.Changed = false
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := applyEnvSettings(cmd); err != nil {
+		return fmt.Errorf("invalid environment variable %v", err)
+	}
+	if err := applyProfileSettings(cmd, file, loaded.profile); err != nil {
+		return fmt.Errorf("invalid %v", err)
+	}
+
+	return nil
+}
+
+// saveFlags saves the values of all flags of a set.
+func saveFlags(flags *pflag.FlagSet) map[string]flagState {
+	saved := make(map[string]flagState)
+	flags.VisitAll(func(flag *pflag.Flag) {
+		values := []string{flag.Value.String()}
+		if slice, ok := flag.Value.(pflag.SliceValue); ok {
+			values = slice.GetSlice()
+		}
+		saved[flag.Name] = flagState{values: values, changed: flag.Changed}
+	})
+	return saved
+}
+
+// restoreFlags sets the flags of a set back to values saved with saveFlags.
+func restoreFlags(flags *pflag.FlagSet, saved map[string]flagState) {
+	flags.VisitAll(func(flag *pflag.Flag) {
+		state, ok := saved[flag.Name]
+		if !ok {
+			return
+		}
+		if err := setFlag(flags, flag, state.values); err != nil {
+			log.Printf("Failed to restore flag %s: %v", flag.Name, err)
+		}
+		flag.Changed = state.changed
+	})
+}
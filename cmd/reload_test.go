@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/Diniboy1123/usque/config"
+	"github.com/spf13/pflag"
+)
+
+func TestReloadFlags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeSettings := func(settings config.Settings) {
+		t.Helper()
+		f := &config.File{Default: config.Config{Settings: settings}}
+		if err := f.Save(path); err != nil {
+			t.Fatalf("failed to save config: %v", err)
+		}
+	}
+
+	// started with the port on the command line, the DNS servers from the environment
+	// and the MTU from the config file
+	t.Setenv("USQUE_DNS", "1.1.1.1")
+	writeSettings(config.Settings{"socks": {"port": "2000", "mtu": 1400.0}})
+	cmd := newSettingsCommand(t, "-p", "6000", "-c", path)
+
+	cliFlags := make(map[string]bool)
+	cmd.Flags().Visit(func(flag *pflag.Flag) {
+		cliFlags[flag.Name] = true
+	})
+	if err := applyEnvSettings(cmd); err != nil {
+		t.Fatalf("failed to apply environment: %v", err)
+	}
+	file, err := config.LoadFile(path)
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	if err := applyProfileSettings(cmd, file, config.DefaultProfile); err != nil {
+		t.Fatalf("failed to apply settings: %v", err)
+	}
+	cmd.SetContext(context.WithValue(context.Background(), configKey{},
+		&loadedConfig{file: file, profile: config.DefaultProfile, cliFlags: cliFlags}))
+
+	steps := []struct {
+		name     string
+		env      string // USQUE_DNS, unset if empty
+		settings config.Settings
+		wantMTU  int
+		wantDNS  []string
+		wantErr  bool
+	}{
+		{
+			name:     "unchanged",
+			env:      "1.1.1.1",
+			settings: config.Settings{"socks": {"port": "2000", "mtu": 1400.0}},
+			wantMTU:  1400,
+			wantDNS:  []string{"1.1.1.1"},
+		},
+		{
+			name:     "environment and file changed",
+			env:      "1.0.0.1,1.1.1.1",
+			settings: config.Settings{"socks": {"port": "3000", "mtu": 1500.0, "dns": []any{"8.8.8.8"}}},
+			wantMTU:  1500,
+			wantDNS:  []string{"1.0.0.1", "1.1.1.1"},
+		},
+		{
+			name:     "variable removed",
+			settings: config.Settings{config.GlobalSection: {"port": "4000", "dns": []any{"8.8.8.8"}}},
+			wantMTU:  1280,
+			wantDNS:  []string{"8.8.8.8"},
+		},
+		{
+			name:    "everything removed",
+			wantMTU: 1280,
+			wantDNS: []string{"9.9.9.9", "149.112.112.112"},
+		},
+		{
+			name:     "invalid setting",
+			settings: config.Settings{"socks": {"mtu": "big"}},
+			wantErr:  true,
+		},
+	}
+
+	for _, step := range steps {
+		if step.env != "" {
+			t.Setenv("USQUE_DNS", step.env)
+		} else {
+			os.Unsetenv("USQUE_DNS")
+		}
+		writeSettings(step.settings)
+
+		err := reloadFlags(cmd)
+		if step.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", step.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: failed to reload: %v", step.name, err)
+		}
+
+		port, _ := cmd.Flags().GetString("port")
+		mtu, _ := cmd.Flags().GetInt("mtu")
+		dns, _ := cmd.Flags().GetStringSlice("dns")
+		if port != "6000" {
+			t.Errorf("%s: port = %q, want the command line value 6000", step.name, port)
+		}
+		if mtu != step.wantMTU || !slices.Equal(dns, step.wantDNS) {
+			t.Errorf("%s: got mtu %d, dns %v, want %d, %v", step.name, mtu, dns, step.wantMTU, step.wantDNS)
+		}
+		if path, _ := cmd.Flags().GetString("config"); path == "" {
+			t.Errorf("%s: config path was reset", step.name)
+		}
+	}
+}
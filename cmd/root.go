@@ -1,10 +1,16 @@
 package cmd
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"os"
+	"strings"
 
+	"github.com/Diniboy1123/usque/api"
 	"github.com/Diniboy1123/usque/config"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 var rootCmd = &cobra.Command{
@@ -12,24 +18,234 @@ var rootCmd = &cobra.Command{
 	Short: "Usque Warp CLI",
 	Long:  "An unofficial Cloudflare Warp CLI that uses the MASQUE protocol and exposes the tunnel as various different services.",
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		// Flags win over the environment, which wins over the config file.
+		cliFlags := make(map[string]bool)
+		cmd.Flags().Visit(func(flag *pflag.Flag) {
+			cliFlags[flag.Name] = true
+		})
+		if err := applyEnvSettings(cmd); err != nil {
+			log.Fatalf("Invalid environment variable %v", err)
+		}
+
 		configPath, err := cmd.Flags().GetString("config")
 		if err != nil {
 			log.Fatalf("Failed to get config path: %v", err)
 		}
 
+		profile, err := cmd.Flags().GetString("profile")
+		if err != nil {
+			log.Fatalf("Failed to get profile: %v", err)
+		}
+
+		loaded := &loadedConfig{file: &config.File{}, cliFlags: cliFlags}
+		fileLoaded := false
 		if configPath != "" {
-			if err := config.LoadConfig(configPath); err != nil {
-				log.Printf("Config file not found: %v", err)
-				log.Printf("You may only use the register command to generate one.")
+			if file, err := config.LoadFile(configPath); err != nil {
+				log.Printf("Config not loaded: %v", err)
+				log.Printf("You may only use the register or import command to generate one.")
+			} else {
+				loaded.file = file
+				fileLoaded = true
+			}
+		}
+		loaded.profile = loaded.file.ProfileName(profile)
+
+		if loaded.file.Encrypted() && cmd.Annotations["secrets"] != noSecrets["secrets"] {
+			passphrase, err := readPassphrase(cmd, false)
+			if err != nil {
+				log.Fatalf("Failed to get passphrase: %v", err)
+			}
+			if err := loaded.file.Unlock(passphrase); err != nil {
+				log.Fatalf("Failed to unlock config: %v", err)
+			}
+		}
+
+		if version, ok := loaded.file.Migrated(); ok && cmd != configMigrateCmd {
+			log.Printf("%s is of config version %d, run \"usque config migrate\" to update it to version %d and keep a backup",
+				configPath, version, config.CurrentVersion)
+		}
+
+		if _, ok := loaded.file.Profile(loaded.profile); ok {
+			if loaded.config, err = loaded.file.Select(loaded.profile); err != nil {
+				log.Fatalf("Failed to load config: %v", err)
 			}
+		} else if fileLoaded {
+			log.Printf("Config not loaded: profile %q not found in %s", loaded.profile, configPath)
+		}
+		if err := applyProfileSettings(cmd, loaded.file, loaded.profile); err != nil {
+			log.Fatalf("Invalid %v", err)
 		}
+
+		cmd.SetContext(context.WithValue(cmd.Context(), configKey{}, loaded))
 	},
 }
 
+// configKey is the context key of the loadedConfig of the running command.
+type configKey struct{}
+
+// loadedConfig is the config file and profile the running command works with, set up by the root command.
+type loadedConfig struct {
+	file     *config.File    // The config file, empty if it couldn't be loaded
+	profile  string          // Name of the selected profile
+	config   *config.Config  // The selected profile, nil if the file has no such profile
+	cliFlags map[string]bool // Flags given on the command line, they are kept on reload
+}
+
+// commandState returns the config loaded for the running command.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The running command.
+//
+// Returns:
+//   - *loadedConfig: The loaded config. Empty if the root command didn't run.
+func commandState(cmd *cobra.Command) *loadedConfig {
+	if loaded, ok := cmd.Context().Value(configKey{}).(*loadedConfig); ok {
+		return loaded
+	}
+	return &loadedConfig{file: &config.File{}, profile: config.DefaultProfile}
+}
+
+// commandConfig returns the selected profile of the running command.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The running command.
+//
+// Returns:
+//   - *config.Config: The profile, nil if no config was loaded.
+func commandConfig(cmd *cobra.Command) *config.Config {
+	return commandState(cmd).config
+}
+
+// newCommandConfig returns an empty profile that replaces the selected profile of the running command once saved.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The running command.
+//
+// Returns:
+//   - *config.Config: The empty profile.
+func newCommandConfig(cmd *cobra.Command) *config.Config {
+	loaded := commandState(cmd)
+	return loaded.file.NewConfig(loaded.profile)
+}
+
+// apiSettings returns the registration API overrides of the selected profile. A named
+// profile inherits the fields it leaves empty from the top level of the config file.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The running command.
+//
+// Returns:
+//   - config.APISettings: The overrides.
+func apiSettings(cmd *cobra.Command) config.APISettings {
+	loaded := commandState(cmd)
+
+	var settings config.APISettings
+	if loaded.config != nil {
+		settings = loaded.config.APISettings
+	}
+	if loaded.profile == config.DefaultProfile {
+		return settings
+	}
+
+	inherited := loaded.file.Default.APISettings
+	for _, field := range []struct{ value, fallback *string }{
+		{&settings.ClientProfile, &inherited.ClientProfile},
+		{&settings.ApiUrl, &inherited.ApiUrl},
+		{&settings.ApiVersion, &inherited.ApiVersion},
+		{&settings.ClientVersion, &inherited.ClientVersion},
+		{&settings.UserAgent, &inherited.UserAgent},
+	} {
+		if *field.value == "" {
+			*field.value = *field.fallback
+		}
+	}
+
+	return settings
+}
+
+// savedProfile describes where a config was saved, for log messages.
+//
+// Parameters:
+//   - cfg: *config.Config - The saved config.
+//   - configPath: string - The path of the config file.
+//
+// Returns:
+//   - string: The path, followed by the profile if it is a named one.
+func savedProfile(cfg *config.Config, configPath string) string {
+	if cfg.Profile() == config.DefaultProfile {
+		return configPath
+	}
+	return fmt.Sprintf("%s (profile %s)", configPath, cfg.Profile())
+}
+
+// apiSetting resolves a registration API setting. A flag set on the command line wins over
+// the environment variable, which wins over the config file.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The running command.
+//   - flag: string - The name of the flag.
+//   - env: string - The name of the environment variable.
+//   - configValue: string - The value from the config file.
+//
+// Returns:
+//   - string: The resolved value, empty if none is set.
+func apiSetting(cmd *cobra.Command, flag, env, configValue string) string {
+	if cmd.Flags().Changed(flag) {
+		value, _ := cmd.Flags().GetString(flag)
+		return value
+	}
+	if value := os.Getenv(env); value != "" {
+		return value
+	}
+	return configValue
+}
+
+// clientProfile builds the client profile for API calls from the built-in profile
+// and any overrides given via flags, environment variables or the config file.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The running command.
+//
+// Returns:
+//   - api.ClientProfile: The resolved profile.
+//   - error: An error if the selected profile doesn't exist.
+func clientProfile(cmd *cobra.Command) (api.ClientProfile, error) {
+	settings := apiSettings(cmd)
+
+	profile, err := api.GetClientProfile(apiSetting(cmd, "client-profile", "USQUE_CLIENT_PROFILE", settings.ClientProfile))
+	if err != nil {
+		return api.ClientProfile{}, err
+	}
+
+	if value := apiSetting(cmd, "api-url", "USQUE_API_URL", settings.ApiUrl); value != "" {
+		profile.BaseURL = value
+	}
+	if value := apiSetting(cmd, "api-version", "USQUE_API_VERSION", settings.ApiVersion); value != "" {
+		profile.Version = value
+	}
+	if value := apiSetting(cmd, "client-version", "USQUE_CLIENT_VERSION", settings.ClientVersion); value != "" {
+		profile.ClientVersion = value
+	}
+	if value := apiSetting(cmd, "user-agent", "USQUE_USER_AGENT", settings.UserAgent); value != "" {
+		profile.UserAgent = value
+	}
+
+	return profile, nil
+}
+
 func Execute() error {
 	return rootCmd.Execute()
 }
 
 func init() {
 	rootCmd.PersistentFlags().StringP("config", "c", "config.json", "config file (default is config.json)")
+	rootCmd.PersistentFlags().String("profile", "", "profile of the config file to use (default is the file's default_profile, else \""+config.DefaultProfile+"\")")
+	rootCmd.PersistentFlags().Int("passphrase-fd", -1, "read the passphrase of an encrypted config from this file descriptor (env "+passphraseEnv+" otherwise)")
+	rootCmd.PersistentFlags().String("client-profile", "", "client profile to identify as towards the API ("+strings.Join(api.ClientProfileNames(), ", ")+")")
+	rootCmd.PersistentFlags().String("api-url", "", "override the base URL of the registration API")
+	rootCmd.PersistentFlags().String("api-version", "", "override the API version")
+	rootCmd.PersistentFlags().String("client-version", "", "override the CF-Client-Version header")
+	rootCmd.PersistentFlags().String("user-agent", "", "override the User-Agent header")
+	rootCmd.PersistentFlags().String("api-proxy", "", "proxy for API calls, e.g. socks5://127.0.0.1:1080 (HTTPS_PROXY is honoured if unset)")
+	rootCmd.PersistentFlags().Bool("api-via-tunnel", false, "make API calls through a MASQUE tunnel using the current config")
 }
@@ -0,0 +1,294 @@
+package cmd
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/spf13/cobra"
+)
+
+var serverCmd = &cobra.Command{
+	Use:   "server",
+	Short: "Run a CONNECT-IP server for self-hosting and testing",
+	Long: "Runs a MASQUE CONNECT-IP server that accepts both Cloudflare's cf-connect-ip and standard RFC 9484 connect-ip." +
+		" Clients authenticate with their enrolled public key. Traffic is forwarded via a userspace NAT by default," +
+		" or written to a native TUN device with --tun.",
+	Annotations: noSecrets,
+	Run: func(cmd *cobra.Command, args []string) {
+		bindAddress, err := cmd.Flags().GetString("bind")
+		if err != nil {
+			cmd.Printf("Failed to get bind address: %v\n", err)
+			return
+		}
+
+		port, err := cmd.Flags().GetString("port")
+		if err != nil {
+			cmd.Printf("Failed to get port: %v\n", err)
+			return
+		}
+
+		authorizedKeysPath, err := cmd.Flags().GetString("authorized-keys")
+		if err != nil {
+			cmd.Printf("Failed to get authorized keys path: %v\n", err)
+			return
+		}
+		if authorizedKeysPath == "" {
+			cmd.Println("An authorized keys file is required")
+			return
+		}
+
+		certPath, err := cmd.Flags().GetString("cert")
+		if err != nil {
+			cmd.Printf("Failed to get certificate path: %v\n", err)
+			return
+		}
+
+		keyPath, err := cmd.Flags().GetString("key")
+		if err != nil {
+			cmd.Printf("Failed to get key path: %v\n", err)
+			return
+		}
+
+		poolV4, err := cmd.Flags().GetString("pool-ipv4")
+		if err != nil {
+			cmd.Printf("Failed to get IPv4 pool: %v\n", err)
+			return
+		}
+
+		poolV6, err := cmd.Flags().GetString("pool-ipv6")
+		if err != nil {
+			cmd.Printf("Failed to get IPv6 pool: %v\n", err)
+			return
+		}
+
+		mtu, err := cmd.Flags().GetInt("mtu")
+		if err != nil {
+			cmd.Printf("Failed to get MTU: %v\n", err)
+			return
+		}
+
+		useTun, err := cmd.Flags().GetBool("tun")
+		if err != nil {
+			cmd.Printf("Failed to get TUN mode: %v\n", err)
+			return
+		}
+
+		interfaceName, err := cmd.Flags().GetString("interface-name")
+		if err != nil {
+			cmd.Printf("Failed to get interface name: %v\n", err)
+			return
+		}
+
+		allowLocal, err := cmd.Flags().GetBool("allow-local")
+		if err != nil {
+			cmd.Printf("Failed to get allow local: %v\n", err)
+			return
+		}
+
+		authorizedKeysData, err := os.ReadFile(authorizedKeysPath)
+		if err != nil {
+			cmd.Printf("Failed to read authorized keys: %v\n", err)
+			return
+		}
+
+		authorizedKeys, err := api.ParseAuthorizedKeys(authorizedKeysData)
+		if err != nil {
+			cmd.Printf("Failed to parse authorized keys: %v\n", err)
+			return
+		}
+		if len(authorizedKeys) == 0 {
+			log.Println("Warning: no authorized keys, every client will be rejected")
+		}
+
+		var prefixes []netip.Prefix
+		for _, pool := range []string{poolV4, poolV6} {
+			if pool == "" {
+				continue
+			}
+			prefix, err := netip.ParsePrefix(pool)
+			if err != nil {
+				cmd.Printf("Failed to parse address pool: %v\n", err)
+				return
+			}
+			prefixes = append(prefixes, prefix)
+		}
+
+		pool, err := api.NewAddressPool(prefixes...)
+		if err != nil {
+			cmd.Printf("Failed to create address pool: %v\n", err)
+			return
+		}
+
+		tlsConfig := &tls.Config{}
+		if certPath != "" || keyPath != "" {
+			cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+			if err != nil {
+				cmd.Printf("Failed to load certificate: %v\n", err)
+				return
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		} else {
+			cert, err := newSelfSignedCert()
+			if err != nil {
+				cmd.Printf("Failed to generate certificate: %v\n", err)
+				return
+			}
+			tlsConfig.GetCertificate = cert.getCertificate
+		}
+
+		var dev api.TunnelDevice
+		if useTun {
+			if interfaceName != "" {
+				if err := internal.CheckIfname(interfaceName); err != nil {
+					log.Printf("Invalid interface name: %v", err)
+					return
+				}
+			}
+
+			t := &tunDevice{
+				name:     interfaceName,
+				mtu:      mtu,
+				iproute2: true,
+			}
+
+			dev, err = t.create()
+			if err != nil {
+				log.Println("Are you root/administrator? TUN device creation usually requires elevated privileges.")
+				log.Fatalf("Failed to create TUN device: %v", err)
+			}
+
+			log.Printf("Created TUN device: %s, route the address pools to it and set up NAT", t.name)
+		} else {
+			nat, err := api.NewNATDevice(mtu)
+			if err != nil {
+				log.Fatalf("Failed to create NAT device: %v", err)
+			}
+			defer nat.Close()
+			nat.AllowLocal = allowLocal
+			if allowLocal {
+				log.Println("Warning: peers can reach the loopback, link-local and own addresses of this host")
+			}
+			dev = nat
+		}
+
+		server := &api.Server{
+			Addr:           net.JoinHostPort(bindAddress, port),
+			TLSConfig:      tlsConfig,
+			AuthorizedKeys: authorizedKeys,
+			Pool:           pool,
+			Device:         dev,
+			MTU:            mtu,
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		log.Printf("Listening on %s (UDP) with %d authorized key(s)", server.Addr, len(authorizedKeys))
+
+		if err := server.ListenAndServe(ctx); err != nil && ctx.Err() == nil {
+			log.Fatalf("Server stopped: %v", err)
+		}
+	},
+}
+
+// selfSignedRenewBefore is how long before its expiry a self-signed certificate is reissued.
+const selfSignedRenewBefore = time.Hour
+
+// selfSignedCert is a throwaway server certificate. The certificates issued by
+// internal.GenerateCert expire after a day, so it is reissued for the same key before it
+// expires, which keeps the public key pinned by clients valid for the lifetime of the server.
+type selfSignedCert struct {
+	privKey *ecdsa.PrivateKey
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	notAfter time.Time
+}
+
+// newSelfSignedCert generates the key of a self-signed server certificate and logs its
+// public key, which clients pin as endpoint_pub_key in their config.
+//
+// Returns:
+//   - *selfSignedCert: The certificate.
+//   - error: An error if key or certificate generation fails.
+func newSelfSignedCert() (*selfSignedCert, error) {
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &selfSignedCert{privKey: privKey}
+	if _, err := c.getCertificate(nil); err != nil {
+		return nil, err
+	}
+
+	pubKey, err := x509.MarshalPKIXPublicKey(&privKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("Generated a self-signed certificate, reissued for the same key before it expires. Set endpoint_pub_key in the client config to:")
+	log.Printf("\n%s", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubKey}))
+
+	return c, nil
+}
+
+// getCertificate returns the current certificate, reissuing it if it is about to expire.
+// It is used as tls.Config.GetCertificate.
+func (c *selfSignedCert) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cert != nil && time.Until(c.notAfter) > selfSignedRenewBefore {
+		return c.cert, nil
+	}
+
+	cert, err := internal.GenerateCert(c.privKey, &c.privKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(cert[0])
+	if err != nil {
+		return nil, err
+	}
+
+	c.cert = &tls.Certificate{
+		Certificate: cert,
+		PrivateKey:  c.privKey,
+		Leaf:        leaf,
+	}
+	c.notAfter = leaf.NotAfter
+
+	return c.cert, nil
+}
+
+func init() {
+	serverCmd.Flags().StringP("bind", "b", "0.0.0.0", "Address to bind the server to")
+	serverCmd.Flags().StringP("port", "p", strconv.Itoa(443), "UDP port to listen on")
+	serverCmd.Flags().StringP("authorized-keys", "a", "", "File with the enrolled client public keys (PEM or base64, one per line)")
+	serverCmd.Flags().String("cert", "", "PEM certificate chain for the server (self-signed if empty)")
+	serverCmd.Flags().String("key", "", "PEM private key for the server certificate")
+	serverCmd.Flags().String("pool-ipv4", "10.77.0.0/24", "IPv4 pool to assign standard connect-ip clients from")
+	serverCmd.Flags().String("pool-ipv6", "fd00:7573:7175:6500::/64", "IPv6 pool to assign standard connect-ip clients from")
+	serverCmd.Flags().IntP("mtu", "m", 1280, "MTU of the forwarding device")
+	serverCmd.Flags().Bool("tun", false, "Write traffic to a native TUN device instead of the userspace NAT")
+	serverCmd.Flags().StringP("interface-name", "n", "", "Custom TUN interface name when using --tun")
+	serverCmd.Flags().Bool("allow-local", false, "Let peers reach the loopback, link-local and own addresses of this host through the userspace NAT")
+	rootCmd.AddCommand(serverCmd)
+}
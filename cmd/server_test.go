@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"testing"
+	"time"
+)
+
+func TestSelfSignedCertReissue(t *testing.T) {
+	c, err := newSelfSignedCert()
+	if err != nil {
+		t.Fatalf("failed to generate certificate: %v", err)
+	}
+
+	first, err := c.getCertificate(nil)
+	if err != nil {
+		t.Fatalf("failed to get certificate: %v", err)
+	}
+	if again, _ := c.getCertificate(nil); again != first {
+		t.Error("certificate reissued while still valid")
+	}
+
+	// pretend the certificate is about to expire
+	c.notAfter = time.Now().Add(selfSignedRenewBefore / 2)
+	renewed, err := c.getCertificate(nil)
+	if err != nil {
+		t.Fatalf("failed to reissue certificate: %v", err)
+	}
+	if renewed == first {
+		t.Fatal("certificate not reissued before expiry")
+	}
+	if !renewed.Leaf.PublicKey.(*ecdsa.PublicKey).Equal(first.Leaf.PublicKey) {
+		t.Error("reissued certificate has a different public key")
+	}
+	if time.Until(renewed.Leaf.NotAfter) <= selfSignedRenewBefore {
+		t.Errorf("reissued certificate expires at %s", renewed.Leaf.NotAfter)
+	}
+}
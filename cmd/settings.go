@@ -0,0 +1,342 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Diniboy1123/usque/config"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// settingsSection returns the name of the settings section of a command, its path
+// without the root command. (e.g., "socks" or "devices list")
+//
+// Parameters:
+//   - cmd: *cobra.Command - The command.
+//
+// Returns:
+//   - string: The section name.
+func settingsSection(cmd *cobra.Command) string {
+	return strings.TrimPrefix(cmd.CommandPath(), cmd.Root().Name()+" ")
+}
+
+// settingsEnv returns the environment variable for a flag, USQUE_<FLAG> or, with a section,
+// USQUE_<SECTION>_<FLAG>. Dashes and spaces become underscores. (e.g., USQUE_HTTP_PROXY_PORT)
+//
+// Parameters:
+//   - section: string - The settings section, empty for the variable shared by all commands.
+//   - flag: string - The flag name.
+//
+// Returns:
+//   - string: The variable name.
+func settingsEnv(section, flag string) string {
+	name := "USQUE_"
+	if section != "" {
+		name += section + "_"
+	}
+	return strings.ToUpper(strings.NewReplacer("-", "_", " ", "_").Replace(name + flag))
+}
+
+// commandLineOnly holds the flags that confirm destructive commands, e.g. unregister --yes.
+// They are only taken from the command line, so a variable or setting left behind can't
+// silently skip a confirmation.
+var commandLineOnly = map[string]bool{
+	"yes":   true,
+	"force": true,
+}
+
+// applyEnvSettings sets the flags not given on the command line from USQUE_<SECTION>_<FLAG>,
+// or else USQUE_<FLAG>. Repeatable flags take comma separated values. The flags in
+// commandLineOnly are skipped.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The running command.
+//
+// Returns:
+//   - error: An error if a variable holds an invalid value.
+func applyEnvSettings(cmd *cobra.Command) error {
+	section := settingsSection(cmd)
+
+	var err error
+	cmd.Flags().VisitAll(func(flag *pflag.Flag) {
+		if err != nil || flag.Changed || flag.Name == "help" || commandLineOnly[flag.Name] {
+			return
+		}
+
+		for _, env := range []string{settingsEnv(section, flag.Name), settingsEnv("", flag.Name)} {
+			value, ok := os.LookupEnv(env)
+			if !ok {
+				continue
+			}
+
+			values := []string{value}
+			if isRepeatable(flag) {
+				values = strings.Split(value, ",")
+			}
+			if setErr := setFlag(cmd.Flags(), flag, values); setErr != nil {
+				err = fmt.Errorf("%s: %v", env, setErr)
+			}
+			return
+		}
+	})
+
+	return err
+}
+
+// applyFileSettings sets the flags given neither on the command line nor in the environment
+// from the command's section of the config, or else from its global section. The flags in
+// commandLineOnly are skipped.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The running command.
+//   - settings: config.Settings - The settings of the config.
+//
+// Returns:
+//   - error: An error if a setting holds an invalid value.
+func applyFileSettings(cmd *cobra.Command, settings config.Settings) error {
+	section := settingsSection(cmd)
+
+	for key := range settings[section] {
+		if cmd.Flags().Lookup(key) == nil {
+			log.Printf("Warning: ignoring unknown setting %q in section %q", key, section)
+		} else if commandLineOnly[key] {
+			log.Printf("Warning: ignoring setting %q in section %q, it can only be given on the command line", key, section)
+		}
+	}
+
+	var err error
+	cmd.Flags().VisitAll(func(flag *pflag.Flag) {
+		if err != nil || flag.Changed || flag.Name == "help" || flag.Name == "config" || flag.Name == "profile" ||
+			commandLineOnly[flag.Name] {
+			return
+		}
+
+		for _, name := range []string{section, config.GlobalSection} {
+			value, ok := settings[name][flag.Name]
+			if !ok {
+				continue
+			}
+
+			values, convErr := settingValues(value)
+			if convErr == nil && len(values) > 1 && !isRepeatable(flag) {
+				convErr = fmt.Errorf("expected a single value")
+			}
+			if convErr == nil {
+				convErr = setFlag(cmd.Flags(), flag, values)
+			}
+			if convErr != nil {
+				err = fmt.Errorf("setting %q in section %q: %v", flag.Name, name, convErr)
+			}
+			return
+		}
+	})
+
+	return err
+}
+
+// applyProfileSettings sets the flags given neither on the command line nor in the environment
+// from the settings of a profile. Named profiles inherit the settings of the top level they
+// don't set themselves.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The running command.
+//   - file: *config.File - The config file.
+//   - profile: string - The name of the selected profile.
+//
+// Returns:
+//   - error: An error if a setting holds an invalid value.
+func applyProfileSettings(cmd *cobra.Command, file *config.File, profile string) error {
+	if selected, ok := file.Profile(profile); ok {
+		if err := applyFileSettings(cmd, selected.Settings); err != nil {
+			return err
+		}
+	}
+	if profile != config.DefaultProfile {
+		return applyFileSettings(cmd, file.Default.Settings)
+	}
+	return nil
+}
+
+// settingValues converts a JSON setting to flag values.
+//
+// Parameters:
+//   - value: any - The decoded JSON value.
+//
+// Returns:
+//   - []string: The flag values.
+//   - error: An error if the value is an object or a nested array.
+func settingValues(value any) ([]string, error) {
+	switch v := value.(type) {
+	case string:
+		return []string{v}, nil
+	case bool:
+		return []string{strconv.FormatBool(v)}, nil
+	case float64:
+		return []string{strconv.FormatFloat(v, 'f', -1, 64)}, nil
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if _, nested := item.([]any); nested {
+				return nil, fmt.Errorf("nested arrays are not supported")
+			}
+			itemValues, err := settingValues(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, itemValues...)
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("unsupported value %v", value)
+	}
+}
+
+// setFlag sets a flag as if it was given once per value on the command line.
+//
+// Parameters:
+//   - flags: *pflag.FlagSet - The flag set of the command.
+//   - flag: *pflag.Flag - The flag to set.
+//   - values: []string - The values.
+//
+// Returns:
+//   - error: An error if a value is invalid for the flag.
+func setFlag(flags *pflag.FlagSet, flag *pflag.Flag, values []string) error {
+	// Once set, repeatable flags append, so they are replaced as a whole. This keeps
+	// settings applied again on reload from adding to the previous values.
+	if slice, ok := flag.Value.(pflag.SliceValue); ok {
+		trimmed := make([]string, len(values))
+		for i, value := range values {
+			trimmed[i] = strings.TrimSpace(value)
+		}
+		if err := slice.Replace(trimmed); err != nil {
+			return err
+		}
+		flag.Changed = true
+		return nil
+	}
+
+	for _, value := range values {
+		if err := flags.Set(flag.Name, strings.TrimSpace(value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flagDefault returns the default values of a flag, as setFlag takes them.
+//
+// Parameters:
+//   - flag: *pflag.Flag - The flag.
+//
+// Returns:
+//   - []string: The default values.
+//   - error: An error if the default of a repeatable flag can't be parsed.
+func flagDefault(flag *pflag.Flag) ([]string, error) {
+	if !isRepeatable(flag) {
+		return []string{flag.DefValue}, nil
+	}
+
+	// Repeatable flags print their defaults as a bracketed CSV list. (e.g., "[9.9.9.9,2620:fe::fe]")
+	list := strings.TrimSuffix(strings.TrimPrefix(flag.DefValue, "["), "]")
+	if list == "" {
+		return nil, nil
+	}
+	return csv.NewReader(strings.NewReader(list)).Read()
+}
+
+// isRepeatable reports whether a flag takes multiple values, e.g. --dns or --forward-port.
+func isRepeatable(flag *pflag.Flag) bool {
+	t := flag.Value.Type()
+	return strings.HasSuffix(t, "Slice") || strings.HasSuffix(t, "Array")
+}
+
+// validateSettings checks the settings of a config against the commands and their flags.
+// Values are checked by setting them on the flags, so it must only be used by commands
+// that don't read the flags of other commands afterwards.
+//
+// Parameters:
+//   - settings: config.Settings - The settings to check.
+//
+// Returns:
+//   - []error: The problems found, each prefixed with the section and setting. Empty if there are none.
+func validateSettings(settings config.Settings) []error {
+	commands := make(map[string]*cobra.Command)
+	var walk func(cmd *cobra.Command)
+	walk = func(cmd *cobra.Command) {
+		for _, sub := range cmd.Commands() {
+			commands[settingsSection(sub)] = sub
+			walk(sub)
+		}
+	}
+	walk(rootCmd)
+
+	var problems []error
+	for _, section := range sortedKeys(settings) {
+		values := settings[section]
+		var targets []*cobra.Command
+		if section == config.GlobalSection {
+			for _, name := range sortedKeys(commands) {
+				targets = append(targets, commands[name])
+			}
+		} else if cmd, ok := commands[section]; ok {
+			targets = []*cobra.Command{cmd}
+		} else {
+			problems = append(problems, fmt.Errorf("settings: unknown section %q", section))
+			continue
+		}
+
+		for _, key := range sortedKeys(values) {
+			if err := validateSetting(targets, key, values[key]); err != nil {
+				problems = append(problems, fmt.Errorf("settings: %q in section %q: %v", key, section, err))
+			}
+		}
+	}
+
+	return problems
+}
+
+// validateSetting checks a setting against the first of the commands that has the flag.
+func validateSetting(targets []*cobra.Command, key string, value any) error {
+	if key == "help" || key == "config" || key == "profile" || commandLineOnly[key] {
+		return fmt.Errorf("can't be set in the config file")
+	}
+
+	for _, cmd := range targets {
+		flags := cmd.Flags()
+		flag := flags.Lookup(key)
+		if flag == nil {
+			flags = cmd.InheritedFlags()
+			flag = flags.Lookup(key)
+		}
+		if flag == nil {
+			continue
+		}
+
+		values, err := settingValues(value)
+		if err != nil {
+			return err
+		}
+		if len(values) > 1 && !isRepeatable(flag) {
+			return fmt.Errorf("expected a single value")
+		}
+		return setFlag(flags, flag, values)
+	}
+
+	return fmt.Errorf("unknown flag")
+}
+
+// sortedKeys returns the keys of a map in order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,267 @@
+package cmd
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/Diniboy1123/usque/config"
+	"github.com/spf13/cobra"
+)
+
+// newSettingsCommand returns "usque socks" with a few flags of each kind, parsed from args.
+func newSettingsCommand(t *testing.T, args ...string) *cobra.Command {
+	t.Helper()
+
+	root := &cobra.Command{Use: "usque"}
+	root.PersistentFlags().StringP("config", "c", "", "")
+	cmd := &cobra.Command{Use: "socks"}
+	root.AddCommand(cmd)
+
+	cmd.Flags().StringP("port", "p", "1080", "")
+	cmd.Flags().Int("mtu", 1280, "")
+	cmd.Flags().StringSlice("dns", []string{"9.9.9.9", "149.112.112.112"}, "")
+	cmd.Flags().BoolP("yes", "y", false, "")
+	cmd.Flags().Bool("force", false, "")
+
+	if err := cmd.ParseFlags(args); err != nil {
+		t.Fatalf("failed to parse flags: %v", err)
+	}
+	return cmd
+}
+
+func TestSettingsPrecedence(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		env      map[string]string
+		settings config.Settings
+		want     string
+	}{
+		{name: "default", want: "1080"},
+		{
+			name:     "global setting",
+			settings: config.Settings{config.GlobalSection: {"port": "2000"}},
+			want:     "2000",
+		},
+		{
+			name:     "section setting over global",
+			settings: config.Settings{config.GlobalSection: {"port": "2000"}, "socks": {"port": 3000.0}},
+			want:     "3000",
+		},
+		{
+			name:     "shared variable over settings",
+			env:      map[string]string{"USQUE_PORT": "4000"},
+			settings: config.Settings{config.GlobalSection: {"port": "2000"}, "socks": {"port": "3000"}},
+			want:     "4000",
+		},
+		{
+			name:     "section variable over shared",
+			env:      map[string]string{"USQUE_PORT": "4000", "USQUE_SOCKS_PORT": "5000"},
+			settings: config.Settings{"socks": {"port": "3000"}},
+			want:     "5000",
+		},
+		{
+			name:     "flag over everything",
+			args:     []string{"-p", "6000"},
+			env:      map[string]string{"USQUE_PORT": "4000", "USQUE_SOCKS_PORT": "5000"},
+			settings: config.Settings{config.GlobalSection: {"port": "2000"}, "socks": {"port": "3000"}},
+			want:     "6000",
+		},
+		{
+			name:     "other section ignored",
+			env:      map[string]string{"USQUE_HTTP_PROXY_PORT": "4000"},
+			settings: config.Settings{"http-proxy": {"port": "3000"}},
+			want:     "1080",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			cmd := newSettingsCommand(t, tt.args...)
+
+			if err := applyEnvSettings(cmd); err != nil {
+				t.Fatalf("failed to apply environment: %v", err)
+			}
+			if err := applyFileSettings(cmd, tt.settings); err != nil {
+				t.Fatalf("failed to apply settings: %v", err)
+			}
+
+			if got, _ := cmd.Flags().GetString("port"); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProfileSettings(t *testing.T) {
+	file := &config.File{
+		Default: config.Config{Settings: config.Settings{
+			config.GlobalSection: {"port": "2000", "mtu": 1400.0},
+		}},
+		Profiles: map[string]config.Config{
+			"work": {Settings: config.Settings{"socks": {"port": "3000"}}},
+		},
+	}
+
+	tests := []struct {
+		profile  string
+		wantPort string
+		wantMTU  int
+	}{
+		{profile: config.DefaultProfile, wantPort: "2000", wantMTU: 1400},
+		// named profiles inherit what they don't set from the top level
+		{profile: "work", wantPort: "3000", wantMTU: 1400},
+		{profile: "missing", wantPort: "2000", wantMTU: 1400},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.profile, func(t *testing.T) {
+			cmd := newSettingsCommand(t)
+			if err := applyProfileSettings(cmd, file, tt.profile); err != nil {
+				t.Fatalf("failed to apply settings: %v", err)
+			}
+
+			port, _ := cmd.Flags().GetString("port")
+			mtu, _ := cmd.Flags().GetInt("mtu")
+			if port != tt.wantPort || mtu != tt.wantMTU {
+				t.Errorf("got %q, %d, want %q, %d", port, mtu, tt.wantPort, tt.wantMTU)
+			}
+		})
+	}
+}
+
+func TestCommandLineOnlySettings(t *testing.T) {
+	tests := []struct {
+		name      string
+		args      []string
+		wantYes   bool
+		wantForce bool
+	}{
+		{name: "not given"},
+		{name: "given", args: []string{"-y", "--force"}, wantYes: true, wantForce: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("USQUE_YES", "true")
+			t.Setenv("USQUE_SOCKS_YES", "true")
+			t.Setenv("USQUE_FORCE", "true")
+			cmd := newSettingsCommand(t, tt.args...)
+
+			if err := applyEnvSettings(cmd); err != nil {
+				t.Fatalf("failed to apply environment: %v", err)
+			}
+			if err := applyFileSettings(cmd, config.Settings{
+				config.GlobalSection: {"yes": true},
+				"socks":              {"force": true},
+			}); err != nil {
+				t.Fatalf("failed to apply settings: %v", err)
+			}
+
+			yes, _ := cmd.Flags().GetBool("yes")
+			force, _ := cmd.Flags().GetBool("force")
+			if yes != tt.wantYes || force != tt.wantForce {
+				t.Errorf("got yes=%v force=%v, want yes=%v force=%v", yes, force, tt.wantYes, tt.wantForce)
+			}
+		})
+	}
+
+	if err := validateSetting([]*cobra.Command{newSettingsCommand(t)}, "yes", true); err == nil {
+		t.Errorf("expected validation to reject yes in the config file")
+	}
+}
+
+func TestSliceSettingsReplace(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		env      map[string]string
+		settings config.Settings
+		want     []string
+	}{
+		{name: "default", want: []string{"9.9.9.9", "149.112.112.112"}},
+		{
+			name: "variable",
+			env:  map[string]string{"USQUE_DNS": "1.1.1.1, 1.0.0.1"},
+			want: []string{"1.1.1.1", "1.0.0.1"},
+		},
+		{
+			name:     "setting",
+			settings: config.Settings{"socks": {"dns": []any{"8.8.8.8"}}},
+			want:     []string{"8.8.8.8"},
+		},
+		{
+			name:     "flags",
+			args:     []string{"--dns", "8.8.4.4", "--dns", "8.8.8.8"},
+			env:      map[string]string{"USQUE_DNS": "1.1.1.1"},
+			settings: config.Settings{"socks": {"dns": []any{"9.9.9.10"}}},
+			want:     []string{"8.8.4.4", "8.8.8.8"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			cmd := newSettingsCommand(t, tt.args...)
+
+			if err := applyEnvSettings(cmd); err != nil {
+				t.Fatalf("failed to apply environment: %v", err)
+			}
+			if err := applyFileSettings(cmd, tt.settings); err != nil {
+				t.Fatalf("failed to apply settings: %v", err)
+			}
+
+			if got, _ := cmd.Flags().GetStringSlice("dns"); !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// setting a repeatable flag again replaces the values, as on reload
+	cmd := newSettingsCommand(t)
+	flag := cmd.Flags().Lookup("dns")
+	for _, values := range [][]string{{"1.1.1.1"}, {"8.8.8.8", "8.8.4.4"}} {
+		if err := setFlag(cmd.Flags(), flag, values); err != nil {
+			t.Fatalf("failed to set flag: %v", err)
+		}
+	}
+	if got, _ := cmd.Flags().GetStringSlice("dns"); !slices.Equal(got, []string{"8.8.8.8", "8.8.4.4"}) {
+		t.Errorf("got %v after setting twice, want [8.8.8.8 8.8.4.4]", got)
+	}
+}
+
+func TestInvalidSettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		settings config.Settings
+	}{
+		{name: "variable not a number", env: map[string]string{"USQUE_MTU": "big"}},
+		{name: "setting not a number", settings: config.Settings{"socks": {"mtu": "big"}}},
+		{name: "list for a single value", settings: config.Settings{"socks": {"port": []any{"1", "2"}}}},
+		{name: "object", settings: config.Settings{"socks": {"dns": map[string]any{"a": "b"}}}},
+		{name: "nested list", settings: config.Settings{"socks": {"dns": []any{[]any{"1.1.1.1"}}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			cmd := newSettingsCommand(t)
+
+			err := applyEnvSettings(cmd)
+			if err == nil {
+				err = applyFileSettings(cmd, tt.settings)
+			}
+			if err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
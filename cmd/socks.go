@@ -2,14 +2,13 @@ package cmd
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net"
-	"net/netip"
 	"os"
+	"sync/atomic"
 	"time"
 
-	"github.com/Diniboy1123/usque/api"
-	"github.com/Diniboy1123/usque/config"
 	"github.com/Diniboy1123/usque/internal"
 	"github.com/spf13/cobra"
 	"github.com/things-go/go-socks5"
@@ -21,51 +20,12 @@ var socksCmd = &cobra.Command{
 	Short: "Expose Warp as a SOCKS5 proxy",
 	Long:  "Dual-stack SOCKS5 proxy with optional authentication. Doesn't require elevated privileges.",
 	Run: func(cmd *cobra.Command, args []string) {
-		if !config.ConfigLoaded {
+		cfg := commandConfig(cmd)
+		if cfg == nil {
 			cmd.Println("Config not loaded. Please register first.")
 			return
 		}
 
-		sni, err := cmd.Flags().GetString("sni-address")
-		if err != nil {
-			cmd.Printf("Failed to get SNI address: %v\n", err)
-			return
-		}
-
-		privKey, err := config.AppConfig.GetEcPrivateKey()
-		if err != nil {
-			cmd.Printf("Failed to get private key: %v\n", err)
-			return
-		}
-		peerPubKey, err := config.AppConfig.GetEcEndpointPublicKey()
-		if err != nil {
-			cmd.Printf("Failed to get public key: %v\n", err)
-			return
-		}
-
-		cert, err := internal.GenerateCert(privKey, &privKey.PublicKey)
-		if err != nil {
-			cmd.Printf("Failed to generate cert: %v\n", err)
-			return
-		}
-
-		tlsConfig, err := api.PrepareTlsConfig(privKey, peerPubKey, cert, sni)
-		if err != nil {
-			cmd.Printf("Failed to prepare TLS config: %v\n", err)
-			return
-		}
-
-		keepalivePeriod, err := cmd.Flags().GetDuration("keepalive-period")
-		if err != nil {
-			cmd.Printf("Failed to get keepalive period: %v\n", err)
-			return
-		}
-		initialPacketSize, err := cmd.Flags().GetUint16("initial-packet-size")
-		if err != nil {
-			cmd.Printf("Failed to get initial packet size: %v\n", err)
-			return
-		}
-
 		bindAddress, err := cmd.Flags().GetString("bind")
 		if err != nil {
 			cmd.Printf("Failed to get bind address: %v\n", err)
@@ -78,157 +38,150 @@ var socksCmd = &cobra.Command{
 			return
 		}
 
-		connectPort, err := cmd.Flags().GetInt("connect-port")
+		tunnel, err := tunnelClient(cmd)
 		if err != nil {
-			cmd.Printf("Failed to get connect port: %v\n", err)
+			cmd.Printf("Failed to set up tunnel: %v\n", err)
 			return
 		}
+		defer tunnel.Close()
+		runTunnel(tunnel)
+		tunNet := tunnel.Net()
 
-		var endpoint *net.UDPAddr
-		if ipv6, err := cmd.Flags().GetBool("ipv6"); err == nil && !ipv6 {
-			endpoint = &net.UDPAddr{
-				IP:   net.ParseIP(config.AppConfig.EndpointV4),
-				Port: connectPort,
-			}
-		} else {
-			endpoint = &net.UDPAddr{
-				IP:   net.ParseIP(config.AppConfig.EndpointV6),
-				Port: connectPort,
-			}
-		}
-
-		tunnelIPv4, err := cmd.Flags().GetBool("no-tunnel-ipv4")
+		var servers atomic.Pointer[socks5.Server]
+		server, err := newSocksServer(cmd, tunNet)
 		if err != nil {
-			cmd.Printf("Failed to get no tunnel IPv4: %v\n", err)
+			cmd.Printf("Failed to set up SOCKS proxy: %v\n", err)
 			return
 		}
+		servers.Store(server)
 
-		tunnelIPv6, err := cmd.Flags().GetBool("no-tunnel-ipv6")
-		if err != nil {
-			cmd.Printf("Failed to get no tunnel IPv6: %v\n", err)
-			return
-		}
-
-		var localAddresses []netip.Addr
-		if !tunnelIPv4 {
-			v4, err := netip.ParseAddr(config.AppConfig.IPv4)
+		// Connections keep the server they were accepted with, a reload only affects new ones.
+		watchReload(cmd, socksReloadable, func() error {
+			server, err := newSocksServer(cmd, tunNet)
 			if err != nil {
-				cmd.Printf("Failed to parse IPv4 address: %v\n", err)
-				return
-			}
-			localAddresses = append(localAddresses, v4)
-		}
-		if !tunnelIPv6 {
-			v6, err := netip.ParseAddr(config.AppConfig.IPv6)
-			if err != nil {
-				cmd.Printf("Failed to parse IPv6 address: %v\n", err)
-				return
+				return err
 			}
-			localAddresses = append(localAddresses, v6)
-		}
+			servers.Store(server)
+			return nil
+		})
 
-		dnsServers, err := cmd.Flags().GetStringArray("dns")
+		listener, err := net.Listen("tcp", net.JoinHostPort(bindAddress, port))
 		if err != nil {
-			cmd.Printf("Failed to get DNS servers: %v\n", err)
+			cmd.Printf("Failed to start SOCKS proxy: %v\n", err)
 			return
 		}
+		defer listener.Close()
 
-		var dnsAddrs []netip.Addr
-		for _, dns := range dnsServers {
-			addr, err := netip.ParseAddr(dns)
+		log.Printf("SOCKS proxy listening on %s:%s", bindAddress, port)
+		for {
+			conn, err := listener.Accept()
 			if err != nil {
-				cmd.Printf("Failed to parse DNS server: %v\n", err)
+				cmd.Printf("Failed to accept SOCKS connection: %v\n", err)
 				return
 			}
-			dnsAddrs = append(dnsAddrs, addr)
-		}
-
-		var dnsTimeout time.Duration
-		if dnsTimeout, err = cmd.Flags().GetDuration("dns-timeout"); err != nil {
-			cmd.Printf("Failed to get DNS timeout: %v\n", err)
-			return
-		}
-
-		localDNS, err := cmd.Flags().GetBool("local-dns")
-		if err != nil {
-			cmd.Printf("Failed to get local-dns flag: %v\n", err)
-			return
-		}
-
-		mtu, err := cmd.Flags().GetInt("mtu")
-		if err != nil {
-			cmd.Printf("Failed to get MTU: %v\n", err)
-			return
-		}
-		if mtu != 1280 {
-			log.Println("Warning: MTU is not the default 1280. This is not supported. Packet loss and other issues may occur.")
-		}
-
-		var username string
-		var password string
-		if u, err := cmd.Flags().GetString("username"); err == nil && u != "" {
-			username = u
-		}
-		if p, err := cmd.Flags().GetString("password"); err == nil && p != "" {
-			password = p
-		}
 
-		reconnectDelay, err := cmd.Flags().GetDuration("reconnect-delay")
-		if err != nil {
-			cmd.Printf("Failed to get reconnect delay: %v\n", err)
-			return
-		}
-
-		tunDev, tunNet, err := netstack.CreateNetTUN(localAddresses, dnsAddrs, mtu)
-		if err != nil {
-			cmd.Printf("Failed to create virtual TUN device: %v\n", err)
-			return
+			go func(server *socks5.Server) {
+				if err := server.ServeConn(conn); err != nil {
+					socksLogger.Errorf("server: %v", err)
+				}
+			}(servers.Load())
 		}
-		defer tunDev.Close()
+	},
+}
 
-		go api.MaintainTunnel(context.Background(), tlsConfig, keepalivePeriod, initialPacketSize, endpoint, api.NewNetstackAdapter(tunDev), mtu, reconnectDelay)
+// socksLogger logs the errors of SOCKS connections.
+var socksLogger = socks5.NewLogger(log.New(os.Stdout, "socks5: ", log.LstdFlags))
+
+// socksReloadable are the flags of the socks command that are reloaded on SIGHUP.
+var socksReloadable = []string{"username", "password", "dns", "dns-timeout", "local-dns", "apply-policy", "allow-client", "deny-dest"}
+
+// newSocksServer creates the SOCKS server with the authentication, DNS servers, ACL and
+// device policy given by the flags of the socks command.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The running command.
+//   - tunNet: *netstack.Net - The network stack of the tunnel.
+//
+// Returns:
+//   - *socks5.Server: The server.
+//   - error: An error if a flag is invalid or the policy can't be fetched.
+func newSocksServer(cmd *cobra.Command, tunNet *netstack.Net) (*socks5.Server, error) {
+	dnsServers, err := cmd.Flags().GetStringArray("dns")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get DNS servers: %v", err)
+	}
+	dnsAddrs, err := parseDNSServers(dnsServers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse DNS server: %v", err)
+	}
+
+	dnsTimeout, err := cmd.Flags().GetDuration("dns-timeout")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get DNS timeout: %v", err)
+	}
+
+	localDNS, err := cmd.Flags().GetBool("local-dns")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get local-dns flag: %v", err)
+	}
+
+	var username string
+	var password string
+	if u, err := cmd.Flags().GetString("username"); err == nil && u != "" {
+		username = u
+	}
+	if p, err := cmd.Flags().GetString("password"); err == nil && p != "" {
+		password = p
+	}
+
+	acl, err := proxyACL(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	split, fallback, err := fetchPolicy(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get policy: %v", err)
+	}
+
+	dnsResolver := internal.TunnelDNSResolver{TunNet: tunNet, DNSAddrs: dnsAddrs, Timeout: dnsTimeout}
+	if localDNS {
+		dnsResolver.TunNet = nil
+	}
+
+	router := &policyRouter{split: split, fallback: fallback, acl: acl, tunNet: tunNet, timeout: dnsTimeout}
+	resolver := policyResolver{router: router, next: dnsResolver}
+
+	options := []socks5.Option{
+		socks5.WithLogger(socksLogger),
+		socks5.WithDial(router.dial),
+		socks5.WithResolver(resolver),
+		socks5.WithRule(clientRule{acl: acl}),
+	}
+	if username != "" && password != "" {
+		options = append(options, socks5.WithAuthMethods(
+			[]socks5.Authenticator{
+				socks5.UserPassAuthenticator{
+					Credentials: socks5.StaticCredentials{
+						username: password,
+					},
+				},
+			},
+		))
+	}
 
-		var resolver socks5.NameResolver
-		if localDNS {
-			resolver = internal.TunnelDNSResolver{TunNet: nil, DNSAddrs: dnsAddrs, Timeout: dnsTimeout}
-		} else {
-			resolver = internal.TunnelDNSResolver{TunNet: tunNet, DNSAddrs: dnsAddrs, Timeout: dnsTimeout}
-		}
+	return socks5.NewServer(options...), nil
+}
 
-		var server *socks5.Server
-		if username == "" || password == "" {
-			server = socks5.NewServer(
-				socks5.WithLogger(socks5.NewLogger(log.New(os.Stdout, "socks5: ", log.LstdFlags))),
-				socks5.WithDial(func(ctx context.Context, network, addr string) (net.Conn, error) {
-					return tunNet.DialContext(ctx, network, addr)
-				}),
-				socks5.WithResolver(resolver),
-			)
-		} else {
-			server = socks5.NewServer(
-				socks5.WithLogger(socks5.NewLogger(log.New(os.Stdout, "socks5: ", log.LstdFlags))),
-				socks5.WithDial(func(ctx context.Context, network, addr string) (net.Conn, error) {
-					return tunNet.DialContext(ctx, network, addr)
-				}),
-				socks5.WithResolver(resolver),
-				socks5.WithAuthMethods(
-					[]socks5.Authenticator{
-						socks5.UserPassAuthenticator{
-							Credentials: socks5.StaticCredentials{
-								username: password,
-							},
-						},
-					},
-				),
-			)
-		}
+// clientRule refuses the SOCKS requests of clients the ACL doesn't allow.
+type clientRule struct {
+	acl *internal.ACL
+}
 
-		log.Printf("SOCKS proxy listening on %s:%s", bindAddress, port)
-		if err := server.ListenAndServe("tcp", net.JoinHostPort(bindAddress, port)); err != nil {
-			cmd.Printf("Failed to start SOCKS proxy: %v\n", err)
-			return
-		}
-	},
+// Allow implements socks5.RuleSet.
+func (r clientRule) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	addr, ok := req.RemoteAddr.(*net.TCPAddr)
+	return ctx, ok && r.acl.AllowsClient(addr.AddrPort().Addr())
 }
 
 func init() {
@@ -242,11 +195,19 @@ func init() {
 	socksCmd.Flags().BoolP("ipv6", "6", false, "Use IPv6 for MASQUE connection")
 	socksCmd.Flags().BoolP("no-tunnel-ipv4", "F", false, "Disable IPv4 inside the MASQUE tunnel")
 	socksCmd.Flags().BoolP("no-tunnel-ipv6", "S", false, "Disable IPv6 inside the MASQUE tunnel")
-	socksCmd.Flags().StringP("sni-address", "s", internal.ConnectSNI, "SNI address to use for MASQUE connection")
+	socksCmd.Flags().StringP("sni-address", "s", "", "SNI address to use for MASQUE connection (default: "+internal.ZeroTierSNI+" for Zero Trust accounts, "+internal.ConnectSNI+" otherwise)")
+	socksCmd.Flags().String("connect-uri", "", "Use standard RFC 9484 connect-ip with this URI template instead of Cloudflare (e.g. https://proxy.example.com/.well-known/masque/ip/{target}/{ipproto}/)")
 	socksCmd.Flags().DurationP("keepalive-period", "k", 30*time.Second, "Keepalive period for MASQUE connection")
 	socksCmd.Flags().IntP("mtu", "m", 1280, "MTU for MASQUE connection")
 	socksCmd.Flags().Uint16P("initial-packet-size", "i", 1242, "Initial packet size for MASQUE connection")
 	socksCmd.Flags().DurationP("reconnect-delay", "r", 1*time.Second, "Delay between reconnect attempts")
+	socksCmd.Flags().Duration("rotate-interval", 0, "Replace the MASQUE session make-before-break at this interval (0 disables)")
+	socksCmd.Flags().Duration("drain-period", 5*time.Second, "How long a replaced MASQUE session keeps delivering in-flight packets")
+	socksCmd.Flags().Bool("on-demand", false, "Only connect the MASQUE tunnel when there is traffic")
+	socksCmd.Flags().Duration("idle-timeout", 5*time.Minute, "Disconnect an on-demand MASQUE tunnel after this long without traffic (0 disables)")
 	socksCmd.Flags().BoolP("local-dns", "l", false, "Don't use the tunnel for DNS queries")
+	socksCmd.Flags().Bool("apply-policy", false, "Apply the split tunnel and fallback domains of the device policy")
+	socksCmd.Flags().StringArray("allow-client", nil, "Only accept clients from this address or prefix (repeatable, default: all clients)")
+	socksCmd.Flags().StringArray("deny-dest", nil, "Refuse connections to this destination address or prefix (repeatable)")
 	rootCmd.AddCommand(socksCmd)
 }
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/things-go/go-socks5"
+)
+
+func TestClientRule(t *testing.T) {
+	acl, err := internal.NewACL([]string{"127.0.0.0/8", "fd00::/8"}, nil)
+	if err != nil {
+		t.Fatalf("failed to create ACL: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		acl        *internal.ACL
+		remoteAddr net.Addr
+		want       bool
+	}{
+		{name: "allowed", acl: acl, remoteAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.2"), Port: 50000}, want: true},
+		{name: "allowed IPv6", acl: acl, remoteAddr: &net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 50000}, want: true},
+		{name: "refused", acl: acl, remoteAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 50000}},
+		{name: "not TCP", acl: acl, remoteAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 50000}},
+		{name: "no ACL", remoteAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 50000}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, got := clientRule{acl: tt.acl}.Allow(context.Background(), &socks5.Request{RemoteAddr: tt.remoteAddr})
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
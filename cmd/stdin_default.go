@@ -0,0 +1,21 @@
+//go:build !unix
+
+package cmd
+
+import (
+	"context"
+	"io"
+	"os"
+)
+
+// newStdinReader returns stdin. Pending reads can't be abandoned on this platform, so the
+// context is ignored.
+//
+// Parameters:
+//   - ctx: context.Context - Unused.
+//
+// Returns:
+//   - io.Reader: The reader.
+func newStdinReader(_ context.Context) io.Reader {
+	return os.Stdin
+}
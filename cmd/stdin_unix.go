@@ -0,0 +1,51 @@
+//go:build unix
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// stdinReader reads stdin, but only once input is available, so that a pending read can
+// be abandoned without consuming input meant for later prompts.
+type stdinReader struct {
+	ctx context.Context
+}
+
+// newStdinReader returns a reader of stdin that fails with the context's error once the
+// context is done, instead of blocking until the next line is typed.
+//
+// Parameters:
+//   - ctx: context.Context - Cancels pending reads.
+//
+// Returns:
+//   - io.Reader: The reader.
+func newStdinReader(ctx context.Context) io.Reader {
+	return stdinReader{ctx: ctx}
+}
+
+func (r stdinReader) Read(p []byte) (int, error) {
+	fds := []unix.PollFd{{Fd: int32(os.Stdin.Fd()), Events: unix.POLLIN}}
+	for {
+		if err := r.ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		n, err := unix.Poll(fds, 100)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			// stdin can't be polled, fall back to a blocking read
+			return os.Stdin.Read(p)
+		}
+		if n > 0 {
+			return os.Stdin.Read(p)
+		}
+	}
+}
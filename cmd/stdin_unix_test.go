@@ -0,0 +1,53 @@
+//go:build unix
+
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStdinReaderCancel(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %v", err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var delivered string
+	done := make(chan struct{})
+	go func() {
+		readTeamTokens(newStdinReader(ctx), func(token string) { delivered = token })
+		close(done)
+	}()
+
+	// e.g. the token arrived through the callback listener
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("reading stdin didn't stop")
+	}
+	if delivered != "" {
+		t.Errorf("delivered %q without input", delivered)
+	}
+
+	// input typed afterwards is left for the next prompt
+	if _, err := w.WriteString("y\n"); err != nil {
+		t.Fatalf("failed to write to pipe: %v", err)
+	}
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil || line != "y\n" {
+		t.Errorf("next prompt read %q, %v, want %q", line, err, "y\n")
+	}
+}
@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/Diniboy1123/usque/api"
+)
+
+// teamLogin runs the Zero Trust login flow. It prints the team's login URL and waits until
+// the redirect URL shown after logging in is pasted, either on stdin or into the page served
+// by the local callback listener. The listener also accepts the redirect directly on /auth,
+// e.g. when the com.cloudflare.warp:// scheme is rewritten to point at it.
+//
+// Parameters:
+//   - ctx: context.Context - Cancels the login.
+//   - team: string - The team name, domain or stand-in URL. (see api.TeamLoginURL)
+//   - callback: string - Address of the local callback listener, empty to only read stdin.
+//
+// Returns:
+//   - string: The team token.
+//   - error: An error if the login URL is invalid, the listener can't be started or no token was given.
+func teamLogin(ctx context.Context, team, callback string) (string, error) {
+	loginURL, err := api.TeamLoginURL(team)
+	if err != nil {
+		return "", err
+	}
+
+	tokens := make(chan string, 1)
+	deliver := func(token string) {
+		select {
+		case tokens <- token:
+		default:
+		}
+	}
+	stdinDone := make(chan struct{})
+
+	log.Printf("Log in to your organization at %s", loginURL)
+	log.Printf("Once logged in, copy the link behind the \"Open Cloudflare WARP\" button (com.cloudflare.warp://...)")
+
+	if callback != "" {
+		listener, err := net.Listen("tcp", callback)
+		if err != nil {
+			return "", fmt.Errorf("failed to start callback listener: %v", err)
+		}
+
+		server := &http.Server{Handler: teamCallbackHandler(loginURL, deliver)}
+		go server.Serve(listener)
+		defer server.Close()
+
+		log.Printf("Paste the link below or at http://%s", listener.Addr())
+	}
+
+	// Stop reading stdin once we return, so later prompts get their input.
+	stdinCtx, stopStdin := context.WithCancel(ctx)
+	defer stopStdin()
+	go func() {
+		readTeamTokens(newStdinReader(stdinCtx), deliver)
+		close(stdinDone)
+	}()
+
+	fmt.Print("Redirect URL or token: ")
+
+	for {
+		select {
+		case token := <-tokens:
+			return token, nil
+		case <-stdinDone:
+			if callback == "" {
+				return "", errors.New("no team token given")
+			}
+			// Keep waiting for the callback listener, stdin may just not be interactive.
+			stdinDone = nil
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+// readTeamTokens reads pasted redirect URLs or tokens line by line until a valid one is found.
+//
+// Parameters:
+//   - r: io.Reader - The input to read.
+//   - deliver: func(string) - Called with the first valid token.
+func readTeamTokens(r io.Reader, deliver func(string)) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if scanner.Text() == "" {
+			continue
+		}
+
+		token, err := api.ParseTeamToken(scanner.Text())
+		if err != nil {
+			fmt.Printf("Invalid input: %v. Try again: ", err)
+			continue
+		}
+
+		deliver(token)
+		return
+	}
+}
+
+// teamCallbackHandler serves the callback listener of teamLogin. GET / shows a form to paste
+// the redirect URL into, GET /?url=<redirect> and GET /auth?token=<token> take the token.
+//
+// Parameters:
+//   - loginURL: string - The login URL to link to from the form.
+//   - deliver: func(string) - Called with every valid token.
+//
+// Returns:
+//   - http.Handler: The handler.
+func teamCallbackHandler(loginURL string, deliver func(string)) http.Handler {
+	mux := http.NewServeMux()
+
+	respond := func(w http.ResponseWriter, input string) {
+		token, err := api.ParseTeamToken(input)
+		if err != nil {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "<p>Invalid input: %s</p><p><a href=\"/\">Try again</a></p>", html.EscapeString(err.Error()))
+			return
+		}
+
+		deliver(token)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, "<p>Token received, you can close this window.</p>")
+	}
+
+	mux.HandleFunc("GET /auth", func(w http.ResponseWriter, r *http.Request) {
+		respond(w, r.URL.Query().Get("token"))
+	})
+
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		if input := r.URL.Query().Get("url"); input != "" {
+			respond(w, input)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, `<!DOCTYPE html>
+<title>usque team login</title>
+<p>1. Log in at <a href="%[1]s" target="_blank">%[1]s</a></p>
+<p>2. Copy the link behind the "Open Cloudflare WARP" button and paste it here:</p>
+<form method="get" action="/"><input name="url" size="80" autofocus> <button>Submit</button></form>
+`, html.EscapeString(loginURL))
+	})
+
+	return mux
+}
@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/Diniboy1123/usque/internal/mockapi"
+)
+
+func TestTeamCallbackHandler(t *testing.T) {
+	mock, err := mockapi.New()
+	if err != nil {
+		t.Fatalf("failed to create mock API: %v", err)
+	}
+	stand := httptest.NewServer(mock)
+	defer stand.Close()
+
+	// follow the stand-in login page to the link a browser would show
+	resp, err := stand.Client().Get(stand.URL + "/warp")
+	if err != nil {
+		t.Fatalf("failed to open login page: %v", err)
+	}
+	page, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("failed to read login page: %v", err)
+	}
+	link := regexp.MustCompile(`href="([^"]*)"`).FindSubmatch(page)
+	if link == nil {
+		t.Fatalf("login page has no link: %s", page)
+	}
+	redirect := string(link[1])
+	token := redirect[strings.Index(redirect, "token=")+len("token="):]
+
+	tests := []struct {
+		name       string
+		target     string
+		wantStatus int
+		wantToken  string
+	}{
+		{name: "form", target: "/", wantStatus: http.StatusOK},
+		{name: "pasted redirect", target: "/?url=" + url.QueryEscape(redirect), wantStatus: http.StatusOK, wantToken: token},
+		{name: "direct redirect", target: "/auth?token=" + url.QueryEscape(token), wantStatus: http.StatusOK, wantToken: token},
+		{name: "redirect without token", target: "/?url=" + url.QueryEscape("com.cloudflare.warp://acme/auth"), wantStatus: http.StatusBadRequest},
+		{name: "malformed token", target: "/auth?token=not-a-token", wantStatus: http.StatusBadRequest},
+		{name: "empty token", target: "/auth", wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var delivered string
+			handler := teamCallbackHandler(stand.URL+"/warp", func(token string) { delivered = token })
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.target, nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if delivered != tt.wantToken {
+				t.Errorf("delivered token %q, want %q", delivered, tt.wantToken)
+			}
+		})
+	}
+}
+
+func TestReadTeamTokens(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{name: "redirect URL", input: "com.cloudflare.warp://acme/auth?token=a.b.c\n", want: "a.b.c"},
+		{name: "retried after malformed input", input: "garbage\n\ncom.cloudflare.warp://acme/auth\na.b.c\n", want: "a.b.c"},
+		{name: "only malformed input", input: "garbage\nhttp://acme/\n"},
+		{name: "empty input"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			readTeamTokens(strings.NewReader(tt.input), func(token string) { got = token })
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/client"
+	"github.com/spf13/cobra"
+)
+
+// tunnelClient creates a MASQUE client for the selected profile from the tunnel flags of
+// the running command.
+//
+// Parameters:
+//   - cmd: *cobra.Command - The running command.
+//   - opts: ...client.Option - Further options, e.g. client.WithDevice.
+//
+// Returns:
+//   - *client.Client: The client, not started yet.
+//   - error: An error if a flag is invalid or the client can't be created.
+func tunnelClient(cmd *cobra.Command, opts ...client.Option) (*client.Client, error) {
+	cfg := commandConfig(cmd)
+	if cfg == nil {
+		return nil, errors.New("config not loaded")
+	}
+
+	sni, err := cmd.Flags().GetString("sni-address")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get SNI address: %v", err)
+	}
+
+	connectURI, err := cmd.Flags().GetString("connect-uri")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get connect URI: %v", err)
+	}
+
+	keepalivePeriod, err := cmd.Flags().GetDuration("keepalive-period")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get keepalive period: %v", err)
+	}
+
+	initialPacketSize, err := cmd.Flags().GetUint16("initial-packet-size")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get initial packet size: %v", err)
+	}
+
+	connectPort, err := cmd.Flags().GetInt("connect-port")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get connect port: %v", err)
+	}
+
+	ipv6, err := cmd.Flags().GetBool("ipv6")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ipv6 flag: %v", err)
+	}
+
+	noTunnelIPv4, err := cmd.Flags().GetBool("no-tunnel-ipv4")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get no tunnel IPv4: %v", err)
+	}
+
+	noTunnelIPv6, err := cmd.Flags().GetBool("no-tunnel-ipv6")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get no tunnel IPv6: %v", err)
+	}
+
+	mtu, err := cmd.Flags().GetInt("mtu")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get MTU: %v", err)
+	}
+	if mtu != client.DefaultMTU {
+		log.Println("Warning: MTU is not the default 1280. This is not supported. Packet loss and other issues may occur.")
+	}
+
+	reconnectDelay, err := cmd.Flags().GetDuration("reconnect-delay")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get reconnect delay: %v", err)
+	}
+
+	rotateInterval, err := cmd.Flags().GetDuration("rotate-interval")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rotate interval: %v", err)
+	}
+
+	drainPeriod, err := cmd.Flags().GetDuration("drain-period")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get drain period: %v", err)
+	}
+
+	onDemand, err := cmd.Flags().GetBool("on-demand")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get on-demand flag: %v", err)
+	}
+
+	idleTimeout, err := cmd.Flags().GetDuration("idle-timeout")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get idle timeout: %v", err)
+	}
+
+	options := []client.Option{
+		client.WithSNI(sni),
+		client.WithConnectURI(connectURI),
+		client.WithKeepalivePeriod(keepalivePeriod),
+		client.WithInitialPacketSize(initialPacketSize),
+		client.WithConnectPort(connectPort),
+		client.WithIPv6Endpoint(ipv6),
+		client.WithTunnelIPv4(!noTunnelIPv4),
+		client.WithTunnelIPv6(!noTunnelIPv6),
+		client.WithMTU(mtu),
+		client.WithReconnectDelay(reconnectDelay),
+		client.WithRotation(rotateInterval, drainPeriod),
+	}
+	if onDemand {
+		options = append(options, client.WithOnDemand(idleTimeout))
+	}
+
+	// nativetun has no DNS servers, the system resolver is used there.
+	if cmd.Flags().Lookup("dns") != nil {
+		dnsServers, err := cmd.Flags().GetStringArray("dns")
+		if err != nil {
+			return nil, fmt.Errorf("failed to get DNS servers: %v", err)
+		}
+		dnsAddrs, err := parseDNSServers(dnsServers)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse DNS server: %v", err)
+		}
+		options = append(options, client.WithDNS(dnsAddrs))
+	}
+
+	return client.New(cfg, append(options, opts...)...)
+}
+
+// parseDNSServers parses the addresses given with the dns flag.
+//
+// Parameters:
+//   - dnsServers: []string - The DNS server addresses.
+//
+// Returns:
+//   - []netip.Addr: The parsed addresses.
+//   - error: An error if an address is invalid.
+func parseDNSServers(dnsServers []string) ([]netip.Addr, error) {
+	var dnsAddrs []netip.Addr
+	for _, dns := range dnsServers {
+		addr, err := netip.ParseAddr(dns)
+		if err != nil {
+			return nil, err
+		}
+		dnsAddrs = append(dnsAddrs, addr)
+	}
+	return dnsAddrs, nil
+}
+
+// runTunnel starts the client in the background. The process exits if the tunnel stops,
+// e.g. because the server rejected our key.
+func runTunnel(tunnel *client.Client) {
+	if err := tunnel.Start(context.Background()); err != nil {
+		log.Fatalf("Failed to start tunnel: %v", err)
+	}
+
+	go func() {
+		err := tunnel.Wait()
+		if errors.Is(err, api.ErrAuthDenied) {
+			log.Println("Your key may have been revoked or replaced. Run the enroll command to enroll it again.")
+		}
+		log.Fatalf("Tunnel stopped: %v", err)
+	}()
+}
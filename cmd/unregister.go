@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/spf13/cobra"
+)
+
+var unregisterCmd = &cobra.Command{
+	Use:   "unregister",
+	Short: "Delete the registration and wipe local secrets",
+	Long: "Deletes the device registration from the server, then removes the private key, access token" +
+		" and device ID from the config. The rest of the config is kept.",
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg := commandConfig(cmd)
+		if cfg == nil || cfg.ID == "" {
+			cmd.Println("Config not loaded or not registered. Nothing to unregister.")
+			return
+		}
+
+		configPath, err := cmd.Flags().GetString("config")
+		if err != nil {
+			log.Fatalf("Failed to get config path: %v", err)
+		}
+		if configPath == "" {
+			log.Fatalf("Config path is required")
+		}
+
+		yes, err := cmd.Flags().GetBool("yes")
+		if err != nil {
+			log.Fatalf("Failed to get yes flag: %v", err)
+		}
+
+		force, err := cmd.Flags().GetBool("force")
+		if err != nil {
+			log.Fatalf("Failed to get force flag: %v", err)
+		}
+
+		if !yes {
+			fmt.Printf("This deletes device %s and its keys from %s. Continue? (y/n): ", cfg.ID, savedProfile(cfg, configPath))
+			var response string
+			if _, err := fmt.Scanln(&response); err != nil {
+				log.Fatalf("Failed to read user input: %v", err)
+			}
+			if response != "y" {
+				return
+			}
+		}
+
+		withAPI(cmd, func(cfg *config.Config, profile api.ClientProfile, httpClient *http.Client) {
+			apiErr, err := api.Unregister(cmd.Context(), httpClient, profile, configAccount(cfg))
+			if err != nil {
+				if !force {
+					fatalAPIError("Failed to unregister (use --force to wipe the local secrets anyway)", apiErr, err)
+				}
+				log.Printf("Failed to unregister, wiping local secrets anyway: %v", err)
+			} else {
+				log.Printf("Deleted registration %s", cfg.ID)
+			}
+		})
+
+		if err := cfg.WipeSecrets(configPath); err != nil {
+			log.Fatalf("Failed to wipe secrets: %v", err)
+		}
+
+		log.Printf("Removed private key, access token and device ID from %s", savedProfile(cfg, configPath))
+	},
+}
+
+func init() {
+	unregisterCmd.Flags().BoolP("yes", "y", false, "Don't ask for confirmation")
+	unregisterCmd.Flags().BoolP("force", "f", false, "Wipe the local secrets even if the server can't be reached")
+	rootCmd.AddCommand(unregisterCmd)
+}
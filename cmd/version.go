@@ -13,8 +13,9 @@ var (
 )
 
 var versionCmd = &cobra.Command{
-	Use:   "version",
-	Short: "Print the version number of usque",
+	Use:         "version",
+	Short:       "Print the version number of usque",
+	Annotations: noSecrets,
 	Run: func(cmd *cobra.Command, args []string) {
 		fmt.Printf("usque version: %s\n", version)
 		fmt.Printf("Commit: %s\n", commit)
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"bytes"
 	"crypto/ecdsa"
 	"crypto/x509"
 	"encoding/base64"
@@ -8,71 +9,377 @@ import (
 	"encoding/pem"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
 )
 
 // Config represents the application configuration structure, containing essential details such as keys, endpoints, and access tokens.
 type Config struct {
-	PrivateKey     string `json:"private_key"`      // Base64-encoded ECDSA private key
-	EndpointV4     string `json:"endpoint_v4"`      // IPv4 address of the endpoint
-	EndpointV6     string `json:"endpoint_v6"`      // IPv6 address of the endpoint
-	EndpointPubKey string `json:"endpoint_pub_key"` // PEM-encoded ECDSA public key of the endpoint to verify against
-	License        string `json:"license"`          // Application license key
-	ID             string `json:"id"`               // Device unique identifier
-	AccessToken    string `json:"access_token"`     // Authentication token for API access
-	IPv4           string `json:"ipv4"`             // Assigned IPv4 address
-	IPv6           string `json:"ipv6"`             // Assigned IPv6 address
+	PrivateKey     string `json:"private_key"`            // Base64-encoded ECDSA private key
+	EndpointV4     string `json:"endpoint_v4"`            // IPv4 address of the endpoint
+	EndpointV6     string `json:"endpoint_v6"`            // IPv6 address of the endpoint
+	EndpointPubKey string `json:"endpoint_pub_key"`       // PEM-encoded ECDSA public key of the endpoint to verify against
+	License        string `json:"license"`                // Application license key
+	AccountType    string `json:"account_type,omitempty"` // Type of the account (e.g., free, limited)
+	ID             string `json:"id"`                     // Device unique identifier
+	AccessToken    string `json:"access_token"`           // Authentication token for API access
+	IPv4           string `json:"ipv4"`                   // Assigned IPv4 address
+	IPv6           string `json:"ipv6"`                   // Assigned IPv6 address
+	APISettings
+	Settings Settings `json:"settings,omitempty"` // Command options, see Settings
+	Sealed   string   `json:"sealed,omitempty"`   // Encrypted secrets in an encrypted config file, see Encryption
+
+	file    *File  // File the config was selected from, see File.Select
+	profile string // Name of the profile in file
+}
+
+// Settings holds command options keyed by section. A section is named after the command
+// (e.g., "socks", "http-proxy" or "devices list") and maps flag names to values. Values are
+// strings, numbers, booleans or, for repeatable flags, arrays of these. The GlobalSection
+// applies to every command that has the flag.
+type Settings map[string]map[string]any
+
+// GlobalSection is the Settings section that applies to every command.
+const GlobalSection = "global"
+
+// APISettings override the registration API parameters of the client profile. Empty fields keep the profile's value.
+type APISettings struct {
+	ClientProfile string `json:"client_profile,omitempty"` // Name of the built-in client profile
+	ApiUrl        string `json:"api_url,omitempty"`        // Base URL of the API
+	ApiVersion    string `json:"api_version,omitempty"`    // API version path segment
+	ClientVersion string `json:"client_version,omitempty"` // Value of the CF-Client-Version header
+	UserAgent     string `json:"user_agent,omitempty"`     // Value of the User-Agent header
 }
 
-// AppConfig holds the global application configuration.
-var AppConfig Config
+// DefaultProfile is the name of the profile stored in the top level of the config file.
+// Files written before named profiles existed only hold this one.
+const DefaultProfile = "default"
 
-// ConfigLoaded indicates whether the configuration has been successfully loaded.
-var ConfigLoaded bool
+// File is the layout of the config file. The top level holds the default profile,
+// Profiles holds any number of further named ones.
+type File struct {
+	Version         int               `json:"version"`                   // Version of the config format, see CurrentVersion
+	Default         Config            `json:"-"`                         // Default profile, stored in the top level
+	SelectedProfile string            `json:"default_profile,omitempty"` // Profile used when none is selected
+	Profiles        map[string]Config `json:"profiles,omitempty"`        // Named profiles
+	Encryption      *Encryption       `json:"encryption,omitempty"`      // Set if the secrets are sealed with a passphrase
 
-// LoadConfig loads the application configuration from a JSON file.
+	key          []byte // Key derived from the passphrase of an encrypted file, set by Unlock
+	migratedFrom int    // Version the file was loaded with, if it was migrated
+	migrated     bool   // Whether the file was migrated when it was loaded
+}
+
+// fileJSON is the JSON encoding of File, with the fields of the default profile in the top level.
+type fileJSON struct {
+	Version int `json:"version"`
+	Config
+	SelectedProfile string            `json:"default_profile,omitempty"`
+	Profiles        map[string]Config `json:"profiles,omitempty"`
+	Encryption      *Encryption       `json:"encryption,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (f File) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(fileJSON{
+		Version:         f.Version,
+		Config:          f.Default,
+		SelectedProfile: f.SelectedProfile,
+		Profiles:        f.Profiles,
+		Encryption:      f.Encryption,
+	}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (f *File) UnmarshalJSON(data []byte) error {
+	var v fileJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	f.Version = v.Version
+	f.Default = v.Config
+	f.SelectedProfile = v.SelectedProfile
+	f.Profiles = v.Profiles
+	f.Encryption = v.Encryption
+
+	return nil
+}
+
+// Profile returns a profile of the file.
+//
+// Parameters:
+//   - name: string - The profile name, DefaultProfile for the top level.
+//
+// Returns:
+//   - Config: The profile.
+//   - bool: False if there is no such profile.
+func (f *File) Profile(name string) (Config, bool) {
+	if name == DefaultProfile {
+		return f.Default, true
+	}
+	profile, ok := f.Profiles[name]
+	return profile, ok
+}
+
+// SetProfile adds or replaces a profile of the file.
+//
+// Parameters:
+//   - name: string - The profile name, DefaultProfile for the top level.
+//   - profile: Config - The profile.
+func (f *File) SetProfile(name string, profile Config) {
+	if name == DefaultProfile {
+		f.Default = profile
+		return
+	}
+	if f.Profiles == nil {
+		f.Profiles = make(map[string]Config)
+	}
+	f.Profiles[name] = profile
+}
+
+// ProfileNames returns the names of all profiles, the default profile first.
+//
+// Returns:
+//   - []string: The profile names.
+func (f *File) ProfileNames() []string {
+	names := make([]string, 0, len(f.Profiles))
+	for name := range f.Profiles {
+		if name != DefaultProfile {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return append([]string{DefaultProfile}, names...)
+}
+
+// LoadFile loads a config file with all its profiles. Files of older versions are migrated
+// to CurrentVersion in memory, see File.Migrated. The secrets of an encrypted file stay
+// sealed until it is unlocked with File.Unlock.
 //
 // Parameters:
 //   - configPath: string - The path to the configuration JSON file.
 //
 // Returns:
-//   - error: An error if the configuration file cannot be loaded or parsed.
-func LoadConfig(configPath string) error {
-	file, err := os.Open(configPath)
+//   - *File: The config file.
+//   - error: An error if the configuration file cannot be loaded, parsed or migrated.
+func LoadFile(configPath string) (*File, error) {
+	data, err := os.ReadFile(configPath)
 	if err != nil {
-		return fmt.Errorf("failed to open config file: %v", err)
+		return nil, fmt.Errorf("failed to open config file: %v", err)
 	}
-	defer file.Close()
 
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&AppConfig); err != nil {
-		return fmt.Errorf("failed to decode config file: %v", err)
+	data, version, err := migrate(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode config file: %v", err)
 	}
 
-	ConfigLoaded = true
+	var f File
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to decode config file: %v", err)
+	}
+	if version != CurrentVersion {
+		f.migratedFrom = version
+		f.migrated = true
+	}
 
-	return nil
+	return &f, nil
+}
+
+// Migrated reports whether the file was migrated from an older version when it was loaded.
+// The migration is only written back when the file is saved, e.g. by the config migrate command.
+//
+// Returns:
+//   - int: The version of the file on disk.
+//   - bool: True if the file was migrated.
+func (f *File) Migrated() (int, bool) {
+	return f.migratedFrom, f.migrated
+}
+
+// LoadConfig loads a profile of an unencrypted config file. For encrypted files, use LoadFile,
+// File.Unlock and File.Select.
+//
+// Parameters:
+//   - configPath: string - The path to the configuration JSON file.
+//   - profile: string - The profile to select, empty for the file's default.
+//
+// Returns:
+//   - *Config: The profile, saved back to its place in the file by SaveConfig.
+//   - error: An error if the configuration file cannot be loaded or parsed, is encrypted or has no such profile.
+func LoadConfig(configPath, profile string) (*Config, error) {
+	f, err := LoadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	if f.Encrypted() {
+		return nil, fmt.Errorf("config file is encrypted")
+	}
+
+	return f.Select(profile)
+}
+
+// ProfileName resolves the name of the profile to select.
+//
+// Parameters:
+//   - name: string - The requested profile, empty for the file's default.
+//
+// Returns:
+//   - string: The name, default_profile or else DefaultProfile if name is empty.
+func (f *File) ProfileName(name string) string {
+	if name == "" {
+		name = f.SelectedProfile
+	}
+	if name == "" {
+		name = DefaultProfile
+	}
+	return name
 }
 
-// SaveConfig writes the current application configuration to a prettified JSON file.
+// Select returns a profile of the file. If the file is encrypted and unlocked, its secrets are unsealed.
+//
+// Parameters:
+//   - name: string - The profile, empty for the file's default.
+//
+// Returns:
+//   - *Config: A copy of the profile, saved back to the file by SaveConfig.
+//   - error: An error if there is no such profile or its secrets can't be unsealed.
+func (f *File) Select(name string) (*Config, error) {
+	name = f.ProfileName(name)
+
+	profile, ok := f.Profile(name)
+	if !ok {
+		return nil, fmt.Errorf("profile %q not found", name)
+	}
+
+	if f.Unlocked() {
+		var err error
+		if profile, err = f.unseal(name, profile); err != nil {
+			return nil, fmt.Errorf("failed to unseal profile %s: %v", name, err)
+		}
+	}
+
+	profile.file = f
+	profile.profile = name
+
+	return &profile, nil
+}
+
+// NewConfig returns an empty profile that replaces the profile of the same name once it is saved.
+//
+// Parameters:
+//   - name: string - The profile, empty for the file's default.
+//
+// Returns:
+//   - *Config: The empty profile.
+func (f *File) NewConfig(name string) *Config {
+	return &Config{file: f, profile: f.ProfileName(name)}
+}
+
+// Profile returns the name of the profile the config was selected as.
+//
+// Returns:
+//   - string: The profile name, DefaultProfile for configs that don't belong to a file.
+func (c *Config) Profile() string {
+	if c.profile == "" {
+		return DefaultProfile
+	}
+	return c.profile
+}
+
+// File returns the config file the config was selected from.
+//
+// Returns:
+//   - *File: The file, nil for configs that don't belong to a file.
+func (c *Config) File() *File {
+	return c.file
+}
+
+// SaveConfig writes the configuration to a prettified JSON file. A config selected from a file
+// replaces its profile there and the other profiles of the file are kept. Any other config is
+// written as the only profile of a new file.
+//
+// Parameters:
+//   - configPath: string - The path to save the configuration JSON file.
+//
+// Returns:
+//   - error: An error if the configuration file cannot be written.
+func (c *Config) SaveConfig(configPath string) error {
+	if c.file == nil {
+		c.file = &File{}
+		c.profile = DefaultProfile
+	}
+
+	c.file.SetProfile(c.Profile(), *c)
+	return c.file.Save(configPath)
+}
+
+// Save writes the whole config file with all profiles as prettified JSON. The secrets of an
+// encrypted file are sealed first. The file is replaced atomically and only readable by its owner.
 //
 // Parameters:
 //   - configPath: string - The path to save the configuration JSON file.
 //
 // Returns:
 //   - error: An error if the configuration file cannot be written.
-func (*Config) SaveConfig(configPath string) error {
-	file, err := os.Create(configPath)
+func (f *File) Save(configPath string) error {
+	f.Version = CurrentVersion
+
+	out, err := f.sealed()
 	if err != nil {
-		return fmt.Errorf("failed to create config file: %v", err)
+		return err
 	}
-	defer file.Close()
 
-	encoder := json.NewEncoder(file)
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
 	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(AppConfig); err != nil {
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(out); err != nil {
 		return fmt.Errorf("failed to encode config file: %v", err)
 	}
 
+	return WriteFile(configPath, buf.Bytes())
+}
+
+// WriteFile replaces a file atomically with data, through a temporary file in the same
+// directory. The new file is only readable by its owner, whatever the mode of the old one.
+//
+// Parameters:
+//   - path: string - The path of the file.
+//   - data: []byte - The new contents.
+//
+// Returns:
+//   - error: An error if the file cannot be written.
+func WriteFile(path string, data []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create config file: %v", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if err := file.Chmod(0600); err != nil {
+		return fmt.Errorf("failed to restrict config file permissions: %v", err)
+	}
+
+	if _, err := file.Write(data); err != nil {
+		return fmt.Errorf("failed to write config file: %v", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync config file: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write config file: %v", err)
+	}
+
+	if err := os.Rename(file.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace config file: %v", err)
+	}
+
 	return nil
 }
 
@@ -81,8 +388,8 @@ func (*Config) SaveConfig(configPath string) error {
 // Returns:
 //   - *ecdsa.PrivateKey: The parsed ECDSA private key.
 //   - error: An error if decoding or parsing the private key fails.
-func (*Config) GetEcPrivateKey() (*ecdsa.PrivateKey, error) {
-	privKeyB64, err := base64.StdEncoding.DecodeString(AppConfig.PrivateKey)
+func (c *Config) GetEcPrivateKey() (*ecdsa.PrivateKey, error) {
+	privKeyB64, err := base64.StdEncoding.DecodeString(c.PrivateKey)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decode private key: %v", err)
 	}
@@ -100,8 +407,8 @@ func (*Config) GetEcPrivateKey() (*ecdsa.PrivateKey, error) {
 // Returns:
 //   - *ecdsa.PublicKey: The parsed ECDSA public key.
 //   - error: An error if decoding or parsing the public key fails.
-func (*Config) GetEcEndpointPublicKey() (*ecdsa.PublicKey, error) {
-	endpointPubKeyB64, _ := pem.Decode([]byte(AppConfig.EndpointPubKey))
+func (c *Config) GetEcEndpointPublicKey() (*ecdsa.PublicKey, error) {
+	endpointPubKeyB64, _ := pem.Decode([]byte(c.EndpointPubKey))
 	if endpointPubKeyB64 == nil {
 		return nil, fmt.Errorf("failed to decode endpoint public key")
 	}
@@ -118,3 +425,54 @@ func (*Config) GetEcEndpointPublicKey() (*ecdsa.PublicKey, error) {
 
 	return ecPubKey, nil
 }
+
+// WipeSecrets removes the private key, access token and device ID from the configuration.
+// The remaining configuration replaces the file atomically like SaveConfig does, and only
+// then are the old file contents overwritten with zeros, so the secrets don't linger on disk
+// and the configuration is never left without an intact copy. The old contents are kept
+// reachable through a temporary hard link until they are wiped; on file systems without hard
+// links they are only unlinked.
+//
+// Parameters:
+//   - configPath: string - The path of the configuration JSON file.
+//
+// Returns:
+//   - error: An error if the configuration cannot be written or the old contents cannot be overwritten.
+func (c *Config) WipeSecrets(configPath string) error {
+	oldPath := filepath.Join(filepath.Dir(configPath), "."+filepath.Base(configPath)+".wipe")
+	os.Remove(oldPath)
+	linked := os.Link(configPath, oldPath) == nil
+	if linked {
+		defer os.Remove(oldPath)
+	}
+
+	c.PrivateKey = ""
+	c.AccessToken = ""
+	c.ID = ""
+
+	if err := c.SaveConfig(configPath); err != nil {
+		return err
+	}
+	if !linked {
+		return nil
+	}
+
+	old, err := os.OpenFile(oldPath, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open old config file: %v", err)
+	}
+	defer old.Close()
+
+	info, err := old.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat old config file: %v", err)
+	}
+	if _, err := old.Write(make([]byte, info.Size())); err != nil {
+		return fmt.Errorf("failed to overwrite old config file: %v", err)
+	}
+	if err := old.Sync(); err != nil {
+		return fmt.Errorf("failed to sync old config file: %v", err)
+	}
+
+	return nil
+}
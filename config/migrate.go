@@ -0,0 +1,118 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// CurrentVersion is the version of the config format written by this build. It is bumped
+// whenever existing files need a migration to be read correctly.
+const CurrentVersion = 2
+
+// migrations upgrade a decoded config file in place, migrations[n] from version n to n+1.
+// Files without a version field are version 0.
+var migrations = []func(file map[string]any) error{
+	migrateEndpoints,
+	migrateBoundSeals,
+}
+
+// migrate upgrades the JSON of a config file to CurrentVersion.
+//
+// Parameters:
+//   - data: []byte - The JSON of the config file.
+//
+// Returns:
+//   - []byte: The JSON of the upgraded file, data itself if it is up to date.
+//   - int: The version of data.
+//   - error: An error if data is not a JSON object, its version is unknown or a migration fails.
+func migrate(data []byte) ([]byte, int, error) {
+	var file map[string]any
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, 0, err
+	}
+
+	version := 0
+	if v, ok := file["version"]; ok {
+		number, ok := v.(float64)
+		if !ok || number != float64(int(number)) || number < 0 {
+			return nil, 0, fmt.Errorf("invalid version %v", v)
+		}
+		version = int(number)
+	}
+
+	if version > CurrentVersion {
+		return nil, version, fmt.Errorf("config version %d is newer than the supported version %d, update usque", version, CurrentVersion)
+	}
+	if version == CurrentVersion {
+		return data, version, nil
+	}
+
+	for v := version; v < CurrentVersion; v++ {
+		if err := migrations[v](file); err != nil {
+			return nil, version, fmt.Errorf("failed to migrate from version %d: %v", v, err)
+		}
+	}
+	file["version"] = CurrentVersion
+
+	migrated, err := json.Marshal(file)
+	if err != nil {
+		return nil, version, err
+	}
+
+	return migrated, version, nil
+}
+
+// profileObjects returns the JSON objects of all profiles of a decoded config file.
+func profileObjects(file map[string]any) []map[string]any {
+	objects := []map[string]any{file}
+	if profiles, ok := file["profiles"].(map[string]any); ok {
+		for _, profile := range profiles {
+			if object, ok := profile.(map[string]any); ok {
+				objects = append(objects, object)
+			}
+		}
+	}
+	return objects
+}
+
+// migrateEndpoints (version 0 to 1) repairs endpoints written by versions that cut the
+// port off the API's "address:port" by length, which left parts of ports other than 0
+// behind. (e.g., "162.159.198.1:4" or "2606:4700:103::]:")
+func migrateEndpoints(file map[string]any) error {
+	for _, profile := range profileObjects(file) {
+		for _, key := range []string{"endpoint_v4", "endpoint_v6"} {
+			if endpoint, ok := profile[key].(string); ok && endpoint != "" {
+				profile[key] = repairEndpoint(endpoint)
+			}
+		}
+	}
+	return nil
+}
+
+// repairEndpoint strips brackets and port remnants from an endpoint address.
+// Values that can't be repaired are returned as they are, validation reports them.
+func repairEndpoint(endpoint string) string {
+	if _, err := netip.ParseAddr(endpoint); err == nil {
+		return endpoint
+	}
+
+	host := strings.TrimPrefix(endpoint, "[")
+	if i := strings.Index(host, "]"); i >= 0 {
+		host = host[:i]
+	} else if strings.Count(host, ":") == 1 {
+		host = host[:strings.Index(host, ":")]
+	}
+
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return addr.String()
+	}
+	return endpoint
+}
+
+// migrateBoundSeals (version 1 to 2) leaves the JSON as it is. Version 2 binds sealed values
+// to their profile and field, which needs the key, so File.Unlock reseals older encrypted files.
+func migrateBoundSeals(file map[string]any) error {
+	return nil
+}
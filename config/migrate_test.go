@@ -0,0 +1,164 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		wantVersion int
+		wantErr     bool
+		check       map[string]string // Top level or profile ("work.endpoint_v4") fields after migration
+	}{
+		{
+			name:        "version 0",
+			data:        `{"endpoint_v4": "162.159.198.1:4", "endpoint_v6": "2606:4700:103::]:", "profiles": {"work": {"endpoint_v4": "[162.159.198.2]:0", "endpoint_v6": "2606:4700:103::2"}}}`,
+			wantVersion: 0,
+			check: map[string]string{
+				"endpoint_v4":      "162.159.198.1",
+				"endpoint_v6":      "2606:4700:103::",
+				"work.endpoint_v4": "162.159.198.2",
+				"work.endpoint_v6": "2606:4700:103::2",
+			},
+		},
+		{
+			name:        "version 0 with unrepairable endpoint",
+			data:        `{"endpoint_v4": "not an address"}`,
+			wantVersion: 0,
+			check:       map[string]string{"endpoint_v4": "not an address"},
+		},
+		{
+			name:        "version 1",
+			data:        `{"version": 1, "endpoint_v4": "162.159.198.1:4", "sealed": "abc"}`,
+			wantVersion: 1,
+			// endpoints were repaired when the file became version 1
+			check: map[string]string{"endpoint_v4": "162.159.198.1:4", "sealed": "abc"},
+		},
+		{
+			name:        "current version",
+			data:        `{"version": 2, "endpoint_v4": "162.159.198.1"}`,
+			wantVersion: CurrentVersion,
+			check:       map[string]string{"endpoint_v4": "162.159.198.1"},
+		},
+		{name: "newer version", data: `{"version": 3}`, wantVersion: 3, wantErr: true},
+		{name: "fractional version", data: `{"version": 1.5}`, wantErr: true},
+		{name: "negative version", data: `{"version": -1}`, wantErr: true},
+		{name: "string version", data: `{"version": "2"}`, wantErr: true},
+		{name: "not an object", data: `["version", 2]`, wantErr: true},
+		{name: "not JSON", data: `version = 2`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, version, err := migrate([]byte(tt.data))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", data)
+				}
+				if version != tt.wantVersion {
+					t.Errorf("version = %d, want %d", version, tt.wantVersion)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if version != tt.wantVersion {
+				t.Errorf("version = %d, want %d", version, tt.wantVersion)
+			}
+			if version == CurrentVersion && string(data) != tt.data {
+				t.Errorf("up to date file changed to %s", data)
+			}
+
+			var file map[string]any
+			if err := json.Unmarshal(data, &file); err != nil {
+				t.Fatalf("failed to decode migrated file: %v", err)
+			}
+			if file["version"] != float64(CurrentVersion) {
+				t.Errorf("migrated version = %v, want %d", file["version"], CurrentVersion)
+			}
+			for key, want := range tt.check {
+				object := file
+				if profile, field, ok := strings.Cut(key, "."); ok {
+					object = file["profiles"].(map[string]any)[profile].(map[string]any)
+					key = field
+				}
+				if got := object[key]; got != want {
+					t.Errorf("%s = %v, want %q", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadFileMigrated(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		wantVersion int
+		wantOK      bool
+		wantErr     bool
+	}{
+		{name: "version 0", data: `{"endpoint_v4": "162.159.198.1:0"}`, wantVersion: 0, wantOK: true},
+		{name: "version 1", data: `{"version": 1}`, wantVersion: 1, wantOK: true},
+		{name: "current", data: `{"version": 2}`},
+		{name: "newer", data: `{"version": 3}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(path, []byte(tt.data), 0600); err != nil {
+				t.Fatalf("failed to write config: %v", err)
+			}
+
+			f, err := LoadFile(path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if version, ok := f.Migrated(); version != tt.wantVersion || ok != tt.wantOK {
+				t.Errorf("Migrated() = %d, %v, want %d, %v", version, ok, tt.wantVersion, tt.wantOK)
+			}
+			if tt.wantOK && f.Default.EndpointV4 != "" && f.Default.EndpointV4 != "162.159.198.1" {
+				t.Errorf("endpoint_v4 = %q, want it repaired", f.Default.EndpointV4)
+			}
+		})
+	}
+}
+
+func TestRepairEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		want     string
+	}{
+		{endpoint: "162.159.198.1", want: "162.159.198.1"},
+		{endpoint: "2606:4700:103::1", want: "2606:4700:103::1"},
+		{endpoint: "162.159.198.1:0", want: "162.159.198.1"},
+		{endpoint: "162.159.198.1:4", want: "162.159.198.1"},
+		{endpoint: "[2606:4700:103::1]:0", want: "2606:4700:103::1"},
+		{endpoint: "[2606:4700:103::1]", want: "2606:4700:103::1"},
+		{endpoint: "2606:4700:103::]:", want: "2606:4700:103::"},
+		{endpoint: "engage.cloudflareclient.com:2408", want: "engage.cloudflareclient.com:2408"},
+		{endpoint: "garbage", want: "garbage"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.endpoint, func(t *testing.T) {
+			if got := repairEndpoint(tt.endpoint); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,350 @@
+package config
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Parameters of the scrypt key derivation for new encrypted configs. (N=2^15, as recommended for interactive logins)
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+)
+
+// checkPlaintext is sealed into Encryption.Check to tell a wrong passphrase apart from a damaged profile.
+var checkPlaintext = []byte("usque")
+
+// Names of the fields holding sealed values, bound into their associated data. (see associatedData)
+const (
+	sealedField = "sealed"
+	checkField  = "check"
+)
+
+// boundSealVersion is the first config version whose sealed values are bound to their profile
+// and field. Older encrypted files are resealed when they are unlocked.
+const boundSealVersion = 2
+
+// Encryption describes how the secrets of an encrypted config file are sealed. The private key,
+// access token and license of every profile are stored in its sealed field, AES-256-GCM encrypted
+// with a key derived from a passphrase. Each sealed value is bound to its profile and field, so
+// it can't be moved to another profile or swapped with the check value unnoticed.
+type Encryption struct {
+	KDF   string `json:"kdf"`   // Key derivation function, only "scrypt"
+	N     int    `json:"n"`     // scrypt CPU/memory cost
+	R     int    `json:"r"`     // scrypt block size
+	P     int    `json:"p"`     // scrypt parallelization
+	Salt  string `json:"salt"`  // Base64-encoded salt
+	Check string `json:"check"` // Base64-encoded sealed check value, verifies the passphrase
+}
+
+// secrets are the fields of a Config that are sealed in encrypted config files.
+type secrets struct {
+	PrivateKey  string `json:"private_key,omitempty"`
+	AccessToken string `json:"access_token,omitempty"`
+	License     string `json:"license,omitempty"`
+}
+
+// Encrypted reports whether the secrets of the file are sealed with a passphrase.
+//
+// Returns:
+//   - bool: True if the file is encrypted.
+func (f *File) Encrypted() bool {
+	return f.Encryption != nil
+}
+
+// Unlocked reports whether the key of an encrypted file is known, so it can be saved.
+//
+// Returns:
+//   - bool: True if the file is encrypted and unlocked.
+func (f *File) Unlocked() bool {
+	return f.key != nil
+}
+
+// Unlock derives the key of an encrypted file from the passphrase and checks it. Files sealed
+// before boundSealVersion are resealed in memory, and written back when the file is saved.
+//
+// Parameters:
+//   - passphrase: []byte - The passphrase.
+//
+// Returns:
+//   - error: An error if the file isn't encrypted, its parameters are invalid or the passphrase is wrong.
+func (f *File) Unlock(passphrase []byte) error {
+	if f.Encryption == nil {
+		return fmt.Errorf("config is not encrypted")
+	}
+	if f.Encryption.KDF != "scrypt" {
+		return fmt.Errorf("unsupported key derivation function %q", f.Encryption.KDF)
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(f.Encryption.Salt)
+	if err != nil {
+		return fmt.Errorf("failed to decode salt: %v", err)
+	}
+
+	key, err := scrypt.Key(passphrase, salt, f.Encryption.N, f.Encryption.R, f.Encryption.P, scryptKeyLen)
+	if err != nil {
+		return fmt.Errorf("failed to derive key: %v", err)
+	}
+
+	legacy := f.migrated && f.migratedFrom < boundSealVersion
+
+	checkData := associatedData("", checkField)
+	if legacy {
+		checkData = nil
+	}
+	check, err := open(key, f.Encryption.Check, checkData)
+	if err != nil || subtle.ConstantTimeCompare(check, checkPlaintext) != 1 {
+		return fmt.Errorf("wrong passphrase")
+	}
+
+	if legacy {
+		if err := f.rebind(key); err != nil {
+			return err
+		}
+	}
+	f.key = key
+
+	return nil
+}
+
+// rebind reseals the check value and the secrets of every profile of a file written before
+// boundSealVersion, whose sealed values aren't bound to their profile and field yet.
+func (f *File) rebind(key []byte) error {
+	check, err := seal(key, checkPlaintext, associatedData("", checkField))
+	if err != nil {
+		return err
+	}
+
+	profiles := make(map[string]Config)
+	for _, name := range f.ProfileNames() {
+		profile, _ := f.Profile(name)
+		if profile.Sealed == "" {
+			continue
+		}
+
+		plaintext, err := open(key, profile.Sealed, nil)
+		if err != nil {
+			return fmt.Errorf("profile %s: %v", name, err)
+		}
+		if profile.Sealed, err = seal(key, plaintext, associatedData(name, sealedField)); err != nil {
+			return fmt.Errorf("profile %s: %v", name, err)
+		}
+		profiles[name] = profile
+	}
+
+	encryption := *f.Encryption
+	encryption.Check = check
+	f.Encryption = &encryption
+	for name, profile := range profiles {
+		f.SetProfile(name, profile)
+	}
+
+	return nil
+}
+
+// Encrypt turns on encryption with a new salt. The secrets are sealed when the file is saved.
+//
+// Parameters:
+//   - passphrase: []byte - The new passphrase.
+//
+// Returns:
+//   - error: An error if the file is already encrypted or the key can't be derived.
+func (f *File) Encrypt(passphrase []byte) error {
+	if f.Encryption != nil {
+		return fmt.Errorf("config is already encrypted")
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return fmt.Errorf("failed to generate salt: %v", err)
+	}
+
+	key, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, scryptKeyLen)
+	if err != nil {
+		return fmt.Errorf("failed to derive key: %v", err)
+	}
+
+	check, err := seal(key, checkPlaintext, associatedData("", checkField))
+	if err != nil {
+		return err
+	}
+
+	f.Encryption = &Encryption{
+		KDF:   "scrypt",
+		N:     scryptN,
+		R:     scryptR,
+		P:     scryptP,
+		Salt:  base64.StdEncoding.EncodeToString(salt),
+		Check: check,
+	}
+	f.key = key
+
+	return nil
+}
+
+// Decrypt unseals the secrets of every profile and turns off encryption. The file must be unlocked.
+//
+// Returns:
+//   - error: An error if the file is locked or a profile can't be unsealed.
+func (f *File) Decrypt() error {
+	if f.key == nil {
+		return fmt.Errorf("config is not unlocked")
+	}
+
+	for _, name := range f.ProfileNames() {
+		profile, _ := f.Profile(name)
+		unsealed, err := f.unseal(name, profile)
+		if err != nil {
+			return fmt.Errorf("profile %s: %v", name, err)
+		}
+		f.SetProfile(name, unsealed)
+	}
+
+	f.Encryption = nil
+	f.key = nil
+
+	return nil
+}
+
+// sealed returns a copy of the file to write to disk, with the secrets of every profile sealed.
+func (f *File) sealed() (*File, error) {
+	if f.Encryption == nil {
+		return f, nil
+	}
+	if f.key == nil {
+		return nil, fmt.Errorf("config is encrypted but not unlocked")
+	}
+
+	out := *f
+	out.Profiles = make(map[string]Config, len(f.Profiles))
+	for _, name := range f.ProfileNames() {
+		profile, _ := f.Profile(name)
+		sealed, err := f.seal(name, profile)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %v", name, err)
+		}
+		out.SetProfile(name, sealed)
+	}
+	if len(out.Profiles) == 0 {
+		out.Profiles = nil
+	}
+
+	return &out, nil
+}
+
+// seal moves the secrets of a profile into its sealed field. Profiles without plaintext
+// secrets are returned as they are, they are either empty or still sealed.
+func (f *File) seal(name string, c Config) (Config, error) {
+	if c.PrivateKey == "" && c.AccessToken == "" && c.License == "" {
+		return c, nil
+	}
+
+	plaintext, err := json.Marshal(secrets{PrivateKey: c.PrivateKey, AccessToken: c.AccessToken, License: c.License})
+	if err != nil {
+		return c, fmt.Errorf("failed to encode secrets: %v", err)
+	}
+
+	c.Sealed, err = seal(f.key, plaintext, associatedData(name, sealedField))
+	if err != nil {
+		return c, err
+	}
+	c.PrivateKey, c.AccessToken, c.License = "", "", ""
+
+	return c, nil
+}
+
+// unseal restores the secrets of a profile from its sealed field and clears it.
+func (f *File) unseal(name string, c Config) (Config, error) {
+	if c.Sealed == "" {
+		return c, nil
+	}
+	if f.key == nil {
+		return c, fmt.Errorf("config is not unlocked")
+	}
+
+	plaintext, err := open(f.key, c.Sealed, associatedData(name, sealedField))
+	if err != nil {
+		return c, err
+	}
+
+	var s secrets
+	if err := json.Unmarshal(plaintext, &s); err != nil {
+		return c, fmt.Errorf("failed to decode secrets: %v", err)
+	}
+
+	c.PrivateKey, c.AccessToken, c.License = s.PrivateKey, s.AccessToken, s.License
+	c.Sealed = ""
+
+	return c, nil
+}
+
+// associatedData returns the AES-GCM associated data that binds a sealed value to the field
+// it is stored in and its profile, empty for values of the file like the check value.
+func associatedData(profile, field string) []byte {
+	return []byte("usque\x00" + field + "\x00" + profile)
+}
+
+// seal encrypts plaintext with AES-GCM under a random nonce.
+//
+// Parameters:
+//   - key: []byte - The key derived from the passphrase.
+//   - plaintext: []byte - The value to seal.
+//   - additionalData: []byte - The associated data binding the value to its place. (see associatedData)
+//
+// Returns:
+//   - string: Base64 of the nonce followed by the ciphertext.
+//   - error: An error if encryption fails.
+func seal(key, plaintext, additionalData []byte) (string, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, additionalData)), nil
+}
+
+// open decrypts a value produced by seal with the same associated data.
+func open(key []byte, sealed string, additionalData []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode sealed value: %v", err)
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("sealed value is too short")
+	}
+
+	plaintext, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt sealed value")
+	}
+
+	return plaintext, nil
+}
+
+// newAEAD creates the AES-256-GCM cipher for a key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,315 @@
+package config
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+var testPassphrase = []byte("correct horse battery staple")
+
+// testSecrets returns a profile with distinct secrets, recognizable in the written file.
+func testSecrets(name string) Config {
+	return Config{
+		PrivateKey:  "private-key-of-" + name,
+		AccessToken: "access-token-of-" + name,
+		License:     "license-of-" + name,
+		ID:          "id-of-" + name,
+	}
+}
+
+// writeEncryptedFile saves an encrypted file with a default and a "work" profile.
+func writeEncryptedFile(t *testing.T) string {
+	t.Helper()
+
+	f := &File{}
+	f.SetProfile(DefaultProfile, testSecrets(DefaultProfile))
+	f.SetProfile("work", testSecrets("work"))
+	if err := f.Encrypt(testPassphrase); err != nil {
+		t.Fatalf("failed to encrypt: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := f.Save(path); err != nil {
+		t.Fatalf("failed to save: %v", err)
+	}
+	return path
+}
+
+// checkSecrets checks that a profile selected from an unlocked file has its own secrets.
+func checkSecrets(t *testing.T, f *File, name string) {
+	t.Helper()
+
+	profile, err := f.Select(name)
+	if err != nil {
+		t.Fatalf("failed to select %s: %v", name, err)
+	}
+	want := testSecrets(name)
+	if profile.PrivateKey != want.PrivateKey || profile.AccessToken != want.AccessToken ||
+		profile.License != want.License || profile.Sealed != "" {
+		t.Errorf("profile %s = %+v, want the secrets of %+v", name, *profile, want)
+	}
+}
+
+func TestSealRoundTrip(t *testing.T) {
+	path := writeEncryptedFile(t)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read config: %v", err)
+	}
+	for _, name := range []string{DefaultProfile, "work"} {
+		secrets := testSecrets(name)
+		for _, secret := range []string{secrets.PrivateKey, secrets.AccessToken, secrets.License} {
+			if strings.Contains(string(data), secret) {
+				t.Errorf("%s is written in plaintext", secret)
+			}
+		}
+		if !strings.Contains(string(data), secrets.ID) {
+			t.Errorf("%s isn't written in plaintext", secrets.ID)
+		}
+	}
+
+	f, err := LoadFile(path)
+	if err != nil {
+		t.Fatalf("failed to load: %v", err)
+	}
+	if !f.Encrypted() || f.Unlocked() {
+		t.Fatalf("loaded file: encrypted %v, unlocked %v, want encrypted and locked", f.Encrypted(), f.Unlocked())
+	}
+	locked, err := f.Select("work")
+	if err != nil {
+		t.Fatalf("failed to select locked profile: %v", err)
+	}
+	if locked.PrivateKey != "" || locked.Sealed == "" {
+		t.Errorf("locked profile = %+v, want only sealed secrets", *locked)
+	}
+	if err := f.Save(path); err == nil {
+		t.Errorf("saved a locked file")
+	}
+
+	if err := f.Unlock(testPassphrase); err != nil {
+		t.Fatalf("failed to unlock: %v", err)
+	}
+	checkSecrets(t, f, DefaultProfile)
+	checkSecrets(t, f, "work")
+
+	// saving an unlocked file seals the secrets again
+	if err := f.Save(path); err != nil {
+		t.Fatalf("failed to save again: %v", err)
+	}
+	if f, err = LoadFile(path); err != nil {
+		t.Fatalf("failed to load again: %v", err)
+	}
+	if err := f.Unlock(testPassphrase); err != nil {
+		t.Fatalf("failed to unlock again: %v", err)
+	}
+	checkSecrets(t, f, "work")
+
+	if err := f.Decrypt(); err != nil {
+		t.Fatalf("failed to decrypt: %v", err)
+	}
+	if err := f.Save(path); err != nil {
+		t.Fatalf("failed to save decrypted: %v", err)
+	}
+	if f, err = LoadFile(path); err != nil {
+		t.Fatalf("failed to load decrypted: %v", err)
+	}
+	if f.Encrypted() {
+		t.Fatalf("decrypted file is still encrypted")
+	}
+	checkSecrets(t, f, DefaultProfile)
+	checkSecrets(t, f, "work")
+}
+
+func TestUnlockWrongPassphrase(t *testing.T) {
+	f, err := LoadFile(writeEncryptedFile(t))
+	if err != nil {
+		t.Fatalf("failed to load: %v", err)
+	}
+
+	for _, passphrase := range []string{"", "correct horse battery stapler", "Correct horse battery staple"} {
+		if err := f.Unlock([]byte(passphrase)); err == nil || err.Error() != "wrong passphrase" {
+			t.Errorf("unlock with %q: got %v, want wrong passphrase", passphrase, err)
+		}
+	}
+	if f.Unlocked() {
+		t.Errorf("file is unlocked after failed attempts")
+	}
+	if err := f.Decrypt(); err == nil {
+		t.Errorf("decrypted a locked file")
+	}
+}
+
+func TestSealedValueMoved(t *testing.T) {
+	tests := []struct {
+		name       string
+		edit       func(file map[string]any)
+		wantLocked bool   // Unlock must fail
+		profile    string // Otherwise selecting this profile must fail
+	}{
+		{
+			name: "work secrets in the default profile",
+			edit: func(file map[string]any) {
+				file["sealed"] = file["profiles"].(map[string]any)["work"].(map[string]any)["sealed"]
+			},
+			profile: DefaultProfile,
+		},
+		{
+			name: "default secrets in the work profile",
+			edit: func(file map[string]any) {
+				file["profiles"].(map[string]any)["work"].(map[string]any)["sealed"] = file["sealed"]
+			},
+			profile: "work",
+		},
+		{
+			name: "profile renamed",
+			edit: func(file map[string]any) {
+				profiles := file["profiles"].(map[string]any)
+				profiles["home"] = profiles["work"]
+				delete(profiles, "work")
+			},
+			profile: "home",
+		},
+		{
+			name: "secrets as the check value",
+			edit: func(file map[string]any) {
+				file["encryption"].(map[string]any)["check"] = file["sealed"]
+			},
+			wantLocked: true,
+		},
+		{
+			name: "check value as secrets",
+			edit: func(file map[string]any) {
+				file["sealed"] = file["encryption"].(map[string]any)["check"]
+			},
+			profile: DefaultProfile,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeEncryptedFile(t)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("failed to read config: %v", err)
+			}
+			var file map[string]any
+			if err := json.Unmarshal(data, &file); err != nil {
+				t.Fatalf("failed to decode config: %v", err)
+			}
+			tt.edit(file)
+			if data, err = json.Marshal(file); err != nil {
+				t.Fatalf("failed to encode config: %v", err)
+			}
+			if err := os.WriteFile(path, data, 0600); err != nil {
+				t.Fatalf("failed to write config: %v", err)
+			}
+
+			f, err := LoadFile(path)
+			if err != nil {
+				t.Fatalf("failed to load: %v", err)
+			}
+			err = f.Unlock(testPassphrase)
+			if tt.wantLocked {
+				if err == nil {
+					t.Fatalf("unlocked with a moved check value")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to unlock: %v", err)
+			}
+			if profile, err := f.Select(tt.profile); err == nil {
+				t.Errorf("selected %s with moved secrets: %+v", tt.profile, *profile)
+			}
+		})
+	}
+}
+
+func TestUnlockRebindsLegacySeals(t *testing.T) {
+	// a version 1 file, sealed without associated data
+	salt := []byte("0123456789abcdef")
+	key, err := scrypt.Key(testPassphrase, salt, 1024, 8, 1, scryptKeyLen)
+	if err != nil {
+		t.Fatalf("failed to derive key: %v", err)
+	}
+	check, err := seal(key, checkPlaintext, nil)
+	if err != nil {
+		t.Fatalf("failed to seal check value: %v", err)
+	}
+	sealedProfile := func(name string) string {
+		secrets := testSecrets(name)
+		plaintext, _ := json.Marshal(map[string]string{
+			"private_key":  secrets.PrivateKey,
+			"access_token": secrets.AccessToken,
+			"license":      secrets.License,
+		})
+		sealed, err := seal(key, plaintext, nil)
+		if err != nil {
+			t.Fatalf("failed to seal profile: %v", err)
+		}
+		return sealed
+	}
+
+	legacy, err := json.Marshal(map[string]any{
+		"version": 1,
+		"id":      testSecrets(DefaultProfile).ID,
+		"sealed":  sealedProfile(DefaultProfile),
+		"profiles": map[string]any{
+			"work": map[string]any{"id": testSecrets("work").ID, "sealed": sealedProfile("work")},
+		},
+		"encryption": map[string]any{
+			"kdf": "scrypt", "n": 1024, "r": 8, "p": 1,
+			"salt":  base64.StdEncoding.EncodeToString(salt),
+			"check": check,
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to encode config: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, legacy, 0600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	f, err := LoadFile(path)
+	if err != nil {
+		t.Fatalf("failed to load: %v", err)
+	}
+	if version, ok := f.Migrated(); !ok || version != 1 {
+		t.Fatalf("Migrated() = %d, %v, want 1, true", version, ok)
+	}
+	if err := f.Unlock([]byte("wrong")); err == nil {
+		t.Fatalf("unlocked a legacy file with a wrong passphrase")
+	}
+	if err := f.Unlock(testPassphrase); err != nil {
+		t.Fatalf("failed to unlock: %v", err)
+	}
+	checkSecrets(t, f, DefaultProfile)
+	checkSecrets(t, f, "work")
+
+	// the resealed values are bound and written back with the current version
+	if _, err := open(key, f.Encryption.Check, nil); err == nil {
+		t.Errorf("check value is still sealed without associated data")
+	}
+	if err := f.Save(path); err != nil {
+		t.Fatalf("failed to save: %v", err)
+	}
+	if f, err = LoadFile(path); err != nil {
+		t.Fatalf("failed to load again: %v", err)
+	}
+	if version, ok := f.Migrated(); ok {
+		t.Fatalf("saved file is still migrated from version %d", version)
+	}
+	if err := f.Unlock(testPassphrase); err != nil {
+		t.Fatalf("failed to unlock saved file: %v", err)
+	}
+	checkSecrets(t, f, DefaultProfile)
+	checkSecrets(t, f, "work")
+}
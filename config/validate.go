@@ -0,0 +1,144 @@
+package config
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/asn1"
+	"encoding/base64"
+	"fmt"
+	"net/netip"
+	"net/url"
+)
+
+// Redacted replaces the values of secret fields, so the config can be shown or logged.
+const Redacted = "<redacted>"
+
+// ecPrivateKey is the ASN.1 structure of a SEC 1 EC private key. (RFC 5915)
+type ecPrivateKey struct {
+	Version       int
+	PrivateKey    []byte
+	NamedCurveOID asn1.ObjectIdentifier `asn1:"optional,explicit,tag:0"`
+	PublicKey     asn1.BitString        `asn1:"optional,explicit,tag:1"`
+}
+
+// Validate checks a profile for problems that would otherwise only show up once a command
+// uses the field, e.g. when a tunnel starts.
+//
+// Returns:
+//   - []error: The problems found, each prefixed with the JSON name of the field. Empty if there are none.
+func (c *Config) Validate() []error {
+	var problems []error
+	add := func(field string, format string, args ...any) {
+		problems = append(problems, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+	}
+
+	if c.Sealed != "" {
+		add("sealed", "secrets are encrypted, unlock the config to validate them")
+	} else if c.PrivateKey == "" {
+		add("private_key", "missing, register or enroll first")
+	} else if privKey, err := c.GetEcPrivateKey(); err != nil {
+		add("private_key", "%v", err)
+	} else {
+		if privKey.Curve != elliptic.P256() {
+			add("private_key", "not on the P-256 curve")
+		}
+		if err := checkEmbeddedPublicKey(c.PrivateKey, privKey); err != nil {
+			add("private_key", "%v", err)
+		}
+	}
+
+	if c.EndpointPubKey == "" {
+		add("endpoint_pub_key", "missing, run the enroll or refresh command")
+	} else if pubKey, err := c.GetEcEndpointPublicKey(); err != nil {
+		add("endpoint_pub_key", "%v", err)
+	} else if pubKey.Curve != elliptic.P256() {
+		add("endpoint_pub_key", "not on the P-256 curve")
+	}
+
+	if c.EndpointV4 == "" && c.EndpointV6 == "" {
+		add("endpoint_v4", "no endpoint, run the enroll or refresh command")
+	}
+	checkAddr := func(field, value string, want4 bool) {
+		if value == "" {
+			return
+		}
+		addr, err := netip.ParseAddr(value)
+		switch {
+		case err != nil:
+			add(field, "%q is not an IP address", value)
+		case want4 && !addr.Is4():
+			add(field, "%s is not an IPv4 address", value)
+		case !want4 && (!addr.Is6() || addr.Is4In6()):
+			add(field, "%s is not an IPv6 address", value)
+		}
+	}
+	checkAddr("endpoint_v4", c.EndpointV4, true)
+	checkAddr("endpoint_v6", c.EndpointV6, false)
+
+	if c.IPv4 == "" {
+		add("ipv4", "missing, run the enroll or refresh command")
+	}
+	if c.IPv6 == "" {
+		add("ipv6", "missing, run the enroll or refresh command")
+	}
+	checkAddr("ipv4", c.IPv4, true)
+	checkAddr("ipv6", c.IPv6, false)
+
+	if c.ID == "" {
+		add("id", "missing, the registration can't be managed through the API")
+	}
+	if c.AccessToken == "" && c.Sealed == "" {
+		add("access_token", "missing, the registration can't be managed through the API")
+	}
+
+	if c.ApiUrl != "" {
+		if u, err := url.Parse(c.ApiUrl); err != nil || u.Scheme == "" || u.Host == "" {
+			add("api_url", "%q is not an absolute URL", c.ApiUrl)
+		}
+	}
+
+	return problems
+}
+
+// checkEmbeddedPublicKey compares the public key stored in a SEC 1 private key, if any,
+// with the one derived from the private scalar. Parsing the key ignores the stored one,
+// so a damaged key would otherwise authenticate with a different key than expected.
+func checkEmbeddedPublicKey(privateKeyB64 string, privKey *ecdsa.PrivateKey) error {
+	der, err := base64.StdEncoding.DecodeString(privateKeyB64)
+	if err != nil {
+		return err
+	}
+
+	var key ecPrivateKey
+	if _, err := asn1.Unmarshal(der, &key); err != nil {
+		return fmt.Errorf("failed to parse private key structure: %v", err)
+	}
+	if len(key.PublicKey.Bytes) == 0 {
+		return nil
+	}
+
+	derived, err := privKey.PublicKey.ECDH()
+	if err != nil {
+		return fmt.Errorf("failed to derive public key: %v", err)
+	}
+	if !bytes.Equal(key.PublicKey.Bytes, derived.Bytes()) {
+		return fmt.Errorf("stored public key doesn't match the private key")
+	}
+
+	return nil
+}
+
+// Redact returns a copy of the profile with the private key, access token, license and
+// sealed secrets replaced by Redacted.
+//
+// Returns:
+//   - Config: The redacted copy.
+func (c Config) Redact() Config {
+	for _, field := range []*string{&c.PrivateKey, &c.AccessToken, &c.License, &c.Sealed} {
+		if *field != "" {
+			*field = Redacted
+		}
+	}
+	return c
+}
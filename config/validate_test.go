@@ -0,0 +1,164 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testPrivateKey returns a base64 SEC 1 private key on the given curve.
+func testPrivateKey(t *testing.T, curve elliptic.Curve) string {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(der)
+}
+
+// testPublicKey returns a PEM encoded PKIX public key.
+func testPublicKey(t *testing.T, key any) string {
+	t.Helper()
+
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal public key: %v", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// testEndpointKey returns a PEM encoded ECDSA public key on the given curve.
+func testEndpointKey(t *testing.T, curve elliptic.Curve) string {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	return testPublicKey(t, &key.PublicKey)
+}
+
+// mismatchedPrivateKey returns a P-256 private key storing the public key of another key.
+func mismatchedPrivateKey(t *testing.T) string {
+	t.Helper()
+
+	decode := func(b64 string) ecPrivateKey {
+		der, _ := base64.StdEncoding.DecodeString(b64)
+		var key ecPrivateKey
+		if _, err := asn1.Unmarshal(der, &key); err != nil {
+			t.Fatalf("failed to parse key structure: %v", err)
+		}
+		return key
+	}
+	key := decode(testPrivateKey(t, elliptic.P256()))
+	key.PublicKey = decode(testPrivateKey(t, elliptic.P256())).PublicKey
+
+	der, err := asn1.Marshal(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key structure: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(der)
+}
+
+func TestValidate(t *testing.T) {
+	valid := Config{
+		PrivateKey:     testPrivateKey(t, elliptic.P256()),
+		EndpointV4:     "162.159.198.1",
+		EndpointV6:     "2606:4700:103::1",
+		EndpointPubKey: testEndpointKey(t, elliptic.P256()),
+		IPv4:           "172.16.0.2",
+		IPv6:           "2606:4700:110:8a36::2",
+		ID:             "id",
+		AccessToken:    "token",
+		APISettings:    APISettings{ApiUrl: "https://api.cloudflareclient.com"},
+	}
+	_, ed25519Key, _ := ed25519.GenerateKey(rand.Reader)
+
+	tests := []struct {
+		name string
+		edit func(c *Config)
+		want []string // Fields of the problems, in order
+	}{
+		{name: "valid", edit: func(c *Config) {}},
+		{name: "only IPv6 endpoint", edit: func(c *Config) { c.EndpointV4 = "" }},
+		{name: "default API", edit: func(c *Config) { c.ApiUrl = "" }},
+		{
+			name: "sealed",
+			edit: func(c *Config) { c.Sealed, c.PrivateKey, c.AccessToken = "sealed", "", "" },
+			want: []string{"sealed"},
+		},
+		{name: "private key missing", edit: func(c *Config) { c.PrivateKey = "" }, want: []string{"private_key"}},
+		{name: "private key not base64", edit: func(c *Config) { c.PrivateKey = "not base64!" }, want: []string{"private_key"}},
+		{
+			name: "private key not a key",
+			edit: func(c *Config) { c.PrivateKey = base64.StdEncoding.EncodeToString([]byte("key")) },
+			want: []string{"private_key"},
+		},
+		{
+			name: "private key on P-384",
+			edit: func(c *Config) { c.PrivateKey = testPrivateKey(t, elliptic.P384()) },
+			want: []string{"private_key"},
+		},
+		{
+			name: "private key with another public key",
+			edit: func(c *Config) { c.PrivateKey = mismatchedPrivateKey(t) },
+			want: []string{"private_key"},
+		},
+		{name: "endpoint key missing", edit: func(c *Config) { c.EndpointPubKey = "" }, want: []string{"endpoint_pub_key"}},
+		{name: "endpoint key not PEM", edit: func(c *Config) { c.EndpointPubKey = "key" }, want: []string{"endpoint_pub_key"}},
+		{
+			name: "endpoint key not ECDSA",
+			edit: func(c *Config) { c.EndpointPubKey = testPublicKey(t, ed25519Key.Public()) },
+			want: []string{"endpoint_pub_key"},
+		},
+		{
+			name: "endpoint key on P-384",
+			edit: func(c *Config) { c.EndpointPubKey = testEndpointKey(t, elliptic.P384()) },
+			want: []string{"endpoint_pub_key"},
+		},
+		{name: "no endpoint", edit: func(c *Config) { c.EndpointV4, c.EndpointV6 = "", "" }, want: []string{"endpoint_v4"}},
+		{name: "endpoint with port", edit: func(c *Config) { c.EndpointV4 = "162.159.198.1:443" }, want: []string{"endpoint_v4"}},
+		{name: "IPv6 as endpoint_v4", edit: func(c *Config) { c.EndpointV4 = "2606:4700:103::1" }, want: []string{"endpoint_v4"}},
+		{name: "IPv4 as endpoint_v6", edit: func(c *Config) { c.EndpointV6 = "162.159.198.1" }, want: []string{"endpoint_v6"}},
+		{name: "mapped IPv4 as endpoint_v6", edit: func(c *Config) { c.EndpointV6 = "::ffff:162.159.198.1" }, want: []string{"endpoint_v6"}},
+		{name: "ipv4 missing", edit: func(c *Config) { c.IPv4 = "" }, want: []string{"ipv4"}},
+		{name: "ipv6 missing", edit: func(c *Config) { c.IPv6 = "" }, want: []string{"ipv6"}},
+		{name: "ipv4 not an address", edit: func(c *Config) { c.IPv4 = "172.16.0.2/32" }, want: []string{"ipv4"}},
+		{name: "swapped addresses", edit: func(c *Config) { c.IPv4, c.IPv6 = c.IPv6, c.IPv4 }, want: []string{"ipv4", "ipv6"}},
+		{name: "id missing", edit: func(c *Config) { c.ID = "" }, want: []string{"id"}},
+		{name: "access token missing", edit: func(c *Config) { c.AccessToken = "" }, want: []string{"access_token"}},
+		{name: "relative API URL", edit: func(c *Config) { c.ApiUrl = "api.cloudflareclient.com" }, want: []string{"api_url"}},
+		{name: "empty profile", edit: func(c *Config) { *c = Config{} }, want: []string{
+			"private_key", "endpoint_pub_key", "endpoint_v4", "ipv4", "ipv6", "id", "access_token",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid
+			tt.edit(&c)
+
+			var fields []string
+			for _, problem := range c.Validate() {
+				field, _, _ := strings.Cut(problem.Error(), ":")
+				fields = append(fields, field)
+			}
+			if !slices.Equal(fields, tt.want) {
+				t.Errorf("got problems %v, want %v (%v)", fields, tt.want, c.Validate())
+			}
+		})
+	}
+}
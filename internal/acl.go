@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"net/netip"
+	"slices"
+)
+
+// ACL restricts which clients may use a proxy and which destinations they may reach.
+// A nil ACL allows everything.
+type ACL struct {
+	clients []netip.Prefix // Allowed clients, all if empty
+	denied  []netip.Prefix // Refused destinations
+}
+
+// NewACL creates an ACL from lists of addresses and prefixes.
+//
+// Parameters:
+//   - allowClients: []string - The clients that may connect. Empty allows all clients.
+//   - denyDests: []string - The destinations that are refused.
+//
+// Returns:
+//   - *ACL: The ACL, nil if both lists are empty.
+//   - error: An error if an entry is neither an address nor a prefix.
+func NewACL(allowClients, denyDests []string) (*ACL, error) {
+	if len(allowClients) == 0 && len(denyDests) == 0 {
+		return nil, nil
+	}
+
+	acl := &ACL{}
+	for _, entry := range allowClients {
+		prefix, err := parsePrefixOrAddr(entry)
+		if err != nil {
+			return nil, err
+		}
+		acl.clients = append(acl.clients, prefix)
+	}
+	for _, entry := range denyDests {
+		prefix, err := parsePrefixOrAddr(entry)
+		if err != nil {
+			return nil, err
+		}
+		acl.denied = append(acl.denied, prefix)
+	}
+
+	return acl, nil
+}
+
+// AllowsClient reports whether a client may connect.
+//
+// Parameters:
+//   - addr: netip.Addr - The address of the client.
+//
+// Returns:
+//   - bool: True if the client is allowed.
+func (a *ACL) AllowsClient(addr netip.Addr) bool {
+	if a == nil || len(a.clients) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(a.clients, func(p netip.Prefix) bool { return p.Contains(addr.Unmap()) })
+}
+
+// AllowsDest reports whether a destination may be reached.
+//
+// Parameters:
+//   - addr: netip.Addr - The destination address.
+//
+// Returns:
+//   - bool: True if the destination is allowed.
+func (a *ACL) AllowsDest(addr netip.Addr) bool {
+	if a == nil {
+		return true
+	}
+	return !slices.ContainsFunc(a.denied, func(p netip.Prefix) bool { return p.Contains(addr.Unmap()) })
+}
+
+// FiltersDests reports whether the ACL refuses any destination, so destinations given by
+// name can't be let through unchecked.
+//
+// Returns:
+//   - bool: True if there are refused destinations.
+func (a *ACL) FiltersDests() bool {
+	return a != nil && len(a.denied) > 0
+}
@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestACL(t *testing.T) {
+	tests := []struct {
+		name         string
+		allowClients []string
+		denyDests    []string
+		clients      map[string]bool // Client address to whether it is allowed
+		dests        map[string]bool // Destination address to whether it is allowed
+		wantNil      bool
+		wantErr      bool
+	}{
+		{
+			name:    "empty",
+			clients: map[string]bool{"192.0.2.1": true, "2001:db8::1": true},
+			dests:   map[string]bool{"10.0.0.1": true},
+			wantNil: true,
+		},
+		{
+			name:         "allowed clients",
+			allowClients: []string{"127.0.0.1", "192.168.0.0/16", "fd00::/8"},
+			clients: map[string]bool{
+				"127.0.0.1":          true,
+				"::ffff:192.168.1.2": true,
+				"fd12::1":            true,
+				"127.0.0.2":          false,
+				"10.0.0.1":           false,
+				"::1":                false,
+			},
+			dests: map[string]bool{"10.0.0.1": true, "::1": true},
+		},
+		{
+			name:      "denied destinations",
+			denyDests: []string{"10.0.0.0/8", "169.254.169.254", "fc00::/7"},
+			clients:   map[string]bool{"10.0.0.1": true},
+			dests: map[string]bool{
+				"10.1.2.3":             false,
+				"::ffff:10.1.2.3":      false,
+				"169.254.169.254":      false,
+				"fd00::1":              false,
+				"169.254.169.253":      true,
+				"1.1.1.1":              true,
+				"2606:4700:4700::1111": true,
+			},
+		},
+		{name: "invalid client", allowClients: []string{"localhost"}, wantErr: true},
+		{name: "invalid destination", denyDests: []string{"10.0.0.0/33"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acl, err := NewACL(tt.allowClients, tt.denyDests)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if (acl == nil) != tt.wantNil {
+				t.Errorf("got ACL %v, want nil: %v", acl, tt.wantNil)
+			}
+			if acl.FiltersDests() != (len(tt.denyDests) > 0) {
+				t.Errorf("FiltersDests() = %v, want %v", acl.FiltersDests(), len(tt.denyDests) > 0)
+			}
+
+			for addr, want := range tt.clients {
+				if got := acl.AllowsClient(netip.MustParseAddr(addr)); got != want {
+					t.Errorf("client %s: got %v, want %v", addr, got, want)
+				}
+			}
+			for addr, want := range tt.dests {
+				if got := acl.AllowsDest(netip.MustParseAddr(addr)); got != want {
+					t.Errorf("destination %s: got %v, want %v", addr, got, want)
+				}
+			}
+		})
+	}
+}
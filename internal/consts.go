@@ -3,21 +3,30 @@ package internal
 const (
 	ApiUrl     = "https://api.cloudflareclient.com"
 	ApiVersion = "v0a4471"
-	ConnectSNI = "consumer-masque.cloudflareclient.com"
-	// unused for now
-	ZeroTierSNI   = "zt-masque.cloudflareclient.com"
-	ConnectURI    = "https://cloudflareaccess.com"
+	// ClientVersion and UserAgent are the values sent by the Android app.
+	ClientVersion = "a-6.35-4471"
+	UserAgent     = "WARP for Android"
+	// LinuxClientVersion and LinuxUserAgent are the values sent by the Linux desktop client.
+	LinuxClientVersion = "l-2024.12.554.0"
+	LinuxUserAgent     = "warp-svc/2024.12.554.0"
+	ConnectSNI         = "consumer-masque.cloudflareclient.com"
+	// ZeroTierSNI is the default SNI for Zero Trust accounts.
+	ZeroTierSNI = "zt-masque.cloudflareclient.com"
+	ConnectURI  = "https://cloudflareaccess.com"
+	// TeamDomain is the parent domain of Zero Trust team login pages.
+	TeamDomain    = "cloudflareaccess.com"
 	DefaultModel  = "PC"
 	KeyTypeWg     = "curve25519"
 	TunTypeWg     = "wireguard"
 	KeyTypeMasque = "secp256r1"
 	TunTypeMasque = "masque"
 	DefaultLocale = "en_US"
+	// AccountTypeTeam is the account type of Zero Trust registrations.
+	AccountTypeTeam = "team"
 )
 
+// Headers are sent with every API request regardless of the client profile.
 var Headers = map[string]string{
-	"User-Agent":        "WARP for Android",
-	"CF-Client-Version": "a-6.35-4471",
-	"Content-Type":      "application/json; charset=UTF-8",
-	"Connection":        "Keep-Alive",
+	"Content-Type": "application/json; charset=UTF-8",
+	"Connection":   "Keep-Alive",
 }
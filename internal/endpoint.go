@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// PeerEndpoint is a parsed peer endpoint as handed out by the API.
+type PeerEndpoint struct {
+	V4    netip.Addr // IPv4 address of the endpoint, invalid if none was given.
+	V6    netip.Addr // IPv6 address of the endpoint, invalid if none was given.
+	Host  string     // Hostname of the endpoint without port, empty if none was given.
+	Ports []int      // Candidate ports. Ports given with an address come first, 0 is omitted.
+}
+
+// SplitHostPortOptional splits an endpoint into host and port. Unlike net.SplitHostPort
+// the port is optional, and IPv6 addresses may be given with or without brackets.
+//
+// Accepted forms: "1.2.3.4", "1.2.3.4:443", "2606:4700::1", "[2606:4700::1]",
+// "[2606:4700::1]:443", "example.com" and "example.com:443".
+//
+// Parameters:
+//   - endpoint: string - The endpoint to split.
+//
+// Returns:
+//   - string: The host, without brackets.
+//   - int: The port, 0 if none was given.
+//   - error: An error if the endpoint is malformed.
+func SplitHostPortOptional(endpoint string) (string, int, error) {
+	endpoint = strings.TrimSpace(endpoint)
+	if endpoint == "" {
+		return "", 0, errors.New("empty endpoint")
+	}
+
+	// A bare IPv6 address contains colons but no port.
+	if addr, err := netip.ParseAddr(endpoint); err == nil {
+		return addr.String(), 0, nil
+	}
+
+	if strings.HasPrefix(endpoint, "[") && strings.HasSuffix(endpoint, "]") {
+		addr, err := netip.ParseAddr(endpoint[1 : len(endpoint)-1])
+		if err != nil || !addr.Is6() {
+			return "", 0, fmt.Errorf("invalid IPv6 address in %q", endpoint)
+		}
+		return addr.String(), 0, nil
+	}
+
+	if !strings.Contains(endpoint, ":") {
+		return endpoint, 0, nil
+	}
+
+	host, portStr, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid endpoint %q: %v", endpoint, err)
+	}
+	if host == "" {
+		return "", 0, fmt.Errorf("missing host in endpoint %q", endpoint)
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid port in endpoint %q", endpoint)
+	}
+
+	return host, port, nil
+}
+
+// ParsePeerEndpoint parses the endpoint fields of a peer from the API.
+//
+// Parameters:
+//   - v4: string - The IPv4 endpoint. (e.g., "162.159.198.1:0")
+//   - v6: string - The IPv6 endpoint. (e.g., "[2606:4700:103::1]:0")
+//   - host: string - The hostname endpoint. (e.g., "engage.cloudflareclient.com:2408", optional)
+//   - ports: []int - Additional ports the endpoint listens on. (optional)
+//
+// Returns:
+//   - PeerEndpoint: The parsed endpoint.
+//   - error: An error if an endpoint is malformed or neither an IPv4 nor an IPv6 address was given.
+func ParsePeerEndpoint(v4, v6, host string, ports []int) (PeerEndpoint, error) {
+	var endpoint PeerEndpoint
+	seen := make(map[int]bool)
+	addPort := func(port int) {
+		if port > 0 && !seen[port] {
+			seen[port] = true
+			endpoint.Ports = append(endpoint.Ports, port)
+		}
+	}
+
+	if v4 != "" {
+		addr, port, err := SplitHostPortOptional(v4)
+		if err != nil {
+			return PeerEndpoint{}, err
+		}
+		if endpoint.V4, err = netip.ParseAddr(addr); err != nil || !endpoint.V4.Is4() {
+			return PeerEndpoint{}, fmt.Errorf("invalid IPv4 endpoint %q", v4)
+		}
+		addPort(port)
+	}
+
+	if v6 != "" {
+		addr, port, err := SplitHostPortOptional(v6)
+		if err != nil {
+			return PeerEndpoint{}, err
+		}
+		if endpoint.V6, err = netip.ParseAddr(addr); err != nil || !endpoint.V6.Is6() {
+			return PeerEndpoint{}, fmt.Errorf("invalid IPv6 endpoint %q", v6)
+		}
+		addPort(port)
+	}
+
+	if !endpoint.V4.IsValid() && !endpoint.V6.IsValid() {
+		return PeerEndpoint{}, errors.New("peer has neither an IPv4 nor an IPv6 endpoint")
+	}
+
+	if host != "" {
+		name, port, err := SplitHostPortOptional(host)
+		if err != nil {
+			return PeerEndpoint{}, err
+		}
+		endpoint.Host = name
+		addPort(port)
+	}
+
+	for _, port := range ports {
+		addPort(port)
+	}
+
+	return endpoint, nil
+}
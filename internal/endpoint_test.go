@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestSplitHostPortOptional(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		wantHost string
+		wantPort int
+		wantErr  bool
+	}{
+		{endpoint: "162.159.198.1", wantHost: "162.159.198.1"},
+		{endpoint: "162.159.198.1:443", wantHost: "162.159.198.1", wantPort: 443},
+		{endpoint: " 162.159.198.1:0 ", wantHost: "162.159.198.1"},
+		{endpoint: "2606:4700:103::1", wantHost: "2606:4700:103::1"},
+		{endpoint: "[2606:4700:103::1]", wantHost: "2606:4700:103::1"},
+		{endpoint: "[2606:4700:103::1]:2408", wantHost: "2606:4700:103::1", wantPort: 2408},
+		{endpoint: "engage.cloudflareclient.com", wantHost: "engage.cloudflareclient.com"},
+		{endpoint: "engage.cloudflareclient.com:2408", wantHost: "engage.cloudflareclient.com", wantPort: 2408},
+		{endpoint: "", wantErr: true},
+		{endpoint: "   ", wantErr: true},
+		{endpoint: "[162.159.198.1]", wantErr: true},
+		{endpoint: "[not-an-address]", wantErr: true},
+		{endpoint: "162.159.198.1:", wantErr: true},
+		{endpoint: "162.159.198.1:https", wantErr: true},
+		{endpoint: "162.159.198.1:65536", wantErr: true},
+		{endpoint: ":443", wantErr: true},
+		{endpoint: "[2606:4700:103::1]:2408:1", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.endpoint, func(t *testing.T) {
+			host, port, err := SplitHostPortOptional(tt.endpoint)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %q, %d", host, port)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if host != tt.wantHost || port != tt.wantPort {
+				t.Errorf("got %q, %d, want %q, %d", host, port, tt.wantHost, tt.wantPort)
+			}
+		})
+	}
+}
+
+func TestParsePeerEndpoint(t *testing.T) {
+	tests := []struct {
+		name    string
+		v4      string
+		v6      string
+		host    string
+		ports   []int
+		want    PeerEndpoint
+		wantErr bool
+	}{
+		{
+			name: "API defaults",
+			v4:   "162.159.198.1:0",
+			v6:   "[2606:4700:103::1]:0",
+			want: PeerEndpoint{
+				V4: netip.MustParseAddr("162.159.198.1"),
+				V6: netip.MustParseAddr("2606:4700:103::1"),
+			},
+		},
+		{
+			name: "ports with the addresses and host",
+			v4:   "162.159.198.1:443",
+			v6:   "[2606:4700:103::1]:500",
+			host: "engage.cloudflareclient.com:2408",
+			want: PeerEndpoint{
+				V4:    netip.MustParseAddr("162.159.198.1"),
+				V6:    netip.MustParseAddr("2606:4700:103::1"),
+				Host:  "engage.cloudflareclient.com",
+				Ports: []int{443, 500, 2408},
+			},
+		},
+		{
+			name:  "ports list after the address ports without duplicates",
+			v4:    "162.159.198.1:443",
+			ports: []int{0, 443, 4443, 8443, 4443},
+			want: PeerEndpoint{
+				V4:    netip.MustParseAddr("162.159.198.1"),
+				Ports: []int{443, 4443, 8443},
+			},
+		},
+		{
+			name: "bare IPv6 only",
+			v6:   "2606:4700:103::1",
+			want: PeerEndpoint{V6: netip.MustParseAddr("2606:4700:103::1")},
+		},
+		{
+			name: "bracketed IPv6 without port",
+			v6:   "[2606:4700:103::1]",
+			host: "engage.cloudflareclient.com",
+			want: PeerEndpoint{
+				V6:   netip.MustParseAddr("2606:4700:103::1"),
+				Host: "engage.cloudflareclient.com",
+			},
+		},
+		{name: "empty peer", wantErr: true},
+		{name: "host only", host: "engage.cloudflareclient.com:2408", wantErr: true},
+		{name: "IPv6 as v4", v4: "[2606:4700:103::1]:0", wantErr: true},
+		{name: "IPv4 as v6", v6: "162.159.198.1:0", wantErr: true},
+		{name: "hostname as v4", v4: "engage.cloudflareclient.com:2408", wantErr: true},
+		{name: "garbage v4", v4: "not an endpoint", wantErr: true},
+		{name: "garbage port", v4: "162.159.198.1:port", wantErr: true},
+		{name: "garbage host", v4: "162.159.198.1:0", host: "example.com:port", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePeerEndpoint(tt.v4, tt.v6, tt.host, tt.ports)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got.V4 != tt.want.V4 || got.V6 != tt.want.V6 || got.Host != tt.want.Host || !slices.Equal(got.Ports, tt.want.Ports) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Identity formats understood by ParseIdentity.
+const (
+	IdentityFormatAuto = "auto" // Detect the format from the content
+	IdentityFormatWarp = "warp" // reg.json of the official WARP client
+	IdentityFormatWgcf = "wgcf" // wgcf-account.toml of wgcf
+)
+
+// Identity is a registration taken over from another client.
+type Identity struct {
+	ID          string // Device unique identifier
+	AccessToken string // Authentication token for API access
+	License     string // License key, empty if the source doesn't store it
+}
+
+// warpRegistration covers the fields of reg.json across client versions.
+type warpRegistration struct {
+	RegistrationID string `json:"registration_id"`
+	ID             string `json:"id"`
+	DeviceID       string `json:"device_id"`
+	APIToken       string `json:"api_token"`
+	Token          string `json:"token"`
+	AccessToken    string `json:"access_token"`
+	License        string `json:"license"`
+	Account        struct {
+		License string `json:"license"`
+	} `json:"account"`
+}
+
+// ParseIdentity parses a registration exported by another client.
+//
+// Parameters:
+//   - data: []byte - The file contents.
+//   - format: string - One of IdentityFormatAuto, IdentityFormatWarp or IdentityFormatWgcf.
+//
+// Returns:
+//   - Identity: The parsed identity.
+//   - error: An error if the format is unknown or the data lacks the device ID or the access token.
+func ParseIdentity(data []byte, format string) (Identity, error) {
+	switch format {
+	case IdentityFormatAuto, "":
+		if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+			return ParseWarpRegistration(data)
+		}
+		return ParseWgcfAccount(data)
+	case IdentityFormatWarp:
+		return ParseWarpRegistration(data)
+	case IdentityFormatWgcf:
+		return ParseWgcfAccount(data)
+	default:
+		return Identity{}, fmt.Errorf("unknown identity format %q", format)
+	}
+}
+
+// ParseWarpRegistration parses the reg.json of the official WARP client,
+// found at /var/lib/cloudflare-warp/reg.json on Linux.
+//
+// Parameters:
+//   - data: []byte - The contents of reg.json.
+//
+// Returns:
+//   - Identity: The parsed identity.
+//   - error: An error if the JSON is malformed or lacks the device ID or the access token.
+func ParseWarpRegistration(data []byte) (Identity, error) {
+	var reg warpRegistration
+	if err := json.Unmarshal(data, &reg); err != nil {
+		return Identity{}, fmt.Errorf("failed to parse registration: %v", err)
+	}
+
+	identity := Identity{
+		ID:          firstNonEmpty(reg.RegistrationID, reg.ID, reg.DeviceID),
+		AccessToken: firstNonEmpty(reg.APIToken, reg.Token, reg.AccessToken),
+		License:     firstNonEmpty(reg.Account.License, reg.License),
+	}
+
+	return identity, identity.validate()
+}
+
+// ParseWgcfAccount parses the wgcf-account.toml written by wgcf. Only the flat
+// key = 'value' lines wgcf writes are supported, not TOML in general.
+//
+// Parameters:
+//   - data: []byte - The contents of wgcf-account.toml.
+//
+// Returns:
+//   - Identity: The parsed identity.
+//   - error: An error if a line is malformed or the file lacks the device ID or the access token.
+func ParseWgcfAccount(data []byte) (Identity, error) {
+	var identity Identity
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "[") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return Identity{}, fmt.Errorf("line %d: expected key = value", lineNo)
+		}
+
+		value, err := unquoteTomlString(strings.TrimSpace(value))
+		if err != nil {
+			return Identity{}, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+
+		switch strings.TrimSpace(key) {
+		case "device_id":
+			identity.ID = value
+		case "access_token":
+			identity.AccessToken = value
+		case "license_key":
+			identity.License = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return Identity{}, fmt.Errorf("failed to read account: %v", err)
+	}
+
+	return identity, identity.validate()
+}
+
+// unquoteTomlString unquotes a TOML literal ('...') or basic ("...") string.
+func unquoteTomlString(value string) (string, error) {
+	if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+		return value[1 : len(value)-1], nil
+	}
+	if len(value) >= 2 && value[0] == '"' {
+		unquoted, err := strconv.Unquote(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid string %s: %v", value, err)
+		}
+		return unquoted, nil
+	}
+	return "", fmt.Errorf("expected a quoted string, got %s", value)
+}
+
+// validate checks that the identity can authenticate against the API.
+func (i Identity) validate() error {
+	if i.ID == "" {
+		return errors.New("device ID not found")
+	}
+	if i.AccessToken == "" {
+		return errors.New("access token not found")
+	}
+	return nil
+}
+
+// firstNonEmpty returns the first non-empty string, or "" if all are empty.
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseIdentity(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string // Fixture in testdata, used instead of data if set
+		data    string
+		format  string
+		want    Identity
+		wantErr bool
+	}{
+		{
+			name:   "reg.json",
+			file:   "reg.json",
+			format: IdentityFormatAuto,
+			want: Identity{
+				ID:          "4f2c7e1a-9b3d-4c5e-8f60-1a2b3c4d5e6f",
+				AccessToken: "e1b2c3d4-a5b6-4c7d-8e9f-0a1b2c3d4e5f",
+				License:     "AAAAAAAA-BBBBBBBB-CCCCCCCC",
+			},
+		},
+		{
+			name:   "legacy reg.json",
+			file:   "reg-legacy.json",
+			format: IdentityFormatWarp,
+			want: Identity{
+				ID:          "t.7c3e9a1b-2d4f-4e6a-8b0c-1d2e3f4a5b6c",
+				AccessToken: "9d8c7b6a-5f4e-4d3c-2b1a-0f9e8d7c6b5a",
+			},
+		},
+		{
+			name: "wgcf-account.toml",
+			file: "wgcf-account.toml",
+			want: Identity{
+				ID:          "5a6b7c8d-9e0f-4a1b-8c2d-3e4f5a6b7c8d",
+				AccessToken: "3e4f5a6b-7c8d-4e9f-a0b1-c2d3e4f5a6b7",
+				License:     "DDDDDDDD-EEEEEEEE-FFFFFFFF",
+			},
+		},
+		{
+			name:   "wgcf basic strings and comments",
+			data:   "# written by hand\n[account]\ndevice_id = \"dev\\u0069ce\"\n\naccess_token = 'token'\n",
+			format: IdentityFormatWgcf,
+			want:   Identity{ID: "device", AccessToken: "token"},
+		},
+		{name: "reg.json as wgcf", file: "reg.json", format: IdentityFormatWgcf, wantErr: true},
+		{name: "wgcf as reg.json", file: "wgcf-account.toml", format: IdentityFormatWarp, wantErr: true},
+		{name: "unknown format", file: "reg.json", format: "wireguard", wantErr: true},
+		{name: "truncated JSON", data: `{"registration_id": "id", "api_token": `, wantErr: true},
+		{name: "JSON without token", data: `{"registration_id": "id"}`, wantErr: true},
+		{name: "JSON without ID", data: `{"api_token": "token"}`, wantErr: true},
+		{name: "line without value", data: "device_id\naccess_token = 'token'\n", wantErr: true},
+		{name: "unquoted value", data: "device_id = id\naccess_token = 'token'\n", wantErr: true},
+		{name: "broken basic string", data: "device_id = \"id\naccess_token = 'token'\n", wantErr: true},
+		{name: "toml without token", data: "device_id = 'id'\n", wantErr: true},
+		{name: "empty", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := []byte(tt.data)
+			if tt.file != "" {
+				var err error
+				data, err = os.ReadFile(filepath.Join("testdata", tt.file))
+				if err != nil {
+					t.Fatalf("failed to read fixture: %v", err)
+				}
+			}
+
+			got, err := ParseIdentity(data, tt.format)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
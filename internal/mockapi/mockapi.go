@@ -0,0 +1,511 @@
+// Package mockapi implements an in-memory stand-in for the Cloudflare registration API.
+// It is meant for testing the register and enroll flows offline, e.g. against a local
+// `usque server`.
+package mockapi
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/Diniboy1123/usque/models"
+)
+
+// Error codes returned by the mock. The real API uses numeric codes as well,
+// but they aren't documented, so only the messages should be relied upon.
+const (
+	CodeAuthentication = 10000
+	CodeBadRequest     = 1000
+	CodeNotFound       = 1002
+	CodeInvalidKey     = 1005
+	CodeRateLimited    = 1015
+	CodeInvalidLicense = 1020
+)
+
+// wgPeerKey is handed out as the peer public key while a device is in WireGuard mode.
+const wgPeerKey = "bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo="
+
+// Server is a fake registration API. The exported fields describe the endpoint handed out
+// to clients and may be changed before the server starts handling requests.
+type Server struct {
+	// EndpointV4 is the IPv4 address of the MASQUE endpoint.
+	EndpointV4 string
+	// EndpointV6 is the IPv6 address of the MASQUE endpoint.
+	EndpointV6 string
+	// EndpointPubKey is the PEM encoded public key of the MASQUE endpoint.
+	EndpointPubKey string
+	// RejectKeys makes the next RejectKeys key enrollments fail with models.InvalidPublicKey.
+	RejectKeys int
+	// Throttle makes the next Throttle requests fail with 429 Too Many Requests and a Retry-After of one second.
+	Throttle int
+	// ServiceTokens maps Access service token client IDs to their secrets. Registrations presenting
+	// one of them, or any team JWT, create Zero Trust accounts.
+	ServiceTokens map[string]string
+	// TeamPolicy is the device policy of Zero Trust devices. Its TunnelProtocol is overwritten with the device's.
+	TeamPolicy models.Policy
+
+	mu         sync.Mutex
+	devices    map[string]*device
+	accounts   map[string]*models.Account
+	teamTokens map[string]bool
+	mux        *http.ServeMux
+}
+
+// device is a registration known to the mock. Its Account field is ignored
+// in favour of the shared account referenced by accountID.
+type device struct {
+	data      models.AccountData
+	token     string
+	accountID string
+	active    bool
+}
+
+// New creates a mock API server handing out a local endpoint with a freshly generated key.
+//
+// Returns:
+//   - *Server: The mock server.
+//   - error: An error if the endpoint key can't be generated.
+func New() (*Server, error) {
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate endpoint key: %v", err)
+	}
+
+	pubKey, err := x509.MarshalPKIXPublicKey(&privKey.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal endpoint key: %v", err)
+	}
+
+	s := &Server{
+		EndpointV4:     "127.0.0.1",
+		EndpointV6:     "::1",
+		EndpointPubKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubKey})),
+		ServiceTokens:  make(map[string]string),
+		devices:        make(map[string]*device),
+		accounts:       make(map[string]*models.Account),
+		teamTokens:     make(map[string]bool),
+		mux:            http.NewServeMux(),
+	}
+
+	s.mux.HandleFunc("GET /warp", s.teamLogin)
+	s.mux.HandleFunc("POST /{version}/reg", s.register)
+	s.mux.HandleFunc("GET /{version}/reg/{id}", s.withDevice(s.getDevice))
+	s.mux.HandleFunc("PATCH /{version}/reg/{id}", s.withDevice(s.updateDevice))
+	s.mux.HandleFunc("DELETE /{version}/reg/{id}", s.withDevice(s.deleteDevice))
+	s.mux.HandleFunc("GET /{version}/reg/{id}/account", s.withDevice(s.getAccount))
+	s.mux.HandleFunc("PUT /{version}/reg/{id}/account", s.withDevice(s.updateLicense))
+	s.mux.HandleFunc("POST /{version}/reg/{id}/account/license", s.withDevice(s.resetLicense))
+	s.mux.HandleFunc("GET /{version}/reg/{id}/account/devices", s.withDevice(s.listDevices))
+	s.mux.HandleFunc("PATCH /{version}/reg/{id}/account/reg/{device}", s.withDevice(s.updateBoundDevice))
+	s.mux.HandleFunc("DELETE /{version}/reg/{id}/account/reg/{device}", s.withDevice(s.removeBoundDevice))
+	s.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, CodeNotFound, "Not found")
+	})
+
+	return s, nil
+}
+
+// AddPlusAccount creates a WARP+ account that devices can bind to with the given license.
+//
+// Parameters:
+//   - license: string - The license key of the account.
+//   - quota: int - The WARP+ data of the account in bytes.
+func (s *Server) AddPlusAccount(license string, quota int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := internal.TimeAsCfString(time.Now())
+	account := &models.Account{
+		ID:          randomUUID(),
+		AccountType: "limited",
+		Created:     now,
+		Updated:     now,
+		PremiumData: quota,
+		Quota:       quota,
+		WarpPlus:    true,
+		Role:        "parent",
+		License:     license,
+	}
+	s.accounts[account.ID] = account
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Printf("%s %s", r.Method, r.URL.Path)
+
+	s.mu.Lock()
+	throttled := s.Throttle > 0
+	if throttled {
+		s.Throttle--
+	}
+	s.mu.Unlock()
+
+	if throttled {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, http.StatusTooManyRequests, CodeRateLimited, "Too many requests")
+		return
+	}
+
+	s.mux.ServeHTTP(w, r)
+}
+
+// teamLogin handles GET /warp, standing in for the login page of a Zero Trust team. It skips
+// the login and shows the link to hand the team token to the client right away. Each token
+// can be used for one registration.
+func (s *Server) teamLogin(w http.ResponseWriter, r *http.Request) {
+	b := make([]byte, 16)
+	rand.Read(b)
+	token := "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString(b) + ".mock"
+
+	s.mu.Lock()
+	s.teamTokens[token] = true
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<a href=\"com.cloudflare.warp://%s/auth?token=%s\">Open Cloudflare WARP</a>\n", r.Host, token)
+}
+
+// register handles POST /reg and creates a new WireGuard mode device.
+func (s *Server) register(w http.ResponseWriter, r *http.Request) {
+	var reg models.Registration
+	if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "Invalid request body")
+		return
+	}
+	if reg.Tos == "" {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "Terms of service not accepted")
+		return
+	}
+	if reg.Key == "" {
+		writeError(w, http.StatusBadRequest, CodeInvalidKey, models.InvalidPublicKey)
+		return
+	}
+
+	now := internal.TimeAsCfString(time.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	accountType := "free"
+	if clientID := r.Header.Get("CF-Access-Client-Id"); clientID != "" {
+		secret, ok := s.ServiceTokens[clientID]
+		if !ok || secret != r.Header.Get("CF-Access-Client-Secret") {
+			writeError(w, http.StatusForbidden, CodeAuthentication, "Invalid service token")
+			return
+		}
+		accountType = internal.AccountTypeTeam
+	} else if jwt := r.Header.Get("CF-Access-Jwt-Assertion"); jwt != "" {
+		if !s.teamTokens[jwt] {
+			writeError(w, http.StatusForbidden, CodeAuthentication, "Invalid team token")
+			return
+		}
+		delete(s.teamTokens, jwt)
+		accountType = internal.AccountTypeTeam
+	}
+
+	account := &models.Account{
+		ID:          randomUUID(),
+		AccountType: accountType,
+		Created:     now,
+		Updated:     now,
+		Role:        "parent",
+		License:     randomLicense(),
+	}
+	s.accounts[account.ID] = account
+
+	dev := &device{token: randomUUID(), accountID: account.ID, active: true}
+	dev.data = models.AccountData{
+		ID:           randomUUID(),
+		Type:         "a",
+		Model:        reg.Model,
+		Key:          reg.Key,
+		KeyType:      reg.KeyType,
+		TunType:      reg.TunType,
+		WarpEnabled:  true,
+		Created:      now,
+		Updated:      now,
+		Tos:          reg.Tos,
+		Locale:       reg.Locale,
+		Enabled:      true,
+		InstallID:    reg.InstallID,
+		FcmToken:     reg.FcmToken,
+		SerialNumber: reg.Serial,
+	}
+	dev.data.Config.ClientID = base64.StdEncoding.EncodeToString([]byte(dev.data.ID[:3]))
+	dev.data.Config.Interface.Addresses.V4 = "172.16.0.2"
+	dev.data.Config.Interface.Addresses.V6 = netip.AddrFrom16([16]byte{0: 0xfd, 1: 0x01, 15: byte(len(s.devices) + 2)}).String()
+	s.refresh(&dev.data)
+	s.devices[dev.data.ID] = dev
+
+	resp := s.view(dev)
+	resp.Token = dev.token
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// getDevice handles GET /reg/{id}.
+func (s *Server) getDevice(w http.ResponseWriter, r *http.Request, dev *device) {
+	writeJSON(w, http.StatusOK, s.view(dev))
+}
+
+// deleteDevice handles DELETE /reg/{id}.
+func (s *Server) deleteDevice(w http.ResponseWriter, r *http.Request, dev *device) {
+	delete(s.devices, dev.data.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getAccount handles GET /reg/{id}/account.
+func (s *Server) getAccount(w http.ResponseWriter, r *http.Request, dev *device) {
+	writeJSON(w, http.StatusOK, s.accounts[dev.accountID])
+}
+
+// updateLicense handles PUT /reg/{id}/account and moves the device to the account owning the license.
+func (s *Server) updateLicense(w http.ResponseWriter, r *http.Request, dev *device) {
+	var license models.License
+	if err := json.NewDecoder(r.Body).Decode(&license); err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "Invalid request body")
+		return
+	}
+
+	for _, account := range s.accounts {
+		if account.License == license.License {
+			dev.accountID = account.ID
+			writeJSON(w, http.StatusOK, account)
+			return
+		}
+	}
+
+	writeError(w, http.StatusBadRequest, CodeInvalidLicense, "Invalid license")
+}
+
+// resetLicense handles POST /reg/{id}/account/license and replaces the license of the device's account.
+func (s *Server) resetLicense(w http.ResponseWriter, r *http.Request, dev *device) {
+	account := s.accounts[dev.accountID]
+	account.License = randomLicense()
+	account.Updated = internal.TimeAsCfString(time.Now())
+
+	writeJSON(w, http.StatusOK, models.License{License: account.License})
+}
+
+// listDevices handles GET /reg/{id}/account/devices.
+func (s *Server) listDevices(w http.ResponseWriter, r *http.Request, dev *device) {
+	writeJSON(w, http.StatusOK, s.boundDevices(dev.accountID))
+}
+
+// updateBoundDevice handles PATCH /reg/{id}/account/reg/{device}, which renames or (de)activates a device.
+func (s *Server) updateBoundDevice(w http.ResponseWriter, r *http.Request, dev *device) {
+	target, ok := s.devices[r.PathValue("device")]
+	if !ok || target.accountID != dev.accountID {
+		writeError(w, http.StatusNotFound, CodeNotFound, "Device not found")
+		return
+	}
+
+	var update models.DeviceUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "Invalid request body")
+		return
+	}
+
+	if update.Name != "" {
+		target.data.Name = update.Name
+	}
+	if update.Active != nil {
+		target.active = *update.Active
+	}
+
+	writeJSON(w, http.StatusOK, s.boundDevices(dev.accountID))
+}
+
+// removeBoundDevice handles DELETE /reg/{id}/account/reg/{device}.
+func (s *Server) removeBoundDevice(w http.ResponseWriter, r *http.Request, dev *device) {
+	target, ok := s.devices[r.PathValue("device")]
+	if !ok || target.accountID != dev.accountID {
+		writeError(w, http.StatusNotFound, CodeNotFound, "Device not found")
+		return
+	}
+
+	delete(s.devices, target.data.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// boundDevices lists the devices of an account.
+func (s *Server) boundDevices(accountID string) []models.BoundDevice {
+	devices := []models.BoundDevice{}
+	for _, dev := range s.devices {
+		if dev.accountID != accountID {
+			continue
+		}
+
+		role := "child"
+		if s.accounts[accountID].Created == dev.data.Created {
+			role = "parent"
+		}
+
+		devices = append(devices, models.BoundDevice{
+			ID:        dev.data.ID,
+			Type:      dev.data.Type,
+			Model:     dev.data.Model,
+			Name:      dev.data.Name,
+			Key:       dev.data.Key,
+			KeyType:   dev.data.KeyType,
+			TunType:   dev.data.TunType,
+			Created:   dev.data.Created,
+			Activated: dev.data.Created,
+			Active:    dev.active,
+			Role:      role,
+		})
+	}
+
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].Created < devices[j].Created
+	})
+
+	return devices
+}
+
+// view returns the registration of a device as the API presents it.
+func (s *Server) view(dev *device) models.AccountData {
+	data := dev.data
+	data.Account = *s.accounts[dev.accountID]
+	if data.Account.AccountType == internal.AccountTypeTeam {
+		data.Policy = s.TeamPolicy
+		data.Policy.TunnelProtocol = data.TunType
+	}
+	return data
+}
+
+// updateDevice handles PATCH /reg/{id} and enrolls a new key.
+func (s *Server) updateDevice(w http.ResponseWriter, r *http.Request, dev *device) {
+	var update models.DeviceUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "Invalid request body")
+		return
+	}
+
+	if s.RejectKeys > 0 {
+		s.RejectKeys--
+		writeError(w, http.StatusBadRequest, CodeInvalidKey, models.InvalidPublicKey)
+		return
+	}
+	if update.KeyType == internal.KeyTypeMasque && !validMasqueKey(update.Key) {
+		writeError(w, http.StatusBadRequest, CodeInvalidKey, models.InvalidPublicKey)
+		return
+	}
+
+	dev.data.Key = update.Key
+	dev.data.KeyType = update.KeyType
+	dev.data.TunType = update.TunType
+	if update.Name != "" {
+		dev.data.Name = update.Name
+	}
+	dev.data.Updated = internal.TimeAsCfString(time.Now())
+	s.refresh(&dev.data)
+
+	writeJSON(w, http.StatusOK, s.view(dev))
+}
+
+// withDevice authenticates the request and looks up the device in the path.
+// The device is passed to next with the server lock held.
+func (s *Server) withDevice(next func(http.ResponseWriter, *http.Request, *device)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		dev, ok := s.devices[r.PathValue("id")]
+		if !ok {
+			writeError(w, http.StatusNotFound, CodeNotFound, "Device not found")
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer "+dev.token {
+			writeError(w, http.StatusUnauthorized, CodeAuthentication, "Authentication error")
+			return
+		}
+
+		next(w, r, dev)
+	}
+}
+
+// refresh updates the peer config of a device to match its tunnel type.
+func (s *Server) refresh(data *models.AccountData) {
+	var peer models.Peer
+	peer.Endpoint.V4 = net.JoinHostPort(s.EndpointV4, "0")
+	peer.Endpoint.V6 = net.JoinHostPort(s.EndpointV6, "0")
+	if data.TunType == internal.TunTypeMasque {
+		peer.PublicKey = s.EndpointPubKey
+		peer.Endpoint.Host = internal.ConnectSNI + ":443"
+		peer.Endpoint.Ports = []int{443}
+	} else {
+		peer.PublicKey = wgPeerKey
+		peer.Endpoint.Host = "engage.cloudflareclient.com:2408"
+		peer.Endpoint.Ports = []int{2408, 500, 1701, 4500}
+	}
+
+	data.Config.Peers = []models.Peer{peer}
+	data.Policy.TunnelProtocol = data.TunType
+}
+
+// validMasqueKey reports whether key is a base64 PKIX encoded P-256 public key.
+func validMasqueKey(key string) bool {
+	der, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return false
+	}
+
+	pubKey, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return false
+	}
+
+	ecPubKey, ok := pubKey.(*ecdsa.PublicKey)
+	return ok && ecPubKey.Curve == elliptic.P256()
+}
+
+// writeJSON writes v as a JSON response.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
+
+// writeError writes an error response in the shape of models.APIError.
+func writeError(w http.ResponseWriter, status, code int, message string) {
+	writeJSON(w, status, models.APIError{
+		Success:  false,
+		Errors:   []models.ErrorInfo{{Code: code, Message: message}},
+		Messages: []string{},
+	})
+}
+
+// randomUUID returns a random version 4 UUID.
+func randomUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b)
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// randomLicense returns a random license key in the xxxxxxxx-xxxxxxxx-xxxxxxxx format.
+func randomLicense() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	h := strings.ToUpper(hex.EncodeToString(b))
+	return h[:8] + "-" + h[8:16] + "-" + h[16:]
+}
@@ -0,0 +1,325 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/Diniboy1123/usque/models"
+)
+
+// SplitTunnel decides which destinations use the tunnel according to the include or
+// exclude list of a device policy. Host entries match the host and its subdomains.
+// Addresses resolved for them are learned, so connections by address follow the same rule.
+type SplitTunnel struct {
+	include  bool
+	prefixes []netip.Prefix
+	domains  []string
+
+	mu      sync.RWMutex
+	learned map[netip.Addr]bool
+}
+
+// NewSplitTunnel creates a split tunnel from the include and exclude lists of a policy.
+// As in the official client, a non-empty include list takes precedence.
+//
+// Parameters:
+//   - policy: models.Policy - The device policy.
+//
+// Returns:
+//   - *SplitTunnel: The split tunnel, nil if the policy has neither list.
+//   - error: An error if an address entry is malformed.
+func NewSplitTunnel(policy models.Policy) (*SplitTunnel, error) {
+	entries := policy.Exclude
+	if len(policy.Include) > 0 {
+		entries = policy.Include
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	s := &SplitTunnel{
+		include: len(policy.Include) > 0,
+		learned: make(map[netip.Addr]bool),
+	}
+
+	for _, entry := range entries {
+		switch {
+		case entry.Address != "":
+			prefix, err := parsePrefixOrAddr(entry.Address)
+			if err != nil {
+				return nil, err
+			}
+			s.prefixes = append(s.prefixes, prefix)
+		case entry.Host != "":
+			s.domains = append(s.domains, normalizeDomain(entry.Host))
+		}
+	}
+
+	return s, nil
+}
+
+// Include reports whether only matching destinations use the tunnel.
+//
+// Returns:
+//   - bool: True for an include list, false for an exclude list.
+func (s *SplitTunnel) Include() bool {
+	return s.include
+}
+
+// Prefixes returns the address entries of the list.
+//
+// Returns:
+//   - []netip.Prefix: The address entries.
+func (s *SplitTunnel) Prefixes() []netip.Prefix {
+	return s.prefixes
+}
+
+// Domains returns the host entries of the list.
+//
+// Returns:
+//   - []string: The host entries, lowercase and without leading or trailing dots.
+func (s *SplitTunnel) Domains() []string {
+	return s.domains
+}
+
+// MatchesHost reports whether a host name is on the list.
+//
+// Parameters:
+//   - host: string - The host name.
+//
+// Returns:
+//   - bool: True if the host or one of its parents is a host entry.
+func (s *SplitTunnel) MatchesHost(host string) bool {
+	host = normalizeDomain(host)
+	for _, domain := range s.domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Learn records the addresses a listed host resolved to. Addresses of other hosts are ignored.
+//
+// Parameters:
+//   - host: string - The resolved host name.
+//   - ips: []net.IP - The addresses it resolved to.
+func (s *SplitTunnel) Learn(host string, ips []net.IP) {
+	if !s.MatchesHost(host) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ip := range ips {
+		if addr, ok := netip.AddrFromSlice(ip); ok {
+			s.learned[addr.Unmap()] = true
+		}
+	}
+}
+
+// Tunneled reports whether traffic to an address should use the tunnel.
+//
+// Parameters:
+//   - addr: netip.Addr - The destination address.
+//
+// Returns:
+//   - bool: True if the address should use the tunnel.
+func (s *SplitTunnel) Tunneled(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	matched := false
+	for _, prefix := range s.prefixes {
+		if prefix.Contains(addr) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		s.mu.RLock()
+		matched = s.learned[addr]
+		s.mu.RUnlock()
+	}
+
+	return matched == s.include
+}
+
+// Routes returns the prefixes to route into the tunnel. Host entries are not covered.
+//
+// Parameters:
+//   - base: []netip.Prefix - The prefixes the tunnel would carry without a policy. (e.g., 0.0.0.0/0 and ::/0)
+//   - exclude: []netip.Prefix - Prefixes that must never be routed into the tunnel, e.g. the MASQUE endpoint.
+//
+// Returns:
+//   - []netip.Prefix: The include entries within base, or base without the exclude entries.
+//     Both without the exclude parameter.
+func (s *SplitTunnel) Routes(base, exclude []netip.Prefix) []netip.Prefix {
+	if s.include {
+		var routes []netip.Prefix
+		for _, prefix := range s.prefixes {
+			for _, b := range base {
+				if b.Overlaps(prefix) && b.Bits() <= prefix.Bits() {
+					routes = append(routes, prefix)
+					break
+				}
+			}
+		}
+		return SubtractPrefixes(routes, exclude)
+	}
+
+	return SubtractPrefixes(base, append(append([]netip.Prefix(nil), s.prefixes...), exclude...))
+}
+
+// SubtractPrefixes returns the smallest set of prefixes covering base but none of exclude.
+//
+// Parameters:
+//   - base: []netip.Prefix - The prefixes to subtract from.
+//   - exclude: []netip.Prefix - The prefixes to subtract.
+//
+// Returns:
+//   - []netip.Prefix: The remaining prefixes.
+func SubtractPrefixes(base, exclude []netip.Prefix) []netip.Prefix {
+	var result []netip.Prefix
+	for _, prefix := range base {
+		result = append(result, subtractPrefix(prefix.Masked(), exclude)...)
+	}
+	return result
+}
+
+// subtractPrefix removes exclude from a single prefix by splitting it in halves until
+// each half is either disjoint from or covered by exclude.
+func subtractPrefix(prefix netip.Prefix, exclude []netip.Prefix) []netip.Prefix {
+	overlaps := false
+	for _, e := range exclude {
+		if !prefix.Overlaps(e) {
+			continue
+		}
+		if e.Bits() <= prefix.Bits() {
+			return nil
+		}
+		overlaps = true
+	}
+	if !overlaps {
+		return []netip.Prefix{prefix}
+	}
+
+	lo := netip.PrefixFrom(prefix.Addr(), prefix.Bits()+1)
+	b := prefix.Addr().AsSlice()
+	b[prefix.Bits()/8] |= 0x80 >> (prefix.Bits() % 8)
+	hiAddr, _ := netip.AddrFromSlice(b)
+	hi := netip.PrefixFrom(hiAddr, prefix.Bits()+1)
+
+	return append(subtractPrefix(lo, exclude), subtractPrefix(hi, exclude)...)
+}
+
+// FallbackDNS maps domain suffixes to the DNS servers that resolve them outside the tunnel.
+type FallbackDNS struct {
+	domains []fallbackDomain
+}
+
+type fallbackDomain struct {
+	suffix  string
+	servers []netip.Addr
+}
+
+// NewFallbackDNS creates the fallback DNS table of a policy.
+//
+// Parameters:
+//   - policy: models.Policy - The device policy.
+//
+// Returns:
+//   - *FallbackDNS: The table, nil if the policy has no fallback domains.
+//   - error: An error if a DNS server address is malformed.
+func NewFallbackDNS(policy models.Policy) (*FallbackDNS, error) {
+	if len(policy.FallbackDomains) == 0 {
+		return nil, nil
+	}
+
+	f := &FallbackDNS{}
+	for _, domain := range policy.FallbackDomains {
+		entry := fallbackDomain{suffix: normalizeDomain(domain.Suffix)}
+		for _, server := range domain.DNSServer {
+			addr, err := netip.ParseAddr(server)
+			if err != nil {
+				return nil, fmt.Errorf("invalid DNS server %q for %s: %v", server, domain.Suffix, err)
+			}
+			entry.servers = append(entry.servers, addr)
+		}
+		f.domains = append(f.domains, entry)
+	}
+
+	return f, nil
+}
+
+// Match finds the fallback domain of a host name. The longest matching suffix wins.
+//
+// Parameters:
+//   - host: string - The host name to resolve.
+//
+// Returns:
+//   - []netip.Addr: The DNS servers of the domain, empty for the system resolver.
+//   - bool: True if the host is in a fallback domain.
+func (f *FallbackDNS) Match(host string) ([]netip.Addr, bool) {
+	host = normalizeDomain(host)
+
+	var best *fallbackDomain
+	for i, domain := range f.domains {
+		if host != domain.suffix && !strings.HasSuffix(host, "."+domain.suffix) {
+			continue
+		}
+		if best == nil || len(domain.suffix) > len(best.suffix) {
+			best = &f.domains[i]
+		}
+	}
+	if best == nil {
+		return nil, false
+	}
+
+	return best.servers, true
+}
+
+// Servers returns every DNS server of the table. They must be reachable outside the tunnel.
+//
+// Returns:
+//   - []netip.Addr: The DNS servers.
+func (f *FallbackDNS) Servers() []netip.Addr {
+	var servers []netip.Addr
+	for _, domain := range f.domains {
+		servers = append(servers, domain.servers...)
+	}
+	return servers
+}
+
+// Suffixes returns the domain suffixes of the table.
+//
+// Returns:
+//   - []string: The suffixes, lowercase and without leading or trailing dots.
+func (f *FallbackDNS) Suffixes() []string {
+	suffixes := make([]string, 0, len(f.domains))
+	for _, domain := range f.domains {
+		suffixes = append(suffixes, domain.suffix)
+	}
+	return suffixes
+}
+
+// parsePrefixOrAddr parses a CIDR prefix or a single address.
+func parsePrefixOrAddr(s string) (netip.Prefix, error) {
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid address %q", s)
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// normalizeDomain lowercases a domain and strips leading wildcards and dots.
+func normalizeDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	domain = strings.TrimPrefix(domain, "*")
+	return strings.Trim(domain, ".")
+}
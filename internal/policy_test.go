@@ -0,0 +1,255 @@
+package internal
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/Diniboy1123/usque/models"
+)
+
+// mustPrefixes parses prefixes and single addresses.
+func mustPrefixes(t *testing.T, values ...string) []netip.Prefix {
+	t.Helper()
+
+	var prefixes []netip.Prefix
+	for _, value := range values {
+		prefix, err := parsePrefixOrAddr(value)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", value, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}
+
+// checkRoutes checks that no two routes overlap, that the routed addresses are covered and
+// that the notRouted prefixes or addresses aren't.
+func checkRoutes(t *testing.T, routes []netip.Prefix, routed, notRouted []string) {
+	t.Helper()
+
+	for i, a := range routes {
+		for _, b := range routes[i+1:] {
+			if a.Overlaps(b) {
+				t.Errorf("routes %s and %s overlap", a, b)
+			}
+		}
+	}
+
+	for _, addr := range routed {
+		if !slices.ContainsFunc(routes, func(p netip.Prefix) bool { return p.Contains(netip.MustParseAddr(addr)) }) {
+			t.Errorf("%s isn't routed", addr)
+		}
+	}
+	for _, prefix := range mustPrefixes(t, notRouted...) {
+		if slices.ContainsFunc(routes, prefix.Overlaps) {
+			t.Errorf("%s is routed", prefix)
+		}
+	}
+}
+
+func TestSubtractPrefixes(t *testing.T) {
+	tests := []struct {
+		name      string
+		base      []string
+		exclude   []string
+		want      []string
+		wantCount int // Checked instead of want if set
+	}{
+		{name: "nothing excluded", base: []string{"0.0.0.0/0"}, want: []string{"0.0.0.0/0"}},
+		{name: "unmasked base", base: []string{"10.0.0.5/30"}, want: []string{"10.0.0.4/30"}},
+		{name: "disjoint exclude", base: []string{"10.0.0.0/8"}, exclude: []string{"192.168.0.0/16"}, want: []string{"10.0.0.0/8"}},
+		{name: "exact exclude", base: []string{"10.0.0.0/8"}, exclude: []string{"10.0.0.0/8"}},
+		{name: "wider exclude", base: []string{"10.0.0.0/8"}, exclude: []string{"0.0.0.0/0"}},
+		{
+			name:    "first quarter",
+			base:    []string{"192.168.0.0/24"},
+			exclude: []string{"192.168.0.0/26"},
+			want:    []string{"192.168.0.64/26", "192.168.0.128/25"},
+		},
+		{
+			name:    "single endpoint address",
+			base:    []string{"162.159.198.0/30"},
+			exclude: []string{"162.159.198.1"},
+			want:    []string{"162.159.198.0/32", "162.159.198.2/31"},
+		},
+		{
+			name:      "single address from everything",
+			base:      []string{"0.0.0.0/0"},
+			exclude:   []string{"1.1.1.1"},
+			wantCount: 32,
+		},
+		{
+			name:    "nested and overlapping excludes",
+			base:    []string{"10.0.0.0/24"},
+			exclude: []string{"10.0.0.0/25", "10.0.0.0/26", "10.0.0.64/26", "10.0.0.100"},
+			want:    []string{"10.0.0.128/25"},
+		},
+		{
+			name:    "mixed families",
+			base:    []string{"10.0.0.0/30", "fd00::/126"},
+			exclude: []string{"10.0.0.1", "fd00::2/127", "::/0"},
+			want:    []string{"10.0.0.0/32", "10.0.0.2/31"},
+		},
+		{
+			name:    "families don't affect each other",
+			base:    []string{"10.0.0.0/30", "fd00::/126"},
+			exclude: []string{"10.0.0.1", "fd00::2/127"},
+			want:    []string{"10.0.0.0/32", "10.0.0.2/31", "fd00::/127"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := SubtractPrefixes(mustPrefixes(t, tt.base...), mustPrefixes(t, tt.exclude...))
+			if tt.wantCount > 0 {
+				if len(got) != tt.wantCount {
+					t.Errorf("got %d prefixes, want %d", len(got), tt.wantCount)
+				}
+			} else if want := mustPrefixes(t, tt.want...); !slices.Equal(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			checkRoutes(t, got, nil, tt.exclude)
+		})
+	}
+}
+
+func TestSplitTunnelRoutes(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    models.Policy
+		base      []string
+		exclude   []string // Fallback DNS servers of the policy are added
+		want      []string // Checked if set
+		routed    []string
+		notRouted []string
+	}{
+		{
+			name:    "exclude list",
+			policy:  models.Policy{Exclude: []models.SplitTunnelEntry{{Address: "10.0.0.0/25"}, {Host: "example.com"}}},
+			base:    []string{"10.0.0.0/24", "fd00::/120"},
+			exclude: []string{"10.0.0.192/26", "fd00::80/121"},
+			want:    []string{"10.0.0.128/26", "fd00::/121"},
+		},
+		{
+			name: "exclude list with endpoint and fallback DNS",
+			policy: models.Policy{
+				Exclude: []models.SplitTunnelEntry{{Address: "10.0.0.0/8"}, {Address: "fd00::/8"}},
+				FallbackDomains: []models.FallbackDomain{
+					{Suffix: "corp.example", DNSServer: []string{"192.0.2.53", "2001:db8::53"}},
+				},
+			},
+			base:      []string{"0.0.0.0/0", "::/0"},
+			exclude:   []string{"162.159.198.1", "2606:4700:103::1"},
+			routed:    []string{"1.1.1.1", "11.0.0.1", "162.159.198.2", "192.0.2.54", "2001:db8::54", "2606:4700:4700::1111"},
+			notRouted: []string{"10.1.2.3", "fd12::1", "162.159.198.1", "2606:4700:103::1", "192.0.2.53", "2001:db8::53"},
+		},
+		{
+			name: "include list",
+			policy: models.Policy{Include: []models.SplitTunnelEntry{
+				{Address: "10.1.0.0/16"},
+				{Address: "192.168.1.1"},
+				{Address: "2001:db8::/32"},
+				{Host: "intranet.example"},
+			}},
+			base:    []string{"0.0.0.0/0", "::/0"},
+			exclude: []string{"10.1.0.0/17"},
+			want:    []string{"10.1.128.0/17", "192.168.1.1/32", "2001:db8::/32"},
+		},
+		{
+			name:    "include list takes precedence",
+			policy:  models.Policy{Include: []models.SplitTunnelEntry{{Address: "10.1.0.0/16"}}, Exclude: []models.SplitTunnelEntry{{Address: "10.1.0.0/16"}}},
+			base:    []string{"0.0.0.0/0"},
+			exclude: []string{"10.1.0.1"},
+			routed:  []string{"10.1.0.2", "10.1.255.255"},
+			// outside the include list or the endpoint
+			notRouted: []string{"10.1.0.1", "10.2.0.1", "1.1.1.1"},
+		},
+		{
+			name:   "include entries outside the base",
+			policy: models.Policy{Include: []models.SplitTunnelEntry{{Address: "10.1.0.0/16"}, {Address: "2001:db8::/32"}}},
+			base:   []string{"0.0.0.0/0"},
+			want:   []string{"10.1.0.0/16"},
+		},
+		{
+			name:   "everything of one family excluded",
+			policy: models.Policy{Exclude: []models.SplitTunnelEntry{{Address: "0.0.0.0/0"}}},
+			base:   []string{"0.0.0.0/0", "::/0"},
+			want:   []string{"::/0"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			split, err := NewSplitTunnel(tt.policy)
+			if err != nil {
+				t.Fatalf("failed to create split tunnel: %v", err)
+			}
+
+			exclude := mustPrefixes(t, tt.exclude...)
+			fallback, err := NewFallbackDNS(tt.policy)
+			if err != nil {
+				t.Fatalf("failed to create fallback DNS: %v", err)
+			}
+			if fallback != nil {
+				for _, server := range fallback.Servers() {
+					exclude = append(exclude, netip.PrefixFrom(server, server.BitLen()))
+				}
+			}
+
+			got := split.Routes(mustPrefixes(t, tt.base...), exclude)
+			if tt.want != nil {
+				if want := mustPrefixes(t, tt.want...); !slices.Equal(got, want) {
+					t.Errorf("got %v, want %v", got, want)
+				}
+			}
+			checkRoutes(t, got, tt.routed, append(tt.notRouted, tt.exclude...))
+		})
+	}
+}
+
+func TestFallbackDNSMatch(t *testing.T) {
+	fallback, err := NewFallbackDNS(models.Policy{FallbackDomains: []models.FallbackDomain{
+		{Suffix: "corp.example", DNSServer: []string{"10.0.0.53"}},
+		{Suffix: ".EU.corp.example.", DNSServer: []string{"10.1.0.53", "fd00::53"}},
+		{Suffix: "*.intranet"},
+	}})
+	if err != nil {
+		t.Fatalf("failed to create fallback DNS: %v", err)
+	}
+
+	tests := []struct {
+		host        string
+		wantServers []string
+		wantOK      bool
+	}{
+		{host: "corp.example", wantServers: []string{"10.0.0.53"}, wantOK: true},
+		{host: "host.corp.example", wantServers: []string{"10.0.0.53"}, wantOK: true},
+		{host: "db.eu.corp.example", wantServers: []string{"10.1.0.53", "fd00::53"}, wantOK: true},
+		{host: "DB.EU.CORP.EXAMPLE.", wantServers: []string{"10.1.0.53", "fd00::53"}, wantOK: true},
+		{host: "printer.intranet", wantOK: true},
+		{host: "intranet", wantOK: true},
+		{host: "notcorp.example"},
+		{host: "example"},
+		{host: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			servers, ok := fallback.Match(tt.host)
+			var want []netip.Addr
+			for _, server := range tt.wantServers {
+				want = append(want, netip.MustParseAddr(server))
+			}
+			if ok != tt.wantOK || !slices.Equal(servers, want) {
+				t.Errorf("got %v, %v, want %v, %v", servers, ok, want, tt.wantOK)
+			}
+		})
+	}
+
+	if _, err := NewFallbackDNS(models.Policy{FallbackDomains: []models.FallbackDomain{
+		{Suffix: "corp.example", DNSServer: []string{"not-an-address"}},
+	}}); err == nil {
+		t.Errorf("expected an error for a malformed DNS server")
+	}
+}
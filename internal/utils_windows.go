@@ -5,6 +5,7 @@ package internal
 import (
 	"fmt"
 	"log"
+	"net/netip"
 	"os/exec"
 )
 
@@ -63,3 +64,22 @@ func SetIPv6MTU(ifaceName string, mtu int) error {
 	log.Println("IPv6 MTU set successfully:", mtu)
 	return nil
 }
+
+func AddRoute(ifaceName string, prefix netip.Prefix) error {
+	family := "ipv4"
+	if prefix.Addr().Is6() {
+		family = "ipv6"
+	}
+
+	cmd := exec.Command("netsh", "interface", family, "add", "route",
+		"prefix="+prefix.String(),
+		fmt.Sprintf("interface=\"%s\"", ifaceName),
+		"store=active")
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s", output)
+	}
+
+	return nil
+}
@@ -0,0 +1,16 @@
+package models
+
+// BoundDevice is a device bound to the same account, as listed by the account devices endpoint.
+type BoundDevice struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	Model     string `json:"model"`
+	Name      string `json:"name"`
+	Key       string `json:"key"`
+	KeyType   string `json:"key_type"`
+	TunType   string `json:"tunnel_type"`
+	Created   string `json:"created"`
+	Activated string `json:"activated"`
+	Active    bool   `json:"active"`
+	Role      string `json:"role"`
+}
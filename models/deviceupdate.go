@@ -1,8 +1,10 @@
 package models
 
+// DeviceUpdate is the body of requests updating a device. Only set fields are changed.
 type DeviceUpdate struct {
-	Key     string `json:"key"`
-	KeyType string `json:"key_type"`
-	TunType string `json:"tunnel_type"`
+	Key     string `json:"key,omitempty"`
+	KeyType string `json:"key_type,omitempty"`
+	TunType string `json:"tunnel_type,omitempty"`
 	Name    string `json:"name,omitempty"`
+	Active  *bool  `json:"active,omitempty"`
 }
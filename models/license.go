@@ -0,0 +1,6 @@
+package models
+
+// License is the request and response body of the license endpoints.
+type License struct {
+	License string `json:"license"`
+}
@@ -0,0 +1,55 @@
+package models
+
+// Policy is the device policy of a registration. Consumer accounts only get TunnelProtocol,
+// all other fields are only set for ZeroTier (Zero Trust) devices and left empty otherwise.
+type Policy struct {
+	// TunnelProtocol is the protocol the device tunnels with, "masque" or "wireguard".
+	TunnelProtocol string `json:"tunnel_protocol"`
+	// Organization is the Zero Trust team name the device is enrolled in.
+	Organization string `json:"organization,omitempty"`
+	// GatewayUniqueID identifies the Gateway account that filters the device's DNS queries.
+	GatewayUniqueID string `json:"gateway_unique_id,omitempty"`
+	// ServiceMode is the mode the official client runs in, e.g. full tunnel or proxy only.
+	ServiceMode *ServiceMode `json:"service_mode_v2,omitempty"`
+	// Include lists the only destinations routed through the tunnel. Empty means all of them.
+	Include []SplitTunnelEntry `json:"include,omitempty"`
+	// Exclude lists the destinations kept off the tunnel. Ignored if Include is not empty.
+	Exclude []SplitTunnelEntry `json:"exclude,omitempty"`
+	// FallbackDomains are resolved outside the tunnel instead of by the tunnel's DNS.
+	FallbackDomains []FallbackDomain `json:"fallback_domains,omitempty"`
+	// AllowModeSwitch lets the user switch the official client between WARP and DNS only mode.
+	AllowModeSwitch bool `json:"allow_mode_switch,omitempty"`
+	// SwitchLocked keeps the user from turning the official client off.
+	SwitchLocked bool `json:"switch_locked,omitempty"`
+	// AllowedToLeave lets the user log the device out of the organization.
+	AllowedToLeave bool `json:"allowed_to_leave,omitempty"`
+	// AutoConnect is the number of minutes after which a disabled client reconnects, 0 for never.
+	AutoConnect int `json:"auto_connect,omitempty"`
+	// CaptivePortal is the number of seconds the tunnel is paused to log in to a captive portal.
+	CaptivePortal int `json:"captive_portal,omitempty"`
+	// SupportURL is where the organization's users report problems with the client.
+	SupportURL string `json:"support_url,omitempty"`
+}
+
+// ServiceMode is the mode the official client runs in. usque only shows it and always tunnels.
+type ServiceMode struct {
+	// Mode is the mode name, e.g. "warp" for a full tunnel or "proxy" for a local proxy.
+	Mode string `json:"mode"`
+	// Port is the local proxy port, only set in proxy mode.
+	Port int `json:"port,omitempty"`
+}
+
+// SplitTunnelEntry is either an address (CIDR or single IP) or a host name.
+type SplitTunnelEntry struct {
+	Address     string `json:"address,omitempty"`
+	Host        string `json:"host,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// FallbackDomain is resolved with DNSServer outside the tunnel instead of the tunnel's DNS.
+// An empty DNSServer means the system resolver.
+type FallbackDomain struct {
+	Suffix      string   `json:"suffix"`
+	Description string   `json:"description,omitempty"`
+	DNSServer   []string `json:"dns_server,omitempty"`
+}
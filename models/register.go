@@ -11,6 +11,7 @@ type Registration struct {
 	KeyType   string `json:"key_type"`
 	TunType   string `json:"tunnel_type"`
 	Locale    string `json:"locale"`
+	Type      string `json:"type,omitempty"`
 }
 
 type AccountData struct {
@@ -95,8 +96,3 @@ type Peer struct {
 		Ports []int  `json:"ports"`
 	} `json:"endpoint"`
 }
-
-type Policy struct {
-	TunnelProtocol string `json:"tunnel_protocol"`
-	// TODO: add ZeroTier fields
-}